@@ -2,33 +2,144 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"time"
 )
 
+const (
+	// DefaultMaxIdleConnsPerHost is the default number of idle connections
+	// kept open for reuse if no option is specified
+	DefaultMaxIdleConnsPerHost = 32
+
+	// maxErrorBodySize limits how much of an error response is included in errors
+	maxErrorBodySize = 1024
+)
+
+var (
+	// ErrBadRequest is wrapped by errors for a 4xx response code other than
+	// an auth failure. The event is invalid and should not be retried.
+	ErrBadRequest = errors.New("bad request")
+
+	// ErrUnauthorized is wrapped by errors for a 401 or 403 response code,
+	// when the auth token is missing or not allowed
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrServerError is wrapped by errors for a 5xx response code. The
+	// server could not store the event, and it may be retried.
+	ErrServerError = errors.New("server error")
+)
+
+// StatusError is returned for an unexpected response code. It wraps one of
+// ErrBadRequest, ErrUnauthorized or ErrServerError for use with errors.Is.
+type StatusError struct {
+	StatusCode int
+
+	// Body is the start of the response body, which describes the error.
+	// For an invalid event it is the message of the structured error.
+	Body string
+
+	// Code is the machine readable code of an invalid event, such as
+	// "missing_id", if the server returned a structured error
+	Code string
+}
+
+func (e *StatusError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("bad response code %d (%s): %s", e.StatusCode, e.Code, e.Body)
+	}
+	return fmt.Sprintf("bad response code %d: %s", e.StatusCode, e.Body)
+}
+
+// Unwrap returns the kind of error based on the status code
+func (e *StatusError) Unwrap() error {
+	switch {
+	case e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden:
+		return ErrUnauthorized
+	case e.StatusCode >= 400 && e.StatusCode < 500:
+		return ErrBadRequest
+	case e.StatusCode >= 500:
+		return ErrServerError
+	default:
+		return nil
+	}
+}
+
 // Client provides a high level API client for counterd
 type Client struct {
-	addr string
-	opts *ClientOptions
+	addr   string
+	opts   *ClientOptions
+	client *http.Client
 }
 
 // ClientOptions is used to configure the client
 type ClientOptions struct {
 	// AuthToken is used to send a Bearer token with requests for authorization
 	AuthToken string
+
+	// MaxIdleConnsPerHost is the number of idle connections kept open for
+	// reuse. This should be at least the number of concurrent requests.
+	MaxIdleConnsPerHost int
 }
 
 // NewClient returns a new client for the given address and options
 func NewClient(addr string, opts *ClientOptions) (*Client, error) {
+	// Keep enough idle connections to reuse them under load
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	if opts != nil && opts.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+	}
+	if transport.MaxIdleConns < transport.MaxIdleConnsPerHost {
+		transport.MaxIdleConns = transport.MaxIdleConnsPerHost
+	}
+
 	c := &Client{
-		addr: addr,
-		opts: opts,
+		addr:   addr,
+		opts:   opts,
+		client: &http.Client{Transport: transport},
 	}
 	return c, nil
 }
 
+// Ping checks that counterd is reachable and that the auth token, if any,
+// is accepted. Auth failures return an error wrapping ErrUnauthorized.
+func (c *Client) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.addr+"/health", nil)
+	if err != nil {
+		return fmt.Errorf("failed to setup request: %v", err)
+	}
+
+	// The health endpoint only checks the token if one is given
+	if c.opts != nil && c.opts.AuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.opts.AuthToken)
+	}
+
+	// Send the request
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach counterd: %w", err)
+	}
+	defer func() {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		return &StatusError{
+			StatusCode: resp.StatusCode,
+			Body:       string(bytes.TrimSpace(body)),
+		}
+	}
+	return nil
+}
+
 // SendEvent is used to submit an event to be ingressed
 func (c *Client) SendEvent(e *Event) error {
 	// Marshal the event
@@ -43,24 +154,125 @@ func (c *Client) SendEvent(e *Event) error {
 		return fmt.Errorf("failed to setup request: %v", err)
 	}
 
+	req.Header.Set("Content-Type", "application/json")
+
 	// Check if we should add an Auth header
 	if c.opts != nil && c.opts.AuthToken != "" {
 		req.Header.Set("Authorization", "Bearer "+c.opts.AuthToken)
 	}
 
 	// Send the request
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.client.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to make request: %v", err)
 	}
 
-	// Verify we got a 200 OK
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad response code %d", resp.StatusCode)
+	// Drain and close the body so the connection can be reused
+	defer func() {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	// Verify we got a 200 OK, or a 202 Accepted if the server queues events
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		statusErr := &StatusError{
+			StatusCode: resp.StatusCode,
+			Body:       string(bytes.TrimSpace(body)),
+		}
+
+		// Invalid events are described by a structured error
+		if resp.Header.Get("Content-Type") == "application/json" {
+			var out struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			}
+			if err := json.Unmarshal(body, &out); err == nil && out.Code != "" {
+				statusErr.Code = out.Code
+				statusErr.Body = out.Message
+			}
+		}
+		return statusErr
 	}
 	return nil
 }
 
+// Query is used to sum the counters of an interval
+type Query struct {
+	// Interval is one of "day", "week", "month" or "quarter"
+	Interval string
+
+	// From and To optionally bound the dates, inclusive. They are
+	// formatted for the interval, e.g. "2018-01" for a month.
+	From string
+	To   string
+
+	// Attributes filters the counters. A counter matches if it has one of
+	// the values of every attribute.
+	Attributes map[string][]string
+}
+
+// QueryResult is the summed count of the matching counters for a date
+type QueryResult struct {
+	Date  string `json:"date"`
+	Count int64  `json:"count"`
+}
+
+// Query is used to sum the counters matching the query for each date.
+// Counters are unique counts, so IDs under more than one matching
+// counter are counted more than once.
+func (c *Client) Query(ctx context.Context, q *Query) ([]*QueryResult, error) {
+	// Encode the query parameters
+	params := url.Values{}
+	if q.From != "" {
+		params.Set("from", q.From)
+	}
+	if q.To != "" {
+		params.Set("to", q.To)
+	}
+	for key, values := range q.Attributes {
+		params[key] = values
+	}
+	addr := c.addr + "/v1/query/" + url.PathEscape(q.Interval)
+	if len(params) > 0 {
+		addr += "?" + params.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", addr, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup request: %v", err)
+	}
+
+	// Check if we should add an Auth header
+	if c.opts != nil && c.opts.AuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.opts.AuthToken)
+	}
+
+	// Send the request
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request: %v", err)
+	}
+	defer func() {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		return nil, &StatusError{
+			StatusCode: resp.StatusCode,
+			Body:       string(bytes.TrimSpace(body)),
+		}
+	}
+
+	var out []*QueryResult
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+	return out, nil
+}
+
 // Event is used to provide a structured input
 type Event struct {
 	// Unique identifier for this event
@@ -73,4 +285,8 @@ type Event struct {
 	// Attributes are an opaque set of key/value pairs. If none provided, the
 	// special NullAttribute will be automatically injected.
 	Attributes map[string]string `json:"attributes,omitempty"`
+
+	// MultiAttributes are attributes with a list of values. The event is
+	// counted under every combination of the values.
+	MultiAttributes map[string][]string `json:"multi_attributes,omitempty"`
 }
@@ -0,0 +1,223 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestClient_SendEvent_ReusesConnections(t *testing.T) {
+	var conns int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	client, err := NewClient(srv.URL, &ClientOptions{AuthToken: "token"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := client.SendEvent(&Event{ID: "1234"}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if n := atomic.LoadInt64(&conns); n != 1 {
+		t.Fatalf("expected 1 connection, got %d", n)
+	}
+}
+
+func TestClient_SendEvent_Error(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+		w.Write([]byte("Invalid Request: missing request ID\n"))
+	}))
+	defer srv.Close()
+
+	client, err := NewClient(srv.URL, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err = client.SendEvent(&Event{})
+	if err == nil || !strings.Contains(err.Error(), "bad response code 400: Invalid Request: missing request ID") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestClient_SendEvent_ValidationError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(400)
+		w.Write([]byte(`{"code":"missing_id","message":"missing request ID"}` + "\n"))
+	}))
+	defer srv.Close()
+
+	client, err := NewClient(srv.URL, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err = client.SendEvent(&Event{})
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("bad: %v", err)
+	}
+	if statusErr.Code != "missing_id" || statusErr.Body != "missing request ID" {
+		t.Fatalf("bad: %#v", statusErr)
+	}
+	if !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("bad: %v", err)
+	}
+	if err.Error() != "bad response code 400 (missing_id): missing request ID" {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestClient_SendEvent_ErrorKind(t *testing.T) {
+	type tcase struct {
+		Code int
+		Kind error
+	}
+	cases := []tcase{
+		{400, ErrBadRequest},
+		{413, ErrBadRequest},
+		{401, ErrUnauthorized},
+		{403, ErrUnauthorized},
+		{500, ErrServerError},
+		{503, ErrServerError},
+	}
+	for _, tc := range cases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.Code)
+		}))
+
+		client, err := NewClient(srv.URL, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		err = client.SendEvent(&Event{ID: "1234"})
+		srv.Close()
+
+		if !errors.Is(err, tc.Kind) {
+			t.Fatalf("code %d: expected %v, got %v", tc.Code, tc.Kind, err)
+		}
+		var statusErr *StatusError
+		if !errors.As(err, &statusErr) || statusErr.StatusCode != tc.Code {
+			t.Fatalf("code %d: bad status error: %v", tc.Code, err)
+		}
+		for _, other := range []error{ErrBadRequest, ErrUnauthorized, ErrServerError} {
+			if other != tc.Kind && errors.Is(err, other) {
+				t.Fatalf("code %d: unexpected match %v", tc.Code, other)
+			}
+		}
+	}
+}
+
+func TestClient_Ping(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if auth := r.Header.Get("Authorization"); auth != "" && auth != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"redis":{"breaker":"closed"}}`))
+	}))
+
+	// Succeeds with a valid or no token
+	for _, opts := range []*ClientOptions{nil, {AuthToken: "token"}} {
+		client, err := NewClient(srv.URL, opts)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := client.Ping(context.Background()); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Auth failures are distinguished
+	client, err := NewClient(srv.URL, &ClientOptions{AuthToken: "wrong"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := client.Ping(context.Background()); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected unauthorized, got %v", err)
+	}
+
+	// Unreachable servers are not auth failures
+	srv.Close()
+	err = client.Ping(context.Background())
+	if err == nil || errors.Is(err, ErrUnauthorized) || !strings.Contains(err.Error(), "failed to reach counterd") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestClient_Query(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/query/day" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		q := r.URL.Query()
+		if q.Get("from") != "2018-01-01" || q.Get("to") != "" || len(q["country"]) != 2 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid Request: bad query " + r.URL.RawQuery))
+			return
+		}
+		w.Write([]byte(`[{"date":"2018-01-01","count":406}]`))
+	}))
+	defer srv.Close()
+
+	client, err := NewClient(srv.URL, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, err := client.Query(context.Background(), &Query{
+		Interval:   "day",
+		From:       "2018-01-01",
+		Attributes: map[string][]string{"country": {"us", "ca"}},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 1 || out[0].Date != "2018-01-01" || out[0].Count != 406 {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Errors are returned with the status
+	_, err = client.Query(context.Background(), &Query{Interval: "week"})
+	if !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected bad request, got %v", err)
+	}
+}
+
+func TestClient_SendEvent_Accepted(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	client, err := NewClient(srv.URL, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := client.SendEvent(&Event{ID: "1234"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
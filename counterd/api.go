@@ -2,15 +2,30 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	hclog "github.com/hashicorp/go-hclog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -19,220 +34,1984 @@ const (
 
 	// KeySeperator is used to segment K/V pairs and cannot be used in an attribute key or value
 	KeySeperator = ":"
+
+	// ExactKeyPrefix is prefixed to the keys of counters that are counted
+	// exactly using a set instead of a HyperLogLog
+	ExactKeyPrefix = "exact" + KeySeperator
+
+	// IncrKeyPrefix is prefixed to the keys of counters that count every
+	// event with INCR, which are updated by events without an ID
+	IncrKeyPrefix = "incr" + KeySeperator
+
+	// CounterKindUnique and CounterKindEvents are the kinds of counters in
+	// the database. Unique counters count the unique IDs of events, while
+	// event counters count every increment, so they are stored and queried
+	// separately even if they have the same attributes.
+	CounterKindUnique = "unique"
+	CounterKindEvents = "events"
+
+	// KeyFormatV1 separates the attribute keys and values with colons, so
+	// they cannot contain a colon. KeyFormatV2 prefixes each attribute key
+	// and value with its length instead, so they can contain any character.
+	KeyFormatV1 = "v1"
+	KeyFormatV2 = "v2"
+
+	// KeyFormatV2Prefix is prefixed to the keys in the v2 format, after the
+	// exact or incr prefix. It is not an interval, so v1 keys never start with it.
+	KeyFormatV2Prefix = KeyFormatV2 + KeySeperator
+
+	// MaxMultiAttributeCombinations limits the number of attribute sets an
+	// event with multi-valued attributes can expand to, since each set is
+	// counted under every interval
+	MaxMultiAttributeCombinations = 64
+
+	// DefaultTopLimit is the number of values returned by a top query
+	// if no limit is given
+	DefaultTopLimit = 10
+
+	// MaxTopLimit is the maximum number of values of a top query
+	MaxTopLimit = 1000
+
+	// MaxRangeDates is the maximum number of dates of a range query
+	MaxRangeDates = 10000
+
+	// RootStatus, RootRedirect and RootNotFound are the responses to the
+	// root path. RootStatus returns a JSON status document, RootRedirect
+	// redirects to the UI and RootNotFound returns a 404.
+	RootStatus   = "status"
+	RootRedirect = "redirect"
+	RootNotFound = "not_found"
+
+	// NDJSONContentType is the content type of newline delimited JSON,
+	// which streams one result per line
+	NDJSONContentType = "application/x-ndjson"
+
+	// StreamFlushRows is the number of rows streamed between flushes
+	StreamFlushRows = 64
+
+	// DefaultDomainLimit is the number of values in a page of the domain
+	// if no limit is given
+	DefaultDomainLimit = 100
+
+	// MaxDomainLimit is the maximum number of values in a page of the domain
+	MaxDomainLimit = 1000
 )
 
-const (
-	DayInterval = 1 << iota
-	WeekInterval
-	MonthInterval
-)
+// ReservedAttributes are the attribute keys that cannot be used because
+// they collide with the interval names of the keys, or with the path of
+// /v1/domain/counts which shadows /v1/domain/<attribute>. This must be sorted.
+var ReservedAttributes = []string{"counts", "custom", "day", "month", "quarter", "week"}
+
+const (
+	DayInterval = 1 << iota
+	WeekInterval
+	MonthInterval
+	QuarterInterval
+
+	// CustomInterval is the configured custom interval, which is
+	// counted by default if it is configured
+	CustomInterval
+
+	// AllIntervals are the calendar intervals counted unless configured otherwise
+	AllIntervals = DayInterval | WeekInterval | MonthInterval | QuarterInterval
+)
+
+// IntervalBits maps the name of each interval to its bit
+var IntervalBits = map[string]int{
+	"day":     DayInterval,
+	"week":    WeekInterval,
+	"month":   MonthInterval,
+	"quarter": QuarterInterval,
+	"custom":  CustomInterval,
+}
+
+// ParseIntervals returns the bitmask of the named intervals, which
+// must include at least one interval
+func ParseIntervals(names []string) (int, error) {
+	var intervals int
+	for _, name := range names {
+		bit, ok := IntervalBits[name]
+		if !ok {
+			return 0, fmt.Errorf("invalid interval %q", name)
+		}
+		intervals |= bit
+	}
+	if intervals == 0 {
+		return 0, fmt.Errorf("at least one interval must be enabled")
+	}
+	return intervals, nil
+}
+
+// IntervalNames returns the names of the intervals in the bitmask, from
+// the shortest to the longest. All the intervals are named if zero.
+func IntervalNames(intervals int) []string {
+	if intervals == 0 {
+		intervals = AllIntervals
+	}
+	var out []string
+	for _, name := range []string{"day", "week", "month", "quarter", "custom"} {
+		if intervals&IntervalBits[name] != 0 {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// APIHandler implements the HTTP API endpoints
+type APIHandler struct {
+	logger        hclog.Logger
+	client        RedisClient
+	db            DatabaseClient
+	attrConfig    *AttributeConfig
+	exactConfig   *ExactConfig
+	ingressConfig *IngressConfig
+	timezone      *time.Location
+	recentIDs     *RecentIDs
+	queue         *IngressQueue
+	breaker       *CircuitBreaker
+	stats         *Stats
+	leader        *LeaderElection
+
+	// info describes the capabilities of the server, the info
+	// endpoint is not found if nil
+	info *InfoResponse
+
+	// intervals is the bitmask of the intervals that are counted.
+	// All the intervals are counted if zero.
+	intervals int
+
+	// customInterval is the custom interval, which is not
+	// counted or queried if nil
+	customInterval *CustomIntervalConfig
+
+	// weeklyFromDaily skips the approximate weekly keys, since the
+	// snapshot derives them from the daily keys
+	weeklyFromDaily bool
+
+	// root is the response to the root path. RootStatus is used if empty.
+	root string
+
+	// domainCache caches the domain responses, disabled if nil
+	domainCache *DomainCache
+}
+
+// checkMethod verifies the request uses one of the methods, setting the
+// Allow header on a 405. OPTIONS requests are answered with the allowed
+// methods. Returns false if the request has been handled.
+func checkMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(append(methods, "OPTIONS"), ", "))
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(204)
+	} else {
+		w.WriteHeader(405)
+	}
+	return false
+}
+
+// Ingress is used to take events and update the appropriate redis keys
+func (a *APIHandler) Ingress(w http.ResponseWriter, r *http.Request) {
+	// Verify the method
+	if !checkMethod(w, r, "PUT") {
+		return
+	}
+
+	// Verify the content type
+	if !IsJSONContentType(r.Header.Get("Content-Type")) {
+		a.stats.EventRejected()
+		w.WriteHeader(415)
+		w.Write([]byte("Content-Type must be application/json"))
+		return
+	}
+
+	// Start a span, continuing any trace propagated by the caller
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "Ingress", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	// Parse the request body, limiting the size
+	r.Body = http.MaxBytesReader(w, r.Body, a.maxBodySize())
+	req, err := ParseIngressRequest(r.Body, a.ingressConfig, a.attrConfig)
+	if err != nil {
+		a.stats.EventRejected()
+		span.SetStatus(codes.Error, err.Error())
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			w.WriteHeader(413)
+			w.Write([]byte(fmt.Sprintf("Request body exceeds %d bytes", maxErr.Limit)))
+			return
+		}
+		writeValidationError(w, err)
+		return
+	}
+	a.deriveID(r, req)
+	if code, resp, ok := a.ingest(ctx, w, span, req, IsVerbose(r.URL.Query())); ok {
+		a.writeIngressResponse(ctx, w, code, resp)
+	}
+}
+
+// SimpleIngress is used to take events from query or form parameters,
+// for clients that cannot send JSON. The "id" and "date" parameters set
+// those fields, and every other parameter is an attribute.
+func (a *APIHandler) SimpleIngress(w http.ResponseWriter, r *http.Request) {
+	// Verify the method
+	if !checkMethod(w, r, "GET", "POST") {
+		return
+	}
+
+	// Start a span, continuing any trace propagated by the caller
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "Ingress.Simple", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	// Parse the parameters, limiting the size of a form body
+	r.Body = http.MaxBytesReader(w, r.Body, a.maxBodySize())
+	err := r.ParseForm()
+	var req *IngressRequest
+	if err == nil {
+		req, err = ParseSimpleIngressRequest(r.Form, a.ingressConfig, a.attrConfig)
+	}
+	if err != nil {
+		a.stats.EventRejected()
+		span.SetStatus(codes.Error, err.Error())
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			w.WriteHeader(413)
+			w.Write([]byte(fmt.Sprintf("Request body exceeds %d bytes", maxErr.Limit)))
+			return
+		}
+		writeValidationError(w, err)
+		return
+	}
+	a.deriveID(r, req)
+	if code, resp, ok := a.ingest(ctx, w, span, req, false); ok {
+		a.writeIngressResponse(ctx, w, code, resp)
+	}
+}
+
+// SampledID checks if an event ID is in a sample of the given rate. The
+// same ID is always in or out of the sample, so the unique count of the
+// sampled IDs scaled by the inverse rate estimates the full unique count.
+// FNV is mixed with a finalizer, since similar IDs share the high bits.
+func SampledID(id string, rate float64) bool {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return float64(x) < rate*(1<<64)
+}
+
+// ClientIP returns the IP of the client of a request. If a header is given
+// and set by a proxy, the first address of the header is used. Otherwise
+// the remote address of the connection is used.
+func ClientIP(r *http.Request, header string) string {
+	if header != "" {
+		if raw := r.Header.Get(header); raw != "" {
+			first, _, _ := strings.Cut(raw, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// DeriveID derives an event ID from a hash of the client IP and User-Agent,
+// for clients that cannot provide a stable ID
+func DeriveID(r *http.Request, ipHeader string) string {
+	h := sha256.New()
+	h.Write([]byte(ClientIP(r, ipHeader)))
+	h.Write([]byte{0})
+	h.Write([]byte(r.UserAgent()))
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// deriveID sets the ID of an event without one, if derived IDs are enabled
+func (a *APIHandler) deriveID(r *http.Request, req *IngressRequest) {
+	if req.ID == "" && a.ingressConfig != nil && a.ingressConfig.DeriveID {
+		req.ID = DeriveID(r, a.ingressConfig.ClientIPHeader)
+	}
+}
+
+// beaconPixel is a 1x1 transparent GIF returned by the beacon endpoint
+var beaconPixel = []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\x00\x00\x00" +
+	"!\xf9\x04\x01\x00\x00\x00\x00,\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02D\x01\x00;")
+
+// Beacon is used to take events from the query parameters of a tracking
+// pixel, with the same parameters as SimpleIngress. A GET is answered with
+// a transparent GIF that is never cached, so the pixel is requested for
+// every event. A POST, such as from navigator.sendBeacon, has no pixel.
+func (a *APIHandler) Beacon(w http.ResponseWriter, r *http.Request) {
+	// Verify the method
+	if !checkMethod(w, r, "GET", "POST") {
+		return
+	}
+
+	// Start a span, continuing any trace propagated by the caller
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "Ingress.Beacon", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	// Parse the query parameters
+	req, err := ParseSimpleIngressRequest(r.URL.Query(), a.ingressConfig, a.attrConfig)
+	if err != nil {
+		a.stats.EventRejected()
+		span.SetStatus(codes.Error, err.Error())
+		writeValidationError(w, err)
+		return
+	}
+	a.deriveID(r, req)
+	if _, _, ok := a.ingest(ctx, w, span, req, false); !ok {
+		return
+	}
+
+	// Respond with the pixel, even if the event is queued
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+	if r.Method == "POST" {
+		w.WriteHeader(204)
+		return
+	}
+	w.Header().Set("Content-Type", "image/gif")
+	w.Write(beaconPixel)
+}
+
+// ingest is used to update the redis keys for a parsed request. Failures
+// are written to the response. Otherwise the status code is returned for
+// the caller to respond with, and if verbose a response that describes the
+// attributes that were counted.
+func (a *APIHandler) ingest(ctx context.Context, w http.ResponseWriter, span trace.Span, req *IngressRequest, verbose bool) (int, *IngressResponse, bool) {
+	// Hash the ID first, so the raw ID is not logged or stored
+	req.ID = a.ingressConfig.HashID(req.ID)
+	a.requestLogger(ctx).Debug("Ingress event", "id", req.ID, "attributes", req.Attributes)
+	span.SetAttributes(attribute.String("counterd.event_id", req.ID))
+
+	// Filter the request before generating keys
+	var original []string
+	if verbose {
+		original = req.attributeKeys()
+	}
+	req.Filter(a.attrConfig)
+
+	// Generate the keys
+	intervals := DateIntervals(a.countedIntervals(), req.Date, a.timezone, a.customInterval)
+	var keys []string
+	if req.ID == "" {
+		// Events without an ID increment every interval
+		for _, key := range a.attrConfig.counterKeys(intervals, req) {
+			keys = append(keys, IncrKeyPrefix+key)
+		}
+	} else {
+		exact, approx := SplitExactIntervals(a.exactConfig, intervals, req)
+		if a.weeklyFromDaily {
+			delete(approx, "week")
+		}
+		keys = a.attrConfig.counterKeys(approx, req)
+		for _, key := range a.attrConfig.counterKeys(exact, req) {
+			keys = append(keys, ExactKeyPrefix+key)
+		}
+	}
+	span.SetAttributes(attribute.Int("counterd.keys", len(keys)))
+
+	// Drop replays of recently ingested events
+	now := time.Now()
+	dedupKey := DedupKey(req.ID, keys)
+	if a.recentIDs.Seen(dedupKey, now) {
+		a.stats.EventDuplicate()
+		span.SetAttributes(attribute.Bool("counterd.duplicate", true))
+		return 200, nil, true
+	}
+
+	// Reject events that expand into too many keys
+	if maxKeys := a.maxKeys(); len(keys) > maxKeys {
+		a.requestLogger(ctx).Warn("rejected event with too many keys", "id", req.ID, "keys", len(keys),
+			"attributes", req.Attributes, "multi_attributes", req.MultiAttributes)
+		a.stats.EventRejected()
+		span.SetStatus(codes.Error, "too many keys")
+		writeValidationError(w, newValidationError(ErrCodeTooManyAttributes,
+			"event generates %d keys, exceeding the limit of %d", len(keys), maxKeys))
+		return 0, nil, false
+	}
+
+	// Skip the events outside of the sample
+	if a.ingressConfig.sampleRate() < 1 {
+		sampled := a.ingressConfig.Sampled(req.ID)
+		w.Header().Set("X-Sampled", strconv.FormatBool(sampled))
+		if !sampled {
+			a.stats.EventSkipped()
+			span.SetAttributes(attribute.Bool("counterd.sampled", false))
+			if verbose {
+				resp := NewIngressResponse(req, original, a.attrConfig, len(keys))
+				resp.Sampled = false
+				return 200, resp, true
+			}
+			return 200, nil, true
+		}
+	}
+
+	// Fast-fail if redis has been failing
+	if !a.breaker.Allow(now) {
+		a.stats.EventFailed()
+		span.SetStatus(codes.Error, "redis circuit breaker is open")
+		w.WriteHeader(503)
+		w.Write([]byte("Redis is unavailable"))
+		return 0, nil, false
+	}
+
+	// Queue the update if running asynchronously
+	if a.queue != nil {
+		if !a.queue.Enqueue(KeyUpdate{Keys: keys, ID: req.ID}) {
+			a.stats.EventFailed()
+			span.SetStatus(codes.Error, "ingress queue is full")
+			w.WriteHeader(503)
+			w.Write([]byte("Ingress queue is full"))
+			return 0, nil, false
+		}
+		a.recentIDs.Add(dedupKey, now)
+		if verbose {
+			return 202, NewIngressResponse(req, original, a.attrConfig, len(keys)), true
+		}
+		return 202, nil, true
+	}
+
+	// Update the keys. Redis is healthy if the key budget rejects the
+	// event, so the breaker is not tripped. The update is not cancelled
+	// if the client disconnects, e.g. a beacon sent as a page unloads.
+	err := a.client.UpdateKeys(context.WithoutCancel(ctx), keys, req.ID)
+	if err == ErrKeyBudget {
+		a.requestLogger(ctx).Warn("rejected event creating keys over the key budget", "id", req.ID)
+		a.breaker.Success()
+		a.stats.EventOverBudget()
+		span.SetStatus(codes.Error, err.Error())
+		w.WriteHeader(429)
+		w.Write([]byte("Key budget exceeded, new counters are rejected"))
+		return 0, nil, false
+	}
+	if err != nil {
+		a.requestLogger(ctx).Error("failed to update redis", "error", err)
+		a.breaker.Failure(time.Now())
+		a.stats.EventFailed()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		w.WriteHeader(503)
+		w.Write([]byte("Redis is unavailable"))
+		return 0, nil, false
+	}
+	a.breaker.Success()
+	a.recentIDs.Add(dedupKey, now)
+	a.stats.EventIngested()
+	if verbose {
+		return 200, NewIngressResponse(req, original, a.attrConfig, len(keys)), true
+	}
+	return 200, nil, true
+}
+
+// countedIntervals returns the bitmask of the intervals that are counted
+func (a *APIHandler) countedIntervals() int {
+	if a.intervals == 0 {
+		return AllIntervals
+	}
+	return a.intervals
+}
+
+// writeIngressResponse writes the response to an ingested event, which
+// only has a status code unless it is verbose
+func (a *APIHandler) writeIngressResponse(ctx context.Context, w http.ResponseWriter, code int, resp *IngressResponse) {
+	if resp == nil {
+		w.WriteHeader(code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		a.requestLogger(ctx).Error("failed to encode ingress response", "error", err)
+	}
+}
+
+// HealthResponse is the output of the health endpoint
+type HealthResponse struct {
+	Redis struct {
+		Breaker string `json:"breaker"`
+	} `json:"redis"`
+
+	// Leader is only set if leader election is enabled,
+	// and reports if this server runs the snapshot cron
+	Leader *bool `json:"leader,omitempty"`
+}
+
+// RootResponse is the status document returned for the root path
+type RootResponse struct {
+	Name    string          `json:"name"`
+	Version string          `json:"version"`
+	Health  *HealthResponse `json:"health"`
+}
+
+// health returns the current health of the server
+func (a *APIHandler) health() *HealthResponse {
+	out := &HealthResponse{}
+	out.Redis.Breaker = a.breaker.State(time.Now())
+	if a.leader != nil {
+		leader := a.leader.IsLeader()
+		out.Leader = &leader
+	}
+	return out
+}
+
+// Health is used to report the state of the redis circuit breaker
+func (a *APIHandler) Health(w http.ResponseWriter, r *http.Request) {
+	// Verify the method
+	if !checkMethod(w, r, "GET", "HEAD") {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(a.health()); err != nil {
+		a.requestLogger(r.Context()).Error("failed to encode health", "error", err)
+	}
+}
+
+// Root is used to handle the root path and any path without a route
+func (a *APIHandler) Root(w http.ResponseWriter, r *http.Request) {
+	switch a.root {
+	case RootRedirect:
+		// The UI is not served, so /ui itself has no route
+		if r.URL.Path == "/ui" {
+			http.NotFound(w, r)
+			return
+		}
+
+		// Use a temporary redirect, since browsers cache permanent ones
+		http.Redirect(w, r, "/ui", http.StatusFound)
+		return
+	case RootNotFound:
+		http.NotFound(w, r)
+		return
+	}
+
+	// Only the root path has a status, other paths have no route
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if !checkMethod(w, r, "GET", "HEAD") {
+		return
+	}
+
+	out := &RootResponse{
+		Name:    "counterd",
+		Version: VersionString(),
+		Health:  a.health(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		a.requestLogger(r.Context()).Error("failed to encode status", "error", err)
+	}
+}
+
+// Stats is used to return process level counters and pool stats
+func (a *APIHandler) Stats(w http.ResponseWriter, r *http.Request) {
+	// Verify the method
+	if !checkMethod(w, r, "GET", "HEAD") {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(a.stats.Response(a.client, a.db)); err != nil {
+		a.requestLogger(r.Context()).Error("failed to encode stats", "error", err)
+	}
+}
+
+// Info is used to describe the intervals and features that are enabled
+func (a *APIHandler) Info(w http.ResponseWriter, r *http.Request) {
+	// Verify the method
+	if !checkMethod(w, r, "GET", "HEAD") {
+		return
+	}
+	if a.info == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(a.info); err != nil {
+		a.requestLogger(r.Context()).Error("failed to encode info", "error", err)
+	}
+}
+
+// requestLogger returns the logger of a request, which includes the request ID
+func (a *APIHandler) requestLogger(ctx context.Context) hclog.Logger {
+	return RequestLogger(ctx, a.logger)
+}
+
+// maxBodySize returns the limit on the size of ingress request bodies
+func (a *APIHandler) maxBodySize() int64 {
+	return a.ingressConfig.maxBodySize()
+}
+
+// maxKeys returns the limit on the number of keys an event can update
+func (a *APIHandler) maxKeys() int {
+	return a.ingressConfig.maxKeys()
+}
+
+// Query is used to scan across an interval date range with any
+// optional filtering applied on attributes
+func (a *APIHandler) Query(w http.ResponseWriter, r *http.Request) {
+	// Verify the method
+	if !checkMethod(w, r, "GET", "HEAD") {
+		return
+	}
+
+	// Parse the filter
+	interval := strings.TrimPrefix(r.URL.Path, "/v1/query/")
+	filter, err := ParseQueryRequest(interval, r.URL.Query(), a.customInterval)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("Invalid Request: %s", err)))
+		return
+	}
+
+	iter, err := a.db.QueryCounters(r.Context(), filter)
+	if err != nil {
+		a.requestLogger(r.Context()).Error("failed to query counters", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+	a.writeQueryResults(w, r, filter.Interval, iter)
+}
+
+// writeQueryResults writes the results of a query as a JSON list, or
+// streams them if the request accepts newline delimited JSON
+func (a *APIHandler) writeQueryResults(w http.ResponseWriter, r *http.Request, interval string, iter QueryResultIterator) {
+	// Stream the results as they are read if asked to
+	if AcceptsNDJSON(r.Header.Get("Accept")) {
+		a.streamQueryResults(r.Context(), w, interval, iter)
+		return
+	}
+	results, err := CollectQueryResults(iter)
+	if err != nil {
+		a.requestLogger(r.Context()).Error("failed to query counters", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	// Format the dates the same way as the request
+	out := make([]QueryResponse, len(results))
+	for idx, res := range results {
+		out[idx] = NewQueryResponse(interval, res, a.customInterval)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		a.requestLogger(r.Context()).Error("failed to encode query results", "error", err)
+	}
+}
+
+// streamQueryResults writes each result as a line of JSON as it is read,
+// flushing periodically so the client can consume the stream incrementally.
+// The status is sent before the results are read, so a failure part way
+// through can only end the stream early. The write timeout of the server
+// is cleared, since a large stream can take longer than any single response.
+func (a *APIHandler) streamQueryResults(ctx context.Context, w http.ResponseWriter, interval string, iter QueryResultIterator) {
+	defer iter.Close()
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		a.requestLogger(ctx).Warn("failed to clear the write deadline", "error", err)
+	}
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", NDJSONContentType)
+	w.WriteHeader(200)
+
+	enc := json.NewEncoder(w)
+	for n := 1; ; n++ {
+		res, err := iter.Next()
+		if err != nil {
+			a.requestLogger(ctx).Error("failed to stream query results", "error", err)
+			return
+		}
+		if res == nil {
+			break
+		}
+		if err := enc.Encode(NewQueryResponse(interval, res, a.customInterval)); err != nil {
+			a.requestLogger(ctx).Error("failed to encode query results", "error", err)
+			return
+		}
+		if flusher != nil && n%StreamFlushRows == 0 {
+			flusher.Flush()
+		}
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+// Top is used to find the values of an attribute with the highest counts
+func (a *APIHandler) Top(w http.ResponseWriter, r *http.Request) {
+	// Verify the method
+	if !checkMethod(w, r, "GET", "HEAD") {
+		return
+	}
+
+	// Parse the request
+	interval := strings.TrimPrefix(r.URL.Path, "/v1/top/")
+	req, err := ParseTopRequest(interval, r.URL.Query(), a.customInterval)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("Invalid Request: %s", err)))
+		return
+	}
+
+	values, err := a.db.TopValues(r.Context(), req.Kind, req.Interval, req.Date, req.Attribute, req.Limit)
+	if err != nil {
+		a.requestLogger(r.Context()).Error("failed to query top values", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+	if values == nil {
+		values = []*ValueCount{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(values); err != nil {
+		a.requestLogger(r.Context()).Error("failed to encode top values", "error", err)
+	}
+}
+
+// Compare is used to compare the counts of attribute values between two
+// dates of an interval
+func (a *APIHandler) Compare(w http.ResponseWriter, r *http.Request) {
+	// Verify the method
+	if !checkMethod(w, r, "GET", "HEAD") {
+		return
+	}
+
+	// Parse the request
+	interval := strings.TrimPrefix(r.URL.Path, "/v1/compare/")
+	req, err := ParseCompareRequest(interval, r.URL.Query(), a.customInterval)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("Invalid Request: %s", err)))
+		return
+	}
+
+	values, err := a.db.CompareValues(r.Context(), req.Kind, req.Interval, req.Date, req.Prev, req.Attribute)
+	if err != nil {
+		a.requestLogger(r.Context()).Error("failed to query compared values", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+	for _, v := range values {
+		v.Change = PercentChange(v.Previous, v.Count)
+	}
+	if values == nil {
+		values = []*ValueComparison{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(values); err != nil {
+		a.requestLogger(r.Context()).Error("failed to encode compared values", "error", err)
+	}
+}
+
+// Domain is used to determine the domain of attributes and values
+func (a *APIHandler) Domain(w http.ResponseWriter, r *http.Request) {
+	// Verify the method
+	if !checkMethod(w, r, "GET", "HEAD") {
+		return
+	}
+
+	// Parse the request
+	attribute := strings.TrimPrefix(r.URL.Path, "/v1/domain/")
+	req, err := ParseDomainRequest(attribute, r.URL.Query())
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("Invalid Request: %s", err)))
+		return
+	}
+
+	// Check the cache before the database
+	now := time.Now()
+	a.syncDomainCache(r.Context())
+	out, ok := a.domainCache.Get(*req, now)
+	if !ok {
+		// Fetch an extra value to check if there is another page
+		values, err := a.db.ListDomain(r.Context(), req.Attribute, req.Cursor, req.Limit+1)
+		if err != nil {
+			a.requestLogger(r.Context()).Error("failed to list domain", "error", err)
+			w.WriteHeader(500)
+			return
+		}
+		resp := &DomainResponse{Values: values}
+		if len(values) > req.Limit {
+			resp.Values = values[:req.Limit]
+			resp.Next = resp.Values[req.Limit-1]
+		}
+		if resp.Values == nil {
+			resp.Values = []string{}
+		}
+		a.domainCache.Add(*req, resp, now)
+		out = resp
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		a.requestLogger(r.Context()).Error("failed to encode domain", "error", err)
+	}
+}
+
+// syncDomainCache purges the domain cache if a snapshot updated the domain
+// since, which may have run on another server. If the update time cannot
+// be read, the cache is used as is.
+func (a *APIHandler) syncDomainCache(ctx context.Context) {
+	if a.domainCache == nil {
+		return
+	}
+	updated, err := a.client.GetDomainUpdated(ctx)
+	if err != nil {
+		a.requestLogger(ctx).Warn("failed to get the domain update time", "error", err)
+		return
+	}
+	a.domainCache.Sync(updated)
+}
+
+// DomainCounts is used to determine the number of distinct values of each attribute
+func (a *APIHandler) DomainCounts(w http.ResponseWriter, r *http.Request) {
+	// Verify the method
+	if !checkMethod(w, r, "GET", "HEAD") {
+		return
+	}
+
+	now := time.Now()
+	a.syncDomainCache(r.Context())
+	counts, ok := a.domainCache.Get(domainCountsKey{}, now)
+	if !ok {
+		dbCounts, err := a.db.DomainCounts(r.Context())
+		if err != nil {
+			a.requestLogger(r.Context()).Error("failed to get domain counts", "error", err)
+			w.WriteHeader(500)
+			return
+		}
+		a.domainCache.Add(domainCountsKey{}, dbCounts, now)
+		counts = dbCounts
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(counts); err != nil {
+		a.requestLogger(r.Context()).Error("failed to encode domain counts", "error", err)
+	}
+}
+
+// Range is used to query every date of an interval between the from and
+// to dates, including the dates without any matching counters
+func (a *APIHandler) Range(w http.ResponseWriter, r *http.Request) {
+	// Verify the method
+	if !checkMethod(w, r, "GET", "HEAD") {
+		return
+	}
+
+	// Parse the filter
+	interval := strings.TrimPrefix(r.URL.Path, "/v1/range/")
+	filter, err := ParseRangeRequest(interval, r.URL.Query(), a.customInterval)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("Invalid Request: %s", err)))
+		return
+	}
+
+	iter, err := a.db.QueryCounters(r.Context(), filter)
+	if err != nil {
+		a.requestLogger(r.Context()).Error("failed to query counters", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+	a.writeQueryResults(w, r, filter.Interval, &rangeIterator{
+		iter:     iter,
+		interval: filter.Interval,
+		custom:   a.customInterval,
+		next:     filter.From,
+		to:       filter.To,
+	})
+}
+
+// rangeIterator fills in a zero count for each date from the next date
+// through the to date that is missing from the results of a query.
+// The results must be sorted by date and within the range.
+type rangeIterator struct {
+	iter     QueryResultIterator
+	interval string
+	custom   *CustomIntervalConfig
+	next     time.Time
+	to       time.Time
+
+	// pending is the result read ahead of the next date
+	pending *QueryResult
+	done    bool
+}
+
+func (r *rangeIterator) Next() (*QueryResult, error) {
+	if r.pending == nil && !r.done {
+		res, err := r.iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		r.pending = res
+		r.done = res == nil
+	}
+
+	// Return the pending result once it is due, continuing after its date
+	// in case the from date is not aligned to the interval
+	if r.pending != nil && !r.pending.Date.After(r.next) {
+		res := r.pending
+		r.pending = nil
+		r.next, _ = IntervalEnd(r.interval, res.Date, r.custom)
+		return res, nil
+	}
+	if r.next.After(r.to) {
+		return nil, nil
+	}
+	res := &QueryResult{Date: r.next}
+	r.next, _ = IntervalEnd(r.interval, r.next, r.custom)
+	return res, nil
+}
+
+func (r *rangeIterator) Close() error {
+	return r.iter.Close()
+}
+
+// IngressRequest is input for ingress as a JSON object
+type IngressRequest struct {
+	// Unique identifier for this event
+	ID string
+
+	// Date of the event, set to the current time if omitted.
+	// Expected to be RFC 3339 format.
+	Date time.Time
+
+	// Attributes are an opaque set of key/value pairs. If none provided, the
+	// configured null attribute will be automatically injected.
+	Attributes map[string]string
+
+	// MultiAttributes are attributes with a list of values. The event is
+	// counted under every combination of the values.
+	MultiAttributes map[string][]string `json:"multi_attributes"`
+}
+
+// Codes of the validation errors for an invalid event
+const (
+	ErrCodeInvalidBody        = "invalid_body"
+	ErrCodeDuplicateParameter = "duplicate_parameter"
+	ErrCodeMissingID          = "missing_id"
+	ErrCodeInvalidDate        = "invalid_date"
+	ErrCodeColonInAttribute   = "colon_in_attribute"
+	ErrCodeInvalidUTF8        = "invalid_utf8"
+	ErrCodeAttributeTooLong   = "attribute_too_long"
+	ErrCodeReservedAttribute  = "reserved_attribute"
+	ErrCodeInvalidAttribute   = "invalid_attribute"
+	ErrCodeTooManyAttributes  = "too_many_attributes"
+)
+
+// ValidationError is returned for an invalid event. The code is machine
+// readable, and the message describes the problem.
+type ValidationError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func newValidationError(code, format string, args ...interface{}) *ValidationError {
+	return &ValidationError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+// writeValidationError responds with a 400 and the error as JSON. Other
+// errors, such as a malformed body, use the invalid_body code.
+func writeValidationError(w http.ResponseWriter, err error) {
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		verr = &ValidationError{Code: ErrCodeInvalidBody, Message: err.Error()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(400)
+	json.NewEncoder(w).Encode(verr)
+}
+
+// Validate is used to sanity check a request and initialize defaults.
+// The date is bounds checked if a config is provided.
+func (r *IngressRequest) Validate(config *IngressConfig, attrConfig *AttributeConfig) error {
+	// Ensure there is an ID, unless the event is only counted or the ID is derived
+	if r.ID == "" && (config == nil || (!config.Increments && !config.DeriveID)) {
+		return newValidationError(ErrCodeMissingID, "missing request ID")
+	}
+
+	// Fill in the date if missing, otherwise check the bounds
+	now := time.Now().UTC()
+	if r.Date.IsZero() {
+		r.Date = now
+	} else if config != nil {
+		if config.MaxFuture > 0 && r.Date.After(now.Add(config.MaxFuture)) {
+			return newValidationError(ErrCodeInvalidDate, "date is more than %v in the future", config.MaxFuture)
+		}
+		if config.MaxPast > 0 && r.Date.Before(now.Add(-1*config.MaxPast)) {
+			return newValidationError(ErrCodeInvalidDate, "date is more than %v in the past", config.MaxPast)
+		}
+	}
+
+	// Inject the null attribute if necessary
+	if len(r.Attributes) == 0 && len(r.MultiAttributes) == 0 {
+		null := attrConfig.NullName()
+		r.Attributes = map[string]string{
+			null: null,
+		}
+		return nil
+	}
+	for key, value := range r.Attributes {
+		if err := validateAttribute(key, value, attrConfig); err != nil {
+			return err
+		}
+	}
+
+	// Check the multi-valued attributes, removing duplicate values
+	combinations := 1
+	for key, values := range r.MultiAttributes {
+		if _, ok := r.Attributes[key]; ok {
+			return newValidationError(ErrCodeInvalidAttribute, "attribute key %q is given as both single and multi-valued", key)
+		}
+		if len(values) == 0 {
+			return newValidationError(ErrCodeInvalidAttribute, "multi-valued attribute %q has no values", key)
+		}
+		for _, value := range values {
+			if err := validateAttribute(key, value, attrConfig); err != nil {
+				return err
+			}
+		}
+		values = uniqueStrings(values)
+		r.MultiAttributes[key] = values
+
+		combinations *= len(values)
+		if combinations > MaxMultiAttributeCombinations {
+			return newValidationError(ErrCodeTooManyAttributes,
+				"multi-valued attributes expand to more than %d combinations", MaxMultiAttributeCombinations)
+		}
+	}
+	return nil
+}
+
+// validateAttribute checks that an attribute key/value can be used in a key
+func validateAttribute(key, value string, attrConfig *AttributeConfig) error {
+	// The v2 key format allows any character
+	if attrConfig.keyFormat() != KeyFormatV2 {
+		if strings.Contains(key, KeySeperator) {
+			return newValidationError(ErrCodeColonInAttribute, "invalid use of colon in attribute key")
+		}
+		if strings.Contains(value, KeySeperator) && !attrConfig.encodeValues() {
+			return newValidationError(ErrCodeColonInAttribute, "invalid use of colon in attribute value")
+		}
+	}
+
+	// Invalid UTF-8 would be replaced when the attributes are stored as JSON
+	if !utf8.ValidString(key) || !utf8.ValidString(value) {
+		return newValidationError(ErrCodeInvalidUTF8, "attribute key/value is not valid UTF-8")
+	}
+	if max := attrConfig.maxKeyLength(); len(key) > max {
+		return newValidationError(ErrCodeAttributeTooLong, "attribute key exceeds %d bytes", max)
+	}
+	if max := attrConfig.maxValueLength(); len(value) > max {
+		return newValidationError(ErrCodeAttributeTooLong, "attribute %q value exceeds %d bytes", key, max)
+	}
+	// Check the lower case key as well if it will be normalized
+	if sortedContains(ReservedAttributes, key) ||
+		(attrConfig != nil && attrConfig.LowercaseKeys && sortedContains(ReservedAttributes, strings.ToLower(key))) {
+		return newValidationError(ErrCodeReservedAttribute, "attribute key %q is reserved", key)
+	}
+	return nil
+}
+
+// uniqueStrings sorts the values and removes any duplicates in place
+func uniqueStrings(values []string) []string {
+	sort.Strings(values)
+	out := values[:0]
+	for idx, val := range values {
+		if idx == 0 || val != values[idx-1] {
+			out = append(out, val)
+		}
+	}
+	return out
+}
+
+// Filter is used to normalize and filter the attributes based on the configuration.
+// Whitelist takes precedence when provided. The input set must be sorted.
+// Default attributes are added last, so they are not filtered.
+func (r *IngressRequest) Filter(config *AttributeConfig) {
+	// Skip when there is no config
+	if config == nil {
+		return
+	}
+
+	// Normalize and alias first, so the lists match the canonical keys
+	r.normalize(config)
+	r.alias(config)
+
+	// Apply the whitelist first
+	if len(config.Whitelist) > 0 {
+		for key := range r.Attributes {
+			if !sortedContains(config.Whitelist, key) {
+				delete(r.Attributes, key)
+			}
+		}
+		for key := range r.MultiAttributes {
+			if !sortedContains(config.Whitelist, key) {
+				delete(r.MultiAttributes, key)
+			}
+		}
+	}
+
+	// Apply the blacklist
+	if len(config.Blacklist) > 0 {
+		for _, key := range config.Blacklist {
+			delete(r.Attributes, key)
+			delete(r.MultiAttributes, key)
+		}
+	}
+
+	// Add the defaults without overriding the event
+	for key, value := range config.DefaultAttributes {
+		if _, ok := r.MultiAttributes[key]; ok {
+			continue
+		}
+		if _, ok := r.Attributes[key]; !ok {
+			if r.Attributes == nil {
+				r.Attributes = make(map[string]string)
+			}
+			r.Attributes[key] = value
+		}
+	}
+}
+
+// alias renames the attribute keys to their canonical keys. If the canonical
+// key is already present its value is kept, otherwise the value of the first
+// alias in sorted order is used. Single-valued attributes take precedence
+// over multi-valued attributes with the same key.
+func (r *IngressRequest) alias(config *AttributeConfig) {
+	if len(config.Aliases) == 0 {
+		return
+	}
+
+	// Visit the keys in sorted order so collisions are deterministic
+	keys := make([]string, 0, len(r.Attributes))
+	for key := range r.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		canonical, ok := config.Aliases[key]
+		if !ok || canonical == key {
+			continue
+		}
+		if _, ok := r.Attributes[canonical]; !ok {
+			r.Attributes[canonical] = r.Attributes[key]
+		}
+		delete(r.Attributes, key)
+	}
+
+	// Rename the multi-valued attributes the same way
+	keys = keys[:0]
+	for key := range r.MultiAttributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		canonical, ok := config.Aliases[key]
+		if !ok || canonical == key {
+			continue
+		}
+		if _, ok := r.MultiAttributes[canonical]; !ok {
+			r.MultiAttributes[canonical] = r.MultiAttributes[key]
+		}
+		delete(r.MultiAttributes, key)
+	}
+	for key := range r.Attributes {
+		delete(r.MultiAttributes, key)
+	}
+}
+
+// normalize is used to lower case and trim the attributes if configured.
+// This only removes whitespace and changes case, so it cannot introduce
+// a colon into an attribute that was already validated. If a multi-valued
+// key collides with a single-valued key, the single value is used.
+func (r *IngressRequest) normalize(config *AttributeConfig) {
+	if !config.LowercaseKeys && !config.LowercaseValues && !config.TrimValues {
+		return
+	}
+	normKey := func(key string) string {
+		if config.LowercaseKeys {
+			return strings.ToLower(key)
+		}
+		return key
+	}
+	normValue := func(val string) string {
+		if config.TrimValues {
+			val = strings.TrimSpace(val)
+		}
+		if config.LowercaseValues {
+			val = strings.ToLower(val)
+		}
+		return val
+	}
+
+	// Visit the keys in sorted order so collisions are deterministic
+	keys := make([]string, 0, len(r.Attributes))
+	for key := range r.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	out := make(map[string]string, len(r.Attributes))
+	for _, key := range keys {
+		nk := normKey(key)
+		if _, ok := out[nk]; ok && nk != key {
+			continue
+		}
+		out[nk] = normValue(r.Attributes[key])
+	}
+	r.Attributes = out
+
+	// Normalize the multi-valued attributes the same way
+	if len(r.MultiAttributes) == 0 {
+		return
+	}
+	keys = keys[:0]
+	for key := range r.MultiAttributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	multiOut := make(map[string][]string, len(r.MultiAttributes))
+	for _, key := range keys {
+		nk := normKey(key)
+		if _, ok := out[nk]; ok {
+			continue
+		}
+		if _, ok := multiOut[nk]; ok && nk != key {
+			continue
+		}
+		values := make([]string, 0, len(r.MultiAttributes[key]))
+		for _, val := range r.MultiAttributes[key] {
+			values = append(values, normValue(val))
+		}
+		multiOut[nk] = uniqueStrings(values)
+	}
+	r.MultiAttributes = multiOut
+}
 
-// APIHandler implements the HTTP API endpoints
-type APIHandler struct {
-	logger     hclog.Logger
-	client     RedisClient
-	db         DatabaseClient
-	attrConfig *AttributeConfig
+// ParseIngress is used to parse an ingress request from a reader
+func ParseIngressRequest(r io.Reader, config *IngressConfig, attrConfig *AttributeConfig) (*IngressRequest, error) {
+	var req IngressRequest
+
+	// Attempt to parse the request, rejecting unknown fields to catch typos
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return nil, fmt.Errorf("failed to parse: %w", err)
+	}
+
+	// Validate the request
+	if err := req.Validate(config, attrConfig); err != nil {
+		return nil, err
+	}
+
+	// Return the request
+	return &req, nil
 }
 
-// Ingress is used to take events and update the appropriate redis keys
-func (a *APIHandler) Ingress(w http.ResponseWriter, r *http.Request) {
-	// Verify the method
-	if r.Method != "PUT" {
-		w.WriteHeader(405)
-		return
+// ParseSimpleIngressRequest builds a request from query or form parameters.
+// The "id" and "date" parameters are reserved, and every other parameter
+// is an attribute. Each parameter may only be given once.
+func ParseSimpleIngressRequest(params url.Values, config *IngressConfig, attrConfig *AttributeConfig) (*IngressRequest, error) {
+	req := IngressRequest{
+		Attributes: make(map[string]string),
+	}
+	for key, values := range params {
+		if len(values) != 1 {
+			return nil, newValidationError(ErrCodeDuplicateParameter, "parameter %q given %d times", key, len(values))
+		}
+		switch key {
+		case "id":
+			req.ID = values[0]
+		case "date":
+			date, err := time.Parse(time.RFC3339, values[0])
+			if err != nil {
+				return nil, newValidationError(ErrCodeInvalidDate, "invalid date: %v", err)
+			}
+			req.Date = date
+		default:
+			req.Attributes[key] = values[0]
+		}
 	}
 
-	// Parse the request body
-	req, err := ParseIngressRequest(r.Body)
-	if err != nil {
-		w.WriteHeader(400)
-		w.Write([]byte(fmt.Sprintf("Invalid Request: %s", err)))
-		return
+	// Validate the request
+	if err := req.Validate(config, attrConfig); err != nil {
+		return nil, err
 	}
-	a.logger.Debug("Ingress event", "id", req.ID, "attributes", req.Attributes)
+	return &req, nil
+}
 
-	// Filter the request before generating keys
-	req.Filter(a.attrConfig)
+// QueryFilter selects the counters of an interval to sum
+type QueryFilter struct {
+	Interval string
 
-	// Generate the keys
-	intervals := DateIntervals(DayInterval|WeekInterval|MonthInterval,
-		req.Date)
-	keys := RequestCounterKeys(intervals, req)
+	// Kind is the kind of counters to sum, CounterKindUnique if empty
+	Kind string
+
+	// From and To bound the dates of the counters, inclusive.
+	// A zero date is unbounded.
+	From time.Time
+	To   time.Time
 
-	// Update the keys
-	if err := a.client.UpdateKeys(keys, req.ID); err != nil {
-		a.logger.Error("failed to update redis", "error", err)
+	// Attributes restricts the counters to those with one of the
+	// values of each attribute
+	Attributes map[string][]string
+}
+
+// kind returns the kind of counters to sum
+func (f *QueryFilter) kind() string {
+	if f.Kind == "" {
+		return CounterKindUnique
 	}
+	return f.Kind
 }
 
-// Query is used to scan across an interval date range with any
-// optional filtering applied on attributes
-func (a *APIHandler) Query(w http.ResponseWriter, r *http.Request) {
-	// Verify the method
-	if r.Method != "GET" {
-		w.WriteHeader(405)
-		return
+// Matches checks if a counter with the attributes matches the filter
+func (f *QueryFilter) Matches(attributes map[string]string) bool {
+	for key, values := range f.Attributes {
+		val, ok := attributes[key]
+		if !ok {
+			return false
+		}
+		found := false
+		for _, v := range values {
+			if v == val {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
 	}
-	// TODO
+	return true
 }
 
-// Domain is used to determine the domain of attributes and values
-func (a *APIHandler) Domain(w http.ResponseWriter, r *http.Request) {
-	// Verify the method
-	if r.Method != "GET" {
-		w.WriteHeader(405)
-		return
+// QueryResult is the summed count of the matching counters for a date
+type QueryResult struct {
+	Date  time.Time
+	Count int64
+
+	// FirstSeen is when the first of the counters was snapshotted, and
+	// LastUpdated when any of them was last updated. Zero if unknown.
+	FirstSeen   time.Time
+	LastUpdated time.Time
+}
+
+// QueryResponse is a QueryResult with the date formatted for the interval
+type QueryResponse struct {
+	Date        string     `json:"date"`
+	Count       int64      `json:"count"`
+	FirstSeen   *time.Time `json:"first_seen,omitempty"`
+	LastUpdated *time.Time `json:"last_updated,omitempty"`
+}
+
+// NewQueryResponse formats the date of a result for the interval
+func NewQueryResponse(interval string, res *QueryResult, custom *CustomIntervalConfig) QueryResponse {
+	date, _ := FormatIntervalDate(interval, res.Date, custom)
+	out := QueryResponse{Date: date, Count: res.Count}
+	if !res.FirstSeen.IsZero() {
+		out.FirstSeen = &res.FirstSeen
 	}
-	// TODO
+	if !res.LastUpdated.IsZero() {
+		out.LastUpdated = &res.LastUpdated
+	}
+	return out
 }
 
-// Rnage is used to determine the start/end dates for an interval
-func (a *APIHandler) Range(w http.ResponseWriter, r *http.Request) {
-	// Verify the method
-	if r.Method != "GET" {
-		w.WriteHeader(405)
-		return
+// ParseQueryRequest is used to parse the query parameters of a query.
+// The "from" and "to" parameters bound the dates, the "kind" selects the
+// kind of counters, and every other parameter filters on an attribute.
+// Repeating an attribute matches any of the values.
+func ParseQueryRequest(interval string, params url.Values, custom *CustomIntervalConfig) (*QueryFilter, error) {
+	if _, ok := FormatIntervalDate(interval, time.Time{}, custom); !ok {
+		return nil, fmt.Errorf("invalid interval %q", interval)
+	}
+	filter := &QueryFilter{
+		Interval:   interval,
+		Kind:       CounterKindUnique,
+		Attributes: make(map[string][]string),
+	}
+	for key, values := range params {
+		switch key {
+		case "kind":
+			if len(values) != 1 {
+				return nil, fmt.Errorf("parameter %q given %d times", key, len(values))
+			}
+			kind, err := ParseCounterKind(values[0])
+			if err != nil {
+				return nil, err
+			}
+			filter.Kind = kind
+		case "from", "to":
+			if len(values) != 1 {
+				return nil, fmt.Errorf("parameter %q given %d times", key, len(values))
+			}
+			date, err := ParseIntervalDate(interval, values[0], custom)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s date: %v", key, err)
+			}
+			if key == "from" {
+				filter.From = date
+			} else {
+				filter.To = date
+			}
+		default:
+			filter.Attributes[key] = uniqueStrings(values)
+		}
 	}
-	// TODO
+	if !filter.From.IsZero() && !filter.To.IsZero() && filter.To.Before(filter.From) {
+		return nil, fmt.Errorf("to date is before the from date")
+	}
+	return filter, nil
 }
 
-// IngressRequest is input for ingress as a JSON object
-type IngressRequest struct {
-	// Unique identifier for this event
-	ID string
+// ParseRangeRequest is used to parse the query parameters of a range
+// query. They are the same as a query, except that the "from" and "to"
+// dates are required and can span at most MaxRangeDates dates.
+func ParseRangeRequest(interval string, params url.Values, custom *CustomIntervalConfig) (*QueryFilter, error) {
+	filter, err := ParseQueryRequest(interval, params, custom)
+	if err != nil {
+		return nil, err
+	}
+	if filter.From.IsZero() || filter.To.IsZero() {
+		return nil, fmt.Errorf("missing from or to date")
+	}
+	date := filter.From
+	for n := 1; date.Before(filter.To); n++ {
+		if n >= MaxRangeDates {
+			return nil, fmt.Errorf("range must span at most %d dates", MaxRangeDates)
+		}
+		date, _ = IntervalEnd(interval, date, custom)
+	}
+	return filter, nil
+}
 
-	// Date of the event, set to the current time if omitted.
-	// Expected to be RFC 3339 format.
-	Date time.Time
+// ParseCounterKind parses the kind of counters to query,
+// which is CounterKindUnique if empty
+func ParseCounterKind(raw string) (string, error) {
+	switch raw {
+	case "", CounterKindUnique:
+		return CounterKindUnique, nil
+	case CounterKindEvents:
+		return CounterKindEvents, nil
+	default:
+		return "", fmt.Errorf("invalid kind %q", raw)
+	}
+}
 
-	// Attributes are an opaque set of key/value pairs. If none provided, the
-	// special NullAttribute will be automatically injected.
-	Attributes map[string]string
+// TopRequest selects the values of an attribute to rank by count
+type TopRequest struct {
+	Interval  string
+	Kind      string
+	Date      time.Time
+	Attribute string
+	Limit     int
+}
+
+// DomainRequest is a page of the values of an attribute
+type DomainRequest struct {
+	Attribute string
+
+	// Cursor is the last value of the previous page, or empty for the first page
+	Cursor string
+	Limit  int
+}
+
+// DomainResponse is the output of the domain endpoint. Next is the
+// cursor of the next page, and is empty on the last page.
+type DomainResponse struct {
+	Values []string `json:"values"`
+	Next   string   `json:"next,omitempty"`
+}
+
+// ParseDomainRequest is used to parse the query parameters of a domain
+// request. The "cursor" is the "next" value of the previous page, and the
+// "limit" defaults to DefaultDomainLimit.
+func ParseDomainRequest(attribute string, params url.Values) (*DomainRequest, error) {
+	if attribute == "" {
+		return nil, fmt.Errorf("missing attribute")
+	}
+	req := &DomainRequest{
+		Attribute: attribute,
+		Cursor:    params.Get("cursor"),
+		Limit:     DefaultDomainLimit,
+	}
+	if raw := params.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid limit %q", raw)
+		}
+		if limit > MaxDomainLimit {
+			return nil, fmt.Errorf("limit must be at most %d", MaxDomainLimit)
+		}
+		req.Limit = limit
+	}
+	return req, nil
+}
+
+// ValueCount is the summed count of the counters with an attribute value
+type ValueCount struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
 }
 
-// Validate is used to sanity check a request and initialize defaults
-func (r *IngressRequest) Validate() error {
-	// Ensure there is an ID
-	if r.ID == "" {
-		return fmt.Errorf("missing request ID")
+// ParseTopRequest is used to parse the query parameters of a top query.
+// The "date" and "attribute" parameters are required, the "limit"
+// defaults to DefaultTopLimit and the "kind" to CounterKindUnique.
+func ParseTopRequest(interval string, params url.Values, custom *CustomIntervalConfig) (*TopRequest, error) {
+	if _, ok := FormatIntervalDate(interval, time.Time{}, custom); !ok {
+		return nil, fmt.Errorf("invalid interval %q", interval)
+	}
+	req := &TopRequest{
+		Interval:  interval,
+		Attribute: params.Get("attribute"),
+		Limit:     DefaultTopLimit,
+	}
+	if req.Attribute == "" {
+		return nil, fmt.Errorf("missing attribute")
+	}
+	kind, err := ParseCounterKind(params.Get("kind"))
+	if err != nil {
+		return nil, err
 	}
+	req.Kind = kind
 
-	// Fill in the date if missing
-	if r.Date.IsZero() {
-		r.Date = time.Now().UTC()
+	raw := params.Get("date")
+	if raw == "" {
+		return nil, fmt.Errorf("missing date")
+	}
+	date, err := ParseIntervalDate(interval, raw, custom)
+	if err != nil {
+		return nil, err
 	}
+	req.Date = date
 
-	// Inject the null attribute if necessary
-	if len(r.Attributes) == 0 {
-		r.Attributes = map[string]string{
-			NullAttribute: NullAttribute,
+	if raw := params.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid limit %q", raw)
 		}
-	} else {
-		for key, value := range r.Attributes {
-			if strings.Contains(key, KeySeperator) || strings.Contains(value, KeySeperator) {
-				return fmt.Errorf("invalid use of colon in attribute key/value")
-			}
+		if limit > MaxTopLimit {
+			return nil, fmt.Errorf("limit must be at most %d", MaxTopLimit)
 		}
+		req.Limit = limit
 	}
-	return nil
+	return req, nil
 }
 
-// Filter is used to filter the attributes based on the configuration.
-// Whitelist takes precedence when provided. The input set must be sorted.
-func (r *IngressRequest) Filter(config *AttributeConfig) {
-	// Skip when there is no config
-	if config == nil {
-		return
+// CompareRequest selects the values of an attribute to compare between dates
+type CompareRequest struct {
+	Interval  string
+	Kind      string
+	Date      time.Time
+	Prev      time.Time
+	Attribute string
+}
+
+// ValueComparison has the summed counts of an attribute value for two dates
+type ValueComparison struct {
+	Value    string `json:"value"`
+	Count    int64  `json:"count"`
+	Previous int64  `json:"previous"`
+
+	// Change is the percentage change from the previous count,
+	// or nil if the previous count is zero
+	Change *float64 `json:"change"`
+}
+
+// ParseCompareRequest is used to parse the query parameters of a compare
+// query. The "date" and "attribute" parameters are required, the "prev"
+// date defaults to the period before the date and the "kind" to
+// CounterKindUnique.
+func ParseCompareRequest(interval string, params url.Values, custom *CustomIntervalConfig) (*CompareRequest, error) {
+	if _, ok := FormatIntervalDate(interval, time.Time{}, custom); !ok {
+		return nil, fmt.Errorf("invalid interval %q", interval)
+	}
+	req := &CompareRequest{
+		Interval:  interval,
+		Attribute: params.Get("attribute"),
+	}
+	if req.Attribute == "" {
+		return nil, fmt.Errorf("missing attribute")
+	}
+	kind, err := ParseCounterKind(params.Get("kind"))
+	if err != nil {
+		return nil, err
 	}
+	req.Kind = kind
 
-	// Apply the whitelist first
-	if len(config.Whitelist) > 0 {
-		for key := range r.Attributes {
-			idx := sort.SearchStrings(config.Whitelist, key)
-			if idx >= len(config.Whitelist) || config.Whitelist[idx] != key {
-				delete(r.Attributes, key)
-			}
+	raw := params.Get("date")
+	if raw == "" {
+		return nil, fmt.Errorf("missing date")
+	}
+	date, err := ParseIntervalDate(interval, raw, custom)
+	if err != nil {
+		return nil, err
+	}
+	req.Date = date
+
+	if raw := params.Get("prev"); raw != "" {
+		prev, err := ParseIntervalDate(interval, raw, custom)
+		if err != nil {
+			return nil, err
 		}
+		req.Prev = prev
+	} else {
+		req.Prev = PreviousIntervalDate(interval, date, custom)
+	}
+	if req.Prev.Equal(req.Date) {
+		return nil, fmt.Errorf("prev date must differ from the date")
 	}
+	return req, nil
+}
 
-	// Apply the blacklist
-	if len(config.Blacklist) > 0 {
-		for _, key := range config.Blacklist {
-			delete(r.Attributes, key)
+// PreviousIntervalDate returns the date of the period before the date
+func PreviousIntervalDate(interval string, date time.Time, custom *CustomIntervalConfig) time.Time {
+	switch interval {
+	case "day":
+		return date.AddDate(0, 0, -1)
+	case "week":
+		return date.AddDate(0, 0, -7)
+	case "month":
+		return date.AddDate(0, -1, 0)
+	case "quarter":
+		return date.AddDate(0, -3, 0)
+	case "custom":
+		if custom == nil {
+			return date
 		}
+		return custom.Start(custom.Bucket(date) - 1)
+	default:
+		return date
 	}
 }
 
-// ParseIngress is used to parse an ingress request from a reader
-func ParseIngressRequest(r io.Reader) (*IngressRequest, error) {
-	var req IngressRequest
+// PercentChange returns the percentage change from the previous count,
+// or nil if there is no previous count
+func PercentChange(prev, cur int64) *float64 {
+	if prev == 0 {
+		return nil
+	}
+	change := 100 * float64(cur-prev) / float64(prev)
+	return &change
+}
+
+// IngressResponse is the verbose response to an ingress request, which
+// describes how the attributes of the event were counted
+type IngressResponse struct {
+	// Attributes and MultiAttributes are counted after normalizing,
+	// aliasing and filtering
+	Attributes      map[string]string   `json:"attributes"`
+	MultiAttributes map[string][]string `json:"multi_attributes,omitempty"`
 
-	// Attempt to parse the request
-	if err := json.NewDecoder(r).Decode(&req); err != nil {
-		return nil, fmt.Errorf("failed to parse: %v", err)
+	// Dropped are the sorted keys of the request removed by the filters
+	Dropped []string `json:"dropped"`
+
+	// Keys is the number of counters updated
+	Keys int `json:"keys"`
+
+	// Sampled is false if the event was skipped by the sample rate,
+	// in which case the keys are not updated
+	Sampled bool `json:"sampled"`
+}
+
+// NewIngressResponse returns the verbose response for a filtered request,
+// given the attribute keys of the request before it was filtered
+func NewIngressResponse(req *IngressRequest, original []string, config *AttributeConfig, keys int) *IngressResponse {
+	resp := &IngressResponse{
+		Attributes:      req.Attributes,
+		MultiAttributes: req.MultiAttributes,
+		Dropped:         []string{},
+		Keys:            keys,
+		Sampled:         true,
 	}
+	if resp.Attributes == nil {
+		resp.Attributes = map[string]string{}
+	}
+	for _, key := range original {
+		canonical := canonicalKey(key, config)
+		_, single := req.Attributes[canonical]
+		_, multi := req.MultiAttributes[canonical]
+		if !single && !multi {
+			resp.Dropped = append(resp.Dropped, key)
+		}
+	}
+	return resp
+}
 
-	// Validate the request
-	if err := req.Validate(); err != nil {
-		return nil, err
+// canonicalKey returns the key an attribute is counted under, by
+// normalizing and aliasing a request with only that attribute like Filter
+func canonicalKey(key string, config *AttributeConfig) string {
+	if config == nil {
+		return key
+	}
+	req := &IngressRequest{Attributes: map[string]string{key: ""}}
+	req.normalize(config)
+	req.alias(config)
+	for canonical := range req.Attributes {
+		return canonical
 	}
+	return key
+}
 
-	// Return the request
-	return &req, nil
+// IsVerbose checks if the "verbose" query parameter requests a verbose response
+func IsVerbose(params url.Values) bool {
+	verbose, _ := strconv.ParseBool(params.Get("verbose"))
+	return verbose
+}
+
+// attributeKeys returns the sorted keys of the single and multi-valued attributes
+func (r *IngressRequest) attributeKeys() []string {
+	keys := make([]string, 0, len(r.Attributes)+len(r.MultiAttributes))
+	for key := range r.Attributes {
+		keys = append(keys, key)
+	}
+	for key := range r.MultiAttributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// IsJSONContentType checks if a Content-Type header is for JSON
+func IsJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "application/json"
+}
+
+// AcceptsNDJSON checks if an Accept header asks for newline delimited JSON
+func AcceptsNDJSON(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err == nil && mediaType == NDJSONContentType {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// valueEncoder percent encodes the characters that cannot be used in
+	// an attribute value of a key, and valueDecoder reverses it
+	valueEncoder = strings.NewReplacer("%", "%25", KeySeperator, "%3A")
+	valueDecoder = strings.NewReplacer("%25", "%", "%3A", KeySeperator)
+)
+
+// EncodeAttributeValue encodes an attribute value for use in a key.
+// Values without a colon or percent sign are unchanged.
+func EncodeAttributeValue(value string) string {
+	return valueEncoder.Replace(value)
+}
+
+// DecodeAttributeValue decodes an attribute value of a key
+func DecodeAttributeValue(value string) string {
+	return valueDecoder.Replace(value)
+}
+
+// encodedValues returns a copy of the request with the attribute values
+// encoded, so the keys can be generated from it
+func (r *IngressRequest) encodedValues() *IngressRequest {
+	out := *r
+	out.Attributes = make(map[string]string, len(r.Attributes))
+	for key, value := range r.Attributes {
+		out.Attributes[key] = EncodeAttributeValue(value)
+	}
+	out.MultiAttributes = make(map[string][]string, len(r.MultiAttributes))
+	for key, values := range r.MultiAttributes {
+		encoded := make([]string, len(values))
+		for idx, value := range values {
+			encoded[idx] = EncodeAttributeValue(value)
+		}
+		out.MultiAttributes[key] = encoded
+	}
+	return &out
+}
+
+// counterKeys returns the keys to increment for the request in the
+// configured key format, encoding the values if configured
+func (c *AttributeConfig) counterKeys(intervals map[string]string, r *IngressRequest) []string {
+	if c.keyFormat() == KeyFormatV2 {
+		return RequestCounterKeysV2(intervals, r)
+	}
+	if c.encodeValues() {
+		r = r.encodedValues()
+	}
+	return RequestCounterKeys(intervals, r)
 }
 
 // RequestCounterKeys returns all the keys that should be incremented for the request
 // Key structure is <interval>:<date>:<attr1>:<val1>_<attr2>:...
+// A key is generated for each combination of the multi-valued attributes.
 func RequestCounterKeys(intervals map[string]string, r *IngressRequest) []string {
+	return requestCounterKeys(intervals, r, "", func(buf *bytes.Buffer, first bool, key, val string) {
+		if !first {
+			buf.WriteString(KeySeperator)
+		}
+		buf.WriteString(key)
+		buf.WriteString(KeySeperator)
+		buf.WriteString(val)
+	})
+}
+
+// RequestCounterKeysV2 returns the keys in the v2 format, which prefixes
+// each attribute key and value with its length in bytes. Key structure is
+// v2:<interval>:<date>:<len>:<attr1><len>:<val1><len>:<attr2>...
+func RequestCounterKeysV2(intervals map[string]string, r *IngressRequest) []string {
+	return requestCounterKeys(intervals, r, KeyFormatV2Prefix, func(buf *bytes.Buffer, first bool, key, val string) {
+		writeLengthPrefixed(buf, key)
+		writeLengthPrefixed(buf, val)
+	})
+}
+
+// writeLengthPrefixed writes the length of the string, a colon, and the string
+func writeLengthPrefixed(buf *bytes.Buffer, s string) {
+	buf.WriteString(strconv.Itoa(len(s)))
+	buf.WriteString(KeySeperator)
+	buf.WriteString(s)
+}
+
+// requestCounterKeys generates the keys for every interval and combination
+// of the multi-valued attributes, using writeAttr to write each attribute
+func requestCounterKeys(intervals map[string]string, r *IngressRequest, prefix string,
+	writeAttr func(buf *bytes.Buffer, first bool, key, val string)) []string {
 	// Put the keys into a sorted order
-	keys := make([]string, 0, len(r.Attributes))
+	keys := make([]string, 0, len(r.Attributes)+len(r.MultiAttributes))
 	for key := range r.Attributes {
 		keys = append(keys, key)
 	}
+	for key := range r.MultiAttributes {
+		keys = append(keys, key)
+	}
 	sort.Strings(keys)
 
-	// Build the suffix
-	var buf bytes.Buffer
+	// Build the suffix for every combination of the multi-valued attributes
+	suffixes := []string{""}
 	for idx, key := range keys {
-		val := r.Attributes[key]
-		if idx != 0 {
-			buf.WriteString(KeySeperator)
+		values, ok := r.MultiAttributes[key]
+		if !ok {
+			values = []string{r.Attributes[key]}
 		}
-		buf.WriteString(key)
-		buf.WriteString(KeySeperator)
-		buf.WriteString(val)
+		next := make([]string, 0, len(suffixes)*len(values))
+		for _, suffix := range suffixes {
+			for _, val := range values {
+				var buf bytes.Buffer
+				buf.WriteString(suffix)
+				writeAttr(&buf, idx == 0, key, val)
+				next = append(next, buf.String())
+			}
+		}
+		suffixes = next
 	}
-	suffix := buf.String()
 
 	// Construct key per interval
 	var out []string
 	for interval, date := range intervals {
-		var buf bytes.Buffer
-		buf.WriteString(interval)
-		buf.WriteString(KeySeperator)
-		buf.WriteString(date)
-		buf.WriteString(KeySeperator)
-		buf.WriteString(suffix)
-		out = append(out, buf.String())
+		for _, suffix := range suffixes {
+			var buf bytes.Buffer
+			buf.WriteString(prefix)
+			buf.WriteString(interval)
+			buf.WriteString(KeySeperator)
+			buf.WriteString(date)
+			buf.WriteString(KeySeperator)
+			buf.WriteString(suffix)
+			out = append(out, buf.String())
+		}
 	}
 	return out
 }
 
 // DateIntervals returns the formatted intervals for a given
-// date and set of interval values
-func DateIntervals(intervals int, date time.Time) map[string]string {
+// date and set of interval values. The date is converted into the
+// location first if provided, so intervals follow local time.
+func DateIntervals(intervals int, date time.Time, loc *time.Location, custom *CustomIntervalConfig) map[string]string {
+	if loc != nil {
+		date = date.In(loc)
+	}
 	out := make(map[string]string)
 	if intervals&DayInterval != 0 {
 		out["day"] = date.Format("2006-01-02")
 	}
 	if intervals&WeekInterval != 0 {
 		weekday := date.Weekday()
-		aligned := date.Add(-1 * 24 * time.Hour * time.Duration(weekday))
+		aligned := date.AddDate(0, 0, -1*int(weekday))
 		out["week"] = aligned.Format("2006-01-02")
 	}
 	if intervals&MonthInterval != 0 {
 		out["month"] = date.Format("2006-01")
 	}
+	if intervals&QuarterInterval != 0 {
+		out["quarter"], _ = FormatIntervalDate("quarter", date, nil)
+	}
+	if intervals&CustomInterval != 0 && custom != nil {
+		out["custom"], _ = FormatIntervalDate("custom", date, custom)
+	}
 	return out
 }
+
+// SplitExactIntervals splits the intervals into those that should be
+// counted exactly and those that should be approximated for a request.
+// The exact configuration must be sorted.
+func SplitExactIntervals(config *ExactConfig, intervals map[string]string, r *IngressRequest) (exact, approx map[string]string) {
+	// Skip when there is no config
+	if config == nil || (len(config.Intervals) == 0 && len(config.Attributes) == 0) {
+		return nil, intervals
+	}
+
+	// Check if any attribute requires exact counting
+	exactAttr := false
+	for key := range r.Attributes {
+		if sortedContains(config.Attributes, key) {
+			exactAttr = true
+			break
+		}
+	}
+	for key := range r.MultiAttributes {
+		if sortedContains(config.Attributes, key) {
+			exactAttr = true
+			break
+		}
+	}
+
+	exact = make(map[string]string)
+	approx = make(map[string]string)
+	for interval, date := range intervals {
+		if exactAttr || sortedContains(config.Intervals, interval) {
+			exact[interval] = date
+		} else {
+			approx[interval] = date
+		}
+	}
+	return exact, approx
+}
+
+// sortedContains checks if a sorted list contains a value
+func sortedContains(list []string, val string) bool {
+	idx := sort.SearchStrings(list, val)
+	return idx < len(list) && list[idx] == val
+}
@@ -1,8 +1,21 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/gif"
+	"math"
+	"math/rand"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -13,6 +26,7 @@ import (
 func TestAPI_Ingress_Auth(t *testing.T) {
 	input := `{"id": "1234", "date": "2009-11-10T23:00:00Z", "attributes": {"foo": "bar"}}`
 	req := httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(input))
+	req.Header.Set("Content-Type", "application/json")
 
 	mock := NewMockRedisClient()
 	api := &APIHandler{
@@ -48,6 +62,7 @@ func TestAPI_Ingress_Auth(t *testing.T) {
 func TestAPI_Ingress(t *testing.T) {
 	input := `{"id": "1234", "date": "2009-11-10T23:00:00Z", "attributes": {"foo": "bar", "zoo": "zip"}}`
 	req := httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(input))
+	req.Header.Set("Content-Type", "application/json")
 	resp := httptest.NewRecorder()
 
 	mock := NewMockRedisClient()
@@ -72,67 +87,1718 @@ func TestAPI_Ingress(t *testing.T) {
 	assert.Contains(t, ids, "1234")
 }
 
+func TestAPI_Ingress_EncodeValues(t *testing.T) {
+	input := `{"id": "1234", "date": "2009-11-10T23:00:00Z", "attributes": {"url": "http://x.com/100%", "foo": "bar"}}`
+	ingress := func(api *APIHandler) int {
+		req := httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(input))
+		req.Header.Set("Content-Type", "application/json")
+		resp := httptest.NewRecorder()
+		NewHTTPHandler(api, nil).ServeHTTP(resp, req)
+		return resp.Result().StatusCode
+	}
+
+	// Colons in values are rejected by default
+	mock := NewMockRedisClient()
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		client: mock,
+	}
+	assert.Equal(t, 400, ingress(api))
+
+	// Values are encoded in the keys if enabled
+	api.attrConfig = &AttributeConfig{EncodeValues: true}
+	assert.Equal(t, 200, ingress(api))
+	assert.Contains(t, mock.counters, "day:2009-11-10:foo:bar:url:http%3A//x.com/100%25")
+}
+
+func TestAPI_Ingress_Exact(t *testing.T) {
+	input := `{"id": "1234", "date": "2009-11-10T23:00:00Z", "attributes": {"foo": "bar"}}`
+	req := httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(input))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mock := NewMockRedisClient()
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		client: mock,
+		exactConfig: &ExactConfig{
+			Intervals: []string{"day"},
+		},
+	}
+
+	mux := NewHTTPHandler(api, nil)
+	mux.ServeHTTP(resp, req)
+
+	// Assert a 200 OK
+	assert.Equal(t, 200, resp.Result().StatusCode)
+
+	// Assert only the day counter is exact
+	assert.Contains(t, mock.counters, "exact:day:2009-11-10:foo:bar")
+	assert.Contains(t, mock.counters, "week:2009-11-08:foo:bar")
+	assert.Contains(t, mock.counters, "month:2009-11:foo:bar")
+}
+
+func TestAPI_Ingress_ContentType(t *testing.T) {
+	input := `{"id": "1234", "attributes": {"foo": "bar"}}`
+	mock := NewMockRedisClient()
+	stats := new(Stats)
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		client: mock,
+		stats:  stats,
+	}
+	mux := NewHTTPHandler(api, nil)
+
+	type tcase struct {
+		ContentType string
+		Code        int
+	}
+	tcases := []tcase{
+		{"", 415},
+		{"application/x-www-form-urlencoded", 415},
+		{"text/plain", 415},
+		{"application/json", 200},
+		{"application/json; charset=utf-8", 200},
+	}
+	for _, tc := range tcases {
+		req := httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(input))
+		if tc.ContentType != "" {
+			req.Header.Set("Content-Type", tc.ContentType)
+		}
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		assert.Equal(t, tc.Code, resp.Result().StatusCode, tc.ContentType)
+	}
+
+	// Unsupported content types are counted as rejected events
+	assert.Equal(t, uint64(3), stats.Response(nil, nil).Events.Rejected)
+}
+
+func TestAPI_Ingress_UnknownField(t *testing.T) {
+	input := `{"id": "1234", "atributes": {"foo": "bar"}}`
+	req := httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(input))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mock := NewMockRedisClient()
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		client: mock,
+	}
+	mux := NewHTTPHandler(api, nil)
+	mux.ServeHTTP(resp, req)
+
+	// Assert a 400 and that nothing was counted
+	assert.Equal(t, 400, resp.Result().StatusCode)
+	assert.Contains(t, resp.Body.String(), "atributes")
+	assert.Equal(t, 0, len(mock.counters))
+}
+
+func TestAPI_Ingress_TooLarge(t *testing.T) {
+	input := `{"id": "1234", "attributes": {"foo": "` + strings.Repeat("a", 2048) + `"}}`
+	req := httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(input))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mock := NewMockRedisClient()
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		client: mock,
+		ingressConfig: &IngressConfig{
+			MaxBodySize: 1024,
+		},
+	}
+	mux := NewHTTPHandler(api, nil)
+	mux.ServeHTTP(resp, req)
+
+	// Assert a 413 and that nothing was counted
+	assert.Equal(t, 413, resp.Result().StatusCode)
+	assert.Equal(t, 0, len(mock.counters))
+}
+
+func TestAPI_DomainCounts(t *testing.T) {
+	db := NewMockDatabaseClient()
+	domain := map[string]map[string]struct{}{
+		"foo": map[string]struct{}{
+			"bar": struct{}{},
+			"baz": struct{}{},
+		},
+		"zip": map[string]struct{}{
+			"zap": struct{}{},
+		},
+	}
+	assert.Nil(t, db.UpsertDomain(context.Background(), domain))
+
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		db:     db,
+	}
+	mux := NewHTTPHandler(api, nil)
+
+	req := httptest.NewRequest("GET", "/v1/domain/counts", nil)
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Result().StatusCode)
+
+	var out map[string]int64
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&out))
+	assert.Equal(t, map[string]int64{"foo": 2, "zip": 1}, out)
+}
+
+func TestAPI_Domain(t *testing.T) {
+	db := NewMockDatabaseClient()
+	domain := map[string]map[string]struct{}{
+		"country": map[string]struct{}{
+			"ca": struct{}{},
+			"de": struct{}{},
+			"fr": struct{}{},
+			"us": struct{}{},
+		},
+		"plan": map[string]struct{}{
+			"free": struct{}{},
+		},
+	}
+	assert.Nil(t, db.UpsertDomain(context.Background(), domain))
+
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		db:     db,
+	}
+	mux := NewHTTPHandler(api, nil)
+
+	get := func(path string) (int, *DomainResponse) {
+		req := httptest.NewRequest("GET", path, nil)
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		if resp.Result().StatusCode != 200 {
+			return resp.Result().StatusCode, nil
+		}
+		var out DomainResponse
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&out))
+		return 200, &out
+	}
+
+	// All the values fit in the default page
+	code, out := get("/v1/domain/country")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, &DomainResponse{Values: []string{"ca", "de", "fr", "us"}}, out)
+
+	// Page through with a limit that divides the values evenly, so the
+	// last page is full but has no next cursor
+	_, out = get("/v1/domain/country?limit=2")
+	assert.Equal(t, &DomainResponse{Values: []string{"ca", "de"}, Next: "de"}, out)
+	_, out = get("/v1/domain/country?limit=2&cursor=de")
+	assert.Equal(t, &DomainResponse{Values: []string{"fr", "us"}}, out)
+
+	// A limit that does not divide the values evenly
+	_, out = get("/v1/domain/country?limit=3")
+	assert.Equal(t, &DomainResponse{Values: []string{"ca", "de", "fr"}, Next: "fr"}, out)
+	_, out = get("/v1/domain/country?limit=3&cursor=fr")
+	assert.Equal(t, &DomainResponse{Values: []string{"us"}}, out)
+
+	// A cursor past the end, and an unknown attribute, are empty
+	_, out = get("/v1/domain/country?cursor=us")
+	assert.Equal(t, &DomainResponse{Values: []string{}}, out)
+	_, out = get("/v1/domain/unknown")
+	assert.Equal(t, &DomainResponse{Values: []string{}}, out)
+
+	// Invalid requests
+	for _, path := range []string{"/v1/domain/", "/v1/domain/country?limit=0", "/v1/domain/country?limit=1001"} {
+		code, _ := get(path)
+		assert.Equal(t, 400, code, path)
+	}
+}
+
+func TestAPI_Query(t *testing.T) {
+	db := NewMockDatabaseClient()
+	day := time.Date(2017, 1, 18, 0, 0, 0, 0, time.UTC)
+	dec := time.Date(2016, 12, 1, 0, 0, 0, 0, time.UTC)
+	jan := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	feb := time.Date(2017, 2, 1, 0, 0, 0, 0, time.UTC)
+	attrs := func(country, plan string) map[string]string {
+		return map[string]string{"country": country, "plan": plan}
+	}
+	region := func(region string) map[string]string {
+		return map[string]string{"region": region}
+	}
+	assert.Nil(t, db.UpsertCounters(context.Background(), []*ParsedKey{
+		// Daily counters for the queries
+		{Interval: "day", Date: day, Attributes: map[string]string{"country": "us"}, Count: 10},
+		{Interval: "day", Date: day, Attributes: map[string]string{"country": "ca"}, Count: 5},
+		{Interval: "day", Date: day, Attributes: map[string]string{"country": "mx"}, Count: 2},
+		{Interval: "day", Date: day.AddDate(0, 0, 1), Attributes: map[string]string{"country": "us"}, Count: 7},
+		{Interval: "month", Date: day, Attributes: map[string]string{"country": "us"}, Count: 20},
+		{Interval: "day", Date: day, Attributes: map[string]string{"country": "us"}, Count: 40, Incr: true},
+
+		// Monthly counters for the top values
+		{Interval: "month", Date: jan, Attributes: attrs("us", "free"), Count: 10},
+		{Interval: "month", Date: jan, Attributes: attrs("us", "paid"), Count: 5},
+		{Interval: "month", Date: jan, Attributes: attrs("ca", "free"), Count: 12},
+		{Interval: "month", Date: jan, Attributes: attrs("mx", "free"), Count: 3},
+		{Interval: "month", Date: jan, Attributes: map[string]string{"null": ""}, Count: 100},
+		{Interval: "month", Date: feb, Attributes: attrs("mx", "free"), Count: 50},
+		{Interval: "week", Date: jan, Attributes: attrs("mx", "free"), Count: 50},
+
+		// Counters by region for the comparisons
+		{Interval: "month", Date: feb, Attributes: region("us"), Count: 15},
+		{Interval: "month", Date: jan, Attributes: region("us"), Count: 10},
+		{Interval: "month", Date: feb, Attributes: region("ca"), Count: 4},
+		{Interval: "month", Date: jan, Attributes: region("mx"), Count: 3},
+		{Interval: "month", Date: dec, Attributes: region("us"), Count: 20},
+		{Interval: "custom", Date: time.Date(2017, 1, 29, 0, 0, 0, 0, time.UTC), Attributes: region("us"), Count: 6},
+		{Interval: "custom", Date: time.Date(2017, 1, 15, 0, 0, 0, 0, time.UTC), Attributes: region("us"), Count: 4},
+	}))
+
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		db:     db,
+		customInterval: &CustomIntervalConfig{
+			Anchor:   jan,
+			Duration: 14 * 24 * time.Hour,
+		},
+	}
+	mux := NewHTTPHandler(api, nil)
+
+	change := func(v float64) *float64 { return &v }
+	compare := []*ValueComparison{
+		{Value: "us", Count: 15, Previous: 10, Change: change(50)},
+		{Value: "ca", Count: 4},
+		{Value: "mx", Count: 0, Previous: 3, Change: change(-100)},
+	}
+
+	// Expect is decoded into a value of its own type
+	type tcase struct {
+		URL    string
+		Code   int
+		Expect interface{}
+	}
+	cases := []tcase{
+		{"/v1/query/day?country=us&country=ca", 200, []QueryResponse{
+			{Date: "2017-01-18", Count: 15},
+			{Date: "2017-01-19", Count: 7},
+		}},
+		{"/v1/query/day?country=us&from=2017-01-19", 200, []QueryResponse{
+			{Date: "2017-01-19", Count: 7},
+		}},
+		{"/v1/query/day?to=2017-01-18", 200, []QueryResponse{
+			{Date: "2017-01-18", Count: 17},
+		}},
+		{"/v1/query/day?country=fr", 200, []QueryResponse{}},
+		{"/v1/query/day?kind=events", 200, []QueryResponse{
+			{Date: "2017-01-18", Count: 40},
+		}},
+		{"/v1/query/day?kind=hits", 400, nil},
+		{"/v1/query/hour", 400, nil},
+		{"/v1/query/day?from=2017-01", 400, nil},
+		{"/v1/query/day?from=2017-01-19&to=2017-01-18", 400, nil},
+		{"/v1/query/day?from=2017-01-18&from=2017-01-19", 400, nil},
+
+		{"/v1/top/month?attribute=country&date=2017-01", 200, []*ValueCount{
+			{Value: "us", Count: 15},
+			{Value: "ca", Count: 12},
+			{Value: "mx", Count: 3},
+		}},
+		{"/v1/top/month?attribute=country&date=2017-01&limit=1", 200, []*ValueCount{
+			{Value: "us", Count: 15},
+		}},
+		{"/v1/top/month?attribute=missing&date=2017-01", 200, []*ValueCount{}},
+		{"/v1/top/month?date=2017-01", 400, nil},
+		{"/v1/top/month?attribute=country", 400, nil},
+		{"/v1/top/month?attribute=country&date=2017-01-01", 400, nil},
+		{"/v1/top/month?attribute=country&date=2017-01&limit=0", 400, nil},
+		{"/v1/top/month?attribute=country&date=2017-01&limit=1001", 400, nil},
+		{"/v1/top/hour?attribute=country&date=2017-01", 400, nil},
+
+		{"/v1/compare/month?attribute=region&date=2017-02&prev=2017-01", 200, compare},
+		{"/v1/compare/month?attribute=region&date=2017-02", 200, compare},
+		{"/v1/compare/month?attribute=region&date=2017-01&prev=2016-12", 200, []*ValueComparison{
+			{Value: "us", Count: 10, Previous: 20, Change: change(-50)},
+			{Value: "mx", Count: 3},
+		}},
+		{"/v1/compare/month?attribute=missing&date=2017-02", 200, []*ValueComparison{}},
+		{"/v1/compare/custom?attribute=region&date=2", 200, []*ValueComparison{
+			{Value: "us", Count: 6, Previous: 4, Change: change(50)},
+		}},
+		{"/v1/compare/month?date=2017-02", 400, nil},
+		{"/v1/compare/month?attribute=region", 400, nil},
+		{"/v1/compare/month?attribute=region&date=2017-02&prev=2017-02", 400, nil},
+		{"/v1/compare/month?attribute=region&date=2017-02&prev=2017-01-01", 400, nil},
+		{"/v1/compare/hour?attribute=region&date=2017-02", 400, nil},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", tc.URL, nil)
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		assert.Equal(t, tc.Code, resp.Result().StatusCode, tc.URL)
+		if tc.Code != 200 {
+			continue
+		}
+		out := reflect.New(reflect.TypeOf(tc.Expect))
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(out.Interface()))
+
+		// Times are set when the counters are upserted, so only check they exist
+		if results, ok := out.Elem().Interface().([]QueryResponse); ok {
+			for i := range results {
+				assert.NotNil(t, results[i].FirstSeen, tc.URL)
+				assert.NotNil(t, results[i].LastUpdated, tc.URL)
+				results[i].FirstSeen, results[i].LastUpdated = nil, nil
+			}
+		}
+		assert.Equal(t, tc.Expect, out.Elem().Interface(), tc.URL)
+	}
+}
+
+// blockingQueryDB wraps the mock database so that query results block
+// after the first StreamFlushRows results until released
+type blockingQueryDB struct {
+	*MockDatabaseClient
+	release chan struct{}
+}
+
+func (b *blockingQueryDB) QueryCounters(ctx context.Context, filter *QueryFilter) (QueryResultIterator, error) {
+	iter, err := b.MockDatabaseClient.QueryCounters(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	return &blockingQueryIterator{QueryResultIterator: iter, release: b.release}, nil
+}
+
+type blockingQueryIterator struct {
+	QueryResultIterator
+	release chan struct{}
+	n       int
+}
+
+func (b *blockingQueryIterator) Next() (*QueryResult, error) {
+	if b.n == StreamFlushRows {
+		<-b.release
+	}
+	b.n++
+	return b.QueryResultIterator.Next()
+}
+
+func TestAPI_Query_Stream_WriteTimeout(t *testing.T) {
+	mock := NewMockDatabaseClient()
+	day := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	total := StreamFlushRows + 10
+	for i := 0; i < total; i++ {
+		assert.Nil(t, mock.UpsertCounters(context.Background(), []*ParsedKey{
+			{Interval: "day", Date: day.AddDate(0, 0, i), Attributes: map[string]string{"country": "us"}, Count: int64(i)},
+		}))
+	}
+
+	// The query stalls for longer than the write timeout
+	db := &blockingQueryDB{MockDatabaseClient: mock, release: make(chan struct{})}
+	time.AfterFunc(200*time.Millisecond, func() { close(db.release) })
+
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		db:     db,
+	}
+	srv := httptest.NewUnstartedServer(NewHTTPHandler(api, nil))
+	srv.Config.WriteTimeout = 50 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL+"/v1/query/day", nil)
+	assert.Nil(t, err)
+	req.Header.Set("Accept", NDJSONContentType)
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+
+	// Every row is streamed despite the timeout
+	dec := json.NewDecoder(resp.Body)
+	n := 0
+	for dec.More() {
+		var out QueryResponse
+		if !assert.Nil(t, dec.Decode(&out)) {
+			return
+		}
+		n++
+	}
+	assert.Equal(t, total, n)
+}
+
+func TestAPI_Query_Stream(t *testing.T) {
+	mock := NewMockDatabaseClient()
+	day := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	total := StreamFlushRows + 10
+	for i := 0; i < total; i++ {
+		assert.Nil(t, mock.UpsertCounters(context.Background(), []*ParsedKey{
+			{Interval: "day", Date: day.AddDate(0, 0, i), Attributes: map[string]string{"country": "us"}, Count: int64(i)},
+		}))
+	}
+
+	db := &blockingQueryDB{MockDatabaseClient: mock, release: make(chan struct{})}
+	var once sync.Once
+	release := func() { once.Do(func() { close(db.release) }) }
+	defer release()
+	time.AfterFunc(5*time.Second, release)
+
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		db:     db,
+	}
+	srv := httptest.NewServer(NewHTTPHandler(api, nil))
+	defer srv.Close()
+
+	// The default transport also asks for a gzip response
+	req, err := http.NewRequest("GET", srv.URL+"/v1/query/day", nil)
+	assert.Nil(t, err)
+	req.Header.Set("Accept", "application/json, application/x-ndjson")
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, NDJSONContentType, resp.Header.Get("Content-Type"))
+
+	// The first rows are readable while the query is still running
+	dec := json.NewDecoder(resp.Body)
+	for i := 0; i < total; i++ {
+		if i == StreamFlushRows {
+			select {
+			case <-db.release:
+				t.Fatalf("rows were not streamed before the query finished")
+			default:
+			}
+			release()
+		}
+
+		var out QueryResponse
+		if !assert.Nil(t, dec.Decode(&out)) {
+			return
+		}
+		date, _ := FormatIntervalDate("day", day.AddDate(0, 0, i), nil)
+		assert.Equal(t, date, out.Date)
+		assert.Equal(t, int64(i), out.Count)
+	}
+	assert.False(t, dec.More())
+}
+
+func TestAPI_Range(t *testing.T) {
+	db := NewMockDatabaseClient()
+	day := time.Date(2017, 1, 18, 0, 0, 0, 0, time.UTC)
+	assert.Nil(t, db.UpsertCounters(context.Background(), []*ParsedKey{
+		{Interval: "day", Date: day, Attributes: map[string]string{"country": "us"}, Count: 10},
+		{Interval: "day", Date: day, Attributes: map[string]string{"country": "ca"}, Count: 5},
+		{Interval: "day", Date: day.AddDate(0, 0, 2), Attributes: map[string]string{"country": "us"}, Count: 7},
+	}))
+
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		db:     db,
+	}
+	mux := NewHTTPHandler(api, nil)
+
+	type tcase struct {
+		URL    string
+		Code   int
+		Expect []QueryResponse
+	}
+	cases := []tcase{
+		{"/v1/range/day?from=2017-01-17&to=2017-01-21", 200, []QueryResponse{
+			{Date: "2017-01-17", Count: 0},
+			{Date: "2017-01-18", Count: 15},
+			{Date: "2017-01-19", Count: 0},
+			{Date: "2017-01-20", Count: 7},
+			{Date: "2017-01-21", Count: 0},
+		}},
+		{"/v1/range/day?from=2017-01-18&to=2017-01-19&country=ca", 200, []QueryResponse{
+			{Date: "2017-01-18", Count: 5},
+			{Date: "2017-01-19", Count: 0},
+		}},
+		{"/v1/range/month?from=2016-12&to=2017-02", 200, []QueryResponse{
+			{Date: "2016-12", Count: 0},
+			{Date: "2017-01", Count: 0},
+			{Date: "2017-02", Count: 0},
+		}},
+		{"/v1/range/day?from=2017-01-18", 400, nil},
+		{"/v1/range/day?to=2017-01-18", 400, nil},
+		{"/v1/range/hour?from=2017-01-18&to=2017-01-19", 400, nil},
+		{"/v1/range/day?from=2000-01-01&to=2040-01-01", 400, nil},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", tc.URL, nil)
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		assert.Equal(t, tc.Code, resp.Result().StatusCode, tc.URL)
+		if tc.Code != 200 {
+			continue
+		}
+		var out []QueryResponse
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&out))
+		for i := range out {
+			out[i].FirstSeen, out[i].LastUpdated = nil, nil
+		}
+		assert.Equal(t, tc.Expect, out, tc.URL)
+	}
+}
+
+func TestAPI_Range_Stream(t *testing.T) {
+	// Only every other day has a counter
+	mock := NewMockDatabaseClient()
+	day := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	total := 2*StreamFlushRows + 10
+	for i := 0; i < total; i += 2 {
+		assert.Nil(t, mock.UpsertCounters(context.Background(), []*ParsedKey{
+			{Interval: "day", Date: day.AddDate(0, 0, i), Attributes: map[string]string{"country": "us"}, Count: int64(i + 1)},
+		}))
+	}
+
+	db := &blockingQueryDB{MockDatabaseClient: mock, release: make(chan struct{})}
+	var once sync.Once
+	release := func() { once.Do(func() { close(db.release) }) }
+	defer release()
+	time.AfterFunc(5*time.Second, release)
+
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		db:     db,
+	}
+	srv := httptest.NewServer(NewHTTPHandler(api, nil))
+	defer srv.Close()
+
+	from, _ := FormatIntervalDate("day", day, nil)
+	to, _ := FormatIntervalDate("day", day.AddDate(0, 0, total-1), nil)
+	req, err := http.NewRequest("GET", srv.URL+"/v1/range/day?from="+from+"&to="+to, nil)
+	assert.Nil(t, err)
+	req.Header.Set("Accept", NDJSONContentType)
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, NDJSONContentType, resp.Header.Get("Content-Type"))
+
+	// The first dates are readable while the query is still running,
+	// and every date is streamed with the missing ones filled in
+	dec := json.NewDecoder(resp.Body)
+	for i := 0; i < total; i++ {
+		if i == StreamFlushRows {
+			select {
+			case <-db.release:
+				t.Fatalf("dates were not streamed before the query finished")
+			default:
+			}
+			release()
+		}
+
+		var out QueryResponse
+		if !assert.Nil(t, dec.Decode(&out)) {
+			return
+		}
+		date, _ := FormatIntervalDate("day", day.AddDate(0, 0, i), nil)
+		assert.Equal(t, date, out.Date)
+		if i%2 == 0 {
+			assert.Equal(t, int64(i+1), out.Count)
+		} else {
+			assert.Equal(t, int64(0), out.Count)
+		}
+	}
+	assert.False(t, dec.More())
+}
+
+func TestAcceptsNDJSON(t *testing.T) {
+	type tcase struct {
+		Accept string
+		Expect bool
+	}
+	cases := []tcase{
+		{"", false},
+		{"application/json", false},
+		{"application/x-ndjson", true},
+		{"application/json, application/x-ndjson; q=0.9", true},
+		{"*/*", false},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.Expect, AcceptsNDJSON(tc.Accept), tc.Accept)
+	}
+}
+
+func TestPreviousIntervalDate(t *testing.T) {
+	date := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2017, 2, 28, 0, 0, 0, 0, time.UTC), PreviousIntervalDate("day", date, nil))
+	assert.Equal(t, time.Date(2017, 2, 22, 0, 0, 0, 0, time.UTC), PreviousIntervalDate("week", date, nil))
+	assert.Equal(t, time.Date(2017, 2, 1, 0, 0, 0, 0, time.UTC), PreviousIntervalDate("month", date, nil))
+	assert.Equal(t, time.Date(2016, 12, 1, 0, 0, 0, 0, time.UTC), PreviousIntervalDate("quarter", date, nil))
+
+	// The custom interval steps back a bucket, if configured
+	custom := &CustomIntervalConfig{Anchor: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), Duration: 14 * 24 * time.Hour}
+	assert.Equal(t, time.Date(2017, 2, 12, 0, 0, 0, 0, time.UTC), PreviousIntervalDate("custom", date, custom))
+	assert.Equal(t, date, PreviousIntervalDate("custom", date, nil))
+}
+
+func TestQueryFilter_Matches(t *testing.T) {
+	f := &QueryFilter{Attributes: map[string][]string{
+		"country": {"ca", "us"},
+		"plan":    {"paid"},
+	}}
+	assert.True(t, f.Matches(map[string]string{"country": "us", "plan": "paid"}))
+	assert.True(t, f.Matches(map[string]string{"country": "ca", "plan": "paid", "foo": "bar"}))
+	assert.False(t, f.Matches(map[string]string{"country": "mx", "plan": "paid"}))
+	assert.False(t, f.Matches(map[string]string{"country": "us"}))
+	assert.True(t, (&QueryFilter{}).Matches(map[string]string{"foo": "bar"}))
+}
+
 func TestIngressRequest_Validate(t *testing.T) {
 	// Create a blank request
 	r := &IngressRequest{}
-	assert.NotNil(t, r.Validate())
+	assert.NotNil(t, r.Validate(nil, nil))
+
+	// Set an ID, should be fine
+	r.ID = "12345"
+	assert.Nil(t, r.Validate(nil, nil))
+
+	// Check that date is initialized
+	assert.WithinDuration(t, time.Now(), r.Date, time.Second)
+
+	// Check that we have the null attribute
+	assert.Contains(t, r.Attributes, NullAttribute)
+}
+
+func TestIngressRequest_ValidateIncrements(t *testing.T) {
+	// The ID is only optional if increments are allowed
+	r := &IngressRequest{}
+	assert.NotNil(t, r.Validate(&IngressConfig{}, nil))
+	assert.Nil(t, r.Validate(&IngressConfig{Increments: true}, nil))
+}
+
+func TestAPI_Ingress_Increments(t *testing.T) {
+	mock := NewMockRedisClient()
+	recentIDs, err := NewRecentIDs(16, time.Minute)
+	assert.Nil(t, err)
+	api := &APIHandler{
+		logger:        hclog.Default().Named("api"),
+		client:        mock,
+		ingressConfig: &IngressConfig{Increments: true},
+		exactConfig:   &ExactConfig{Intervals: []string{"day"}},
+		recentIDs:     recentIDs,
+
+		weeklyFromDaily: true,
+	}
+	handler := NewHTTPHandler(api, nil)
+
+	// Events without an ID are never deduplicated
+	input := `{"date": "2009-11-10T23:00:00Z", "attributes": {"page": "home"}}`
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(input))
+		req.Header.Set("Content-Type", "application/json")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		assert.Equal(t, 200, resp.Result().StatusCode)
+	}
+
+	// Every interval is incremented, ignoring the exact configuration
+	keys, _ := mock.ListKeys(context.Background())
+	assert.Equal(t, []string{
+		"incr:day:2009-11-10:page:home",
+		"incr:month:2009-11:page:home",
+		"incr:quarter:2009-Q4:page:home",
+		"incr:week:2009-11-08:page:home",
+	}, keys)
+	counts, _ := mock.GetCounts(context.Background(), keys)
+	assert.Equal(t, []int64{2, 2, 2, 2}, counts)
+}
+
+func TestIngressRequest_ValidateNullAttribute(t *testing.T) {
+	config := &AttributeConfig{Null: "__none__"}
+
+	// The custom sentinel is injected when there are no attributes
+	r := &IngressRequest{ID: "12345"}
+	assert.Nil(t, r.Validate(nil, config))
+	assert.Equal(t, map[string]string{"__none__": "__none__"}, r.Attributes)
+
+	// A legitimate null value no longer collides with the sentinel
+	r = &IngressRequest{ID: "12345", Attributes: map[string]string{"null": "null"}}
+	assert.Nil(t, r.Validate(nil, config))
+	assert.Equal(t, map[string]string{"null": "null"}, r.Attributes)
+	keys := RequestCounterKeys(map[string]string{"day": "2017-01-18"}, r)
+	assert.Equal(t, []string{"day:2017-01-18:null:null"}, keys)
+}
+
+func TestIngressRequest_ValidateReserved(t *testing.T) {
+	for _, key := range []string{"day", "week", "month", "quarter"} {
+		r := &IngressRequest{ID: "12345", Attributes: map[string]string{key: "2017-01-18"}}
+		assert.NotNil(t, r.Validate(nil, nil), key)
+	}
+
+	// Values may still use the interval names
+	r := &IngressRequest{ID: "12345", Attributes: map[string]string{"period": "day"}}
+	assert.Nil(t, r.Validate(nil, nil))
+}
+
+func TestIngressRequest_ValidateLength(t *testing.T) {
+	type tcase struct {
+		Attributes map[string]string
+		Config     *AttributeConfig
+		Err        string
+	}
+	cases := []tcase{
+		{map[string]string{"foo": strings.Repeat("a", DefaultMaxValueLength)}, nil, ""},
+		{map[string]string{"foo": strings.Repeat("a", DefaultMaxValueLength+1)}, nil, `attribute "foo" value exceeds 1024 bytes`},
+		{map[string]string{strings.Repeat("a", DefaultMaxKeyLength+1): "bar"}, nil, "attribute key exceeds 128 bytes"},
+		{map[string]string{"foo": "barbaz"}, &AttributeConfig{MaxValueLength: 5}, `attribute "foo" value exceeds 5 bytes`},
+		{map[string]string{"foo": "bar"}, &AttributeConfig{MaxKeyLength: 2}, "attribute key exceeds 2 bytes"},
+		{map[string]string{"foo": "caf\xc3\xa9"}, nil, ""},
+		{map[string]string{"foo": "bar\xff"}, nil, "not valid UTF-8"},
+		{map[string]string{"foo\xc3": "bar"}, nil, "not valid UTF-8"},
+	}
+	for _, tc := range cases {
+		r := &IngressRequest{ID: "12345", Attributes: tc.Attributes}
+		err := r.Validate(nil, tc.Config)
+		if tc.Err == "" {
+			assert.Nil(t, err, "%q", tc.Attributes)
+		} else if assert.NotNil(t, err, "%q", tc.Attributes) {
+			assert.Contains(t, err.Error(), tc.Err)
+		}
+	}
+
+	// Multi-valued attributes are checked as well
+	r := &IngressRequest{ID: "12345", MultiAttributes: map[string][]string{"tags": {"a", "b\xff"}}}
+	assert.NotNil(t, r.Validate(nil, nil))
+}
+
+func TestAPI_IngressInvalidUTF8(t *testing.T) {
+	mock := NewMockRedisClient()
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		client: mock,
+	}
+	mux := NewHTTPHandler(api, nil)
+
+	req := httptest.NewRequest("GET", "/v1/ingress/simple?id=1234&foo=bar%ff", nil)
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 400, resp.Result().StatusCode)
+	assert.Contains(t, resp.Body.String(), "not valid UTF-8")
+	assert.Equal(t, 0, len(mock.counters))
+}
+
+func TestAPI_IngressVerbose(t *testing.T) {
+	mock := NewMockRedisClient()
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		client: mock,
+		attrConfig: &AttributeConfig{
+			Whitelist:     []string{"country", "tags"},
+			LowercaseKeys: true,
+			Aliases:       map[string]string{"cc": "country"},
+		},
+	}
+	mux := NewHTTPHandler(api, nil)
+
+	input := `{"id": "1234", "date": "2017-01-18T12:00:00Z", "attributes": {"CC": "us", "foo": "bar"}, "multi_attributes": {"tags": ["a", "b"], "other": ["c"]}}`
+	req := httptest.NewRequest("PUT", "/v1/ingress?verbose=true", strings.NewReader(input))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Result().StatusCode)
+	assert.Equal(t, "application/json", resp.Result().Header.Get("Content-Type"))
+
+	var out IngressResponse
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&out))
+	assert.Equal(t, map[string]string{"country": "us"}, out.Attributes)
+	assert.Equal(t, map[string][]string{"tags": {"a", "b"}}, out.MultiAttributes)
+	assert.Equal(t, []string{"foo", "other"}, out.Dropped)
+	assert.Equal(t, 8, out.Keys)
+
+	// The default response is empty
+	req = httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(strings.Replace(input, "1234", "2345", 1)))
+	req.Header.Set("Content-Type", "application/json")
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Result().StatusCode)
+	assert.Equal(t, 0, resp.Body.Len())
+}
+
+func TestAPI_IngressReserved(t *testing.T) {
+	mock := NewMockRedisClient()
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		client: mock,
+	}
+	mux := NewHTTPHandler(api, nil)
+
+	input := `{"id": "1234", "attributes": {"week": "2017-01-15"}}`
+	req := httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(input))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 400, resp.Result().StatusCode)
+	var verr ValidationError
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&verr))
+	assert.Equal(t, ErrCodeReservedAttribute, verr.Code)
+	assert.Equal(t, `attribute key "week" is reserved`, verr.Message)
+	assert.Equal(t, 0, len(mock.counters))
+
+	// The domain counts path is reserved as well
+	input = `{"id": "1234", "attributes": {"counts": "1"}}`
+	req = httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(input))
+	req.Header.Set("Content-Type", "application/json")
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 400, resp.Result().StatusCode)
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&verr))
+	assert.Equal(t, `attribute key "counts" is reserved`, verr.Message)
+	assert.Equal(t, 0, len(mock.counters))
+}
+
+func TestAPI_Ingress_ValidationErrors(t *testing.T) {
+	type tcase struct {
+		Path  string
+		Input string
+		Code  string
+	}
+	cases := []tcase{
+		{"/v1/ingress", `{"id": "1234", "atributes": {"foo": "bar"}}`, ErrCodeInvalidBody},
+		{"/v1/ingress", `{"attributes": {"foo": "bar"}}`, ErrCodeMissingID},
+		{"/v1/ingress", `{"id": "1234", "date": "2000-01-01T00:00:00Z"}`, ErrCodeInvalidDate},
+		{"/v1/ingress", `{"id": "1234", "attributes": {"foo:bar": "baz"}}`, ErrCodeColonInAttribute},
+		{"/v1/ingress", `{"id": "1234", "attributes": {"foo": "bar:baz"}}`, ErrCodeColonInAttribute},
+		{"/v1/ingress", `{"id": "1234", "attributes": {"` + strings.Repeat("a", 1000) + `": "bar"}}`, ErrCodeAttributeTooLong},
+		{"/v1/ingress", `{"id": "1234", "attributes": {"week": "bar"}}`, ErrCodeReservedAttribute},
+		{"/v1/ingress", `{"id": "1234", "multi_attributes": {"tags": []}}`, ErrCodeInvalidAttribute},
+		{"/v1/ingress", `{"id": "1234", "multi_attributes": {"a": ["1", "2", "3"], "b": ["1", "2", "3"]}}`, ErrCodeTooManyAttributes},
+		{"/v1/ingress/simple?id=1234&foo=bar%ff", "", ErrCodeInvalidUTF8},
+		{"/v1/ingress/simple?id=1234&foo=bar&foo=baz", "", ErrCodeDuplicateParameter},
+		{"/v1/ingress/beacon?id=1234&date=yesterday", "", ErrCodeInvalidDate},
+	}
+
+	mock := NewMockRedisClient()
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		client: mock,
+		ingressConfig: &IngressConfig{
+			MaxPast: 24 * time.Hour,
+			MaxKeys: 16,
+		},
+	}
+	mux := NewHTTPHandler(api, nil)
+
+	for _, tc := range cases {
+		var req *http.Request
+		if tc.Input == "" {
+			req = httptest.NewRequest("GET", tc.Path, nil)
+		} else {
+			req = httptest.NewRequest("PUT", tc.Path, strings.NewReader(tc.Input))
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		assert.Equal(t, 400, resp.Result().StatusCode, tc.Input)
+		assert.Equal(t, "application/json", resp.Result().Header.Get("Content-Type"))
+
+		var verr ValidationError
+		if assert.Nil(t, json.NewDecoder(resp.Body).Decode(&verr), tc.Input) {
+			assert.Equal(t, tc.Code, verr.Code, tc.Input)
+			assert.NotEmpty(t, verr.Message)
+		}
+	}
+	assert.Equal(t, 0, len(mock.counters))
+}
+
+func TestIngressRequest_ValidateDate(t *testing.T) {
+	config := &IngressConfig{
+		MaxFuture: 24 * time.Hour,
+		MaxPast:   14 * 24 * time.Hour,
+	}
+
+	// Recent dates are fine
+	r := &IngressRequest{ID: "1234", Date: time.Now().Add(-time.Hour)}
+	assert.Nil(t, r.Validate(config, nil))
+	r.Date = time.Now().Add(time.Hour)
+	assert.Nil(t, r.Validate(config, nil))
+
+	// Far future dates are rejected
+	r.Date = time.Date(2038, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.NotNil(t, r.Validate(config, nil))
+
+	// Expired dates are rejected
+	r.Date = time.Now().Add(-15 * 24 * time.Hour)
+	assert.NotNil(t, r.Validate(config, nil))
+
+	// Without limits, anything goes
+	assert.Nil(t, r.Validate(nil, nil))
+	r.Date = time.Date(2038, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Nil(t, r.Validate(nil, nil))
+
+	// A negative limit is disabled
+	assert.Nil(t, r.Validate(&IngressConfig{MaxFuture: -1}, nil))
+}
+
+func TestIngressRequest_FilterWhitelist(t *testing.T) {
+	input := `{"id": "1234", "date": "2009-11-10T23:00:00Z", "attributes": {"foo": "bar", "zoo": "zip"}}`
+	req, err := ParseIngressRequest(strings.NewReader(input), nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "1234", req.ID)
+
+	config := &AttributeConfig{
+		Whitelist: []string{"foo"},
+	}
+	req.Filter(config)
+
+	assert.Contains(t, req.Attributes, "foo")
+	assert.NotContains(t, req.Attributes, "zoo")
+}
+
+func TestIngressRequest_FilterBlacklist(t *testing.T) {
+	input := `{"id": "1234", "date": "2009-11-10T23:00:00Z", "attributes": {"foo": "bar", "zoo": "zip"}}`
+	req, err := ParseIngressRequest(strings.NewReader(input), nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "1234", req.ID)
+
+	config := &AttributeConfig{
+		Blacklist: []string{"foo"},
+	}
+	req.Filter(config)
+
+	assert.NotContains(t, req.Attributes, "foo")
+	assert.Contains(t, req.Attributes, "zoo")
+}
+
+func TestIngressRequest_FilterDefaults(t *testing.T) {
+	config := &AttributeConfig{
+		Whitelist:         []string{"foo", "tags"},
+		LowercaseKeys:     true,
+		DefaultAttributes: map[string]string{"env": "prod", "foo": "default", "tags": "none"},
+	}
+
+	// Sent attributes take precedence, including after normalizing, and
+	// the defaults are not removed by the whitelist
+	input := `{"id": "1234", "date": "2009-11-10T23:00:00Z", "attributes": {"FOO": "bar", "zoo": "zip"}, "multi_attributes": {"tags": ["a"]}}`
+	req, err := ParseIngressRequest(strings.NewReader(input), nil, config)
+	assert.Nil(t, err)
+	req.Filter(config)
+	assert.Equal(t, map[string]string{"env": "prod", "foo": "bar"}, req.Attributes)
+	assert.Equal(t, map[string][]string{"tags": {"a"}}, req.MultiAttributes)
+
+	// Missing attributes are filled in
+	input = `{"id": "1234", "date": "2009-11-10T23:00:00Z", "attributes": {"zoo": "zip"}}`
+	req, err = ParseIngressRequest(strings.NewReader(input), nil, config)
+	assert.Nil(t, err)
+	req.Filter(config)
+	assert.Equal(t, map[string]string{"env": "prod", "foo": "default", "tags": "none"}, req.Attributes)
+}
+
+func TestIngressRequest_FilterNormalize(t *testing.T) {
+	type tcase struct {
+		Config *AttributeConfig
+		Input  map[string]string
+		Output map[string]string
+	}
+	cases := []tcase{
+		{
+			&AttributeConfig{},
+			map[string]string{"Country": " US "},
+			map[string]string{"Country": " US "},
+		},
+		{
+			&AttributeConfig{LowercaseKeys: true},
+			map[string]string{"Country": " US "},
+			map[string]string{"country": " US "},
+		},
+		{
+			&AttributeConfig{LowercaseValues: true},
+			map[string]string{"Country": " US "},
+			map[string]string{"Country": " us "},
+		},
+		{
+			&AttributeConfig{TrimValues: true},
+			map[string]string{"Country": " US\t", "plan": "\n"},
+			map[string]string{"Country": "US", "plan": ""},
+		},
+		{
+			&AttributeConfig{LowercaseKeys: true, LowercaseValues: true, TrimValues: true},
+			map[string]string{"Country": " US ", "PLAN": "Free"},
+			map[string]string{"country": "us", "plan": "free"},
+		},
+		// Colliding keys prefer the lower case key
+		{
+			&AttributeConfig{LowercaseKeys: true},
+			map[string]string{"Country": "US", "country": "us", "COUNTRY": "usa"},
+			map[string]string{"country": "us"},
+		},
+		// Otherwise the first key in sorted order
+		{
+			&AttributeConfig{LowercaseKeys: true},
+			map[string]string{"Country": "US", "COUNTRY": "usa"},
+			map[string]string{"country": "usa"},
+		},
+		// Lists apply to the normalized keys
+		{
+			&AttributeConfig{LowercaseKeys: true, Whitelist: []string{"country"}},
+			map[string]string{"Country": "US", "Plan": "free"},
+			map[string]string{"country": "US"},
+		},
+	}
+
+	for _, tc := range cases {
+		req := &IngressRequest{ID: "1234", Attributes: tc.Input}
+		assert.Nil(t, req.Validate(nil, tc.Config))
+		req.Filter(tc.Config)
+		assert.Equal(t, tc.Output, req.Attributes)
+	}
+}
+
+func TestIngressRequest_NormalizeReserved(t *testing.T) {
+	config := &AttributeConfig{LowercaseKeys: true}
+
+	// A key that would normalize to an interval name is rejected
+	req := &IngressRequest{ID: "1234", Attributes: map[string]string{"Day": "1"}}
+	assert.NotNil(t, req.Validate(nil, config))
+
+	// Without normalization it is allowed
+	assert.Nil(t, req.Validate(nil, nil))
+
+	// Colons are still rejected before normalizing
+	req = &IngressRequest{ID: "1234", Attributes: map[string]string{"Foo": " a:b "}}
+	assert.NotNil(t, req.Validate(nil, config))
+}
+
+func TestIngressRequest_FilterAliases(t *testing.T) {
+	type tcase struct {
+		Config *AttributeConfig
+		Input  map[string]string
+		Output map[string]string
+	}
+	aliases := map[string]string{"cc": "country", "country_code": "country"}
+	cases := []tcase{
+		{
+			&AttributeConfig{Aliases: aliases},
+			map[string]string{"cc": "us", "plan": "free"},
+			map[string]string{"country": "us", "plan": "free"},
+		},
+		// The canonical key takes precedence
+		{
+			&AttributeConfig{Aliases: aliases},
+			map[string]string{"cc": "us", "country": "ca"},
+			map[string]string{"country": "ca"},
+		},
+		// Otherwise the first alias in sorted order
+		{
+			&AttributeConfig{Aliases: aliases},
+			map[string]string{"country_code": "mx", "cc": "us"},
+			map[string]string{"country": "us"},
+		},
+		// Aliases apply after lower casing
+		{
+			&AttributeConfig{Aliases: aliases, LowercaseKeys: true},
+			map[string]string{"CC": "us"},
+			map[string]string{"country": "us"},
+		},
+		// The blacklist applies to the canonical key
+		{
+			&AttributeConfig{Aliases: aliases, Blacklist: []string{"country"}},
+			map[string]string{"cc": "us", "plan": "free"},
+			map[string]string{"plan": "free"},
+		},
+		{
+			&AttributeConfig{Aliases: aliases, Blacklist: []string{"cc"}},
+			map[string]string{"cc": "us", "plan": "free"},
+			map[string]string{"country": "us", "plan": "free"},
+		},
+		// As does the whitelist
+		{
+			&AttributeConfig{Aliases: aliases, Whitelist: []string{"country"}},
+			map[string]string{"cc": "us", "plan": "free"},
+			map[string]string{"country": "us"},
+		},
+	}
+	for _, tc := range cases {
+		req := &IngressRequest{ID: "1234", Attributes: tc.Input}
+		req.Filter(tc.Config)
+		assert.Equal(t, tc.Output, req.Attributes)
+	}
+
+	// Multi-valued attributes are renamed, with single values taking precedence
+	config := &AttributeConfig{Aliases: map[string]string{"tag": "tags", "cc": "country"}}
+	req := &IngressRequest{
+		ID:         "1234",
+		Attributes: map[string]string{"country": "us"},
+		MultiAttributes: map[string][]string{
+			"tag": {"a", "b"},
+			"cc":  {"ca", "mx"},
+		},
+	}
+	req.Filter(config)
+	assert.Equal(t, map[string]string{"country": "us"}, req.Attributes)
+	assert.Equal(t, map[string][]string{"tags": {"a", "b"}}, req.MultiAttributes)
+}
+
+func TestCanonicalKey(t *testing.T) {
+	config := &AttributeConfig{
+		LowercaseKeys: true,
+		Aliases:       map[string]string{"cc": "country"},
+	}
+	assert.Equal(t, "country", canonicalKey("CC", config))
+	assert.Equal(t, "country", canonicalKey("country", config))
+	assert.Equal(t, "plan", canonicalKey("Plan", config))
+	assert.Equal(t, "Plan", canonicalKey("Plan", nil))
+}
+
+func TestIngressRequest_Parse(t *testing.T) {
+	input := `{"id": "1234", "date": "2009-11-10T23:00:00Z", "attributes": {"foo": "bar"}}`
+	req, err := ParseIngressRequest(strings.NewReader(input), nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "1234", req.ID)
+
+	date, err := time.Parse(time.RFC3339, "2009-11-10T23:00:00Z")
+	assert.Nil(t, err)
+	assert.Equal(t, date, req.Date)
+
+	assert.Contains(t, req.Attributes, "foo")
+	assert.Equal(t, "bar", req.Attributes["foo"])
+}
+
+func TestRequestCounterKeys(t *testing.T) {
+	intervals := map[string]string{
+		"day":   "2018-01-27",
+		"month": "2018-01",
+	}
+	r := &IngressRequest{
+		ID: "1234",
+		Attributes: map[string]string{
+			"foo": "bar",
+			"baz": "zip",
+		},
+	}
+
+	keys := RequestCounterKeys(intervals, r)
+	assert.Equal(t, 2, len(keys))
+
+	dayKey := "day:2018-01-27:baz:zip:foo:bar"
+	assert.Contains(t, keys, dayKey)
+
+	monthKey := "month:2018-01:baz:zip:foo:bar"
+	assert.Contains(t, keys, monthKey)
+}
+
+func TestAttributeValueEncoding(t *testing.T) {
+	type tcase struct {
+		Value   string
+		Encoded string
+	}
+	cases := []tcase{
+		{"bar", "bar"},
+		{"", ""},
+		{"12:30", "12%3A30"},
+		{"http://x.com:8080/", "http%3A//x.com%3A8080/"},
+		{"100%", "100%25"},
+		{"%3A", "%253A"},
+		{"%25:%", "%2525%3A%25"},
+	}
+	for _, tc := range cases {
+		encoded := EncodeAttributeValue(tc.Value)
+		assert.Equal(t, tc.Encoded, encoded, tc.Value)
+		assert.NotContains(t, encoded, KeySeperator)
+		assert.Equal(t, tc.Value, DecodeAttributeValue(encoded), tc.Value)
+	}
+
+	// Keys with encoded values round trip through parsing
+	req := &IngressRequest{
+		Attributes:      map[string]string{"time": "12:30", "rate": "5%"},
+		MultiAttributes: map[string][]string{"url": {"a:b", "c"}},
+	}
+	keys := RequestCounterKeys(map[string]string{"day": "2017-01-18"}, req.encodedValues())
+	assert.Equal(t, 2, len(keys))
+	for _, key := range keys {
+		parsed, err := ParseKey(key, nil)
+		assert.Nil(t, err)
+		parsed.DecodeValues()
+		assert.Equal(t, "12:30", parsed.Attributes["time"])
+		assert.Equal(t, "5%", parsed.Attributes["rate"])
+		assert.Contains(t, []string{"a:b", "c"}, parsed.Attributes["url"])
+	}
+
+	// The request is not modified
+	assert.Equal(t, "12:30", req.Attributes["time"])
+	assert.Equal(t, []string{"a:b", "c"}, req.MultiAttributes["url"])
+}
+
+func TestRequestCounterKeysV2(t *testing.T) {
+	req := &IngressRequest{
+		Attributes:      map[string]string{"time": "12:30", "a:b": "100%", "empty": ""},
+		MultiAttributes: map[string][]string{"url": {"http://x", "c"}},
+	}
+	keys := RequestCounterKeysV2(map[string]string{"day": "2017-01-18"}, req)
+	sort.Strings(keys)
+	assert.Equal(t, []string{
+		"v2:day:2017-01-18:3:a:b4:100%5:empty0:4:time5:12:303:url1:c",
+		"v2:day:2017-01-18:3:a:b4:100%5:empty0:4:time5:12:303:url8:http://x",
+	}, keys)
+
+	// The keys round trip through parsing
+	for _, key := range keys {
+		parsed, err := ParseKey(key, nil)
+		assert.Nil(t, err)
+		assert.True(t, parsed.V2)
+		assert.Equal(t, "12:30", parsed.Attributes["time"])
+		assert.Equal(t, "100%", parsed.Attributes["a:b"])
+		assert.Equal(t, "", parsed.Attributes["empty"])
+		assert.Contains(t, []string{"http://x", "c"}, parsed.Attributes["url"])
+	}
+}
+
+func TestAPI_Ingress_KeyFormatV2(t *testing.T) {
+	input := `{"id": "1234", "date": "2009-11-10T23:00:00Z", "attributes": {"url": "http://x.com"}}`
+	req := httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(input))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mock := NewMockRedisClient()
+	api := &APIHandler{
+		logger:     hclog.Default().Named("api"),
+		client:     mock,
+		attrConfig: &AttributeConfig{KeyFormat: KeyFormatV2},
+	}
+	NewHTTPHandler(api, nil).ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Result().StatusCode)
+	assert.Contains(t, mock.counters, "v2:day:2009-11-10:3:url12:http://x.com")
+}
+
+func TestRequestCounterKeys_MultiAttributes(t *testing.T) {
+	intervals := map[string]string{
+		"day": "2018-01-27",
+	}
+	r := &IngressRequest{
+		ID: "1234",
+		Attributes: map[string]string{
+			"foo": "bar",
+		},
+		MultiAttributes: map[string][]string{
+			"tags":  {"b", "a"},
+			"color": {"red", "blue"},
+		},
+	}
+	assert.Nil(t, r.Validate(nil, nil))
+
+	keys := RequestCounterKeys(intervals, r)
+	sort.Strings(keys)
+	assert.Equal(t, []string{
+		"day:2018-01-27:color:blue:foo:bar:tags:a",
+		"day:2018-01-27:color:blue:foo:bar:tags:b",
+		"day:2018-01-27:color:red:foo:bar:tags:a",
+		"day:2018-01-27:color:red:foo:bar:tags:b",
+	}, keys)
+
+	// Each key must parse back into the attribute set
+	for _, key := range keys {
+		parsed, err := ParseKey(key, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, len(parsed.Attributes))
+	}
+}
+
+func TestIngressRequest_ValidateMultiAttributes(t *testing.T) {
+	type tcase struct {
+		Attributes      map[string]string
+		MultiAttributes map[string][]string
+		Err             bool
+	}
+	cases := []tcase{
+		{nil, map[string][]string{"tags": {"a"}}, false},
+		{nil, map[string][]string{"tags": {}}, true},
+		{nil, map[string][]string{"tags": {"a:b"}}, true},
+		{nil, map[string][]string{"week": {"a"}}, true},
+		{map[string]string{"tags": "a"}, map[string][]string{"tags": {"b"}}, true},
+		{nil, map[string][]string{
+			"a": {"1", "2", "3", "4", "5", "6", "7", "8"},
+			"b": {"1", "2", "3", "4", "5", "6", "7", "8"},
+		}, false},
+		{nil, map[string][]string{
+			"a": {"1", "2", "3", "4", "5", "6", "7", "8"},
+			"b": {"1", "2", "3", "4", "5", "6", "7", "8", "9"},
+		}, true},
+	}
+	for idx, tc := range cases {
+		r := &IngressRequest{ID: "1234", Attributes: tc.Attributes, MultiAttributes: tc.MultiAttributes}
+		err := r.Validate(nil, nil)
+		assert.Equal(t, tc.Err, err != nil, "case %d: %v", idx, err)
+	}
+
+	// Duplicate values are removed, and the null attribute is not injected
+	r := &IngressRequest{ID: "1234", MultiAttributes: map[string][]string{"tags": {"b", "a", "b"}}}
+	assert.Nil(t, r.Validate(nil, nil))
+	assert.Equal(t, []string{"a", "b"}, r.MultiAttributes["tags"])
+	assert.Empty(t, r.Attributes)
+}
+
+func TestIngressRequest_FilterMultiAttributes(t *testing.T) {
+	config := &AttributeConfig{
+		LowercaseKeys:   true,
+		LowercaseValues: true,
+		Whitelist:       []string{"foo", "tags"},
+	}
+	r := &IngressRequest{
+		ID:         "1234",
+		Attributes: map[string]string{"foo": "bar"},
+		MultiAttributes: map[string][]string{
+			"Tags":  {"A", "a", "B"},
+			"other": {"x"},
+		},
+	}
+	assert.Nil(t, r.Validate(nil, config))
+	r.Filter(config)
+	assert.Equal(t, map[string]string{"foo": "bar"}, r.Attributes)
+	assert.Equal(t, map[string][]string{"tags": {"a", "b"}}, r.MultiAttributes)
+}
+
+func TestAPI_IngressMultiAttributes(t *testing.T) {
+	mock := NewMockRedisClient()
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		client: mock,
+	}
+	mux := NewHTTPHandler(api, nil)
+
+	input := `{"id": "1234", "date": "2018-01-27T12:00:00Z", "multi_attributes": {"tags": ["a", "b"]}}`
+	req := httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(input))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Result().StatusCode)
+
+	// Counted under each tag for every interval
+	assert.Equal(t, 8, len(mock.counters))
+	assert.Contains(t, mock.counters, "day:2018-01-27:tags:a")
+	assert.Contains(t, mock.counters, "day:2018-01-27:tags:b")
+}
+
+func TestAPI_IngressWeeklyFromDaily(t *testing.T) {
+	mock := NewMockRedisClient()
+	api := &APIHandler{
+		logger:          hclog.Default().Named("api"),
+		client:          mock,
+		exactConfig:     &ExactConfig{Attributes: []string{"plan"}},
+		weeklyFromDaily: true,
+	}
+	mux := NewHTTPHandler(api, nil)
+
+	input := `{"id": "1234", "date": "2018-01-27T12:00:00Z", "attributes": {"foo": "bar"}}`
+	req := httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(input))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Result().StatusCode)
+
+	// No weekly key is updated
+	assert.Equal(t, 3, len(mock.counters))
+	assert.NotContains(t, mock.counters, "week:2018-01-21:foo:bar")
+
+	// Exact weekly keys are still updated
+	input = `{"id": "1234", "date": "2018-01-27T12:00:00Z", "attributes": {"plan": "free"}}`
+	req = httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(input))
+	req.Header.Set("Content-Type", "application/json")
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Result().StatusCode)
+	assert.Contains(t, mock.counters, "exact:week:2018-01-21:plan:free")
+}
+
+func TestAPI_IngressMaxKeys(t *testing.T) {
+	mock := NewMockRedisClient()
+	api := &APIHandler{
+		logger:        hclog.Default().Named("api"),
+		client:        mock,
+		ingressConfig: &IngressConfig{MaxKeys: 8},
+	}
+	mux := NewHTTPHandler(api, nil)
+
+	// Two tags for each of the four intervals is allowed
+	input := `{"id": "1234", "multi_attributes": {"tags": ["a", "b"]}}`
+	req := httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(input))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Result().StatusCode)
+	assert.Equal(t, 8, len(mock.counters))
 
-	// Set an ID, should be fine
-	r.ID = "12345"
-	assert.Nil(t, r.Validate())
+	// A third tag exceeds the limit
+	input = `{"id": "2345", "multi_attributes": {"tags": ["a", "b", "c"]}}`
+	req = httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(input))
+	req.Header.Set("Content-Type", "application/json")
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 400, resp.Result().StatusCode)
+	assert.Contains(t, resp.Body.String(), ErrCodeTooManyAttributes)
+	assert.Contains(t, resp.Body.String(), "event generates 12 keys, exceeding the limit of 8")
+	assert.Equal(t, 8, len(mock.counters))
+}
 
-	// Check that date is initialized
-	assert.WithinDuration(t, time.Now(), r.Date, time.Second)
+func TestRequestCounterKeys_Deterministic(t *testing.T) {
+	intervals := map[string]string{
+		"day":   "2018-01-27",
+		"week":  "2018-01-21",
+		"month": "2018-01",
+	}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		// Generate a random set of attributes
+		n := 1 + rng.Intn(10)
+		attrKeys := make([]string, n)
+		attrVals := make([]string, n)
+		for j := 0; j < n; j++ {
+			attrKeys[j] = "k" + strconv.Itoa(j) + "-" + strconv.Itoa(rng.Intn(1000))
+			attrVals[j] = "v" + strconv.Itoa(rng.Intn(1000))
+		}
 
-	// Check that we have the null attribute
-	assert.Contains(t, r.Attributes, NullAttribute)
+		var expect []string
+		for trial := 0; trial < 10; trial++ {
+			// Insert the attributes in a random order
+			attrs := make(map[string]string, n)
+			for _, j := range rng.Perm(n) {
+				attrs[attrKeys[j]] = attrVals[j]
+			}
+			r := &IngressRequest{ID: "1234", Attributes: attrs}
+
+			// The intervals are unordered, but the key set must match
+			keys := RequestCounterKeys(intervals, r)
+			sort.Strings(keys)
+			if expect == nil {
+				expect = keys
+				continue
+			}
+			assert.Equal(t, expect, keys)
+		}
+	}
 }
 
-func TestIngressRequest_FilterWhitelist(t *testing.T) {
-	input := `{"id": "1234", "date": "2009-11-10T23:00:00Z", "attributes": {"foo": "bar", "zoo": "zip"}}`
-	req, err := ParseIngressRequest(strings.NewReader(input))
-	assert.Nil(t, err)
-	assert.Equal(t, "1234", req.ID)
+func TestRequestCounterKeys_Golden(t *testing.T) {
+	// The key format is persisted in redis, so changes to it would
+	// orphan existing counters. This must never change.
+	date := time.Date(2018, 1, 27, 15, 4, 5, 0, time.UTC)
+	intervals := DateIntervals(DayInterval|WeekInterval|MonthInterval|QuarterInterval, date, nil, nil)
+	r := &IngressRequest{
+		ID: "1234",
+		Attributes: map[string]string{
+			"plan":    "free",
+			"country": "us",
+			"browser": "firefox",
+		},
+	}
+	exact, approx := SplitExactIntervals(&ExactConfig{Intervals: []string{"month"}}, intervals, r)
 
-	config := &AttributeConfig{
-		Whitelist: []string{"foo"},
+	keys := RequestCounterKeys(approx, r)
+	for _, key := range RequestCounterKeys(exact, r) {
+		keys = append(keys, ExactKeyPrefix+key)
 	}
-	req.Filter(config)
+	sort.Strings(keys)
 
-	assert.Contains(t, req.Attributes, "foo")
-	assert.NotContains(t, req.Attributes, "zoo")
+	golden := []string{
+		"day:2018-01-27:browser:firefox:country:us:plan:free",
+		"exact:month:2018-01:browser:firefox:country:us:plan:free",
+		"quarter:2018-Q1:browser:firefox:country:us:plan:free",
+		"week:2018-01-21:browser:firefox:country:us:plan:free",
+	}
+	assert.Equal(t, golden, keys)
+
+	// The null attribute key is also persisted
+	r = &IngressRequest{ID: "1234"}
+	assert.Nil(t, r.Validate(nil, nil))
+	keys = RequestCounterKeys(map[string]string{"day": "2018-01-27"}, r)
+	assert.Equal(t, []string{"day:2018-01-27:null:null"}, keys)
 }
 
-func TestIngressRequest_FilterBlacklist(t *testing.T) {
-	input := `{"id": "1234", "date": "2009-11-10T23:00:00Z", "attributes": {"foo": "bar", "zoo": "zip"}}`
-	req, err := ParseIngressRequest(strings.NewReader(input))
+func TestDateIntervals(t *testing.T) {
+	intervals := DayInterval | WeekInterval | MonthInterval
+	date, err := time.Parse(time.RFC3339, "2006-01-09T15:04:05Z")
 	assert.Nil(t, err)
-	assert.Equal(t, "1234", req.ID)
+	out := DateIntervals(intervals, date, nil, nil)
 
-	config := &AttributeConfig{
-		Blacklist: []string{"foo"},
+	assert.Equal(t, 3, len(out))
+
+	dayFormat := "2006-01-09"
+	assert.Equal(t, dayFormat, out["day"])
+
+	weekFormat := "2006-01-08"
+	assert.Equal(t, weekFormat, out["week"])
+
+	monthFormat := "2006-01"
+	assert.Equal(t, monthFormat, out["month"])
+}
+
+func TestParseIntervals(t *testing.T) {
+	type tcase struct {
+		names  []string
+		expect int
+		err    bool
 	}
-	req.Filter(config)
+	cases := []tcase{
+		{[]string{"day"}, DayInterval, false},
+		{[]string{"week"}, WeekInterval, false},
+		{[]string{"month"}, MonthInterval, false},
+		{[]string{"quarter"}, QuarterInterval, false},
+		{[]string{"day", "month"}, DayInterval | MonthInterval, false},
+		{[]string{"week", "quarter"}, WeekInterval | QuarterInterval, false},
+		{[]string{"day", "week", "month", "quarter"}, AllIntervals, false},
+		{[]string{"day", "day"}, DayInterval, false},
+		{[]string{}, 0, true},
+		{[]string{"hour"}, 0, true},
+		{[]string{"day", "year"}, 0, true},
+	}
+	for _, tc := range cases {
+		intervals, err := ParseIntervals(tc.names)
+		assert.Equal(t, tc.err, err != nil, "%v", tc.names)
+		assert.Equal(t, tc.expect, intervals, "%v", tc.names)
+	}
+}
 
-	assert.NotContains(t, req.Attributes, "foo")
-	assert.Contains(t, req.Attributes, "zoo")
+func TestAPI_Ingress_Intervals(t *testing.T) {
+	type tcase struct {
+		intervals int
+		expect    []string
+	}
+	cases := []tcase{
+		{0, []string{"day", "month", "quarter", "week"}},
+		{DayInterval, []string{"day"}},
+		{WeekInterval, []string{"week"}},
+		{MonthInterval, []string{"month"}},
+		{QuarterInterval, []string{"quarter"}},
+		{DayInterval | MonthInterval, []string{"day", "month"}},
+		{WeekInterval | QuarterInterval, []string{"quarter", "week"}},
+		{DayInterval | WeekInterval | MonthInterval, []string{"day", "month", "week"}},
+	}
+	for _, tc := range cases {
+		mock := NewMockRedisClient()
+		db := NewMockDatabaseClient()
+		api := &APIHandler{
+			logger:    hclog.Default().Named("api"),
+			client:    mock,
+			intervals: tc.intervals,
+		}
+		mux := NewHTTPHandler(api, nil)
+
+		req := httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(
+			`{"id": "1234", "date": "2017-01-18T10:00:00Z", "attributes": {"foo": "bar"}}`))
+		req.Header.Set("Content-Type", "application/json")
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		assert.Equal(t, 200, resp.Result().StatusCode)
+
+		// Only the enabled intervals are counted and snapshotted
+		snap := &Snapshotter{
+			config: DefaultConfig(),
+			logger: hclog.Default(),
+			client: mock,
+			db:     db,
+		}
+		assert.Nil(t, snap.Run(context.Background(), time.Date(2017, 1, 18, 12, 0, 0, 0, time.UTC)))
+
+		var intervals []string
+		for _, c := range db.counters {
+			intervals = append(intervals, c.interval)
+		}
+		sort.Strings(intervals)
+		assert.Equal(t, tc.expect, intervals, "%v", tc.intervals)
+	}
 }
 
-func TestIngressRequest_Parse(t *testing.T) {
-	input := `{"id": "1234", "date": "2009-11-10T23:00:00Z", "attributes": {"foo": "bar"}}`
-	req, err := ParseIngressRequest(strings.NewReader(input))
+func TestDateIntervals_Timezone(t *testing.T) {
+	loc, err := time.LoadLocation("America/Los_Angeles")
 	assert.Nil(t, err)
-	assert.Equal(t, "1234", req.ID)
+	intervals := DayInterval | WeekInterval | MonthInterval | QuarterInterval
 
-	date, err := time.Parse(time.RFC3339, "2009-11-10T23:00:00Z")
-	assert.Nil(t, err)
-	assert.Equal(t, date, req.Date)
+	// Just before midnight Pacific on Saturday March 31st is already
+	// Sunday April 1st in UTC
+	date := time.Date(2018, 4, 1, 6, 59, 0, 0, time.UTC)
+	out := DateIntervals(intervals, date, nil, nil)
+	assert.Equal(t, map[string]string{
+		"day":     "2018-04-01",
+		"week":    "2018-04-01",
+		"month":   "2018-04",
+		"quarter": "2018-Q2",
+	}, out)
 
-	assert.Contains(t, req.Attributes, "foo")
-	assert.Equal(t, "bar", req.Attributes["foo"])
+	out = DateIntervals(intervals, date, loc, nil)
+	assert.Equal(t, map[string]string{
+		"day":     "2018-03-31",
+		"week":    "2018-03-25",
+		"month":   "2018-03",
+		"quarter": "2018-Q1",
+	}, out)
+
+	// Just after midnight Pacific is the next day
+	out = DateIntervals(intervals, date.Add(2*time.Minute), loc, nil)
+	assert.Equal(t, map[string]string{
+		"day":     "2018-04-01",
+		"week":    "2018-04-01",
+		"month":   "2018-04",
+		"quarter": "2018-Q2",
+	}, out)
 }
 
-func TestRequestCounterKeys(t *testing.T) {
+func TestDateIntervals_Quarter(t *testing.T) {
+	intervals := DayInterval | WeekInterval | MonthInterval | QuarterInterval
+
+	// The last day of a quarter and the first day of the next
+	date := time.Date(2017, 3, 31, 23, 59, 59, 0, time.UTC)
+	out := DateIntervals(intervals, date, nil, nil)
+	assert.Equal(t, "2017-03-31", out["day"])
+	assert.Equal(t, "2017-03", out["month"])
+	assert.Equal(t, "2017-Q1", out["quarter"])
+
+	date = time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC)
+	out = DateIntervals(intervals, date, nil, nil)
+	assert.Equal(t, "2017-04-01", out["day"])
+	assert.Equal(t, "2017-04", out["month"])
+	assert.Equal(t, "2017-Q2", out["quarter"])
+}
+
+func TestDateIntervals_Custom(t *testing.T) {
+	intervals := DayInterval | CustomInterval
+	date := time.Date(2018, 1, 20, 12, 0, 0, 0, time.UTC)
+
+	// The custom interval is skipped unless configured
+	out := DateIntervals(intervals, date, nil, nil)
+	assert.Equal(t, map[string]string{"day": "2018-01-20"}, out)
+
+	custom := &CustomIntervalConfig{
+		Anchor:   time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+		Duration: 14 * 24 * time.Hour,
+	}
+	out = DateIntervals(intervals, date, nil, custom)
+	assert.Equal(t, map[string]string{"day": "2018-01-20", "custom": "1"}, out)
+}
+
+func TestAPI_Ingress_CustomInterval(t *testing.T) {
+	mock := NewMockRedisClient()
+	api := &APIHandler{
+		logger:    hclog.Default().Named("api"),
+		client:    mock,
+		intervals: MonthInterval | CustomInterval,
+		customInterval: &CustomIntervalConfig{
+			Anchor:   time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+			Duration: 14 * 24 * time.Hour,
+		},
+	}
+	mux := NewHTTPHandler(api, nil)
+
+	input := `{"id": "1234", "date": "2018-01-20T12:00:00Z", "attributes": {"foo": "bar"}}`
+	req := httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(input))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Result().StatusCode)
+	assert.Equal(t, 2, len(mock.counters))
+	assert.Contains(t, mock.counters, "month:2018-01:foo:bar")
+	assert.Contains(t, mock.counters, "custom:1:foo:bar")
+
+	// The custom interval is reserved
+	input = `{"id": "1234", "attributes": {"custom": "bar"}}`
+	req = httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(input))
+	req.Header.Set("Content-Type", "application/json")
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 400, resp.Result().StatusCode)
+}
+
+func TestSplitExactIntervals(t *testing.T) {
 	intervals := map[string]string{
 		"day":   "2018-01-27",
 		"month": "2018-01",
@@ -141,34 +1807,497 @@ func TestRequestCounterKeys(t *testing.T) {
 		ID: "1234",
 		Attributes: map[string]string{
 			"foo": "bar",
-			"baz": "zip",
 		},
 	}
 
-	keys := RequestCounterKeys(intervals, r)
-	assert.Equal(t, 2, len(keys))
+	// No config, everything is approximate
+	exact, approx := SplitExactIntervals(nil, intervals, r)
+	assert.Equal(t, 0, len(exact))
+	assert.Equal(t, intervals, approx)
 
-	dayKey := "day:2018-01-27:baz:zip:foo:bar"
-	assert.Contains(t, keys, dayKey)
+	// Exact by interval
+	config := &ExactConfig{Intervals: []string{"month"}}
+	exact, approx = SplitExactIntervals(config, intervals, r)
+	assert.Equal(t, map[string]string{"month": "2018-01"}, exact)
+	assert.Equal(t, map[string]string{"day": "2018-01-27"}, approx)
 
-	monthKey := "month:2018-01:baz:zip:foo:bar"
-	assert.Contains(t, keys, monthKey)
+	// Exact by attribute
+	config = &ExactConfig{Attributes: []string{"foo"}}
+	exact, approx = SplitExactIntervals(config, intervals, r)
+	assert.Equal(t, intervals, exact)
+	assert.Equal(t, 0, len(approx))
 }
 
-func TestDateIntervals(t *testing.T) {
-	intervals := DayInterval | WeekInterval | MonthInterval
-	date, err := time.Parse(time.RFC3339, "2006-01-09T15:04:05Z")
+func TestAPI_SimpleIngress(t *testing.T) {
+	mock := NewMockRedisClient()
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		client: mock,
+	}
+	mux := NewHTTPHandler(api, nil)
+
+	// Query parameters
+	req := httptest.NewRequest("GET", "/v1/ingress/simple?id=1234&date=2009-11-10T23:00:00Z&foo=bar", nil)
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Result().StatusCode)
+	assert.Contains(t, mock.counters["day:2009-11-10:foo:bar"], "1234")
+
+	// Form body
+	form := url.Values{"id": {"5678"}, "date": {"2009-11-10T23:00:00Z"}, "foo": {"baz"}}
+	req = httptest.NewRequest("POST", "/v1/ingress/simple", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Result().StatusCode)
+	assert.Contains(t, mock.counters["day:2009-11-10:foo:baz"], "5678")
+
+	// Other methods are not allowed
+	req = httptest.NewRequest("PUT", "/v1/ingress/simple?id=1234", nil)
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 405, resp.Result().StatusCode)
+	assert.Equal(t, "GET, POST, OPTIONS", resp.Result().Header.Get("Allow"))
+}
+
+func TestIngressConfig_Sampled(t *testing.T) {
+	// Every event is counted by default
+	var config *IngressConfig
+	assert.True(t, config.Sampled("1234"))
+	assert.True(t, (&IngressConfig{}).Sampled(""))
+
+	// The same ID is always sampled the same way
+	config = &IngressConfig{SampleRate: 0.1}
+	sampled := 0
+	for i := 0; i < 10000; i++ {
+		id := strconv.Itoa(i)
+		if config.Sampled(id) {
+			assert.True(t, config.Sampled(id))
+			sampled++
+		}
+	}
+	assert.InDelta(t, 1000, sampled, 100)
+}
+
+func TestIngressConfig_HashID(t *testing.T) {
+	// IDs are unchanged by default
+	var config *IngressConfig
+	assert.Equal(t, "1234", config.HashID("1234"))
+	assert.Equal(t, "1234", (&IngressConfig{}).HashID("1234"))
+
+	// Hashes are deterministic
+	config = &IngressConfig{IDHash: "sha256"}
+	assert.Equal(t, "03ac674216f3e15c761ee1a5e255f067953623c8b388b4459e13f978d7c846f4", config.HashID("1234"))
+	assert.Equal(t, config.HashID("1234"), config.HashID("1234"))
+	assert.NotEqual(t, config.HashID("1234"), config.HashID("1235"))
+	assert.Equal(t, "", config.HashID(""))
+
+	// The salt changes the hash, but the same salt gives the same hash
+	salted := &IngressConfig{IDHash: "sha256", IDSalt: "secret"}
+	other := &IngressConfig{IDHash: "sha256", IDSalt: "other"}
+	assert.NotEqual(t, config.HashID("1234"), salted.HashID("1234"))
+	assert.NotEqual(t, salted.HashID("1234"), other.HashID("1234"))
+	assert.Equal(t, salted.HashID("1234"), (&IngressConfig{IDHash: "sha256", IDSalt: "secret"}).HashID("1234"))
+
+	// Every algorithm is supported
+	for alg, size := range map[string]int{"sha1": 40, "sha256": 64, "sha512": 128} {
+		assert.Len(t, (&IngressConfig{IDHash: alg}).HashID("1234"), size, alg)
+		assert.Len(t, (&IngressConfig{IDHash: alg, IDSalt: "secret"}).HashID("1234"), size, alg)
+	}
+}
+
+func TestAPI_Ingress_KeyBudget(t *testing.T) {
+	mock := NewMockRedisClient()
+	stats := new(Stats)
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		client: mock,
+		stats:  stats,
+	}
+	mux := NewHTTPHandler(api, nil)
+
+	send := func(id, value string) int {
+		req := httptest.NewRequest("GET", "/v1/ingress/simple?date=2009-11-10T23:00:00Z&id="+id+"&foo="+value, nil)
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		return resp.Result().StatusCode
+	}
+
+	// Fill the budget with the keys of one event
+	assert.Equal(t, 200, send("1234", "bar"))
+	mock.keyBudget = len(mock.counters)
+
+	// Existing keys are still updated
+	assert.Equal(t, 200, send("2345", "bar"))
+	assert.Equal(t, 2, len(mock.counters["day:2009-11-10:foo:bar"]))
+
+	// New keys are rejected without tripping the breaker
+	api.breaker = NewCircuitBreaker(1, time.Minute)
+	assert.Equal(t, 429, send("1234", "baz"))
+	assert.Nil(t, mock.counters["day:2009-11-10:foo:baz"])
+	assert.Equal(t, BreakerClosed, api.breaker.State(time.Now()))
+
+	out := stats.Response(nil, nil)
+	assert.Equal(t, uint64(2), out.Events.Ingested)
+	assert.Equal(t, uint64(1), out.Events.OverBudget)
+	assert.Equal(t, uint64(0), out.Events.Failed)
+}
+
+func TestAPI_Ingress_DeriveID(t *testing.T) {
+	mock := NewMockRedisClient()
+	api := &APIHandler{
+		logger:        hclog.Default().Named("api"),
+		client:        mock,
+		ingressConfig: &IngressConfig{DeriveID: true, ClientIPHeader: "X-Forwarded-For"},
+	}
+	mux := NewHTTPHandler(api, nil)
+
+	send := func(path, ip, userAgent string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		if ip != "" {
+			req.Header.Set("X-Forwarded-For", ip+", 10.0.0.2")
+		}
+		req.Header.Set("User-Agent", userAgent)
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		return resp.Result().StatusCode
+	}
+
+	// The same client is counted once across the endpoints, while a
+	// different IP or User-Agent is counted again
+	key := "day:2009-11-10:foo:bar"
+	path := "/v1/ingress/simple?date=2009-11-10T23:00:00Z&foo=bar"
+	assert.Equal(t, 200, send(path, "1.2.3.4", "Firefox"))
+	assert.Equal(t, 200, send(path, "1.2.3.4", "Firefox"))
+	assert.Equal(t, 1, len(mock.counters[key]))
+	assert.Equal(t, 200, send("/v1/ingress/beacon?date=2009-11-10T23:00:00Z&foo=bar", "1.2.3.4", "Firefox"))
+	assert.Equal(t, 1, len(mock.counters[key]))
+	assert.Equal(t, 200, send(path, "1.2.3.4", "Chrome"))
+	assert.Equal(t, 200, send(path, "5.6.7.8", "Firefox"))
+	assert.Equal(t, 200, send(path, "", "Firefox"))
+	assert.Equal(t, 4, len(mock.counters[key]))
+
+	// An explicit ID is used as is
+	assert.Equal(t, 200, send(path+"&id=1234", "1.2.3.4", "Firefox"))
+	assert.Contains(t, mock.counters[key], "1234")
+
+	// The ID is still required by default
+	api.ingressConfig = &IngressConfig{}
+	assert.Equal(t, 400, send(path, "1.2.3.4", "Firefox"))
+}
+
+func TestClientIP(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	assert.Equal(t, "10.0.0.1", ClientIP(req, ""))
+	assert.Equal(t, "10.0.0.1", ClientIP(req, "X-Forwarded-For"))
+
+	req.Header.Set("X-Forwarded-For", " 1.2.3.4 , 10.0.0.2")
+	assert.Equal(t, "1.2.3.4", ClientIP(req, "X-Forwarded-For"))
+	assert.Equal(t, "10.0.0.1", ClientIP(req, ""))
+
+	// Unix sockets have no port
+	req.RemoteAddr = "@"
+	assert.Equal(t, "@", ClientIP(req, ""))
+}
+
+func TestAPI_Ingress_HashID(t *testing.T) {
+	mock := NewMockRedisClient()
+	config := &IngressConfig{IDHash: "sha256", IDSalt: "secret"}
+	api := &APIHandler{
+		logger:        hclog.Default().Named("api"),
+		client:        mock,
+		ingressConfig: config,
+	}
+	mux := NewHTTPHandler(api, nil)
+
+	// Only the hashed ID is written to redis
+	req := httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(
+		`{"id": "1234", "date": "2009-11-10T23:00:00Z", "attributes": {"foo": "bar"}}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Result().StatusCode)
+
+	assert.NotEqual(t, 0, len(mock.counters))
+	for key, ids := range mock.counters {
+		assert.Equal(t, map[string]struct{}{config.HashID("1234"): struct{}{}}, ids, key)
+	}
+}
+
+func TestSampledID(t *testing.T) {
+	// Similar IDs are sampled at the rate, within 4 standard deviations
+	const n = 100000
+	for _, rate := range []float64{0.01, 0.1, 0.5} {
+		sampled := 0
+		for i := 0; i < n; i++ {
+			if SampledID(fmt.Sprintf("user-%08d", i), rate) {
+				sampled++
+			}
+		}
+		assert.InDelta(t, rate*n, sampled, 4*math.Sqrt(n*rate*(1-rate)), "rate %v", rate)
+	}
+	assert.False(t, SampledID("1234", 0))
+}
+
+func TestSampledID_Estimate(t *testing.T) {
+	// Events from 50k users, each seen up to 5 times
+	const users, rate = 50000, 0.1
+	rng := rand.New(rand.NewSource(1))
+	mock := NewMockRedisClient()
+	ctx := context.Background()
+	config := &IngressConfig{SampleRate: rate}
+	for i := 0; i < users; i++ {
+		id := fmt.Sprintf("%x", rng.Int63())
+		for n := rng.Intn(5); n >= 0; n-- {
+			if config.Sampled(id) {
+				assert.Nil(t, mock.UpdateKeys(ctx, []string{"day:2017-01-18:foo:bar"}, id))
+			}
+		}
+	}
+
+	// The scaled count of the sample is within 3% of the unique users
+	counts, err := mock.GetCounts(ctx, []string{"day:2017-01-18:foo:bar"})
 	assert.Nil(t, err)
-	out := DateIntervals(intervals, date)
+	assert.InEpsilon(t, users, float64(counts[0])/rate, 0.03)
+}
 
-	assert.Equal(t, 3, len(out))
+func TestAPI_Ingress_SampleRate(t *testing.T) {
+	mock := NewMockRedisClient()
+	stats := new(Stats)
+	config := &IngressConfig{SampleRate: 0.5}
+	api := &APIHandler{
+		logger:        hclog.Default().Named("api"),
+		client:        mock,
+		ingressConfig: config,
+		stats:         stats,
+	}
+	mux := NewHTTPHandler(api, nil)
 
-	dayFormat := "2006-01-09"
-	assert.Equal(t, dayFormat, out["day"])
+	// Find an ID in and out of the sample
+	var in, out string
+	for i := 0; in == "" || out == ""; i++ {
+		if id := strconv.Itoa(i); config.Sampled(id) {
+			in = id
+		} else {
+			out = id
+		}
+	}
 
-	weekFormat := "2006-01-08"
-	assert.Equal(t, weekFormat, out["week"])
+	// Skipped events succeed without updating redis
+	req := httptest.NewRequest("PUT", "/v1/ingress?verbose=true", strings.NewReader(
+		`{"id": "`+out+`", "date": "2009-11-10T23:00:00Z", "attributes": {"foo": "bar"}}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Result().StatusCode)
+	assert.Equal(t, "false", resp.Result().Header.Get("X-Sampled"))
+	var body IngressResponse
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.False(t, body.Sampled)
+	assert.Equal(t, 0, len(mock.counters))
+	assert.Equal(t, uint64(1), stats.Response(nil, nil).Events.Skipped)
 
-	monthFormat := "2006-01"
-	assert.Equal(t, monthFormat, out["month"])
+	// Sampled events are counted
+	req = httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(
+		`{"id": "`+in+`", "date": "2009-11-10T23:00:00Z", "attributes": {"foo": "bar"}}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Result().StatusCode)
+	assert.Equal(t, "true", resp.Result().Header.Get("X-Sampled"))
+	assert.Contains(t, mock.counters["day:2009-11-10:foo:bar"], in)
+}
+
+func TestAPI_Beacon(t *testing.T) {
+	mock := NewMockRedisClient()
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		client: mock,
+	}
+	mux := NewHTTPHandler(api, nil)
+
+	// A GET responds with an uncached transparent pixel
+	req := httptest.NewRequest("GET", "/v1/ingress/beacon?id=1234&date=2009-11-10T23:00:00Z&foo=bar", nil)
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Result().StatusCode)
+	assert.Equal(t, "image/gif", resp.Result().Header.Get("Content-Type"))
+	assert.Contains(t, resp.Result().Header.Get("Cache-Control"), "no-store")
+	assert.Contains(t, mock.counters["day:2009-11-10:foo:bar"], "1234")
+
+	img, err := gif.Decode(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, image.Rect(0, 0, 1, 1), img.Bounds())
+	_, _, _, alpha := img.At(0, 0).RGBA()
+	assert.Equal(t, uint32(0), alpha)
+
+	// A POST has no pixel
+	req = httptest.NewRequest("POST", "/v1/ingress/beacon?id=5678&date=2009-11-10T23:00:00Z&foo=bar", nil)
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 204, resp.Result().StatusCode)
+	assert.Equal(t, 0, resp.Body.Len())
+	assert.Contains(t, mock.counters["day:2009-11-10:foo:bar"], "5678")
+
+	// Invalid events are rejected without a pixel
+	req = httptest.NewRequest("GET", "/v1/ingress/beacon?foo=bar", nil)
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 400, resp.Result().StatusCode)
+	assert.NotEqual(t, "image/gif", resp.Result().Header.Get("Content-Type"))
+}
+
+func TestAPI_AllowedMethods(t *testing.T) {
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		client: NewMockRedisClient(),
+		db:     NewMockDatabaseClient(),
+	}
+	mux := NewHTTPHandler(api, nil)
+
+	type tcase struct {
+		Path  string
+		Allow string
+	}
+	cases := []tcase{
+		{"/v1/ingress", "PUT, OPTIONS"},
+		{"/v1/ingress/simple", "GET, POST, OPTIONS"},
+		{"/v1/ingress/beacon", "GET, POST, OPTIONS"},
+		{"/v1/query/day", "GET, HEAD, OPTIONS"},
+		{"/v1/top/day", "GET, HEAD, OPTIONS"},
+		{"/v1/compare/day", "GET, HEAD, OPTIONS"},
+		{"/v1/domain/foo", "GET, HEAD, OPTIONS"},
+		{"/v1/domain/counts", "GET, HEAD, OPTIONS"},
+		{"/v1/range/day", "GET, HEAD, OPTIONS"},
+		{"/v1/info", "GET, HEAD, OPTIONS"},
+		{"/stats", "GET, HEAD, OPTIONS"},
+		{"/health", "GET, HEAD, OPTIONS"},
+		{"/", "GET, HEAD, OPTIONS"},
+	}
+	for _, tc := range cases {
+		// OPTIONS lists the allowed methods
+		req := httptest.NewRequest("OPTIONS", tc.Path, nil)
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		assert.Equal(t, 204, resp.Result().StatusCode, tc.Path)
+		assert.Equal(t, tc.Allow, resp.Result().Header.Get("Allow"), tc.Path)
+
+		// Other methods are rejected with the allowed methods
+		req = httptest.NewRequest("DELETE", tc.Path, nil)
+		resp = httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		assert.Equal(t, 405, resp.Result().StatusCode, tc.Path)
+		assert.Equal(t, tc.Allow, resp.Result().Header.Get("Allow"), tc.Path)
+	}
+
+	// HEAD is served like GET without a body
+	req := httptest.NewRequest("HEAD", "/health", nil)
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Result().StatusCode)
+}
+
+func TestAPI_Root(t *testing.T) {
+	type tcase struct {
+		Root     string
+		Path     string
+		Code     int
+		Location string
+	}
+	cases := []tcase{
+		{"", "/", 200, ""},
+		{RootStatus, "/", 200, ""},
+		{RootStatus, "/missing", 404, ""},
+		{RootRedirect, "/", 302, "/ui"},
+		{RootRedirect, "/missing", 302, "/ui"},
+		{RootRedirect, "/ui", 404, ""},
+		{RootNotFound, "/", 404, ""},
+		{RootNotFound, "/missing", 404, ""},
+	}
+	for _, tc := range cases {
+		api := &APIHandler{
+			logger: hclog.Default().Named("api"),
+			client: NewMockRedisClient(),
+			root:   tc.Root,
+		}
+		mux := NewHTTPHandler(api, nil)
+
+		req := httptest.NewRequest("GET", tc.Path, nil)
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		assert.Equal(t, tc.Code, resp.Result().StatusCode, "%s %s", tc.Root, tc.Path)
+		assert.Equal(t, tc.Location, resp.Result().Header.Get("Location"), "%s %s", tc.Root, tc.Path)
+		if tc.Code != 200 {
+			continue
+		}
+
+		// The status includes the version and health
+		assert.Equal(t, "application/json", resp.Result().Header.Get("Content-Type"))
+		var out RootResponse
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&out))
+		assert.Equal(t, "counterd", out.Name)
+		assert.Equal(t, VersionString(), out.Version)
+		if assert.NotNil(t, out.Health) {
+			assert.Equal(t, BreakerClosed, out.Health.Redis.Breaker)
+		}
+	}
+}
+
+func TestParseSimpleIngressRequest(t *testing.T) {
+	type tcase struct {
+		Input    string
+		Expected *IngressRequest
+		Err      string
+	}
+	date := time.Date(2009, 11, 10, 23, 0, 0, 0, time.UTC)
+	tcases := []tcase{
+		{
+			Input: "id=1234&date=2009-11-10T23:00:00Z&foo=bar&zip=zap",
+			Expected: &IngressRequest{
+				ID:         "1234",
+				Date:       date,
+				Attributes: map[string]string{"foo": "bar", "zip": "zap"},
+			},
+		},
+		{
+			Input: "id=1234&date=2009-11-10T23:00:00Z",
+			Expected: &IngressRequest{
+				ID:         "1234",
+				Date:       date,
+				Attributes: map[string]string{NullAttribute: NullAttribute},
+			},
+		},
+		{
+			Input: "foo=bar",
+			Err:   "missing request ID",
+		},
+		{
+			Input: "id=1234&date=yesterday",
+			Err:   "invalid date",
+		},
+		{
+			Input: "id=1234&foo=bar&foo=baz",
+			Err:   `parameter "foo" given 2 times`,
+		},
+		{
+			Input: "id=1234&foo=bar:baz",
+			Err:   "invalid use of colon",
+		},
+	}
+	for _, tc := range tcases {
+		params, err := url.ParseQuery(tc.Input)
+		assert.Nil(t, err)
+		req, err := ParseSimpleIngressRequest(params, nil, nil)
+		if tc.Err != "" {
+			assert.NotNil(t, err, tc.Input)
+			if err != nil {
+				assert.Contains(t, err.Error(), tc.Err)
+			}
+			continue
+		}
+		assert.Nil(t, err, tc.Input)
+		assert.Equal(t, tc.Expected, req)
+	}
 }
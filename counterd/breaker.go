@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBreakerThreshold is the default number of consecutive redis
+	// failures that open the circuit breaker if no setting is specified
+	DefaultBreakerThreshold = 5
+
+	// DefaultBreakerCooldown is the default time the circuit breaker stays
+	// open before allowing a retry if no setting is specified
+	DefaultBreakerCooldown = 10 * time.Second
+
+	// BreakerClosed allows every request, and is the normal state
+	BreakerClosed = "closed"
+
+	// BreakerOpen fast-fails every request until the cooldown expires
+	BreakerOpen = "open"
+
+	// BreakerHalfOpen allows a single trial request after the cooldown.
+	// The breaker closes if it succeeds and opens again if it fails.
+	BreakerHalfOpen = "half-open"
+)
+
+// CircuitBreaker is used to fast-fail requests after consecutive failures
+// of a dependency. Once open, a single request is allowed through after each
+// cooldown to check if the dependency has recovered. All the methods are safe
+// to call concurrently, and on a nil CircuitBreaker, which is always closed.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	failures int
+	openedAt time.Time
+	l        sync.Mutex
+}
+
+// NewCircuitBreaker creates a circuit breaker that opens after threshold
+// consecutive failures and allows a retry after the cooldown
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Allow checks if a request should be attempted
+func (c *CircuitBreaker) Allow(now time.Time) bool {
+	if c == nil {
+		return true
+	}
+	c.l.Lock()
+	defer c.l.Unlock()
+	switch c.state(now) {
+	case BreakerClosed:
+		return true
+	case BreakerHalfOpen:
+		// Only allow one retry per cooldown
+		c.openedAt = now
+		return true
+	default:
+		return false
+	}
+}
+
+// Success records a successful request, closing the breaker
+func (c *CircuitBreaker) Success() {
+	if c == nil {
+		return
+	}
+	c.l.Lock()
+	c.failures = 0
+	c.l.Unlock()
+}
+
+// Failure records a failed request, opening the breaker at the threshold
+func (c *CircuitBreaker) Failure(now time.Time) {
+	if c == nil {
+		return
+	}
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.failures++
+	if c.failures >= c.threshold {
+		c.openedAt = now
+	}
+}
+
+// State returns the current state of the breaker
+func (c *CircuitBreaker) State(now time.Time) string {
+	if c == nil {
+		return BreakerClosed
+	}
+	c.l.Lock()
+	defer c.l.Unlock()
+	return c.state(now)
+}
+
+func (c *CircuitBreaker) state(now time.Time) string {
+	switch {
+	case c.failures < c.threshold:
+		return BreakerClosed
+	case now.Sub(c.openedAt) < c.cooldown:
+		return BreakerOpen
+	default:
+		return BreakerHalfOpen
+	}
+}
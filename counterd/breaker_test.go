@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingRedisClient fails all updates while down
+type failingRedisClient struct {
+	*MockRedisClient
+	down    bool
+	updates int
+}
+
+func (f *failingRedisClient) UpdateKeys(ctx context.Context, keys []string, id string) error {
+	f.updates++
+	if f.down {
+		return fmt.Errorf("connection refused")
+	}
+	return f.MockRedisClient.UpdateKeys(ctx, keys, id)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	c := NewCircuitBreaker(2, time.Minute)
+	now := time.Now()
+	assert.Equal(t, BreakerClosed, c.State(now))
+
+	// Opens after consecutive failures
+	c.Failure(now)
+	assert.True(t, c.Allow(now))
+	c.Failure(now)
+	assert.Equal(t, BreakerOpen, c.State(now))
+	assert.False(t, c.Allow(now))
+
+	// A single retry is allowed after the cooldown
+	later := now.Add(time.Minute)
+	assert.Equal(t, BreakerHalfOpen, c.State(later))
+	assert.True(t, c.Allow(later))
+	assert.False(t, c.Allow(later))
+
+	// A failed retry re-opens, and a success closes
+	c.Failure(later)
+	assert.Equal(t, BreakerOpen, c.State(later))
+	c.Success()
+	assert.Equal(t, BreakerClosed, c.State(later))
+
+	// Nil is always closed
+	var disabled *CircuitBreaker
+	disabled.Failure(now)
+	assert.True(t, disabled.Allow(now))
+	assert.Equal(t, BreakerClosed, disabled.State(now))
+}
+
+func TestAPI_Ingress_RedisDown(t *testing.T) {
+	client := &failingRedisClient{MockRedisClient: NewMockRedisClient(), down: true}
+	api := &APIHandler{
+		logger:  hclog.Default().Named("api"),
+		client:  client,
+		breaker: NewCircuitBreaker(2, time.Hour),
+	}
+	mux := NewHTTPHandler(api, nil)
+
+	ingress := func() int {
+		input := `{"id": "1234", "attributes": {"foo": "bar"}}`
+		req := httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(input))
+		req.Header.Set("Content-Type", "application/json")
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		return resp.Result().StatusCode
+	}
+	health := func() string {
+		req := httptest.NewRequest("GET", "/health", nil)
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		assert.Equal(t, 200, resp.Result().StatusCode)
+		var out HealthResponse
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&out))
+		return out.Redis.Breaker
+	}
+
+	// Failures are returned as unavailable
+	assert.Equal(t, BreakerClosed, health())
+	assert.Equal(t, 503, ingress())
+	assert.Equal(t, 503, ingress())
+	assert.Equal(t, 2, client.updates)
+
+	// Once open, redis is not attempted
+	assert.Equal(t, BreakerOpen, health())
+	assert.Equal(t, 503, ingress())
+	assert.Equal(t, 2, client.updates)
+
+	// Recovers once a retry succeeds
+	client.down = false
+	api.breaker.openedAt = time.Now().Add(-2 * time.Hour)
+	assert.Equal(t, BreakerHalfOpen, health())
+	assert.Equal(t, 200, ingress())
+	assert.Equal(t, BreakerClosed, health())
+}
+
+func TestAPI_Health_NoAuth(t *testing.T) {
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		client: NewMockRedisClient(),
+	}
+	mux := NewHTTPHandler(api, &AuthConfig{Required: true, Tokens: []string{"foo"}})
+
+	req := httptest.NewRequest("GET", "/health", nil)
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Result().StatusCode)
+
+	req = httptest.NewRequest("GET", "/stats", nil)
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 403, resp.Result().StatusCode)
+
+	// A provided token is still checked
+	req = httptest.NewRequest("GET", "/health", nil)
+	req.Header.Set("Authorization", "Bearer bar")
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 403, resp.Result().StatusCode)
+
+	req = httptest.NewRequest("GET", "/health", nil)
+	req.Header.Set("Authorization", "Bearer foo")
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Result().StatusCode)
+}
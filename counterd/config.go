@@ -1,9 +1,21 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
+	"hash"
+	"math/rand"
+	"net/url"
 	"os"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/hcl"
@@ -17,14 +29,74 @@ const (
 	// DefaultDeleteThreshold is the default threshold we delete
 	// counters if no setting is specified
 	DefaultDeleteThreshold = 3 * 31 * 24 * time.Hour // 31 Days
+
+	// DefaultSnapshotBatchSize is the default number of keys a snapshot
+	// counts or deletes at a time
+	DefaultSnapshotBatchSize = 10000
+
+	// DefaultFullSnapshotInterval is the default interval between full
+	// snapshots when incremental snapshots are enabled
+	DefaultFullSnapshotInterval = 24 * time.Hour
+
+	// DefaultLeaderLease is the default expiration of the leader lock.
+	// The leader renews the lock at a third of the lease.
+	DefaultLeaderLease = 15 * time.Second
+
+	// DefaultConnectTimeout is the default time spent retrying the
+	// initial connection to the database
+	DefaultConnectTimeout = 30 * time.Second
+
+	// DefaultLockTTL is the default expiration of the snapshot lock,
+	// which should be longer than any snapshot takes
+	DefaultLockTTL = time.Hour
+
+	// DefaultMaxFuture is the default limit on how far in the
+	// future an event can be dated if no setting is specified
+	DefaultMaxFuture = 24 * time.Hour
+
+	// DefaultMaxBodySize is the default limit on the size of an
+	// ingress request body if no setting is specified
+	DefaultMaxBodySize = 1024 * 1024 // 1MB
+
+	// DefaultMaxKeys is the default limit on the number of keys a single
+	// ingress event can update if no setting is specified. This allows every
+	// combination of multi-valued attributes for each interval.
+	DefaultMaxKeys = 4 * MaxMultiAttributeCombinations
+
+	// DefaultMaxKeyLength is the default limit in bytes on an attribute key
+	DefaultMaxKeyLength = 128
+
+	// DefaultMaxValueLength is the default limit in bytes on an attribute value
+	DefaultMaxValueLength = 1024
+
+	// DefaultReadHeaderTimeout, DefaultReadTimeout, DefaultWriteTimeout and
+	// DefaultIdleTimeout are the default HTTP server timeouts, which close
+	// slow or hung connections
+	DefaultReadHeaderTimeout = 10 * time.Second
+	DefaultReadTimeout       = 30 * time.Second
+	DefaultWriteTimeout      = 2 * time.Minute
+	DefaultIdleTimeout       = 2 * time.Minute
+
+	// DefaultKeyCountInterval is the default time the number of keys in
+	// redis is cached when checking the key budget
+	DefaultKeyCountInterval = time.Minute
+
+	// DefaultMemoryInterval is the default interval between estimates of
+	// the redis memory used, if enabled
+	DefaultMemoryInterval = 10 * time.Minute
 )
 
 // Config is the configuration for the server and snapshot comments
 type Config struct {
-	// ListenAddress is the HTTP listener address
+	// ListenAddress is the HTTP listener address. A unix domain socket
+	// can be used with an address like "unix:///var/run/counterd.sock".
 	// If the PORT environment is set, "0.0.0.0:$PORT" is used.
 	ListenAddress string `hcl:"listen_address"`
 
+	// SocketMode is the octal file mode of a unix domain socket, e.g. "0660"
+	SocketModeRaw string      `hcl:"socket_mode"`
+	SocketMode    os.FileMode `hcl:"-"`
+
 	// RedisAddress is the address of the redis server
 	// If the REDIS_URL environment variable is set, that will be used.
 	RedisAddress string `hcl:"redis_address"`
@@ -33,6 +105,26 @@ type Config struct {
 	// If the PG_URL environment variable is set, that will be used.
 	PGAddress string `hcl:"postgresql_address"`
 
+	// PGReadAddress is the optional address of a postgresql read replica,
+	// used by the query endpoints and export. Writes always use PGAddress.
+	// If the PG_READ_URL environment variable is set, that will be used.
+	PGReadAddress string `hcl:"postgresql_read_address"`
+
+	// Timezone is the IANA location used to bucket events into intervals,
+	// e.g. "America/Los_Angeles". Day, week, month and quarter boundaries
+	// follow local time in this location. Defaults to UTC.
+	TimezoneRaw string         `hcl:"timezone"`
+	Timezone    *time.Location `hcl:"-"`
+
+	// Intervals are the names of the intervals that events are counted
+	// in, any of "day", "week", "month" and "quarter". Intervals is the
+	// parsed bitmask. Defaults to all the intervals.
+	IntervalsRaw []string `hcl:"intervals"`
+	Intervals    int      `hcl:"-"`
+
+	// CustomInterval optionally defines the "custom" interval
+	CustomInterval *CustomIntervalConfig `hcl:"custom_interval"`
+
 	// Snapshot has the snapshot specific configuration
 	Snapshot *SnapshotConfig
 
@@ -41,6 +133,306 @@ type Config struct {
 
 	// Attributes is used to configure filtering of attributes
 	Attributes *AttributeConfig
+
+	// Tracing is used to configure OpenTelemetry tracing
+	Tracing *TracingConfig
+
+	// Exact is used to configure which counters use exact counting
+	Exact *ExactConfig
+
+	// Ingress is used to configure validation of ingress events
+	Ingress *IngressConfig
+
+	// Database is used to configure how the database is written
+	Database *DatabaseConfig
+
+	// Redis is used to configure how redis is written
+	Redis *RedisConfig
+
+	// TLS is used to configure HTTPS for the API server
+	TLS *TLSConfig
+
+	// HTTP is used to configure the timeouts of the API server
+	HTTP *HTTPConfig
+
+	// PGTLS is used to configure TLS for the postgresql connections
+	PGTLS *PGTLSConfig `hcl:"postgresql_tls"`
+}
+
+// CustomIntervalConfig defines an interval of fixed length buckets that do
+// not follow the calendar, such as two week sprints or fiscal periods. The
+// keys use the index of the bucket since the anchor, e.g. "custom:12".
+type CustomIntervalConfig struct {
+	// Anchor is the RFC 3339 start of the bucket with index zero
+	AnchorRaw string    `hcl:"anchor"`
+	Anchor    time.Time `hcl:"-"`
+
+	// Duration is the length of every bucket, e.g. "336h" for two weeks
+	DurationRaw string        `hcl:"duration"`
+	Duration    time.Duration `hcl:"-"`
+}
+
+// Bucket returns the index of the bucket containing the date,
+// which is negative before the anchor
+func (c *CustomIntervalConfig) Bucket(date time.Time) int64 {
+	delta := date.Sub(c.Anchor)
+	bucket := int64(delta / c.Duration)
+	if delta%c.Duration < 0 {
+		bucket--
+	}
+	return bucket
+}
+
+// Start returns the start of the bucket with the index
+func (c *CustomIntervalConfig) Start(bucket int64) time.Time {
+	return c.Anchor.Add(time.Duration(bucket) * c.Duration).UTC()
+}
+
+// PGTLSConfig is used to configure TLS for the postgresql connections.
+// The options are set as parameters of the connection strings, overriding
+// any that are already set.
+type PGTLSConfig struct {
+	// SSLMode is the libpq sslmode, e.g. "require" or "verify-full"
+	SSLMode string `hcl:"sslmode"`
+
+	// RootCert is the path to the PEM encoded CA certificates used to
+	// verify the server with the "verify-ca" and "verify-full" modes
+	RootCert string `hcl:"root_cert"`
+
+	// CertFile and KeyFile are the paths to the PEM encoded client
+	// certificate and private key, if the server requires them
+	CertFile string `hcl:"cert_file"`
+	KeyFile  string `hcl:"key_file"`
+}
+
+// TLSConfig is used to configure HTTPS for the API server
+type TLSConfig struct {
+	// CertFile and KeyFile are the paths to the PEM encoded certificate and
+	// private key. If blank, the server uses plaintext HTTP. The files are
+	// reloaded when the server receives a SIGHUP.
+	CertFile string `hcl:"cert_file"`
+	KeyFile  string `hcl:"key_file"`
+
+	// MinVersion is the minimum TLS version accepted, e.g. "1.2"
+	MinVersionRaw string `hcl:"min_version"`
+	MinVersion    uint16 `hcl:"-"`
+}
+
+// HTTPConfig is used to configure the timeouts of the API server
+type HTTPConfig struct {
+	// ReadHeaderTimeout limits how long the request headers can take to
+	// read, which protects against slowloris attacks
+	ReadHeaderTimeoutRaw string        `hcl:"read_header_timeout"`
+	ReadHeaderTimeout    time.Duration `hcl:"-"`
+
+	// ReadTimeout limits how long the whole request can take to read
+	ReadTimeoutRaw string        `hcl:"read_timeout"`
+	ReadTimeout    time.Duration `hcl:"-"`
+
+	// WriteTimeout limits how long a response can take to write, which
+	// includes the time spent handling the request and streaming results
+	WriteTimeoutRaw string        `hcl:"write_timeout"`
+	WriteTimeout    time.Duration `hcl:"-"`
+
+	// IdleTimeout limits how long a keep-alive connection waits for the
+	// next request
+	IdleTimeoutRaw string        `hcl:"idle_timeout"`
+	IdleTimeout    time.Duration `hcl:"-"`
+
+	// Root is the response to the root path, either RootStatus,
+	// RootRedirect or RootNotFound. Defaults to RootStatus.
+	Root string `hcl:"root"`
+
+	// DomainCacheTTL is how long the responses of the domain endpoints
+	// are cached. The cache is purged after each snapshot, since that is
+	// when new values are written. Disabled if not specified.
+	DomainCacheTTLRaw string        `hcl:"domain_cache_ttl"`
+	DomainCacheTTL    time.Duration `hcl:"-"`
+}
+
+// DatabaseConfig is used to configure how the database is written
+type DatabaseConfig struct {
+	// TransactionSize is the maximum number of rows upserted in a single
+	// transaction. Larger transactions mean fewer commits, at the cost of
+	// holding locks for longer.
+	TransactionSize int `hcl:"transaction_size"`
+
+	// DisableCache disables the caches of previously written attributes and
+	// counters. The caches avoid redundant writes, but a row that is manually
+	// deleted from the database is not re-written while it is cached.
+	DisableCache bool `hcl:"disable_cache"`
+
+	// IsolateFailures retries a transaction of counters that fails one
+	// counter at a time, so that a bad counter does not fail the snapshot.
+	// Counters that still fail are logged and reported as dead letters.
+	IsolateFailures bool `hcl:"isolate_failures"`
+
+	// HashAttributes identifies counters by a SHA-256 hash of their
+	// attributes instead of the jsonb. The unique index on the hash is much
+	// smaller, and conflicts are resolved faster. The dbinit command must be
+	// run after it is enabled, and it cannot be disabled afterwards.
+	HashAttributes bool `hcl:"hash_attributes"`
+
+	// ConflictStrategy is how the count of a counter that already exists
+	// is updated, either ConflictGreatest or ConflictLatest. Defaults to
+	// ConflictGreatest, which never lowers a count. ConflictSum is rejected,
+	// since a snapshot would add the same count again, and is only
+	// supported by the flag of the import command.
+	ConflictStrategy string `hcl:"conflict_strategy"`
+
+	// StatementTimeout limits how long each transaction of upserts can run
+	// before it is cancelled, so that a slow snapshot does not hold locks
+	// indefinitely. The snapshot fails and the counters are retried by the
+	// next snapshot. Disabled if not specified.
+	StatementTimeoutRaw string        `hcl:"statement_timeout"`
+	StatementTimeout    time.Duration `hcl:"-"`
+
+	// ConnectTimeout is how long the initial connection to the database is
+	// retried, so that counterd can start before the database is up
+	ConnectTimeoutRaw string        `hcl:"connect_timeout"`
+	ConnectTimeout    time.Duration `hcl:"-"`
+}
+
+// RedisConfig is used to configure how redis is written
+type RedisConfig struct {
+	// FlushSize is the maximum number of commands sent in a single
+	// transaction when ingesting an event. Events updating more keys are
+	// split into multiple transactions, so they are no longer atomic.
+	FlushSize int `hcl:"flush_size"`
+
+	// CountScript is used to count keys during a snapshot with a Lua script,
+	// which counts a batch of keys in a single command. If the script fails,
+	// the keys are counted with a transaction of PFCOUNT commands instead.
+	CountScript bool `hcl:"count_script"`
+
+	// HybridThreshold is the number of IDs an approximate counter stores in
+	// a set before it is promoted to a HyperLogLog. Small counters are exact
+	// and use less memory than a HyperLogLog. Disabled if zero.
+	HybridThreshold int `hcl:"hybrid_threshold"`
+
+	// KeyBudget is the number of keys in redis at which events that would
+	// create a new key are rejected, while events updating existing keys
+	// are still counted. This protects redis from an explosion of attribute
+	// combinations. Disabled if zero.
+	KeyBudget int `hcl:"key_budget"`
+
+	// KeyCountInterval is how long the number of keys is cached
+	KeyCountIntervalRaw string        `hcl:"key_count_interval"`
+	KeyCountInterval    time.Duration `hcl:"-"`
+
+	// MemorySample is the number of keys sampled with MEMORY USAGE to
+	// estimate the memory used by the counters, reported by /stats.
+	// Estimating scans every key, so it is disabled if zero.
+	MemorySample int `hcl:"memory_sample"`
+
+	// MemoryInterval is how often the memory used is estimated
+	MemoryIntervalRaw string        `hcl:"memory_interval"`
+	MemoryInterval    time.Duration `hcl:"-"`
+}
+
+// IngressConfig is used to configure validation of ingress events
+type IngressConfig struct {
+	// MaxFuture is how far in the future an event can be dated. This guards against
+	// clients with broken clocks creating counters that are never snapshotted.
+	// Setting it to "0" or "-1" disables the limit, leaving MaxFuture negative.
+	MaxFutureRaw string        `hcl:"max_future"`
+	MaxFuture    time.Duration `hcl:"-"`
+
+	// RejectExpired is used to reject events dated before the delete threshold,
+	// since their counters would be immediately deleted by the next snapshot.
+	RejectExpired bool `hcl:"reject_expired"`
+
+	// MaxPast is how far in the past an event can be dated. This is set to
+	// the delete threshold if RejectExpired is enabled, otherwise unlimited.
+	MaxPast time.Duration `hcl:"-"`
+
+	// MaxBodySize is the maximum size in bytes of an ingress request body.
+	// Larger requests are rejected to protect the server's memory.
+	MaxBodySize int64 `hcl:"max_body_size"`
+
+	// MaxKeys is the maximum number of keys a single event can update.
+	// Events expanding to more keys are rejected to protect redis.
+	MaxKeys int `hcl:"max_keys"`
+
+	// SampleRate is the fraction of events that are counted, to reduce the
+	// redis load. Events are sampled by a hash of their ID, so an ID is
+	// always counted or skipped. The rate is stored with the counters so
+	// queries can scale the counts. Every event is counted if not specified.
+	SampleRate float64 `hcl:"sample_rate"`
+
+	// Increments allows events without an ID. Instead of counting unique
+	// IDs, these events increment a plain counter of every event.
+	Increments bool `hcl:"increments"`
+
+	// DeriveID allows events without an ID by deriving one from a hash of
+	// the client IP and User-Agent, for rough unique counts of web traffic.
+	// Clients sharing an IP and browser are counted once, and a client that
+	// changes networks is counted again.
+	DeriveID bool `hcl:"derive_id"`
+
+	// ClientIPHeader is the header with the client IP used by DeriveID when
+	// behind a proxy, e.g. "X-Forwarded-For", using the first address. The
+	// remote address of the connection is used if not specified.
+	ClientIPHeader string `hcl:"client_ip_header"`
+
+	// IDHash is the algorithm used to hash event IDs before they are counted,
+	// so the raw IDs are never written to redis. One of "sha1", "sha256" or
+	// "sha512". The same ID always has the same hash, so unique counts are
+	// unchanged. IDs are not hashed if not specified.
+	IDHash string `hcl:"id_hash"`
+
+	// IDSalt is an optional secret used to key the ID hash with HMAC, so the
+	// hashes can't be reversed by hashing guessed IDs. Changing the salt
+	// changes every hash, counting the same IDs again.
+	IDSalt string `hcl:"id_salt"`
+
+	// DedupWindow enables dropping events whose ID and counter keys were already
+	// ingested within the window, saving redis writes during retry storms. Disabled if not specified.
+	DedupWindowRaw string        `hcl:"dedup_window"`
+	DedupWindow    time.Duration `hcl:"-"`
+
+	// DedupSize is the maximum number of recent event IDs that are tracked
+	DedupSize int `hcl:"dedup_size"`
+
+	// QueueSize enables asynchronous ingress. Events are buffered in a queue
+	// of this size and acknowledged before being written to redis, so queued
+	// events are lost on a crash, and events that fail to be written are not
+	// retried. Disabled if not specified.
+	QueueSize int `hcl:"queue_size"`
+
+	// QueueWorkers is the number of workers writing queued events to redis
+	QueueWorkers int `hcl:"queue_workers"`
+
+	// BreakerThreshold is the number of consecutive redis failures after which
+	// ingress fast-fails without attempting redis, until the cooldown passes
+	BreakerThreshold int `hcl:"breaker_threshold"`
+
+	// BreakerCooldown is how long ingress fast-fails before retrying redis
+	BreakerCooldownRaw string        `hcl:"breaker_cooldown"`
+	BreakerCooldown    time.Duration `hcl:"-"`
+}
+
+// ExactConfig is used to configure exact counting. By default counters use
+// a HyperLogLog, which has a standard error of 0.81% but uses at most 12KB.
+// Exact counters use a set, which is always accurate but stores every ID.
+type ExactConfig struct {
+	// Intervals are the intervals that should be counted exactly
+	Intervals []string
+
+	// Attributes are the attribute keys that should be counted exactly.
+	// Any counter including one of these attributes is counted exactly.
+	Attributes []string
+}
+
+// TracingConfig is used to configure OpenTelemetry tracing
+type TracingConfig struct {
+	// OTLPEndpoint is the URL of an OTLP/HTTP collector to export spans to,
+	// e.g. "http://127.0.0.1:4318". If blank, tracing is disabled.
+	// If the OTEL_EXPORTER_OTLP_ENDPOINT environment variable is set, that will be used.
+	OTLPEndpoint string `hcl:"otlp_endpoint"`
+
+	// ServiceName is the service name reported with all spans
+	ServiceName string `hcl:"service_name"`
 }
 
 // AttributeConfig is used to configure attribute handlign
@@ -50,6 +442,85 @@ type AttributeConfig struct {
 
 	// Blacklist is used to filter out unwanted attributes
 	Blacklist []string
+
+	// LowercaseKeys converts the attribute keys to lower case. If this
+	// causes keys to collide, the value of the key that was already lower
+	// case is used, otherwise the first key in sorted order.
+	LowercaseKeys bool `hcl:"lowercase_keys"`
+
+	// LowercaseValues converts the attribute values to lower case
+	LowercaseValues bool `hcl:"lowercase_values"`
+
+	// TrimValues removes leading and trailing whitespace from the values
+	TrimValues bool `hcl:"trim_values"`
+
+	// Aliases renames attribute keys to a canonical key, so producers using
+	// different names are counted together. Aliases apply after lower casing
+	// and before the whitelist and blacklist.
+	Aliases map[string]string `hcl:"aliases"`
+
+	// DefaultAttributes are added to every event after filtering, unless
+	// the event has an attribute with the same key
+	DefaultAttributes map[string]string `hcl:"default_attributes"`
+
+	// Null is the attribute key and value injected into events without
+	// any attributes. Defaults to NullAttribute.
+	Null string `hcl:"null"`
+
+	// MaxKeyLength and MaxValueLength limit the size in bytes of the
+	// attribute keys and values of an event
+	MaxKeyLength   int `hcl:"max_key_length"`
+	MaxValueLength int `hcl:"max_value_length"`
+
+	// EncodeValues allows colons in attribute values by percent encoding
+	// colons and percent signs in the redis keys. Keys of values without
+	// either are unchanged. Snapshots decode the values, so they must run
+	// with the same setting as ingress.
+	EncodeValues bool `hcl:"encode_values"`
+
+	// KeyFormat is the format of the redis keys, either KeyFormatV1 or
+	// KeyFormatV2. The v2 format allows any character in the attribute keys
+	// and values. Snapshots parse both formats, and merge the counters of
+	// both while the v2 format is configured so they are not split during
+	// a migration. Defaults to KeyFormatV1.
+	KeyFormat string `hcl:"key_format"`
+}
+
+// encodeValues returns if attribute values are encoded in v1 keys
+func (c *AttributeConfig) encodeValues() bool {
+	return c != nil && c.EncodeValues
+}
+
+// keyFormat returns the configured key format, or the default
+func (c *AttributeConfig) keyFormat() string {
+	if c == nil || c.KeyFormat == "" {
+		return KeyFormatV1
+	}
+	return c.KeyFormat
+}
+
+// maxKeyLength returns the configured key length limit, or the default
+func (c *AttributeConfig) maxKeyLength() int {
+	if c == nil || c.MaxKeyLength <= 0 {
+		return DefaultMaxKeyLength
+	}
+	return c.MaxKeyLength
+}
+
+// maxValueLength returns the configured value length limit, or the default
+func (c *AttributeConfig) maxValueLength() int {
+	if c == nil || c.MaxValueLength <= 0 {
+		return DefaultMaxValueLength
+	}
+	return c.MaxValueLength
+}
+
+// NullName returns the configured null attribute, or the default
+func (c *AttributeConfig) NullName() string {
+	if c == nil || c.Null == "" {
+		return NullAttribute
+	}
+	return c.Null
 }
 
 // AuthConfig holds the authentication configuration
@@ -68,17 +539,166 @@ type SnapshotConfig struct {
 	// This is independent from invoking the snapshot command.
 	Cron string `hcl:"cron"`
 
+	// CronTimezone is the IANA location the cron schedule is evaluated in,
+	// independent of the timezone of the host. Defaults to UTC.
+	CronTimezoneRaw string         `hcl:"cron_timezone"`
+	CronTimezone    *time.Location `hcl:"-"`
+
 	// UpdateThreshold is how far back we scan for relevant updates.
 	// This prevents old counters from being updated. This should be relative to the
 	// snapshot rate. For example, if you snapshot hourly, consider a two hour update threshold.
 	UpdateThresholdRaw string        `hcl:"update_threshold"`
 	UpdateThreshold    time.Duration `hcl:"-"`
 
+	// IntervalUpdateThresholds override the UpdateThreshold for specific
+	// intervals, since a daily counter stops changing much sooner than a
+	// quarterly one. Intervals without a threshold use the UpdateThreshold.
+	// Every threshold must be below the DeleteThreshold.
+	IntervalUpdateThresholdsRaw map[string]string        `hcl:"interval_update_thresholds"`
+	IntervalUpdateThresholds    map[string]time.Duration `hcl:"-"`
+
 	// DeleteThreshold is how far back a counter needs to be for deletion.
 	// This should be at least 2x the longest interval that is tracked. For example,
 	// if monthly counters are enabled, consider a two month delete threshold.
 	DeleteThresholdRaw string        `hcl:"delete_threshold"`
 	DeleteThreshold    time.Duration `hcl:"-"`
+
+	// BatchSize is the number of keys a snapshot counts and updates, or
+	// deletes, at a time. Keys are streamed from redis, so this bounds the
+	// memory used by a snapshot instead of the number of keys.
+	BatchSize int `hcl:"batch_size"`
+
+	// LockTTL is how long the snapshot lock is held before it expires. The lock
+	// prevents concurrent snapshots by the server cron and the snapshot command,
+	// and expires in case a snapshot crashes without releasing it. A running
+	// snapshot renews the lock every third of the TTL, and is cancelled if lost.
+	LockTTLRaw string        `hcl:"lock_ttl"`
+	LockTTL    time.Duration `hcl:"-"`
+
+	// LeaderElection is used when multiple servers share redis, so that only
+	// the server holding the leader lock runs the snapshot cron. The leader
+	// renews the lock, and another server takes over if the lease expires.
+	LeaderElection bool `hcl:"leader_election"`
+
+	// LeaderLease is how long the leader lock is held without being renewed
+	LeaderLeaseRaw string        `hcl:"leader_lease"`
+	LeaderLease    time.Duration `hcl:"-"`
+
+	// ExpireBuffer enables a TTL on redis keys as a safety net if snapshots stop running.
+	// Keys expire this long after the delete threshold, so snapshots still own deletion
+	// normally. Disabled if not specified.
+	ExpireBufferRaw string        `hcl:"expire_buffer"`
+	ExpireBuffer    time.Duration `hcl:"-"`
+
+	// StoreHLL persists the raw HyperLogLog registers alongside each counter.
+	// This allows accurate unique counts across attribute combinations to be
+	// computed by merging, at the cost of roughly 12KB of storage per counter.
+	StoreHLL bool `hcl:"store_hll"`
+
+	// WeeklyFromDaily derives the weekly counters by merging the daily
+	// HyperLogLogs of each week during the snapshot, instead of updating
+	// separate weekly keys on ingress. Exact weekly counters are not affected.
+	// The DeleteThreshold must keep at least 7 days of daily keys.
+	WeeklyFromDaily bool `hcl:"weekly_from_daily"`
+
+	// AccuracySample is the fraction of HyperLogLog counters that are also
+	// counted exactly, so the estimation error can be monitored. The samples
+	// are recorded in the counter_accuracy table. Disabled if zero.
+	AccuracySample float64 `hcl:"accuracy_sample"`
+
+	// PruneDomain removes the domain values that are no longer referenced
+	// by any counter after each snapshot. This scans the counters table,
+	// so it is disabled by default.
+	PruneDomain bool `hcl:"prune_domain"`
+
+	// Incremental tracks the keys updated since the last snapshot in redis,
+	// so the server's snapshots only count the changed keys instead of
+	// scanning every key. This adds a command to every key update.
+	Incremental bool `hcl:"incremental"`
+
+	// FullInterval is how often an incremental snapshot scans every key
+	// anyway, to delete the expired keys and retry failed counters.
+	FullIntervalRaw string        `hcl:"full_interval"`
+	FullInterval    time.Duration `hcl:"-"`
+
+	// TrackUpdates records when each key was last updated in redis, so the
+	// server's snapshots skip the keys that have not changed since the
+	// previous snapshot. This adds a command to every key update.
+	TrackUpdates bool `hcl:"track_updates"`
+}
+
+// idHashes are the supported algorithms for hashing event IDs
+var idHashes = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// HashID returns the hex encoded hash of an event ID using the configured
+// algorithm and salt. The ID is returned unchanged if hashing is disabled
+// or the ID is blank.
+func (c *IngressConfig) HashID(id string) string {
+	if c == nil || c.IDHash == "" || id == "" {
+		return id
+	}
+	var h hash.Hash
+	if c.IDSalt != "" {
+		h = hmac.New(idHashes[c.IDHash], []byte(c.IDSalt))
+	} else {
+		h = idHashes[c.IDHash]()
+	}
+	h.Write([]byte(id))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// UpdateThresholds returns the update thresholds of each interval
+// relative to now
+func (c *SnapshotConfig) UpdateThresholds(now time.Time) UpdateThresholds {
+	out := UpdateThresholds{Default: now.Add(-1 * c.UpdateThreshold)}
+	for interval, dur := range c.IntervalUpdateThresholds {
+		if out.Intervals == nil {
+			out.Intervals = make(map[string]time.Time, len(c.IntervalUpdateThresholds))
+		}
+		out.Intervals[interval] = now.Add(-1 * dur)
+	}
+	return out
+}
+
+// maxBodySize returns the limit on the size of ingress request bodies
+func (c *IngressConfig) maxBodySize() int64 {
+	if c == nil || c.MaxBodySize <= 0 {
+		return DefaultMaxBodySize
+	}
+	return c.MaxBodySize
+}
+
+// maxKeys returns the limit on the number of keys an event can update
+func (c *IngressConfig) maxKeys() int {
+	if c == nil || c.MaxKeys <= 0 {
+		return DefaultMaxKeys
+	}
+	return c.MaxKeys
+}
+
+// sampleRate returns the fraction of events that are counted
+func (c *IngressConfig) sampleRate() float64 {
+	if c == nil || c.SampleRate <= 0 {
+		return 1
+	}
+	return c.SampleRate
+}
+
+// Sampled checks if an event with the ID is counted. Events without an ID
+// are sampled at random.
+func (c *IngressConfig) Sampled(id string) bool {
+	rate := c.sampleRate()
+	if rate >= 1 {
+		return true
+	}
+	if id == "" {
+		return rand.Float64() < rate
+	}
+	return SampledID(id, rate)
 }
 
 // DefaultConfig returns the default configuration
@@ -87,18 +707,66 @@ func DefaultConfig() *Config {
 		ListenAddress: "127.0.0.1:8001",
 		RedisAddress:  "127.0.0.1:6379",
 		PGAddress:     "postgres://postgres@localhost/postgres?sslmode=disable",
+		Timezone:      time.UTC,
+		Intervals:     AllIntervals,
 		Snapshot: &SnapshotConfig{
+			CronTimezone:    time.UTC,
+			BatchSize:       DefaultSnapshotBatchSize,
+			LockTTL:         DefaultLockTTL,
+			LeaderLease:     DefaultLeaderLease,
 			UpdateThreshold: DefaultUpdateThreshold,
 			DeleteThreshold: DefaultDeleteThreshold,
+			FullInterval:    DefaultFullSnapshotInterval,
 		},
 		Auth: &AuthConfig{
 			Required: false,
 			Tokens:   []string{},
 		},
 		Attributes: &AttributeConfig{
-			Whitelist: []string{},
-			Blacklist: []string{},
+			Whitelist:      []string{},
+			Blacklist:      []string{},
+			Null:           NullAttribute,
+			MaxKeyLength:   DefaultMaxKeyLength,
+			MaxValueLength: DefaultMaxValueLength,
+			KeyFormat:      KeyFormatV1,
+		},
+		Tracing: &TracingConfig{
+			ServiceName: "counterd",
+		},
+		Exact: &ExactConfig{
+			Intervals:  []string{},
+			Attributes: []string{},
+		},
+		Ingress: &IngressConfig{
+			MaxFuture:        DefaultMaxFuture,
+			MaxBodySize:      DefaultMaxBodySize,
+			MaxKeys:          DefaultMaxKeys,
+			DedupSize:        DefaultDedupSize,
+			QueueWorkers:     DefaultQueueWorkers,
+			BreakerThreshold: DefaultBreakerThreshold,
+			BreakerCooldown:  DefaultBreakerCooldown,
+		},
+		Database: &DatabaseConfig{
+			TransactionSize:  TransactionSizeLimit,
+			ConnectTimeout:   DefaultConnectTimeout,
+			ConflictStrategy: ConflictGreatest,
+		},
+		Redis: &RedisConfig{
+			FlushSize:        DefaultFlushSize,
+			KeyCountInterval: DefaultKeyCountInterval,
+			MemoryInterval:   DefaultMemoryInterval,
+		},
+		TLS: &TLSConfig{
+			MinVersion: tls.VersionTLS12,
 		},
+		HTTP: &HTTPConfig{
+			ReadHeaderTimeout: DefaultReadHeaderTimeout,
+			ReadTimeout:       DefaultReadTimeout,
+			WriteTimeout:      DefaultWriteTimeout,
+			IdleTimeout:       DefaultIdleTimeout,
+			Root:              RootStatus,
+		},
+		PGTLS: &PGTLSConfig{},
 	}
 
 	// Check for environment variables
@@ -111,13 +779,32 @@ func DefaultConfig() *Config {
 	if raw := os.Getenv("PG_URL"); raw != "" {
 		defConf.PGAddress = raw
 	}
+	if raw := os.Getenv("PG_READ_URL"); raw != "" {
+		defConf.PGReadAddress = raw
+	}
 	if raw := os.Getenv("ACL_TOKEN"); raw != "" {
 		defConf.Auth.Required = true
 		defConf.Auth.Tokens = []string{raw}
 	}
+	if raw := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); raw != "" {
+		defConf.Tracing.OTLPEndpoint = raw
+	}
 	return defConf
 }
 
+// parsePositiveDuration parses a duration option that must be positive,
+// naming the option in the error
+func parsePositiveDuration(raw, name string) (time.Duration, error) {
+	dur, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse duration: %v", err)
+	}
+	if dur <= 0 {
+		return 0, fmt.Errorf("%s must be positive", name)
+	}
+	return dur, nil
+}
+
 // ParseConfig is used to parse the configuration
 func ParseConfig(raw string) (*Config, error) {
 	config := DefaultConfig()
@@ -127,6 +814,165 @@ func ParseConfig(raw string) (*Config, error) {
 		return nil, fmt.Errorf("failed to parse config: %v", err)
 	}
 
+	if raw := config.SocketModeRaw; raw != "" {
+		mode, err := strconv.ParseUint(raw, 8, 32)
+		if err != nil || mode > 0777 {
+			return nil, fmt.Errorf("invalid socket mode %q", raw)
+		}
+		config.SocketMode = os.FileMode(mode)
+	}
+
+	if raw := config.TLS.MinVersionRaw; raw != "" {
+		version, err := ParseTLSVersion(raw)
+		if err != nil {
+			return nil, err
+		}
+		config.TLS.MinVersion = version
+	}
+	if config.TLS.MinVersion == 0 {
+		config.TLS.MinVersion = tls.VersionTLS12
+	}
+	if (config.TLS.CertFile == "") != (config.TLS.KeyFile == "") {
+		return nil, fmt.Errorf("tls cert_file and key_file must both be set")
+	}
+
+	if raw := config.HTTP.ReadHeaderTimeoutRaw; raw != "" {
+		dur, err := parsePositiveDuration(raw, "http read header timeout")
+		if err != nil {
+			return nil, err
+		}
+		config.HTTP.ReadHeaderTimeout = dur
+	}
+	if raw := config.HTTP.ReadTimeoutRaw; raw != "" {
+		dur, err := parsePositiveDuration(raw, "http read timeout")
+		if err != nil {
+			return nil, err
+		}
+		config.HTTP.ReadTimeout = dur
+	}
+	if raw := config.HTTP.WriteTimeoutRaw; raw != "" {
+		dur, err := parsePositiveDuration(raw, "http write timeout")
+		if err != nil {
+			return nil, err
+		}
+		config.HTTP.WriteTimeout = dur
+	}
+	if raw := config.HTTP.IdleTimeoutRaw; raw != "" {
+		dur, err := parsePositiveDuration(raw, "http idle timeout")
+		if err != nil {
+			return nil, err
+		}
+		config.HTTP.IdleTimeout = dur
+	}
+	if raw := config.HTTP.DomainCacheTTLRaw; raw != "" {
+		dur, err := parsePositiveDuration(raw, "http domain cache ttl")
+		if err != nil {
+			return nil, err
+		}
+		config.HTTP.DomainCacheTTL = dur
+	}
+	if raw := config.Redis.KeyCountIntervalRaw; raw != "" {
+		dur, err := parsePositiveDuration(raw, "redis key count interval")
+		if err != nil {
+			return nil, err
+		}
+		config.Redis.KeyCountInterval = dur
+	}
+	if raw := config.Redis.MemoryIntervalRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse duration: %v", err)
+		}
+		if dur < time.Second {
+			return nil, fmt.Errorf("redis memory interval must be at least one second")
+		}
+		config.Redis.MemoryInterval = dur
+	}
+
+	switch config.PGTLS.SSLMode {
+	case "", "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		return nil, fmt.Errorf("invalid postgresql sslmode %q", config.PGTLS.SSLMode)
+	}
+	if (config.PGTLS.CertFile == "") != (config.PGTLS.KeyFile == "") {
+		return nil, fmt.Errorf("postgresql_tls cert_file and key_file must both be set")
+	}
+	for _, path := range []string{config.PGTLS.RootCert, config.PGTLS.CertFile, config.PGTLS.KeyFile} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("failed to read postgresql_tls file: %v", err)
+		}
+	}
+	if !IsMemoryAddress(config.PGAddress) {
+		pgAddr, err := PGConnString(config.PGAddress, config.PGTLS)
+		if err != nil {
+			return nil, fmt.Errorf("invalid postgresql address: %v", err)
+		}
+		config.PGAddress = pgAddr
+	}
+	if config.PGReadAddress != "" {
+		pgAddr, err := PGConnString(config.PGReadAddress, config.PGTLS)
+		if err != nil {
+			return nil, fmt.Errorf("invalid postgresql read address: %v", err)
+		}
+		config.PGReadAddress = pgAddr
+	}
+
+	if raw := config.TimezoneRaw; raw != "" {
+		loc, err := time.LoadLocation(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load timezone: %v", err)
+		}
+		config.Timezone = loc
+	}
+
+	if c := config.CustomInterval; c != nil {
+		anchor, err := time.Parse(time.RFC3339, c.AnchorRaw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid custom interval anchor: %v", err)
+		}
+		c.Anchor = anchor.UTC()
+		dur, err := time.ParseDuration(c.DurationRaw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse duration: %v", err)
+		}
+		if dur < time.Second {
+			return nil, fmt.Errorf("custom interval duration must be at least one second")
+		}
+		c.Duration = dur
+		config.Intervals |= CustomInterval
+	}
+	if config.IntervalsRaw != nil {
+		intervals, err := ParseIntervals(config.IntervalsRaw)
+		if err != nil {
+			return nil, err
+		}
+		config.Intervals = intervals
+	}
+	if config.Intervals&CustomInterval != 0 && config.CustomInterval == nil {
+		return nil, fmt.Errorf("the custom interval requires a custom_interval block")
+	}
+	if config.Snapshot.WeeklyFromDaily && config.Intervals&(DayInterval|WeekInterval) != DayInterval|WeekInterval {
+		return nil, fmt.Errorf("weekly from daily requires the day and week intervals")
+	}
+	if config.Exact != nil {
+		for _, interval := range config.Exact.Intervals {
+			if config.Intervals&IntervalBits[interval] == 0 {
+				return nil, fmt.Errorf("exact interval %q is not enabled", interval)
+			}
+		}
+	}
+
+	if raw := config.Snapshot.CronTimezoneRaw; raw != "" {
+		loc, err := time.LoadLocation(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load cron timezone: %v", err)
+		}
+		config.Snapshot.CronTimezone = loc
+	}
+
 	if raw := config.Snapshot.UpdateThresholdRaw; raw != "" {
 		dur, err := time.ParseDuration(raw)
 		if err != nil {
@@ -134,6 +980,19 @@ func ParseConfig(raw string) (*Config, error) {
 		}
 		config.Snapshot.UpdateThreshold = dur
 	}
+	for interval, raw := range config.Snapshot.IntervalUpdateThresholdsRaw {
+		if _, ok := IntervalBits[interval]; !ok {
+			return nil, fmt.Errorf("invalid interval %q for update threshold", interval)
+		}
+		dur, err := parsePositiveDuration(raw, "update threshold")
+		if err != nil {
+			return nil, err
+		}
+		if config.Snapshot.IntervalUpdateThresholds == nil {
+			config.Snapshot.IntervalUpdateThresholds = make(map[string]time.Duration)
+		}
+		config.Snapshot.IntervalUpdateThresholds[interval] = dur
+	}
 	if raw := config.Snapshot.DeleteThresholdRaw; raw != "" {
 		dur, err := time.ParseDuration(raw)
 		if err != nil {
@@ -141,14 +1000,293 @@ func ParseConfig(raw string) (*Config, error) {
 		}
 		config.Snapshot.DeleteThreshold = dur
 	}
+	if raw := config.Snapshot.FullIntervalRaw; raw != "" {
+		dur, err := parsePositiveDuration(raw, "full interval")
+		if err != nil {
+			return nil, err
+		}
+		config.Snapshot.FullInterval = dur
+	}
+	if raw := config.Snapshot.LockTTLRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse duration: %v", err)
+		}
+		if dur < time.Second {
+			return nil, fmt.Errorf("lock ttl must be at least one second")
+		}
+		config.Snapshot.LockTTL = dur
+	}
+	if raw := config.Snapshot.LeaderLeaseRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse duration: %v", err)
+		}
+		if dur < time.Second {
+			return nil, fmt.Errorf("leader lease must be at least one second")
+		}
+		config.Snapshot.LeaderLease = dur
+	}
+	if raw := config.Database.StatementTimeoutRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse duration: %v", err)
+		}
+		if dur < 0 {
+			return nil, fmt.Errorf("statement timeout must be positive")
+		}
+		config.Database.StatementTimeout = dur
+	}
+	if raw := config.Database.ConnectTimeoutRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse duration: %v", err)
+		}
+		if dur < 0 {
+			return nil, fmt.Errorf("connect timeout must be positive")
+		}
+		config.Database.ConnectTimeout = dur
+	}
+	if raw := config.Snapshot.ExpireBufferRaw; raw != "" {
+		dur, err := parsePositiveDuration(raw, "expire buffer")
+		if err != nil {
+			return nil, err
+		}
+		config.Snapshot.ExpireBuffer = dur
+	}
+	if s := config.Snapshot.AccuracySample; s < 0 || s > 1 {
+		return nil, fmt.Errorf("accuracy sample must be between 0 and 1")
+	}
+	if s := config.Ingress.SampleRate; s < 0 || s > 1 {
+		return nil, fmt.Errorf("sample rate must be between 0 and 1")
+	}
+	if alg := config.Ingress.IDHash; alg != "" {
+		if _, ok := idHashes[alg]; !ok {
+			return nil, fmt.Errorf("unsupported ID hash %q", alg)
+		}
+	} else if config.Ingress.IDSalt != "" {
+		return nil, fmt.Errorf("ID salt requires an ID hash")
+	}
+	if config.Ingress.DeriveID && config.Ingress.Increments {
+		return nil, fmt.Errorf("derive ID and increments cannot both be enabled")
+	}
+
+	if raw := config.Ingress.MaxFutureRaw; raw == "-1" {
+		config.Ingress.MaxFuture = -1
+	} else if raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse duration: %v", err)
+		}
+		if dur <= 0 {
+			dur = -1
+		}
+		config.Ingress.MaxFuture = dur
+	}
+
+	if raw := config.Ingress.DedupWindowRaw; raw != "" {
+		dur, err := parsePositiveDuration(raw, "dedup window")
+		if err != nil {
+			return nil, err
+		}
+		config.Ingress.DedupWindow = dur
+	}
+
+	if raw := config.Ingress.BreakerCooldownRaw; raw != "" {
+		dur, err := parsePositiveDuration(raw, "breaker cooldown")
+		if err != nil {
+			return nil, err
+		}
+		config.Ingress.BreakerCooldown = dur
+	}
 
 	// Ensure defaults are provided
+	if config.HTTP.ReadHeaderTimeout == 0 {
+		config.HTTP.ReadHeaderTimeout = DefaultReadHeaderTimeout
+	}
+	if config.HTTP.ReadTimeout == 0 {
+		config.HTTP.ReadTimeout = DefaultReadTimeout
+	}
+	if config.HTTP.WriteTimeout == 0 {
+		config.HTTP.WriteTimeout = DefaultWriteTimeout
+	}
+	if config.HTTP.IdleTimeout == 0 {
+		config.HTTP.IdleTimeout = DefaultIdleTimeout
+	}
+	switch config.HTTP.Root {
+	case "":
+		config.HTTP.Root = RootStatus
+	case RootStatus, RootRedirect, RootNotFound:
+	default:
+		return nil, fmt.Errorf("http root must be %q, %q or %q", RootStatus, RootRedirect, RootNotFound)
+	}
+	if config.Redis.KeyCountInterval == 0 {
+		config.Redis.KeyCountInterval = DefaultKeyCountInterval
+	}
+	if config.Redis.MemoryInterval == 0 {
+		config.Redis.MemoryInterval = DefaultMemoryInterval
+	}
 	if config.Snapshot.UpdateThreshold == 0 {
 		config.Snapshot.UpdateThreshold = DefaultUpdateThreshold
 	}
 	if config.Snapshot.DeleteThreshold == 0 {
 		config.Snapshot.DeleteThreshold = DefaultDeleteThreshold
 	}
+	// Counters would be deleted while they are still being updated otherwise
+	if config.Snapshot.UpdateThreshold >= config.Snapshot.DeleteThreshold {
+		return nil, fmt.Errorf("update threshold must be below the delete threshold")
+	}
+	for interval, dur := range config.Snapshot.IntervalUpdateThresholds {
+		if dur >= config.Snapshot.DeleteThreshold {
+			return nil, fmt.Errorf("update threshold of interval %q must be below the delete threshold", interval)
+		}
+	}
+	if config.Snapshot.WeeklyFromDaily && config.Snapshot.DeleteThreshold < 7*24*time.Hour {
+		return nil, fmt.Errorf("weekly from daily requires a delete threshold of at least 7 days")
+	}
+	if config.Snapshot.FullInterval == 0 {
+		config.Snapshot.FullInterval = DefaultFullSnapshotInterval
+	}
+	if config.Snapshot.BatchSize == 0 {
+		config.Snapshot.BatchSize = DefaultSnapshotBatchSize
+	}
+	if config.Snapshot.BatchSize < 0 {
+		return nil, fmt.Errorf("snapshot batch size must be positive")
+	}
+	if config.Snapshot.LockTTL == 0 {
+		config.Snapshot.LockTTL = DefaultLockTTL
+	}
+	if config.Snapshot.LeaderLease == 0 {
+		config.Snapshot.LeaderLease = DefaultLeaderLease
+	}
+	if config.Snapshot.CronTimezone == nil {
+		config.Snapshot.CronTimezone = time.UTC
+	}
+	if config.Tracing.ServiceName == "" {
+		config.Tracing.ServiceName = "counterd"
+	}
+	if config.Ingress.MaxFuture == 0 {
+		config.Ingress.MaxFuture = DefaultMaxFuture
+	}
+	if config.Ingress.MaxBodySize == 0 {
+		config.Ingress.MaxBodySize = DefaultMaxBodySize
+	}
+	if config.Ingress.MaxBodySize < 0 {
+		return nil, fmt.Errorf("max body size must be positive")
+	}
+	if config.Ingress.MaxKeys == 0 {
+		config.Ingress.MaxKeys = DefaultMaxKeys
+	}
+	if config.Ingress.MaxKeys < 0 {
+		return nil, fmt.Errorf("max keys must be positive")
+	}
+	if config.Ingress.QueueSize < 0 {
+		return nil, fmt.Errorf("queue size must not be negative")
+	}
+	if config.Ingress.QueueWorkers == 0 {
+		config.Ingress.QueueWorkers = DefaultQueueWorkers
+	}
+	if config.Ingress.QueueWorkers < 0 {
+		return nil, fmt.Errorf("queue workers must be positive")
+	}
+	if config.Ingress.BreakerThreshold == 0 {
+		config.Ingress.BreakerThreshold = DefaultBreakerThreshold
+	}
+	if config.Ingress.BreakerThreshold < 0 {
+		return nil, fmt.Errorf("breaker threshold must be positive")
+	}
+	if config.Ingress.BreakerCooldown == 0 {
+		config.Ingress.BreakerCooldown = DefaultBreakerCooldown
+	}
+	if config.Ingress.DedupSize == 0 {
+		config.Ingress.DedupSize = DefaultDedupSize
+	}
+	if config.Ingress.DedupSize < 0 {
+		return nil, fmt.Errorf("dedup size must be positive")
+	}
+	if config.Database.TransactionSize == 0 {
+		config.Database.TransactionSize = TransactionSizeLimit
+	}
+	if config.Database.TransactionSize < 0 {
+		return nil, fmt.Errorf("transaction size must be positive")
+	}
+	switch config.Database.ConflictStrategy {
+	case "":
+		config.Database.ConflictStrategy = ConflictGreatest
+	case ConflictGreatest, ConflictLatest:
+	case ConflictSum:
+		return nil, fmt.Errorf("database conflict strategy %q is only supported by the import -conflict flag", ConflictSum)
+	default:
+		return nil, fmt.Errorf("database conflict strategy must be %q or %q", ConflictGreatest, ConflictLatest)
+	}
+	if config.Attributes.Null == "" {
+		config.Attributes.Null = NullAttribute
+	}
+	if strings.Contains(config.Attributes.Null, KeySeperator) {
+		return nil, fmt.Errorf("null attribute must not contain a colon")
+	}
+	if sortedContains(ReservedAttributes, config.Attributes.Null) {
+		return nil, fmt.Errorf("null attribute %q is reserved", config.Attributes.Null)
+	}
+	if config.Attributes.MaxKeyLength == 0 {
+		config.Attributes.MaxKeyLength = DefaultMaxKeyLength
+	}
+	if config.Attributes.MaxKeyLength < 0 {
+		return nil, fmt.Errorf("max key length must be positive")
+	}
+	if config.Attributes.MaxValueLength == 0 {
+		config.Attributes.MaxValueLength = DefaultMaxValueLength
+	}
+	if config.Attributes.MaxValueLength < 0 {
+		return nil, fmt.Errorf("max value length must be positive")
+	}
+	switch config.Attributes.KeyFormat {
+	case "":
+		config.Attributes.KeyFormat = KeyFormatV1
+	case KeyFormatV1, KeyFormatV2:
+	default:
+		return nil, fmt.Errorf("key format must be %q or %q", KeyFormatV1, KeyFormatV2)
+	}
+	for key, value := range config.Attributes.DefaultAttributes {
+		if strings.Contains(key, KeySeperator) || strings.Contains(value, KeySeperator) {
+			return nil, fmt.Errorf("default attribute %q must not contain a colon", key)
+		}
+		if sortedContains(ReservedAttributes, key) {
+			return nil, fmt.Errorf("default attribute %q is reserved", key)
+		}
+	}
+	for alias, canonical := range config.Attributes.Aliases {
+		if strings.Contains(canonical, KeySeperator) {
+			return nil, fmt.Errorf("alias %q must not contain a colon", canonical)
+		}
+		if sortedContains(ReservedAttributes, canonical) {
+			return nil, fmt.Errorf("alias %q is reserved", canonical)
+		}
+		if _, ok := config.Attributes.Aliases[canonical]; ok && canonical != alias {
+			return nil, fmt.Errorf("alias %q of %q is itself aliased", canonical, alias)
+		}
+	}
+	if config.Redis.FlushSize == 0 {
+		config.Redis.FlushSize = DefaultFlushSize
+	}
+	if config.Redis.FlushSize < 0 {
+		return nil, fmt.Errorf("flush size must be positive")
+	}
+	if config.Redis.HybridThreshold < 0 {
+		return nil, fmt.Errorf("redis hybrid threshold must not be negative")
+	}
+	if config.Redis.KeyBudget < 0 {
+		return nil, fmt.Errorf("redis key budget must not be negative")
+	}
+	if config.Redis.KeyBudget > 0 && config.Ingress.QueueSize > 0 {
+		return nil, fmt.Errorf("redis key budget cannot be combined with an ingress queue")
+	}
+	if config.Redis.MemorySample < 0 {
+		return nil, fmt.Errorf("redis memory sample must not be negative")
+	}
+	if config.Ingress.RejectExpired {
+		config.Ingress.MaxPast = config.Snapshot.DeleteThreshold
+	}
 
 	// Sort the attribute whitelist and blacklist
 	if config.Attributes != nil && config.Attributes.Whitelist != nil {
@@ -157,5 +1295,37 @@ func ParseConfig(raw string) (*Config, error) {
 	if config.Attributes != nil && config.Attributes.Blacklist != nil {
 		sort.Strings(config.Attributes.Blacklist)
 	}
+
+	// Sort the exact intervals and attributes
+	if config.Exact != nil && config.Exact.Intervals != nil {
+		sort.Strings(config.Exact.Intervals)
+	}
+	if config.Exact != nil && config.Exact.Attributes != nil {
+		sort.Strings(config.Exact.Attributes)
+	}
 	return config, nil
 }
+
+// passwordParam matches the password of a key/value connection string
+var passwordParam = regexp.MustCompile(`(?i)(password\s*=\s*)('[^']*'|\S+)`)
+
+// RedactAddress removes any password from a connection address so that
+// it is safe to log. URLs and key/value connection strings are supported.
+func RedactAddress(addr string) string {
+	if strings.Contains(addr, "://") {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return "<unparseable address>"
+		}
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "redacted")
+		}
+		q := u.Query()
+		if q.Get("password") != "" {
+			q.Set("password", "redacted")
+			u.RawQuery = q.Encode()
+		}
+		return u.String()
+	}
+	return passwordParam.ReplaceAllString(addr, "${1}redacted")
+}
@@ -1,86 +1,246 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
 	"os"
-	"reflect"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	hclog "github.com/hashicorp/go-hclog"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 )
 
-type MockCounter struct {
-	interval   string
-	date       time.Time
-	attributes map[string]string
-	count      int64
+// MockDatabaseClient is the in-memory database, used as the test double
+type MockDatabaseClient = MemoryDatabase
+
+// MockCounter is a counter stored by the in-memory database
+type MockCounter = memoryCounter
+
+func NewMockDatabaseClient() *MockDatabaseClient {
+	return NewMemoryDatabase()
 }
 
-func (m *MockCounter) Equal(other *MockCounter) bool {
-	return m.interval == other.interval && m.date == other.date && reflect.DeepEqual(m.attributes, other.attributes)
+// FakeSQLDB is an in-memory database/sql driver that records the
+// arguments of every statement executed in a committed transaction
+type FakeSQLDB struct {
+	l         sync.Mutex
+	commits   int
+	committed [][][]driver.Value
+	queries   int
+	prepared  []string
+
+	// FailCommit causes the Nth commit to fail if set
+	FailCommit int
+
+	// FailValue causes any statement with the argument to fail if set
+	FailValue driver.Value
+
+	// Delay causes every statement to wait before executing if set
+	Delay time.Duration
 }
 
-type MockDatabaseClient struct {
-	domain   map[string]map[string]struct{}
-	counters []*MockCounter
-	sync.Mutex
+// NewFakePGDatabase returns a PGDatabase backed by a FakeSQLDB
+func NewFakePGDatabase(t *testing.T) (*PGDatabase, *FakeSQLDB) {
+	fake := &FakeSQLDB{}
+	pg := newPGDatabase(hclog.Default(), sql.OpenDB(fake))
+	assert.Nil(t, pg.Prepare())
+	return pg, fake
 }
 
-func NewMockDatabaseClient() *MockDatabaseClient {
-	return &MockDatabaseClient{
-		domain: make(map[string]map[string]struct{}),
+// Committed returns the executed arguments of each committed transaction
+func (f *FakeSQLDB) Committed() [][][]driver.Value {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return f.committed
+}
+
+func (f *FakeSQLDB) Connect(ctx context.Context) (driver.Conn, error) {
+	return &fakeSQLConn{db: f}, nil
+}
+
+func (f *FakeSQLDB) Driver() driver.Driver {
+	return nil
+}
+
+type fakeSQLConn struct {
+	db      *FakeSQLDB
+	pending [][]driver.Value
+}
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	c.db.l.Lock()
+	c.db.prepared = append(c.db.prepared, query)
+	c.db.l.Unlock()
+	return &fakeSQLStmt{conn: c}, nil
+}
+
+func (c *fakeSQLConn) Close() error {
+	return nil
+}
+
+func (c *fakeSQLConn) Begin() (driver.Tx, error) {
+	c.pending = nil
+	return c, nil
+}
+
+func (c *fakeSQLConn) Commit() error {
+	c.db.l.Lock()
+	defer c.db.l.Unlock()
+	c.db.commits++
+	if c.db.commits == c.db.FailCommit {
+		c.pending = nil
+		return fmt.Errorf("commit failed")
 	}
+	c.db.committed = append(c.db.committed, c.pending)
+	c.pending = nil
+	return nil
 }
 
-func (m *MockDatabaseClient) UpsertDomain(attributes map[string]map[string]struct{}) error {
-	m.Lock()
-	defer m.Unlock()
+func (c *fakeSQLConn) Rollback() error {
+	c.pending = nil
+	return nil
+}
 
-	// Merge the new attributes with the existing ones
-	for key, values := range attributes {
-		existing, ok := m.domain[key]
-		if !ok {
-			m.domain[key] = values
-			continue
+type fakeSQLStmt struct {
+	conn *fakeSQLConn
+}
+
+func (s *fakeSQLStmt) Close() error {
+	return nil
+}
+
+func (s *fakeSQLStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeSQLStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if s.conn.db.Delay > 0 {
+		select {
+		case <-time.After(s.conn.db.Delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
-		for value := range values {
-			existing[value] = struct{}{}
+	}
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return s.Exec(values)
+}
+
+func (s *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	for _, arg := range args {
+		if s.conn.db.FailValue != nil && arg == s.conn.db.FailValue {
+			return nil, fmt.Errorf("invalid value %v", arg)
 		}
 	}
-	return nil
+	s.conn.pending = append(s.conn.pending, args)
+	return driver.RowsAffected(1), nil
 }
 
-func (m *MockDatabaseClient) UpsertCounters(counters []*ParsedKey) error {
-	m.Lock()
-	defer m.Unlock()
-
-OUTER:
-	for _, counter := range counters {
-		// Create a counter
-		c := &MockCounter{
-			interval:   counter.Interval,
-			date:       counter.Date,
-			attributes: counter.Attributes,
-			count:      counter.Count,
-		}
-
-		// Scan for a matching counter. This is super inefficient but obviously correct.
-		for _, existing := range m.counters {
-			if existing.Equal(c) {
-				// Update the counter, but only monotonically
-				if c.count > existing.count {
-					existing.count = c.count
-				}
-				continue OUTER
-			}
+func (s *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.conn.db.l.Lock()
+	s.conn.db.queries++
+	s.conn.db.l.Unlock()
+	return nil, fmt.Errorf("query not supported")
+}
+
+func TestQueryCountersSQL(t *testing.T) {
+	filter := &QueryFilter{
+		Interval: "day",
+		From:     time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+		Attributes: map[string][]string{
+			"plan":    {"paid"},
+			"country": {"ca", "us"},
+		},
+	}
+	query, args := QueryCountersSQL(filter)
+	assert.Equal(t, "SELECT date, round(sum(count / sample_rate))::bigint, min(first_seen), max(last_updated) FROM counters WHERE interval = $1 AND kind = $2 AND date >= $3 AND "+
+		"attributes->>$4 = ANY($5) AND attributes->>$6 = ANY($7) GROUP BY date ORDER BY date;", query)
+	assert.Equal(t, 7, len(args))
+	assert.Equal(t, CounterKindUnique, args[1])
+	assert.Equal(t, "country", args[3])
+	assert.Equal(t, pq.Array([]string{"ca", "us"}), args[4])
+	assert.Equal(t, "plan", args[5])
+
+	// Only the interval is required, and unique counters are the default
+	query, args = QueryCountersSQL(&QueryFilter{Interval: "week"})
+	assert.Equal(t, "SELECT date, round(sum(count / sample_rate))::bigint, min(first_seen), max(last_updated) FROM counters WHERE interval = $1 AND kind = $2 GROUP BY date ORDER BY date;", query)
+	assert.Equal(t, []interface{}{"week", CounterKindUnique}, args)
+
+	_, args = QueryCountersSQL(&QueryFilter{Interval: "week", Kind: CounterKindEvents})
+	assert.Equal(t, []interface{}{"week", CounterKindEvents}, args)
+}
+
+func TestNewPGDatabaseFromConfig(t *testing.T) {
+	config := DefaultConfig().Database
+	config.TransactionSize = 16
+	config.IsolateFailures = true
+	config.HashAttributes = true
+	config.ConflictStrategy = ConflictLatest
+	config.ConnectTimeout = 0
+
+	// The connection is not used until the queries are prepared
+	pg, err := NewPGDatabaseFromConfig(hclog.Default(), "postgres://localhost/counterd", "", config, false)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, 16, pg.transactionSize)
+	assert.True(t, pg.isolateFailures)
+	assert.True(t, pg.hashAttributes)
+	assert.Equal(t, ConflictLatest, pg.conflictStrategy)
+}
+
+func TestPGDatabase_UpsertDomain_Chunks(t *testing.T) {
+	db, fake := NewFakePGDatabase(t)
+
+	// Build a domain large enough to span many transactions
+	domain := make(map[string]map[string]struct{})
+	for i := 0; i < 5000; i++ {
+		attr := fmt.Sprintf("attr%d", i%7)
+		if domain[attr] == nil {
+			domain[attr] = make(map[string]struct{})
 		}
+		domain[attr][fmt.Sprintf("value%d", i)] = struct{}{}
+	}
+	assert.Nil(t, db.UpsertDomain(context.Background(), domain))
 
-		// No matching entry
-		m.counters = append(m.counters, c)
+	// Check the chunk boundaries and that nothing was inserted twice
+	committed := fake.Committed()
+	assert.Equal(t, (5000+TransactionSizeLimit-1)/TransactionSizeLimit, len(committed))
+	seen := make(map[string]struct{})
+	for i, tx := range committed {
+		if i < len(committed)-1 {
+			assert.Equal(t, TransactionSizeLimit, len(tx))
+		}
+		for _, args := range tx {
+			pair := fmt.Sprintf("%v:%v", args[0], args[1])
+			if _, ok := seen[pair]; ok {
+				t.Fatalf("duplicate insert: %s", pair)
+			}
+			seen[pair] = struct{}{}
+		}
 	}
-	return nil
+	assert.Equal(t, 5000, len(seen))
+
+	// Every committed pair is cached, so a redundant upsert is a no-op
+	assert.Nil(t, db.UpsertDomain(context.Background(), domain))
+	assert.Equal(t, len(committed), len(fake.Committed()))
+
+	// Only the new value should be inserted
+	domain["attr0"]["new"] = struct{}{}
+	assert.Nil(t, db.UpsertDomain(context.Background(), domain))
+	committed = fake.Committed()
+	last := committed[len(committed)-1]
+	assert.Equal(t, [][]driver.Value{{"attr0", "new"}}, last)
 }
 
 // IsDBInteg checks for the INTEG and PG_ADDR env vars
@@ -99,10 +259,10 @@ func TestPGInit(t *testing.T) {
 		t.SkipNow()
 	}
 
-	db, err := NewPGDatabase(hclog.Default(), pgAddr, false)
+	db, err := NewPGDatabase(hclog.Default(), pgAddr, "", false, 0)
 	assert.Nil(t, err)
-	defer db.DBReset()
-	assert.Nil(t, db.DBInit())
+	defer db.DBReset(context.Background())
+	assert.Nil(t, db.DBInit(context.Background()))
 }
 
 func TestPGInit_UpsertDomain(t *testing.T) {
@@ -112,10 +272,10 @@ func TestPGInit_UpsertDomain(t *testing.T) {
 	}
 
 	// Setup and then prepare
-	db, err := NewPGDatabase(hclog.Default(), pgAddr, false)
+	db, err := NewPGDatabase(hclog.Default(), pgAddr, "", false, 0)
 	assert.Nil(t, err)
-	//defer db.DBReset()
-	assert.Nil(t, db.DBInit())
+	//defer db.DBReset(context.Background())
+	assert.Nil(t, db.DBInit(context.Background()))
 	assert.Nil(t, db.Prepare())
 
 	// Attempt to upsert the domain
@@ -128,12 +288,25 @@ func TestPGInit_UpsertDomain(t *testing.T) {
 			"zap": struct{}{},
 		},
 	}
-	err = db.UpsertDomain(domain)
+	err = db.UpsertDomain(context.Background(), domain)
 	assert.Nil(t, err)
 
 	// Test redundant insert
-	err = db.UpsertDomain(domain)
+	err = db.UpsertDomain(context.Background(), domain)
 	assert.Nil(t, err)
+
+	// Count the values
+	counts, err := db.DomainCounts(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int64{"foo": 2, "zip": 1}, counts)
+
+	// Page through the values
+	values, err := db.ListDomain(context.Background(), "foo", "", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"bar"}, values)
+	values, err = db.ListDomain(context.Background(), "foo", "bar", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"baz"}, values)
 }
 
 func TestPGInit_UpsertCounters(t *testing.T) {
@@ -143,26 +316,644 @@ func TestPGInit_UpsertCounters(t *testing.T) {
 	}
 
 	// Setup and then prepare
-	db, err := NewPGDatabase(hclog.Default(), pgAddr, false)
+	db, err := NewPGDatabase(hclog.Default(), pgAddr, "", false, 0)
 	assert.Nil(t, err)
-	//defer db.DBReset()
-	assert.Nil(t, db.DBInit())
+	//defer db.DBReset(context.Background())
+	assert.Nil(t, db.DBInit(context.Background()))
 	assert.Nil(t, db.Prepare())
 
 	// Setup some fake counters
-	p1, _ := ParseKey("day:2017-01-18:foo:bar")
+	p1, _ := ParseKey("day:2017-01-18:foo:bar", nil)
 	p1.Count = 10
-	p2, _ := ParseKey("day:2017-01-10:foo:baz")
+	p2, _ := ParseKey("day:2017-01-10:foo:baz", nil)
 	p2.Count = 20
-	p3, _ := ParseKey("day:2017-01-01:zip:zap")
+	p3, _ := ParseKey("day:2017-01-01:zip:zap", nil)
 	p3.Count = 30
 	counters := []*ParsedKey{p1, p2, p3}
 
 	// Attempt to upsert the counters
-	err = db.UpsertCounters(counters)
+	err = db.UpsertCounters(context.Background(), counters)
 	assert.Nil(t, err)
 
 	// Test redundant insert
-	err = db.UpsertCounters(counters)
+	err = db.UpsertCounters(context.Background(), counters)
+	assert.Nil(t, err)
+
+	// Stream back the counters in range
+	from := time.Date(2017, 1, 5, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2017, 1, 31, 0, 0, 0, 0, time.UTC)
+	iter, err := db.StreamCounters(context.Background(), "day", from, to)
+	assert.Nil(t, err)
+	defer iter.Close()
+
+	var out []*ParsedKey
+	for {
+		c, err := iter.Next()
+		assert.Nil(t, err)
+		if c == nil {
+			break
+		}
+		out = append(out, c)
+	}
+	assert.Equal(t, 2, len(out))
+}
+
+func TestPGDatabase_UpsertDomain_CommitFailure(t *testing.T) {
+	db, fake := NewFakePGDatabase(t)
+	fake.FailCommit = 1
+
+	domain := map[string]map[string]struct{}{
+		"foo": map[string]struct{}{
+			"bar": struct{}{},
+		},
+	}
+	assert.NotNil(t, db.UpsertDomain(context.Background(), domain))
+	assert.Equal(t, 0, len(fake.Committed()))
+	assert.Equal(t, 0, db.attrCache.Len())
+
+	// Retrying should insert the value again
+	assert.Nil(t, db.UpsertDomain(context.Background(), domain))
+	assert.Equal(t, 1, len(fake.Committed()))
+	assert.Equal(t, 1, db.attrCache.Len())
+}
+
+func TestPGDatabase_UpsertCounters_CommitFailure(t *testing.T) {
+	db, fake := NewFakePGDatabase(t)
+	fake.FailCommit = 1
+
+	p1, _ := ParseKey("day:2017-01-18:foo:bar", nil)
+	p1.Count = 10
+	counters := []*ParsedKey{p1}
+	assert.NotNil(t, db.UpsertCounters(context.Background(), counters))
+	assert.Equal(t, 0, len(fake.Committed()))
+	assert.Equal(t, 0, db.counterCache.Len())
+
+	// Retrying should upsert the counter again
+	assert.Nil(t, db.UpsertCounters(context.Background(), counters))
+	assert.Equal(t, 1, len(fake.Committed()))
+	assert.Equal(t, 1, db.counterCache.Len())
+}
+
+func TestPGDatabase_UpsertCounters_CacheHLL(t *testing.T) {
+	db, fake := NewFakePGDatabase(t)
+	ctx := context.Background()
+
+	p1, _ := ParseKey("day:2017-01-18:foo:bar", nil)
+	p1.Count = 10
+	p1.HLL = []byte("first")
+	assert.Nil(t, db.UpsertCounters(ctx, []*ParsedKey{p1}))
+	assert.Equal(t, 1, len(fake.Committed()))
+
+	// An unchanged counter is skipped
+	assert.Nil(t, db.UpsertCounters(ctx, []*ParsedKey{p1}))
+	assert.Equal(t, 1, len(fake.Committed()))
+
+	// The HyperLogLog can change without changing the count
+	p1.HLL = []byte("second")
+	assert.Nil(t, db.UpsertCounters(ctx, []*ParsedKey{p1}))
+	assert.Equal(t, 2, len(fake.Committed()))
+
+	// So can the sample rate
+	p1.SampleRate = 0.5
+	assert.Nil(t, db.UpsertCounters(ctx, []*ParsedKey{p1}))
+	assert.Equal(t, 3, len(fake.Committed()))
+}
+
+func TestPGDatabase_HashAttributes(t *testing.T) {
+	db, fake := NewFakePGDatabase(t)
+	greatest := conflictCountSQL[ConflictGreatest]
+	assert.Contains(t, fake.prepared, fmt.Sprintf(upsertCounterSQL, greatest))
+	assert.NotContains(t, fake.prepared, fmt.Sprintf(upsertCounterHashSQL, greatest))
+
+	// The hash is computed by the database, so the arguments are unchanged
+	db.hashAttributes = true
+	assert.Nil(t, db.Prepare())
+	assert.Contains(t, fake.prepared, fmt.Sprintf(upsertCounterHashSQL, greatest))
+
+	p1, _ := ParseKey("day:2017-01-18:foo:bar", nil)
+	p1.Count = 10
+	assert.Nil(t, db.UpsertCounters(context.Background(), []*ParsedKey{p1}))
+	committed := fake.Committed()
+	if assert.Equal(t, 1, len(committed)) {
+		assert.Equal(t, 8, len(committed[0][0]))
+		assert.Equal(t, []byte(`{"foo":"bar"}`), committed[0][0][2])
+	}
+}
+
+func TestPGInit_HashAttributes(t *testing.T) {
+	pgAddr, integ := IsDBInteg()
+	if !integ {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+
+	// Write a counter before hashing, which must be backfilled
+	db, err := NewPGDatabase(hclog.Default(), pgAddr, "", false, 0)
 	assert.Nil(t, err)
+	defer db.DBReset(ctx)
+	assert.Nil(t, db.DBReset(ctx))
+	assert.Nil(t, db.DBInit(ctx))
+	assert.Nil(t, db.Prepare())
+
+	p1, _ := ParseKey("day:2017-01-18:foo:bar:zip:zap", nil)
+	p1.Count = 10
+	assert.Nil(t, db.UpsertCounters(ctx, []*ParsedKey{p1}))
+
+	// Switch to the hash, which updates the existing counter
+	db.hashAttributes = true
+	db.disableCache = true
+	assert.Nil(t, db.DBInit(ctx))
+	assert.Nil(t, db.Prepare())
+	p1.Count = 20
+	assert.Nil(t, db.UpsertCounters(ctx, []*ParsedKey{p1}))
+
+	c, err := db.GetCounter(ctx, "day", p1.Date, p1.Attributes)
+	assert.Nil(t, err)
+	if assert.NotNil(t, c) {
+		assert.Equal(t, int64(20), c.Count)
+	}
+	var rows int
+	assert.Nil(t, db.db.QueryRow(`SELECT count(*) FROM counters`).Scan(&rows))
+	assert.Equal(t, 1, rows)
+}
+
+func TestPGDatabase_ConflictStrategy(t *testing.T) {
+	db, fake := NewFakePGDatabase(t)
+	for _, strategy := range []string{ConflictLatest, ConflictSum} {
+		db.conflictStrategy = strategy
+		assert.Nil(t, db.Prepare())
+		assert.Contains(t, fake.prepared, fmt.Sprintf(upsertCounterSQL, conflictCountSQL[strategy]))
+	}
+	assert.Contains(t, fake.prepared[len(fake.prepared)-1], "count = EXCLUDED.count + counters.count")
+}
+
+func TestPGInit_ConflictStrategy(t *testing.T) {
+	pgAddr, integ := IsDBInteg()
+	if !integ {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+
+	type tcase struct {
+		Strategy string
+		Hash     bool
+		Expect   int64
+	}
+	cases := []tcase{
+		{ConflictGreatest, false, 20},
+		{ConflictLatest, false, 5},
+		{ConflictSum, false, 35},
+		{ConflictGreatest, true, 20},
+		{ConflictLatest, true, 5},
+		{ConflictSum, true, 35},
+	}
+	for _, tc := range cases {
+		db, err := NewPGDatabase(hclog.Default(), pgAddr, "", false, 0)
+		if !assert.Nil(t, err) {
+			return
+		}
+		db.hashAttributes = tc.Hash
+		db.conflictStrategy = tc.Strategy
+		db.disableCache = true
+		assert.Nil(t, db.DBReset(ctx))
+		assert.Nil(t, db.DBInit(ctx))
+		assert.Nil(t, db.Prepare())
+
+		// Upsert a growing and then shrinking count
+		p1, _ := ParseKey("day:2017-01-18:foo:bar", nil)
+		for _, count := range []int64{10, 20, 5} {
+			p1.Count = count
+			assert.Nil(t, db.UpsertCounters(ctx, []*ParsedKey{p1}))
+		}
+
+		c, err := db.GetCounter(ctx, "day", p1.Date, p1.Attributes)
+		assert.Nil(t, err)
+		if assert.NotNil(t, c, tc.Strategy) {
+			assert.Equal(t, tc.Expect, c.Count, tc.Strategy)
+		}
+		assert.Nil(t, db.DBReset(ctx))
+	}
+}
+
+func TestPGInit_SeenTimes(t *testing.T) {
+	pgAddr, integ := IsDBInteg()
+	if !integ {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+
+	db, err := NewPGDatabase(hclog.Default(), pgAddr, "", false, 0)
+	assert.Nil(t, err)
+	defer db.DBReset(ctx)
+	assert.Nil(t, db.DBReset(ctx))
+	assert.Nil(t, db.DBInit(ctx))
+	assert.Nil(t, db.Prepare())
+
+	p1, _ := ParseKey("day:2017-01-18:foo:bar", nil)
+	p1.Count = 10
+	assert.Nil(t, db.UpsertCounters(ctx, []*ParsedKey{p1}))
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, db.UpsertCounters(ctx, []*ParsedKey{p1}))
+
+	// First seen is set on insert, and last updated on every upsert
+	iter, err := db.QueryCounters(ctx, &QueryFilter{Interval: "day"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer iter.Close()
+	res, err := iter.Next()
+	assert.Nil(t, err)
+	if assert.NotNil(t, res) {
+		assert.False(t, res.FirstSeen.IsZero())
+		assert.True(t, res.FirstSeen.Before(res.LastUpdated))
+	}
+}
+
+func TestPGInit_CounterKinds(t *testing.T) {
+	pgAddr, integ := IsDBInteg()
+	if !integ {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+
+	for _, hash := range []bool{false, true} {
+		db, err := NewPGDatabase(hclog.Default(), pgAddr, "", false, 0)
+		if !assert.Nil(t, err) {
+			return
+		}
+		db.hashAttributes = hash
+		assert.Nil(t, db.DBReset(ctx))
+		assert.Nil(t, db.DBInit(ctx))
+		assert.Nil(t, db.Prepare())
+
+		// A unique and an event counter with the same attributes
+		p1, _ := ParseKey("day:2017-01-18:foo:bar", nil)
+		p1.Count = 10
+		p2, _ := ParseKey("incr:day:2017-01-18:foo:bar", nil)
+		p2.Count = 25
+		assert.Nil(t, db.UpsertCounters(ctx, []*ParsedKey{p1, p2}))
+
+		for kind, expect := range map[string]int64{CounterKindUnique: 10, CounterKindEvents: 25} {
+			iter, err := db.QueryCounters(ctx, &QueryFilter{Interval: "day", Kind: kind})
+			if !assert.Nil(t, err) {
+				return
+			}
+			results, err := CollectQueryResults(iter)
+			assert.Nil(t, err)
+			if assert.Equal(t, 1, len(results), kind) {
+				assert.Equal(t, expect, results[0].Count, kind)
+			}
+		}
+		c, err := db.GetCounter(ctx, "day", p1.Date, p1.Attributes)
+		assert.Nil(t, err)
+		if assert.NotNil(t, c) {
+			assert.Equal(t, int64(10), c.Count)
+		}
+		assert.Nil(t, db.DBReset(ctx))
+	}
+}
+
+func TestPGDatabase_StatementTimeout(t *testing.T) {
+	db, fake := NewFakePGDatabase(t)
+	fake.Delay = time.Second
+	db.statementTimeout = 10 * time.Millisecond
+
+	p1, _ := ParseKey("day:2017-01-18:foo:bar", nil)
+	p1.Count = 10
+	counters := []*ParsedKey{p1}
+	start := time.Now()
+	err := db.UpsertCounters(context.Background(), counters)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < fake.Delay)
+	assert.Equal(t, 0, len(fake.Committed()))
+	assert.Equal(t, 0, db.counterCache.Len())
+
+	domain := map[string]map[string]struct{}{
+		"foo": map[string]struct{}{
+			"bar": struct{}{},
+		},
+	}
+	assert.Equal(t, context.DeadlineExceeded, db.UpsertDomain(context.Background(), domain))
+	assert.Equal(t, 0, db.attrCache.Len())
+
+	// Fast statements are not affected
+	fake.Delay = time.Millisecond
+	assert.Nil(t, db.UpsertCounters(context.Background(), counters))
+	assert.Nil(t, db.UpsertDomain(context.Background(), domain))
+	assert.Equal(t, 2, len(fake.Committed()))
+}
+
+func TestPGDatabase_ReadReplica(t *testing.T) {
+	db, primary := NewFakePGDatabase(t)
+	replica := &FakeSQLDB{}
+	db.readDB = sql.OpenDB(replica)
+	ctx := context.Background()
+
+	// Reads use the replica
+	db.DomainCounts(ctx)
+	db.QueryCounters(ctx, &QueryFilter{Interval: "day"})
+	db.TopValues(ctx, CounterKindUnique, "day", time.Now(), "foo", 10)
+	assert.Equal(t, 0, primary.queries)
+	assert.Equal(t, 3, replica.queries)
+
+	// Writes use the primary
+	p1, _ := ParseKey("day:2017-01-18:foo:bar", nil)
+	assert.Nil(t, db.UpsertCounters(ctx, []*ParsedKey{p1}))
+	assert.Equal(t, 1, len(primary.Committed()))
+	assert.Equal(t, 0, len(replica.Committed()))
+}
+
+func TestPGDatabase_UpsertCounters_IsolateFailures(t *testing.T) {
+	db, fake := NewFakePGDatabase(t)
+	fake.FailValue = "bad"
+
+	p1, _ := ParseKey("day:2017-01-18:foo:bar", nil)
+	p2, _ := ParseKey("day:2017-01-18:foo:baz", nil)
+	p2.Interval = "bad"
+	p3, _ := ParseKey("day:2017-01-18:zip:zap", nil)
+	counters := []*ParsedKey{p1, p2, p3}
+
+	// Without isolation the chunk fails
+	assert.NotNil(t, db.UpsertCounters(context.Background(), counters))
+	assert.Equal(t, 0, len(fake.Committed()))
+
+	// The bad counter is isolated and the others are upserted
+	db.isolateFailures = true
+	err := db.UpsertCounters(context.Background(), counters)
+	var deadErr *DeadLetterError
+	assert.True(t, errors.As(err, &deadErr))
+	assert.Equal(t, []*ParsedKey{p2}, deadErr.Counters)
+	assert.Equal(t, 2, len(fake.Committed()))
+	assert.Equal(t, 2, db.counterCache.Len())
+
+	// If every counter fails, the error is returned
+	err = db.UpsertCounters(context.Background(), []*ParsedKey{p2})
+	assert.NotNil(t, err)
+	assert.False(t, errors.As(err, &deadErr))
+}
+
+func TestPGInit_UpsertCounters_Rollback(t *testing.T) {
+	pgAddr, integ := IsDBInteg()
+	if !integ {
+		t.SkipNow()
+	}
+
+	// Setup and then prepare
+	db, err := NewPGDatabase(hclog.Default(), pgAddr, "", false, 0)
+	assert.Nil(t, err)
+	defer db.DBReset(context.Background())
+	assert.Nil(t, db.DBInit(context.Background()))
+	assert.Nil(t, db.Prepare())
+
+	// The second counter has an interval too long for the table
+	p1, _ := ParseKey("day:2017-01-18:foo:bar", nil)
+	p1.Count = 10
+	p2, _ := ParseKey("day:2017-01-18:foo:bar", nil)
+	p2.Interval = "abcdefghijklmnopqrstuvwxyz"
+	p2.Count = 20
+	err = db.UpsertCounters(context.Background(), []*ParsedKey{p1, p2})
+	assert.NotNil(t, err)
+
+	// The connection should be released without an open transaction
+	assert.Equal(t, 0, db.PoolStats().InUse)
+	var open int
+	err = db.db.QueryRow(`SELECT count(*) FROM pg_stat_activity WHERE datname = current_database() AND state LIKE 'idle in transaction%'`).Scan(&open)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, open)
+
+	// The valid counter in the chunk should be rolled back
+	from := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2017, 1, 31, 0, 0, 0, 0, time.UTC)
+	iter, err := db.StreamCounters(context.Background(), "day", from, to)
+	assert.Nil(t, err)
+	defer iter.Close()
+	c, err := iter.Next()
+	assert.Nil(t, err)
+	assert.Nil(t, c)
+}
+
+func TestPGDatabase_TransactionSize(t *testing.T) {
+	db, fake := NewFakePGDatabase(t)
+	db.transactionSize = 3
+
+	var counters []*ParsedKey
+	for i := 1; i <= 7; i++ {
+		p, _ := ParseKey(fmt.Sprintf("day:2017-01-%02d:foo:bar", i), nil)
+		p.Count = int64(i)
+		counters = append(counters, p)
+	}
+	assert.Nil(t, db.UpsertCounters(context.Background(), counters))
+
+	var sizes []int
+	for _, tx := range fake.Committed() {
+		sizes = append(sizes, len(tx))
+	}
+	assert.Equal(t, []int{3, 3, 1}, sizes)
+}
+
+func TestPGDatabase_DisableCache(t *testing.T) {
+	db, fake := NewFakePGDatabase(t)
+	db.disableCache = true
+
+	domain := map[string]map[string]struct{}{
+		"foo": map[string]struct{}{
+			"bar": struct{}{},
+		},
+	}
+	p1, _ := ParseKey("day:2017-01-18:foo:bar", nil)
+	p1.Count = 10
+	counters := []*ParsedKey{p1}
+
+	// Every upsert should be written without using the caches
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, db.UpsertDomain(context.Background(), domain))
+		assert.Nil(t, db.UpsertCounters(context.Background(), counters))
+	}
+	assert.Equal(t, 4, len(fake.Committed()))
+	assert.Equal(t, 0, db.attrCache.Len())
+	assert.Equal(t, 0, db.counterCache.Len())
+	assert.Equal(t, CacheStats{}, db.CacheStats())
+}
+
+func TestPGDatabase_CacheStats(t *testing.T) {
+	db, fake := NewFakePGDatabase(t)
+
+	domain := map[string]map[string]struct{}{
+		"foo": map[string]struct{}{
+			"bar": struct{}{},
+		},
+	}
+	p1, _ := ParseKey("day:2017-01-18:foo:bar", nil)
+	p1.Count = 10
+	counters := []*ParsedKey{p1}
+
+	// The second upsert should hit the caches
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, db.UpsertDomain(context.Background(), domain))
+		assert.Nil(t, db.UpsertCounters(context.Background(), counters))
+	}
+	assert.Equal(t, 2, len(fake.Committed()))
+	assert.Equal(t, CacheStats{
+		AttributeHits:   1,
+		AttributeMisses: 1,
+		CounterHits:     1,
+		CounterMisses:   1,
+	}, db.CacheStats())
+}
+
+func TestPGDatabase_UpsertCounters_RetryFailedChunk(t *testing.T) {
+	db, fake := NewFakePGDatabase(t)
+	db.transactionSize = 2
+	fake.FailCommit = 2
+
+	var counters []*ParsedKey
+	for i := 1; i <= 5; i++ {
+		p, _ := ParseKey(fmt.Sprintf("day:2017-01-%02d:foo:bar", i), nil)
+		p.Count = int64(i)
+		counters = append(counters, p)
+	}
+
+	// The second chunk fails, so only the first is cached
+	assert.NotNil(t, db.UpsertCounters(context.Background(), counters))
+	assert.Equal(t, 1, len(fake.Committed()))
+	assert.Equal(t, 2, db.counterCache.Len())
+
+	// The next snapshot should retry everything after the first chunk
+	assert.Nil(t, db.UpsertCounters(context.Background(), counters))
+	committed := fake.Committed()
+	assert.Equal(t, 3, len(committed))
+
+	var retried []int64
+	for _, tx := range committed[1:] {
+		for _, args := range tx {
+			retried = append(retried, args[3].(int64))
+		}
+	}
+	assert.Equal(t, []int64{3, 4, 5}, retried)
+	assert.Equal(t, 5, db.counterCache.Len())
+}
+
+func TestConfirmReset(t *testing.T) {
+	type tcase struct {
+		input  string
+		expect bool
+	}
+	tcases := []tcase{
+		{"yes\n", true},
+		{"  yes  \n", true},
+		{"yes", true},
+		{"y\n", false},
+		{"YES\n", false},
+		{"\n", false},
+		{"", false},
+	}
+	for _, tc := range tcases {
+		var out strings.Builder
+		assert.Equal(t, tc.expect, ConfirmReset(strings.NewReader(tc.input), &out, "postgres://localhost"), tc.input)
+		assert.Contains(t, out.String(), "postgres://localhost")
+	}
+}
+
+func TestPGConnString(t *testing.T) {
+	type tcase struct {
+		conn   string
+		conf   *PGTLSConfig
+		expect string
+	}
+	cases := []tcase{
+		{"postgres://localhost/db?sslmode=disable", nil, "postgres://localhost/db?sslmode=disable"},
+		{"postgres://localhost/db?sslmode=disable", &PGTLSConfig{}, "postgres://localhost/db?sslmode=disable"},
+		{
+			"postgres://localhost/db?sslmode=disable",
+			&PGTLSConfig{SSLMode: "require"},
+			"postgres://localhost/db?sslmode=require",
+		},
+		{
+			"postgresql://u:p@localhost:5432/db?connect_timeout=5",
+			&PGTLSConfig{SSLMode: "verify-full", RootCert: "/ca.pem", CertFile: "/cert.pem", KeyFile: "/key.pem"},
+			"postgresql://u:p@localhost:5432/db?connect_timeout=5&sslcert=%2Fcert.pem&sslkey=%2Fkey.pem&sslmode=verify-full&sslrootcert=%2Fca.pem",
+		},
+		{
+			"host=localhost dbname=db sslmode=disable",
+			&PGTLSConfig{SSLMode: "verify-ca", RootCert: `/my certs/it's.pem`},
+			`host=localhost dbname=db sslmode=disable sslmode='verify-ca' sslrootcert='/my certs/it\'s.pem'`,
+		},
+		{"", &PGTLSConfig{SSLMode: "require"}, "sslmode='require'"},
+	}
+	for _, tc := range cases {
+		out, err := PGConnString(tc.conn, tc.conf)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.expect, out)
+	}
+}
+
+func TestRetryConnect(t *testing.T) {
+	// Succeeds once the database is reachable
+	var attempts int
+	err := retryConnect(hclog.Default(), time.Second, func() error {
+		attempts++
+		if attempts < 3 {
+			return fmt.Errorf("connection refused")
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, attempts)
+
+	// Gives up after the timeout
+	attempts = 0
+	start := time.Now()
+	err = retryConnect(hclog.Default(), 500*time.Millisecond, func() error {
+		attempts++
+		return fmt.Errorf("connection refused")
+	})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "connection refused")
+	assert.Equal(t, 2, attempts)
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+}
+
+// benchmarkUpsertCounters upserts a set of counters with many attributes,
+// resolving the conflicts on the jsonb or the hash of the attributes
+func benchmarkUpsertCounters(b *testing.B, hash bool) {
+	pgAddr, integ := IsDBInteg()
+	if !integ {
+		b.SkipNow()
+	}
+	ctx := context.Background()
+	db, err := NewPGDatabase(hclog.Default(), pgAddr, "", false, 0)
+	assert.Nil(b, err)
+	defer db.DBReset(ctx)
+	assert.Nil(b, db.DBReset(ctx))
+	db.hashAttributes = hash
+	db.disableCache = true
+	assert.Nil(b, db.DBInit(ctx))
+	assert.Nil(b, db.Prepare())
+
+	counters := make([]*ParsedKey, 1000)
+	for i := range counters {
+		attrs := make(map[string]string)
+		for j := 0; j < 16; j++ {
+			attrs["attribute"+strconv.Itoa(j)] = "value-" + strconv.Itoa(i*j)
+		}
+		counters[i] = &ParsedKey{
+			Interval:   "day",
+			Date:       time.Date(2017, 1, 18, 0, 0, 0, 0, time.UTC),
+			Attributes: attrs,
+			Count:      int64(i),
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		assert.Nil(b, db.UpsertCounters(ctx, counters))
+	}
+}
+
+func BenchmarkPG_UpsertCounters(b *testing.B) {
+	benchmarkUpsertCounters(b, false)
+}
+
+func BenchmarkPG_UpsertCountersHash(b *testing.B) {
+	benchmarkUpsertCounters(b, true)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"strings"
@@ -47,15 +48,15 @@ func (s *DBInitCommand) Run(args []string) int {
 	}
 
 	// Attempt to connect to the database
-	hclog.Default().Info("Connecting to postgresql", "addr", config.PGAddress)
-	pg, err := NewPGDatabase(hclog.Default().Named("postgresql"), config.PGAddress, false)
+	hclog.Default().Info("Connecting to postgresql", "addr", RedactAddress(config.PGAddress))
+	pg, err := NewPGDatabaseFromConfig(hclog.Default().Named("postgresql"), config.PGAddress, "", config.Database, false)
 	if err != nil {
 		hclog.Default().Error("Failed to setup database connection", "error", err)
 		return 1
 	}
 
 	// Attempt to initialize
-	if err := pg.DBInit(); err != nil {
+	if err := pg.DBInit(context.Background()); err != nil {
 		hclog.Default().Error("Failed to initialize database", "error", err)
 		return 1
 	}
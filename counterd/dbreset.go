@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+type DBResetCommand struct{}
+
+func (s *DBResetCommand) Help() string {
+	helpText := `
+Usage: counterd dbreset <config> [flags]
+
+	dbreset is used to drop the tables created by dbinit, deleting all the
+	stored counters and domain values. This cannot be undone. Unless the
+	-yes flag is given, confirmation is read from stdin.
+	The path to the configuration file must be provided.
+
+Options:
+
+	-yes	Skips the confirmation prompt.
+	`
+	return strings.TrimSpace(helpText)
+}
+
+func (s *DBResetCommand) Synopsis() string {
+	return "dbreset drops the database tables"
+}
+
+func (s *DBResetCommand) Run(args []string) int {
+	// Check that we got at least the config argument
+	if len(args) < 1 {
+		fmt.Println(s.Help())
+		return 1
+	}
+	filename := args[0]
+
+	var yes bool
+	flags := flag.NewFlagSet("dbreset", flag.ContinueOnError)
+	flags.BoolVar(&yes, "yes", false, "")
+	flags.Usage = func() { fmt.Println(s.Help()) }
+	if err := flags.Parse(args[1:]); err != nil {
+		return 1
+	}
+
+	// Attempt to parse the config
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		hclog.Default().Error("Failed to load configuration file", "file", filename, "error", err)
+		return 1
+	}
+
+	// Parse the config
+	config, err := ParseConfig(string(raw))
+	if err != nil {
+		hclog.Default().Error("Failed to parse configuration file", "error", err)
+		return 1
+	}
+
+	// Confirm before dropping anything
+	if !yes && !ConfirmReset(os.Stdin, os.Stdout, config.PGAddress) {
+		hclog.Default().Info("Database reset aborted")
+		return 1
+	}
+
+	// Attempt to connect to the database
+	hclog.Default().Info("Connecting to postgresql", "addr", RedactAddress(config.PGAddress))
+	pg, err := NewPGDatabase(hclog.Default().Named("postgresql"), config.PGAddress, "", false, config.Database.ConnectTimeout)
+	if err != nil {
+		hclog.Default().Error("Failed to setup database connection", "error", err)
+		return 1
+	}
+
+	// Attempt to reset
+	if err := pg.DBReset(context.Background()); err != nil {
+		hclog.Default().Error("Failed to reset database", "error", err)
+		return 1
+	}
+	hclog.Default().Info("Database reset")
+	return 0
+}
+
+// ConfirmReset prompts for confirmation of a reset, returning true
+// only if the response is exactly "yes"
+func ConfirmReset(in io.Reader, out io.Writer, addr string) bool {
+	fmt.Fprintf(out, "This will drop all counterd tables in %s.\n", addr)
+	fmt.Fprint(out, "Type 'yes' to confirm: ")
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false
+	}
+	return strings.TrimSpace(line) == "yes"
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+const (
+	// DefaultDedupSize is the default number of recent event IDs
+	// tracked if no setting is specified
+	DefaultDedupSize = 64 * 1024
+)
+
+// RecentIDs tracks recently ingested events, so that replays can be
+// dropped before updating redis. Events are tracked by their DedupKey. This is only an optimization since the
+// HyperLogLogs would count the ID once anyways. All the methods are safe
+// to call concurrently, and on a nil RecentIDs.
+type RecentIDs struct {
+	cache  *lru.Cache
+	window time.Duration
+}
+
+// NewRecentIDs creates a RecentIDs tracking up to size IDs for the window
+func NewRecentIDs(size int, window time.Duration) (*RecentIDs, error) {
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &RecentIDs{cache: cache, window: window}, nil
+}
+
+// DedupKey returns the key an event is tracked by, which is the ID with a
+// hash of the counter keys it updates. Events from the same ID with other
+// attributes or dates have other keys, so they are not dropped as replays.
+// Events without an ID have a blank key.
+func DedupKey(id string, keys []string) string {
+	if id == "" {
+		return ""
+	}
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	h := sha256.New()
+	for _, key := range sorted {
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+	}
+	return id + ":" + hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// Seen checks if the ID was added within the window before now.
+// Events without an ID are never deduplicated.
+func (r *RecentIDs) Seen(id string, now time.Time) bool {
+	if r == nil || id == "" {
+		return false
+	}
+	raw, ok := r.cache.Get(id)
+	if !ok {
+		return false
+	}
+	return now.Sub(raw.(time.Time)) < r.window
+}
+
+// Add records that the ID was ingested at the given time
+func (r *RecentIDs) Add(id string, now time.Time) {
+	if r != nil && id != "" {
+		r.cache.Add(id, now)
+	}
+}
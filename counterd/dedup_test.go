@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecentIDs(t *testing.T) {
+	recent, err := NewRecentIDs(2, time.Minute)
+	assert.Nil(t, err)
+
+	now := time.Now()
+	assert.False(t, recent.Seen("a", now))
+	recent.Add("a", now)
+	assert.True(t, recent.Seen("a", now.Add(30*time.Second)))
+
+	// Expired once outside the window
+	assert.False(t, recent.Seen("a", now.Add(time.Minute)))
+
+	// The least recently used ID is evicted
+	recent.Add("b", now)
+	recent.Add("c", now)
+	assert.False(t, recent.Seen("a", now))
+	assert.True(t, recent.Seen("b", now))
+	assert.True(t, recent.Seen("c", now))
+
+	// Nil is always disabled
+	var disabled *RecentIDs
+	disabled.Add("a", now)
+	assert.False(t, disabled.Seen("a", now))
+}
+
+func TestAPI_Ingress_Dedup(t *testing.T) {
+	recent, err := NewRecentIDs(DefaultDedupSize, time.Minute)
+	assert.Nil(t, err)
+	stats := new(Stats)
+	mock := NewMockRedisClient()
+	api := &APIHandler{
+		logger:    hclog.Default().Named("api"),
+		client:    mock,
+		recentIDs: recent,
+		stats:     stats,
+	}
+	mux := NewHTTPHandler(api, nil)
+
+	// Replays of the first event should be dropped, while other events
+	// from the same ID are counted
+	inputs := []string{
+		`{"id": "1234", "attributes": {"foo": "bar"}}`,
+		`{"id": "1234", "attributes": {"foo": "bar"}}`,
+		`{"id": "1234", "attributes": {"foo": "baz"}}`,
+		`{"id": "1234", "attributes": {"foo": "bar"}}`,
+		`{"id": "5678", "attributes": {"foo": "bar"}}`,
+	}
+	for _, input := range inputs {
+		req := httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(input))
+		req.Header.Set("Content-Type", "application/json")
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		assert.Equal(t, 200, resp.Result().StatusCode)
+	}
+
+	out := stats.Response(mock, nil)
+	assert.Equal(t, uint64(3), out.Events.Ingested)
+	assert.Equal(t, uint64(2), out.Events.Duplicate)
+	var baz bool
+	for key := range mock.counters {
+		if strings.Contains(key, "baz") {
+			baz = true
+		}
+	}
+	assert.True(t, baz)
+}
+
+func TestDedupKey(t *testing.T) {
+	key := DedupKey("1234", []string{"a", "b"})
+	assert.True(t, strings.HasPrefix(key, "1234:"))
+	assert.Equal(t, key, DedupKey("1234", []string{"b", "a"}))
+	assert.NotEqual(t, key, DedupKey("1234", []string{"a", "c"}))
+	assert.NotEqual(t, key, DedupKey("5678", []string{"a", "b"}))
+	assert.Equal(t, "", DedupKey("", []string{"a", "b"}))
+}
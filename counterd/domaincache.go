@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// DomainCacheSize is the number of domain responses that are cached
+const DomainCacheSize = 1024
+
+// DomainCache caches the responses of the domain endpoints for a TTL, so
+// that polling them does not query the database each time. The domain only
+// changes when a snapshot writes new values, so the cache is purged after
+// each snapshot, including those run by other processes. A nil DomainCache
+// caches nothing.
+type DomainCache struct {
+	cache *lru.Cache
+	ttl   time.Duration
+
+	// purged is when the cache was last purged. Responses read from
+	// the database before then may be stale, so they are not added.
+	purged     time.Time
+	purgedLock sync.Mutex
+}
+
+// domainCacheEntry is a cached response and when it expires
+type domainCacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// domainCountsKey is the cache key of the domain counts
+type domainCountsKey struct{}
+
+// NewDomainCache creates a DomainCache of up to size responses that
+// are cached for the ttl
+func NewDomainCache(size int, ttl time.Duration) (*DomainCache, error) {
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &DomainCache{cache: cache, ttl: ttl}, nil
+}
+
+// Get returns the cached response for the key, if it has not expired by now
+func (d *DomainCache) Get(key interface{}, now time.Time) (interface{}, bool) {
+	if d == nil {
+		return nil, false
+	}
+	raw, ok := d.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	entry := raw.(domainCacheEntry)
+	if !now.Before(entry.expires) {
+		d.cache.Remove(key)
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// Add caches the response for the key, which was read from the database
+// at the given time. It is skipped if the cache was purged since.
+func (d *DomainCache) Add(key, value interface{}, now time.Time) {
+	if d == nil {
+		return
+	}
+	d.purgedLock.Lock()
+	defer d.purgedLock.Unlock()
+	if now.Before(d.purged) {
+		return
+	}
+	d.cache.Add(key, domainCacheEntry{value: value, expires: now.Add(d.ttl)})
+}
+
+// Purge removes every cached response, so the next requests read the
+// domain from the database
+func (d *DomainCache) Purge(now time.Time) {
+	if d == nil {
+		return
+	}
+	d.purgedLock.Lock()
+	defer d.purgedLock.Unlock()
+	d.purged = now
+	d.cache.Purge()
+}
+
+// Sync purges the cache if the domain was updated since the last purge,
+// e.g. by a snapshot in another process
+func (d *DomainCache) Sync(updated time.Time) {
+	if d == nil {
+		return
+	}
+	d.purgedLock.Lock()
+	purged := d.purged
+	d.purgedLock.Unlock()
+	if updated.After(purged) {
+		d.Purge(updated)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDomainCache(t *testing.T) {
+	cache, err := NewDomainCache(2, time.Minute)
+	assert.Nil(t, err)
+
+	now := time.Now()
+	_, ok := cache.Get("a", now)
+	assert.False(t, ok)
+	cache.Add("a", 1, now)
+	val, ok := cache.Get("a", now.Add(30*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, 1, val)
+
+	// Expired once the TTL has passed
+	_, ok = cache.Get("a", now.Add(time.Minute))
+	assert.False(t, ok)
+
+	// Purging removes everything, and responses read before the
+	// purge are not added since they may be stale
+	cache.Add("b", 2, now)
+	cache.Purge(now.Add(time.Second))
+	_, ok = cache.Get("b", now)
+	assert.False(t, ok)
+	cache.Add("c", 3, now)
+	_, ok = cache.Get("c", now)
+	assert.False(t, ok)
+	cache.Add("c", 3, now.Add(time.Second))
+	_, ok = cache.Get("c", now.Add(time.Second))
+	assert.True(t, ok)
+
+	// Nil is always disabled
+	var disabled *DomainCache
+	disabled.Add("a", 1, now)
+	disabled.Purge(now)
+	_, ok = disabled.Get("a", now)
+	assert.False(t, ok)
+}
+
+func TestAPI_Domain_Cache(t *testing.T) {
+	ctx := context.Background()
+	db := NewMockDatabaseClient()
+	assert.Nil(t, db.UpsertDomain(ctx, map[string]map[string]struct{}{
+		"country": {"us": struct{}{}},
+	}))
+
+	cache, err := NewDomainCache(DomainCacheSize, time.Minute)
+	assert.Nil(t, err)
+	redis := NewMockRedisClient()
+	api := &APIHandler{
+		logger:      hclog.Default().Named("api"),
+		client:      redis,
+		db:          db,
+		domainCache: cache,
+	}
+	mux := NewHTTPHandler(api, nil)
+
+	getValues := func() []string {
+		req := httptest.NewRequest("GET", "/v1/domain/country", nil)
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		assert.Equal(t, 200, resp.Result().StatusCode)
+		var out DomainResponse
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&out))
+		return out.Values
+	}
+	getCounts := func() map[string]int64 {
+		req := httptest.NewRequest("GET", "/v1/domain/counts", nil)
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		assert.Equal(t, 200, resp.Result().StatusCode)
+		var out map[string]int64
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&out))
+		return out
+	}
+	assert.Equal(t, []string{"us"}, getValues())
+	assert.Equal(t, map[string]int64{"country": 1}, getCounts())
+
+	// New values are not visible until the cache is purged
+	assert.Nil(t, db.UpsertDomain(ctx, map[string]map[string]struct{}{
+		"country": {"ca": struct{}{}},
+	}))
+	assert.Equal(t, []string{"us"}, getValues())
+	assert.Equal(t, map[string]int64{"country": 1}, getCounts())
+
+	cache.Purge(time.Now())
+	assert.Equal(t, []string{"ca", "us"}, getValues())
+	assert.Equal(t, map[string]int64{"country": 2}, getCounts())
+
+	// A snapshot by another process purges the cache through redis
+	assert.Nil(t, db.UpsertDomain(ctx, map[string]map[string]struct{}{
+		"country": {"mx": struct{}{}},
+	}))
+	assert.Equal(t, []string{"ca", "us"}, getValues())
+	assert.Nil(t, redis.SetDomainUpdated(ctx, time.Now()))
+	assert.Equal(t, []string{"ca", "mx", "us"}, getValues())
+	assert.Equal(t, map[string]int64{"country": 3}, getCounts())
+}
+
+func TestSnapshotter_PurgesDomainCache(t *testing.T) {
+	ctx := context.Background()
+	redis := NewMockRedisClient()
+	db := NewMockDatabaseClient()
+	cache, err := NewDomainCache(DomainCacheSize, time.Hour)
+	assert.Nil(t, err)
+
+	snap := &Snapshotter{
+		config:      DefaultConfig(),
+		logger:      hclog.Default(),
+		client:      redis,
+		db:          db,
+		domainCache: cache,
+	}
+
+	// Cache the empty domain before the snapshot
+	req := DomainRequest{Attribute: "foo", Limit: DefaultDomainLimit}
+	cache.Add(req, &DomainResponse{Values: []string{}}, time.Now())
+	_, ok := cache.Get(req, time.Now())
+	assert.True(t, ok)
+
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:bar"}, "1234"))
+	assert.Nil(t, snap.Run(ctx, time.Date(2017, 1, 18, 12, 0, 0, 0, time.UTC)))
+
+	// The snapshot wrote a new value, so the cached domain is purged,
+	// and the update is recorded for the other servers
+	_, ok = cache.Get(req, time.Now())
+	assert.False(t, ok)
+	updated, err := redis.GetDomainUpdated(ctx)
+	assert.Nil(t, err)
+	assert.False(t, updated.IsZero())
+	values, err := db.ListDomain(ctx, "foo", "", DefaultDomainLimit)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"bar"}, values)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+type ExportCommand struct{}
+
+func (e *ExportCommand) Help() string {
+	helpText := `
+Usage: counterd export <config> [flags]
+
+	export is used to dump the counters table for offline analysis or backups.
+	Rows are streamed from the database, so large tables can be exported.
+	Counts of sampled counters are scaled up by their sample rate.
+	The path to the configuration file must be provided.
+
+Options:
+
+	-interval	(Default: "day"). Configures the interval to export. Use "" for all intervals.
+
+	-from	Configures the starting range of the date interval. Defaults to the earliest counter.
+			Given in RFC3339 format, e.g. 2006-01-02T15:04:05Z.
+	-to		Configures the ending range of the date interval. Defaults to the latest counter.
+			Given in RFC3339 format, e.g. 2006-01-02T15:04:05Z.
+
+	-format	(Default: "csv"). Configures the output format, either "csv" or "json".
+			JSON output is newline delimited, with one counter per line.
+	-output	Configures a file to write to. Defaults to stdout.
+	`
+	return strings.TrimSpace(helpText)
+}
+
+func (e *ExportCommand) Synopsis() string {
+	return "Exports counters from the database"
+}
+
+func (e *ExportCommand) Run(args []string) int {
+	// Check that we got at least the config argument
+	if len(args) < 1 {
+		fmt.Println(e.Help())
+		return 1
+	}
+	filename := args[0]
+
+	var interval, fromDate, toDate, format, output string
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.StringVar(&interval, "interval", "day", "")
+	flags.StringVar(&fromDate, "from", "", "")
+	flags.StringVar(&toDate, "to", "", "")
+	flags.StringVar(&format, "format", "csv", "")
+	flags.StringVar(&output, "output", "", "")
+	flags.Usage = func() { fmt.Println(e.Help()) }
+	if err := flags.Parse(args[1:]); err != nil {
+		return 1
+	}
+
+	// Determine the date range, defaulting to everything
+	fromTime := time.Time{}
+	toTime := time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+	var err error
+	if fromDate != "" {
+		fromTime, err = time.Parse(time.RFC3339, fromDate)
+		if err != nil {
+			hclog.Default().Error("Failed to parse from date", "error", err)
+			return 1
+		}
+	}
+	if toDate != "" {
+		toTime, err = time.Parse(time.RFC3339, toDate)
+		if err != nil {
+			hclog.Default().Error("Failed to parse to date", "error", err)
+			return 1
+		}
+	}
+	if fromTime.After(toTime) {
+		hclog.Default().Error("From must be before the To time")
+		return 1
+	}
+
+	// Determine the writer for the format
+	var writeFn func(io.Writer, CounterIterator, *CustomIntervalConfig) (int, error)
+	switch format {
+	case "csv":
+		writeFn = WriteCountersCSV
+	case "json":
+		writeFn = WriteCountersJSON
+	default:
+		hclog.Default().Error("Unsupported export format", "format", format)
+		return 1
+	}
+
+	// Attempt to parse the config
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		hclog.Default().Error("Failed to load configuration file", "file", filename, "error", err)
+		return 1
+	}
+
+	// Parse the config
+	config, err := ParseConfig(string(raw))
+	if err != nil {
+		hclog.Default().Error("Failed to parse configuration file", "error", err)
+		return 1
+	}
+
+	// Attempt to connect to the database
+	hclog.Default().Info("Connecting to postgresql", "addr", RedactAddress(config.PGAddress))
+	if config.PGReadAddress != "" {
+		hclog.Default().Info("Using postgresql read replica", "addr", RedactAddress(config.PGReadAddress))
+	}
+	pg, err := NewPGDatabase(hclog.Default().Named("postgresql"), config.PGAddress, config.PGReadAddress, false, config.Database.ConnectTimeout)
+	if err != nil {
+		hclog.Default().Error("Failed to setup database connection", "error", err)
+		return 1
+	}
+
+	// Setup the output
+	var out io.Writer = os.Stdout
+	if output != "" {
+		fh, err := os.Create(output)
+		if err != nil {
+			hclog.Default().Error("Failed to create output file", "error", err)
+			return 1
+		}
+		defer fh.Close()
+		out = fh
+	}
+	buf := bufio.NewWriter(out)
+
+	// Stream the counters
+	iter, err := pg.StreamCounters(context.Background(), interval, fromTime, toTime)
+	if err != nil {
+		hclog.Default().Error("Failed to query counters", "error", err)
+		return 1
+	}
+	defer iter.Close()
+
+	n, err := writeFn(buf, iter, config.CustomInterval)
+	if err != nil {
+		hclog.Default().Error("Failed to export counters", "error", err)
+		return 1
+	}
+	if err := buf.Flush(); err != nil {
+		hclog.Default().Error("Failed to write output", "error", err)
+		return 1
+	}
+	hclog.Default().Info("Export complete", "counters", n)
+	return 0
+}
+
+// CounterRecord is the serialized form of a counter used for export and import
+type CounterRecord struct {
+	Interval   string            `json:"interval"`
+	Date       string            `json:"date"`
+	Attributes map[string]string `json:"attributes"`
+	Count      int64             `json:"count"`
+
+	// Kind is the kind of the counter, which is empty for unique counters
+	Kind string `json:"kind,omitempty"`
+}
+
+// NewCounterRecord converts a counter into a record, formatting the
+// date the same way as the counter keys
+func NewCounterRecord(c *ParsedKey, custom *CustomIntervalConfig) *CounterRecord {
+	date, ok := FormatIntervalDate(c.Interval, c.Date, custom)
+	if !ok {
+		date = c.Date.Format(time.RFC3339)
+	}
+	rec := &CounterRecord{
+		Interval:   c.Interval,
+		Date:       date,
+		Attributes: c.Attributes,
+		Count:      c.Count,
+	}
+	if c.Incr {
+		rec.Kind = CounterKindEvents
+	}
+	return rec
+}
+
+// WriteCountersCSV writes all the counters from the iterator as CSV,
+// with the attributes encoded as a JSON object. Returns the number of counters.
+func WriteCountersCSV(w io.Writer, iter CounterIterator, custom *CustomIntervalConfig) (int, error) {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"interval", "date", "attributes", "count", "kind"}); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for {
+		c, err := iter.Next()
+		if err != nil {
+			return n, err
+		}
+		if c == nil {
+			break
+		}
+
+		rec := NewCounterRecord(c, custom)
+		attrBytes, err := json.Marshal(rec.Attributes)
+		if err != nil {
+			return n, fmt.Errorf("failed to marshal attributes: %v", err)
+		}
+		row := []string{rec.Interval, rec.Date, string(attrBytes), strconv.FormatInt(rec.Count, 10), c.Kind()}
+		if err := cw.Write(row); err != nil {
+			return n, err
+		}
+		n++
+	}
+	cw.Flush()
+	return n, cw.Error()
+}
+
+// WriteCountersJSON writes all the counters from the iterator as newline
+// delimited JSON. Returns the number of counters.
+func WriteCountersJSON(w io.Writer, iter CounterIterator, custom *CustomIntervalConfig) (int, error) {
+	enc := json.NewEncoder(w)
+	n := 0
+	for {
+		c, err := iter.Next()
+		if err != nil {
+			return n, err
+		}
+		if c == nil {
+			break
+		}
+		if err := enc.Encode(NewCounterRecord(c, custom)); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
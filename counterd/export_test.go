@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mockExportDB(t *testing.T) *MockDatabaseClient {
+	db := NewMockDatabaseClient()
+	p1, _ := ParseKey("day:2017-01-18:foo:bar", nil)
+	p1.Count = 10
+	p2, _ := ParseKey("month:2017-01:foo:bar", nil)
+	p2.Count = 20
+	p3, _ := ParseKey("incr:day:2017-01-18:foo:bar", nil)
+	p3.Count = 30
+	assert.Nil(t, db.UpsertCounters(context.Background(), []*ParsedKey{p1, p2, p3}))
+	return db
+}
+
+func TestWriteCountersCSV(t *testing.T) {
+	db := mockExportDB(t)
+	iter, err := db.StreamCounters(context.Background(), "", time.Time{}, time.Now())
+	assert.Nil(t, err)
+
+	var buf bytes.Buffer
+	n, err := WriteCountersCSV(&buf, iter, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+
+	expect := `interval,date,attributes,count,kind
+day,2017-01-18,"{""foo"":""bar""}",10,unique
+month,2017-01,"{""foo"":""bar""}",20,unique
+day,2017-01-18,"{""foo"":""bar""}",30,events
+`
+	assert.Equal(t, expect, buf.String())
+}
+
+func TestWriteCountersJSON(t *testing.T) {
+	db := mockExportDB(t)
+	iter, err := db.StreamCounters(context.Background(), "month", time.Time{}, time.Now())
+	assert.Nil(t, err)
+
+	var buf bytes.Buffer
+	n, err := WriteCountersJSON(&buf, iter, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	expect := `{"interval":"month","date":"2017-01","attributes":{"foo":"bar"},"count":20}
+`
+	assert.Equal(t, expect, buf.String())
+}
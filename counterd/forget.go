@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+const (
+	// ForgetBatchSize is the number of keys an ID is removed from at a time
+	ForgetBatchSize = 1000
+)
+
+type ForgetCommand struct{}
+
+func (f *ForgetCommand) Help() string {
+	helpText := `
+Usage: counterd forget <config> -id <id>
+
+	forget is used to honor a request to forget an ID. The ID is removed
+	from every exactly counted key and accuracy sample in redis, after
+	applying the configured id_hash. A HyperLogLog cannot remove a single
+	ID, so approximate counters keep counting the ID until the keys expire,
+	and counters already snapshotted to the database are not lowered.
+	The path to the configuration file must be provided.
+
+Options:
+
+	-id	The ID to forget. Required.
+	`
+	return strings.TrimSpace(helpText)
+}
+
+func (f *ForgetCommand) Synopsis() string {
+	return "Removes an ID from the exact counters"
+}
+
+func (f *ForgetCommand) Run(args []string) int {
+	// Check that we got at least the config argument
+	if len(args) < 1 {
+		fmt.Println(f.Help())
+		return 1
+	}
+	filename := args[0]
+
+	var id string
+	flags := flag.NewFlagSet("forget", flag.ContinueOnError)
+	flags.StringVar(&id, "id", "", "")
+	flags.Usage = func() { fmt.Println(f.Help()) }
+	if err := flags.Parse(args[1:]); err != nil {
+		return 1
+	}
+	if id == "" {
+		fmt.Println(f.Help())
+		return 1
+	}
+
+	// Attempt to parse the config
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		hclog.Default().Error("Failed to load configuration file", "file", filename, "error", err)
+		return 1
+	}
+
+	// Parse the config
+	config, err := ParseConfig(string(raw))
+	if err != nil {
+		hclog.Default().Error("Failed to parse configuration file", "error", err)
+		return 1
+	}
+
+	// Setup the redis pool
+	hclog.Default().Info("Connecting to redis", "addr", RedactAddress(config.RedisAddress))
+	client, err := NewPooledClient(config.RedisAddress)
+	if err != nil {
+		hclog.Default().Error("Failed to setup redis connection", "error", err)
+		return 1
+	}
+	client.hybridThreshold = config.Redis.HybridThreshold
+
+	// Stop if we are interrupted, after the current batch
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	forgetter := &IDForgetter{
+		logger: hclog.Default().Named("forget"),
+		client: client,
+		id:     config.Ingress.HashID(id),
+	}
+	removed, err := forgetter.Run(ctx)
+	if err != nil {
+		hclog.Default().Error("Failed to forget ID", "error", err)
+		return 1
+	}
+	fmt.Printf("Removed the ID from %d keys\n", removed)
+	return 0
+}
+
+// IDForgetter is used to remove an ID from every key that stores it
+type IDForgetter struct {
+	logger hclog.Logger
+	client RedisClient
+
+	// id is the ID to remove, as it is stored in redis
+	id string
+}
+
+// Run scans all the keys and removes the ID from the keys that store IDs,
+// returning the number of keys it was removed from
+func (f *IDForgetter) Run(ctx context.Context) (int, error) {
+	var removed int
+	var keys []string
+	remove := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		n, err := f.client.RemoveID(ctx, keys, f.id)
+		removed += n
+		keys = keys[:0]
+		return err
+	}
+	err := f.client.ListKeysStream(ctx, func(key string) error {
+		// Increments do not store the IDs
+		if IsIncrKey(key) {
+			return nil
+		}
+		keys = append(keys, key)
+		if len(keys) < ForgetBatchSize {
+			return nil
+		}
+		return remove()
+	})
+	if err == nil {
+		err = remove()
+	}
+	return removed, err
+}
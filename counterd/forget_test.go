@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDForgetter(t *testing.T) {
+	mock := NewMockRedisClient()
+	ctx := context.Background()
+	exact := []string{"exact:day:2017-01-18:foo:bar", "exact:week:2017-01-16:foo:bar"}
+	assert.Nil(t, mock.UpdateKeys(ctx, exact, "1234"))
+	assert.Nil(t, mock.UpdateKeys(ctx, exact[:1], "5678"))
+	assert.Nil(t, mock.UpdateKeys(ctx, []string{"day:2017-01-18:foo:bar"}, "1234"))
+	assert.Nil(t, mock.UpdateKeys(ctx, []string{"incr:day:2017-01-18:foo:bar"}, ""))
+
+	forgetter := &IDForgetter{
+		logger: hclog.Default(),
+		client: mock,
+		id:     "1234",
+	}
+	removed, err := forgetter.Run(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, removed)
+
+	// The ID is removed from the exact keys only
+	counts, err := mock.GetCounts(ctx, append(exact, "day:2017-01-18:foo:bar", "incr:day:2017-01-18:foo:bar"))
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1, 0, 1, 1}, counts)
+
+	// Forgetting again is a no-op
+	removed, err = forgetter.Run(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, removed)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MaxInflatedBodySize limits the size of a decompressed request body
+	// to guard against decompression bombs
+	MaxInflatedBodySize = 16 * 1024 * 1024
+)
+
+// GzipHandler wraps a handler to decompress gzip request bodies and
+// to compress the responses of GET requests when the client accepts gzip
+func GzipHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Decompress the request body
+		if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(400)
+				w.Write([]byte("Invalid gzip body"))
+				return
+			}
+			defer gz.Close()
+			r.Body = http.MaxBytesReader(w, gz, MaxInflatedBodySize)
+			r.Header.Del("Content-Encoding")
+			r.ContentLength = -1
+		}
+
+		// Only compress responses to reads
+		if r.Method != "GET" || !AcceptsGzip(r.Header.Get("Accept-Encoding")) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		h.ServeHTTP(&gzipResponseWriter{ResponseWriter: w, Writer: gz}, r)
+	})
+}
+
+// AcceptsGzip checks if an Accept-Encoding header allows gzip
+func AcceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		if strings.TrimSpace(params[0]) != "gzip" {
+			continue
+		}
+
+		// Check for an explicit refusal
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter compresses everything written to the response
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	io.Writer
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	g.Header().Del("Content-Length")
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	return g.Writer.Write(b)
+}
+
+// Unwrap returns the underlying writer, so that http.ResponseController
+// can reach the connection
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// Flush sends the data compressed so far, so that streamed
+// responses are not held back by the compressor
+func (g *gzipResponseWriter) Flush() {
+	if gz, ok := g.Writer.(*gzip.Writer); ok {
+		gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func gzipBytes(t *testing.T, raw []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(raw)
+	assert.Nil(t, err)
+	assert.Nil(t, gz.Close())
+	return buf.Bytes()
+}
+
+func TestGzipHandler_Request(t *testing.T) {
+	input := []byte(`{"id": "1234", "date": "2009-11-10T23:00:00Z", "attributes": {"foo": "bar"}}`)
+	req := httptest.NewRequest("PUT", "/v1/ingress", bytes.NewReader(gzipBytes(t, input)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+
+	mock := NewMockRedisClient()
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		client: mock,
+	}
+	mux := NewHTTPHandler(api, nil)
+	mux.ServeHTTP(resp, req)
+
+	// Assert a 200 OK and that the event was decoded
+	assert.Equal(t, 200, resp.Result().StatusCode)
+	assert.Contains(t, mock.counters, "day:2009-11-10:foo:bar")
+
+	// Invalid gzip bodies are rejected
+	req = httptest.NewRequest("PUT", "/v1/ingress", bytes.NewReader(input))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 400, resp.Result().StatusCode)
+}
+
+func TestGzipHandler_Bomb(t *testing.T) {
+	// A small compressed body that inflates past the limit
+	input := bytes.Repeat([]byte(" "), MaxInflatedBodySize+1)
+	req := httptest.NewRequest("PUT", "/v1/ingress", bytes.NewReader(gzipBytes(t, input)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+
+	mock := NewMockRedisClient()
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		client: mock,
+	}
+	mux := NewHTTPHandler(api, nil)
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 413, resp.Result().StatusCode)
+}
+
+func TestGzipHandler_Response(t *testing.T) {
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		client: NewMockRedisClient(),
+	}
+	mux := NewHTTPHandler(api, nil)
+
+	req := httptest.NewRequest("GET", "/stats", nil)
+	req.Header.Set("Accept-Encoding", "deflate, gzip")
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Result().StatusCode)
+	assert.Equal(t, "gzip", resp.Result().Header.Get("Content-Encoding"))
+
+	// Decompress and decode the body
+	gz, err := gzip.NewReader(resp.Body)
+	assert.Nil(t, err)
+	var out StatsResponse
+	assert.Nil(t, json.NewDecoder(gz).Decode(&out))
+
+	// Without the header, the response is not compressed
+	req = httptest.NewRequest("GET", "/stats", nil)
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, "", resp.Result().Header.Get("Content-Encoding"))
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&out))
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tcases := map[string]bool{
+		"":                   false,
+		"gzip":               true,
+		"deflate, gzip":      true,
+		"gzip;q=0.5, br":     true,
+		"gzip;q=0":           false,
+		"deflate, gzip; q=0": false,
+		"identity":           false,
+	}
+	for header, expect := range tcases {
+		assert.Equal(t, expect, AcceptsGzip(header), header)
+	}
+}
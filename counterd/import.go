@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+const (
+	// ImportBatchSize is the number of records upserted at a time on import
+	ImportBatchSize = 4096
+
+	// maxImportLineSize is the longest JSON line accepted on import
+	maxImportLineSize = 1024 * 1024
+)
+
+type ImportCommand struct{}
+
+func (i *ImportCommand) Help() string {
+	helpText := `
+Usage: counterd import <config> [flags]
+
+	import is used to load historical counters directly into the database,
+	bypassing redis. Records are read from stdin and upserted in batches.
+	Existing counters are updated with the configured conflict_strategy,
+	which only ever increases counts by default, matching snapshot behavior.
+	Invalid records are rejected and reported without stopping the import.
+	The path to the configuration file must be provided.
+
+Options:
+
+	-conflict	Overrides the conflict_strategy of the configuration, either
+			"greatest", "latest" or "sum". "sum" adds the imported counts to
+			the existing counts, e.g. to merge the counters of another
+			deployment, so the same records must not be imported twice.
+
+	-format	(Default: "json"). Configures the input format, either "json" or "csv".
+			JSON input is newline delimited, with one counter per line, e.g.
+			{"interval": "day", "date": "2018-01-31", "attributes": {"foo": "bar"}, "count": 10}
+			The optional "kind" is "events" for the counters of events
+			without an ID. CSV input matches the output of the export command.
+	-input	Configures a file to read from. Defaults to stdin.
+	`
+	return strings.TrimSpace(helpText)
+}
+
+func (i *ImportCommand) Synopsis() string {
+	return "Imports counters into the database"
+}
+
+func (i *ImportCommand) Run(args []string) int {
+	// Check that we got at least the config argument
+	if len(args) < 1 {
+		fmt.Println(i.Help())
+		return 1
+	}
+	filename := args[0]
+
+	var format, input, conflict string
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.StringVar(&format, "format", "json", "")
+	flags.StringVar(&input, "input", "", "")
+	flags.StringVar(&conflict, "conflict", "", "")
+	flags.Usage = func() { fmt.Println(i.Help()) }
+	if err := flags.Parse(args[1:]); err != nil {
+		return 1
+	}
+	switch conflict {
+	case "", ConflictGreatest, ConflictLatest, ConflictSum:
+	default:
+		hclog.Default().Error("Unsupported conflict strategy", "conflict", conflict)
+		return 1
+	}
+
+	// Setup the input
+	var in io.Reader = os.Stdin
+	if input != "" {
+		fh, err := os.Open(input)
+		if err != nil {
+			hclog.Default().Error("Failed to open input file", "error", err)
+			return 1
+		}
+		defer fh.Close()
+		in = fh
+	}
+
+	// Determine the reader for the format
+	var reader RecordReader
+	switch format {
+	case "json":
+		reader = NewJSONRecordReader(in)
+	case "csv":
+		reader = NewCSVRecordReader(in)
+	default:
+		hclog.Default().Error("Unsupported import format", "format", format)
+		return 1
+	}
+
+	// Attempt to parse the config
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		hclog.Default().Error("Failed to load configuration file", "file", filename, "error", err)
+		return 1
+	}
+
+	// Parse the config
+	config, err := ParseConfig(string(raw))
+	if err != nil {
+		hclog.Default().Error("Failed to parse configuration file", "error", err)
+		return 1
+	}
+
+	// Attempt to connect to the database
+	hclog.Default().Info("Connecting to postgresql", "addr", RedactAddress(config.PGAddress))
+	// Failures are not isolated, so a failed batch stops the import
+	dbConfig := *config.Database
+	dbConfig.IsolateFailures = false
+	if conflict != "" {
+		dbConfig.ConflictStrategy = conflict
+	}
+	pg, err := NewPGDatabaseFromConfig(hclog.Default().Named("postgresql"), config.PGAddress, "", &dbConfig, true)
+	if err != nil {
+		hclog.Default().Error("Failed to setup database connection", "error", err)
+		return 1
+	}
+
+	// Import all the records
+	logger := hclog.Default().Named("import")
+	imported, rejected, err := ImportCounters(context.Background(), logger, pg, reader, config.Attributes, config.CustomInterval)
+	if err != nil {
+		hclog.Default().Error("Failed to import counters", "imported", imported, "error", err)
+		return 1
+	}
+	if rejected > 0 {
+		hclog.Default().Warn("Import complete with rejected records", "imported", imported, "rejected", rejected)
+	} else {
+		hclog.Default().Info("Import complete", "imported", imported)
+	}
+	return 0
+}
+
+// ImportCounters reads all the records, upserting the valid ones into the
+// database in batches along with their domain. Invalid records are logged
+// and skipped. Returns the number of imported and rejected records.
+func ImportCounters(ctx context.Context, logger hclog.Logger, db DatabaseClient, reader RecordReader, attrConfig *AttributeConfig, custom *CustomIntervalConfig) (int, int, error) {
+	var imported, rejected int
+	batch := make([]*ParsedKey, 0, ImportBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := db.UpsertCounters(ctx, batch); err != nil {
+			return err
+		}
+		if err := db.UpsertDomain(ctx, CollectDomain(batch)); err != nil {
+			return err
+		}
+		imported += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	for {
+		rec, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if rerr, ok := err.(*RecordError); ok {
+				logger.Warn("rejected record", "record", rerr.Record, "error", rerr.Err)
+				rejected++
+				continue
+			}
+			return imported, rejected, err
+		}
+
+		// Validate the record
+		parsed, err := ParseCounterRecord(rec, attrConfig, custom)
+		if err != nil {
+			logger.Warn("rejected record", "record", reader.Count(), "error", err)
+			rejected++
+			continue
+		}
+
+		// Upsert once the batch is full
+		batch = append(batch, parsed)
+		if len(batch) >= ImportBatchSize {
+			if err := flush(); err != nil {
+				return imported, rejected, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return imported, rejected, err
+	}
+	return imported, rejected, nil
+}
+
+// ParseCounterRecord validates a record and converts it into a counter.
+// The attributes are validated and encoded using the same rules as the
+// ingress, and a record without attributes uses the configured null attribute.
+func ParseCounterRecord(rec *CounterRecord, attrConfig *AttributeConfig, custom *CustomIntervalConfig) (*ParsedKey, error) {
+	if rec.Count < 0 {
+		return nil, fmt.Errorf("negative count %d", rec.Count)
+	}
+	kind, err := ParseCounterKind(rec.Kind)
+	if err != nil {
+		return nil, err
+	}
+
+	// Inject the null attribute if necessary
+	attributes := rec.Attributes
+	if len(attributes) == 0 {
+		null := attrConfig.NullName()
+		attributes = map[string]string{
+			null: null,
+		}
+	}
+	for key, value := range attributes {
+		if err := validateAttribute(key, value, attrConfig); err != nil {
+			return nil, err
+		}
+	}
+	if strings.Contains(rec.Interval, KeySeperator) || strings.Contains(rec.Date, KeySeperator) {
+		return nil, fmt.Errorf("invalid use of colon in interval/date")
+	}
+
+	// Build and parse the counter key
+	intervals := map[string]string{rec.Interval: rec.Date}
+	keys := attrConfig.counterKeys(intervals, &IngressRequest{Attributes: attributes})
+	if kind == CounterKindEvents {
+		keys[0] = IncrKeyPrefix + keys[0]
+	}
+	parsed, err := ParseKey(keys[0], custom)
+	if err != nil {
+		return nil, err
+	}
+	if attrConfig.encodeValues() {
+		parsed.DecodeValues()
+	}
+	parsed.Count = rec.Count
+	return parsed, nil
+}
+
+// RecordError is returned by a RecordReader when a single record is
+// malformed but reading can continue
+type RecordError struct {
+	Record int
+	Err    error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("record %d: %v", e.Record, e.Err)
+}
+
+// RecordReader is used to read counter records from an input
+type RecordReader interface {
+	// Next returns the next record, or io.EOF when done
+	Next() (*CounterRecord, error)
+
+	// Count returns the number of records read so far
+	Count() int
+}
+
+// JSONRecordReader reads newline delimited JSON records
+type JSONRecordReader struct {
+	scanner *bufio.Scanner
+	count   int
+}
+
+func NewJSONRecordReader(r io.Reader) *JSONRecordReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxImportLineSize)
+	return &JSONRecordReader{scanner: scanner}
+}
+
+func (j *JSONRecordReader) Next() (*CounterRecord, error) {
+	for j.scanner.Scan() {
+		// Skip any blank lines
+		line := j.scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		j.count++
+
+		var rec CounterRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, &RecordError{Record: j.count, Err: fmt.Errorf("failed to parse: %v", err)}
+		}
+		return &rec, nil
+	}
+	if err := j.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (j *JSONRecordReader) Count() int {
+	return j.count
+}
+
+// CSVRecordReader reads CSV records in the format written by export
+type CSVRecordReader struct {
+	reader *csv.Reader
+	header bool
+	count  int
+}
+
+// NewCSVRecordReader reads records with or without the kind column,
+// since exports before the column was added do not have it. Every
+// record must have the same number of columns as the header.
+func NewCSVRecordReader(r io.Reader) *CSVRecordReader {
+	reader := csv.NewReader(r)
+	return &CSVRecordReader{reader: reader}
+}
+
+func (c *CSVRecordReader) Next() (*CounterRecord, error) {
+	// Skip the header row
+	if !c.header {
+		c.header = true
+		header, err := c.reader.Read()
+		if err != nil {
+			return nil, err
+		}
+		if len(header) != 4 && len(header) != 5 {
+			return nil, fmt.Errorf("expected 4 or 5 columns, got %d", len(header))
+		}
+	}
+
+	row, err := c.reader.Read()
+	if err != nil {
+		if _, ok := err.(*csv.ParseError); ok {
+			c.count++
+			return nil, &RecordError{Record: c.count, Err: err}
+		}
+		return nil, err
+	}
+	c.count++
+
+	rec := &CounterRecord{
+		Interval: row[0],
+		Date:     row[1],
+	}
+	if err := json.Unmarshal([]byte(row[2]), &rec.Attributes); err != nil {
+		return nil, &RecordError{Record: c.count, Err: fmt.Errorf("failed to parse attributes: %v", err)}
+	}
+	rec.Count, err = strconv.ParseInt(row[3], 10, 64)
+	if err != nil {
+		return nil, &RecordError{Record: c.count, Err: fmt.Errorf("failed to parse count: %v", err)}
+	}
+	if len(row) > 4 && row[4] != CounterKindUnique {
+		rec.Kind = row[4]
+	}
+	return rec, nil
+}
+
+func (c *CSVRecordReader) Count() int {
+	return c.count
+}
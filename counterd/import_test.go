@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCounterRecord(t *testing.T) {
+	type tcase struct {
+		Input    *CounterRecord
+		Config   *AttributeConfig
+		Expected *ParsedKey
+		Err      string
+	}
+	tcases := []tcase{
+		{
+			Input: &CounterRecord{
+				Interval:   "day",
+				Date:       "2017-01-18",
+				Attributes: map[string]string{"foo": "bar"},
+				Count:      10,
+			},
+			Expected: &ParsedKey{
+				Raw:        "day:2017-01-18:foo:bar",
+				Interval:   "day",
+				Date:       time.Date(2017, 1, 18, 0, 0, 0, 0, time.UTC),
+				Attributes: map[string]string{"foo": "bar"},
+				Count:      10,
+			},
+		},
+		{
+			Input: &CounterRecord{
+				Interval: "month",
+				Date:     "2017-01",
+				Count:    5,
+			},
+			Expected: &ParsedKey{
+				Raw:        "month:2017-01:null:null",
+				Interval:   "month",
+				Date:       time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+				Attributes: map[string]string{NullAttribute: NullAttribute},
+				Count:      5,
+			},
+		},
+		{
+			Input: &CounterRecord{
+				Interval: "month",
+				Date:     "2017-01",
+				Count:    5,
+			},
+			Config: &AttributeConfig{Null: "none"},
+			Expected: &ParsedKey{
+				Raw:        "month:2017-01:none:none",
+				Interval:   "month",
+				Date:       time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+				Attributes: map[string]string{"none": "none"},
+				Count:      5,
+			},
+		},
+		{
+			Input: &CounterRecord{
+				Interval:   "day",
+				Date:       "2017-01-18",
+				Attributes: map[string]string{"foo": "bar"},
+				Count:      10,
+				Kind:       CounterKindEvents,
+			},
+			Expected: &ParsedKey{
+				Raw:        "incr:day:2017-01-18:foo:bar",
+				Interval:   "day",
+				Date:       time.Date(2017, 1, 18, 0, 0, 0, 0, time.UTC),
+				Attributes: map[string]string{"foo": "bar"},
+				Count:      10,
+				Incr:       true,
+			},
+		},
+		{
+			Input: &CounterRecord{Interval: "day", Date: "2017-01-18", Count: 1, Kind: "hits"},
+			Err:   "invalid kind \"hits\"",
+		},
+		{
+			Input: &CounterRecord{Interval: "month", Date: "2017-01-18", Count: 1},
+			Err:   "invalid date \"2017-01-18\"",
+		},
+		{
+			Input: &CounterRecord{Interval: "year", Date: "2017", Count: 1},
+			Err:   "invalid interval \"year\"",
+		},
+		{
+			Input: &CounterRecord{Interval: "day", Date: "2017-01-18", Count: -1},
+			Err:   "negative count -1",
+		},
+		{
+			Input: &CounterRecord{
+				Interval:   "day",
+				Date:       "2017-01-18",
+				Attributes: map[string]string{"foo": "b:ar"},
+			},
+			Err: "invalid use of colon in attribute value",
+		},
+		{
+			Input: &CounterRecord{
+				Interval:   "day",
+				Date:       "2017-01-18",
+				Attributes: map[string]string{"foo": "b:ar"},
+				Count:      10,
+			},
+			Config: &AttributeConfig{EncodeValues: true},
+			Expected: &ParsedKey{
+				Raw:        "day:2017-01-18:foo:b%3Aar",
+				Interval:   "day",
+				Date:       time.Date(2017, 1, 18, 0, 0, 0, 0, time.UTC),
+				Attributes: map[string]string{"foo": "b:ar"},
+				Count:      10,
+			},
+		},
+		{
+			Input: &CounterRecord{
+				Interval:   "day",
+				Date:       "2017-01-18",
+				Attributes: map[string]string{"f:oo": "b:ar"},
+				Count:      10,
+			},
+			Config: &AttributeConfig{KeyFormat: KeyFormatV2},
+			Expected: &ParsedKey{
+				Raw:        "v2:day:2017-01-18:4:f:oo4:b:ar",
+				Interval:   "day",
+				Date:       time.Date(2017, 1, 18, 0, 0, 0, 0, time.UTC),
+				Attributes: map[string]string{"f:oo": "b:ar"},
+				Count:      10,
+				V2:         true,
+			},
+		},
+		{
+			Input: &CounterRecord{
+				Interval:   "day",
+				Date:       "2017-01-18",
+				Attributes: map[string]string{"day": "bar"},
+			},
+			Err: "attribute key \"day\" is reserved",
+		},
+		{
+			Input: &CounterRecord{
+				Interval:   "day",
+				Date:       "2017-01-18",
+				Attributes: map[string]string{"foo": "\xff"},
+			},
+			Err: "attribute key/value is not valid UTF-8",
+		},
+	}
+
+	for _, tc := range tcases {
+		out, err := ParseCounterRecord(tc.Input, tc.Config, nil)
+		if tc.Err == "" {
+			assert.Nil(t, err)
+			assert.Equal(t, tc.Expected, out)
+		} else {
+			assert.Equal(t, tc.Err, err.Error())
+		}
+	}
+}
+
+func TestImportCounters_JSON(t *testing.T) {
+	input := `{"interval": "day", "date": "2017-01-18", "attributes": {"foo": "bar"}, "count": 10}
+
+{"interval": "day", "date": "2017-01-18", "attributes": {"foo": "baz"}, "count": 20}
+not json
+{"interval": "year", "date": "2017", "attributes": {"foo": "bar"}, "count": 10}
+`
+	db := NewMockDatabaseClient()
+	reader := NewJSONRecordReader(strings.NewReader(input))
+	imported, rejected, err := ImportCounters(context.Background(), hclog.Default(), db, reader, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, imported)
+	assert.Equal(t, 2, rejected)
+
+	assert.Equal(t, 2, len(db.counters))
+	assert.Contains(t, db.domain["foo"], "bar")
+	assert.Contains(t, db.domain["foo"], "baz")
+}
+
+func TestImportCounters_CSVRoundTrip(t *testing.T) {
+	// Export from one database
+	src := mockExportDB(t)
+	iter, err := src.StreamCounters(context.Background(), "", time.Time{}, time.Now())
+	assert.Nil(t, err)
+	var buf bytes.Buffer
+	_, err = WriteCountersCSV(&buf, iter, nil)
+	assert.Nil(t, err)
+
+	// Import into another
+	dst := NewMockDatabaseClient()
+	reader := NewCSVRecordReader(&buf)
+	imported, rejected, err := ImportCounters(context.Background(), hclog.Default(), dst, reader, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, imported)
+	assert.Equal(t, 0, rejected)
+
+	assert.Equal(t, len(src.counters), len(dst.counters))
+	for idx, c := range src.counters {
+		assert.Equal(t, c.key(), dst.counters[idx].key())
+		assert.Equal(t, c.count, dst.counters[idx].count)
+	}
+}
+
+func TestImportCounters_CSVWithoutKind(t *testing.T) {
+	// Exports before the kind column are unique counters
+	input := `interval,date,attributes,count
+day,2017-01-18,"{""foo"":""bar""}",10
+`
+	db := NewMockDatabaseClient()
+	reader := NewCSVRecordReader(strings.NewReader(input))
+	imported, rejected, err := ImportCounters(context.Background(), hclog.Default(), db, reader, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, imported)
+	assert.Equal(t, 0, rejected)
+	if assert.Equal(t, 1, len(db.counters)) {
+		assert.Equal(t, CounterKindUnique, db.counters[0].kind)
+	}
+}
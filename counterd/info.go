@@ -0,0 +1,105 @@
+package main
+
+import "time"
+
+// InfoResponse is the output of the info endpoint. It describes the
+// capabilities of the server so that clients and the UI can adapt, and
+// must never include tokens, salts or connection strings.
+type InfoResponse struct {
+	Version string `json:"version"`
+
+	// Intervals are the intervals that are counted, and ExactIntervals
+	// are those that are always counted exactly
+	Intervals      []string `json:"intervals"`
+	ExactIntervals []string `json:"exact_intervals"`
+	Timezone       string   `json:"timezone"`
+
+	// CustomInterval describes the buckets of the custom interval, if configured
+	CustomInterval *InfoCustomInterval `json:"custom_interval,omitempty"`
+
+	AuthRequired bool `json:"auth_required"`
+
+	Ingress struct {
+		SampleRate  float64 `json:"sample_rate"`
+		Increments  bool    `json:"increments"`
+		DerivedIDs  bool    `json:"derived_ids"`
+		HashedIDs   bool    `json:"hashed_ids"`
+		Queued      bool    `json:"queued"`
+		MaxBodySize int64   `json:"max_body_size"`
+		MaxKeys     int     `json:"max_keys"`
+
+		// MaxCombinations limits the combinations of multi-valued attributes
+		MaxCombinations int `json:"max_combinations"`
+	} `json:"ingress"`
+
+	Attributes struct {
+		KeyFormat      string `json:"key_format"`
+		EncodeValues   bool   `json:"encode_values"`
+		MaxKeyLength   int    `json:"max_key_length"`
+		MaxValueLength int    `json:"max_value_length"`
+
+		// Whitelist is empty if every attribute is counted
+		Whitelist []string `json:"whitelist"`
+	} `json:"attributes"`
+
+	Snapshot struct {
+		Enabled         bool `json:"enabled"`
+		StoreHLL        bool `json:"store_hll"`
+		WeeklyFromDaily bool `json:"weekly_from_daily"`
+	} `json:"snapshot"`
+}
+
+// InfoCustomInterval describes the custom interval, so that clients
+// can convert between dates and the index of the buckets
+type InfoCustomInterval struct {
+	Anchor   time.Time `json:"anchor"`
+	Duration string    `json:"duration"`
+}
+
+// NewInfoResponse builds the info of a server from its config
+func NewInfoResponse(config *Config) *InfoResponse {
+	out := &InfoResponse{
+		Version:        VersionString(),
+		Intervals:      IntervalNames(config.Intervals),
+		ExactIntervals: []string{},
+		Timezone:       "UTC",
+	}
+	if config.Exact != nil && len(config.Exact.Intervals) > 0 {
+		out.ExactIntervals = config.Exact.Intervals
+	}
+	if config.Timezone != nil {
+		out.Timezone = config.Timezone.String()
+	}
+	if c := config.CustomInterval; c != nil {
+		out.CustomInterval = &InfoCustomInterval{Anchor: c.Anchor, Duration: c.Duration.String()}
+	}
+	out.AuthRequired = config.Auth != nil && config.Auth.Required
+
+	// Use the same defaults as the API handler for missing limits
+	out.Ingress.SampleRate = config.Ingress.sampleRate()
+	out.Ingress.MaxBodySize = config.Ingress.maxBodySize()
+	out.Ingress.MaxKeys = config.Ingress.maxKeys()
+	out.Ingress.MaxCombinations = MaxMultiAttributeCombinations
+	if config.Ingress != nil {
+		out.Ingress.Increments = config.Ingress.Increments
+		out.Ingress.DerivedIDs = config.Ingress.DeriveID
+		out.Ingress.HashedIDs = config.Ingress.IDHash != ""
+		out.Ingress.Queued = config.Ingress.QueueSize > 0
+	}
+
+	out.Attributes.KeyFormat = config.Attributes.keyFormat()
+	out.Attributes.EncodeValues = config.Attributes.encodeValues()
+	out.Attributes.MaxKeyLength = config.Attributes.maxKeyLength()
+	out.Attributes.MaxValueLength = config.Attributes.maxValueLength()
+	out.Attributes.Whitelist = []string{}
+	if config.Attributes != nil && len(config.Attributes.Whitelist) > 0 {
+		out.Attributes.Whitelist = config.Attributes.Whitelist
+	}
+
+	if config.Snapshot != nil {
+		out.Snapshot.Enabled = config.Snapshot.Cron != ""
+		out.Snapshot.StoreHLL = config.Snapshot.StoreHLL
+		out.Snapshot.WeeklyFromDaily = config.Snapshot.WeeklyFromDaily
+	}
+	return out
+}
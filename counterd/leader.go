@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+// LeaderLockName is the name of the redis lock held by the leader
+const LeaderLockName = "leader"
+
+// LeaderElection uses a redis lock as a lease, so that only one of many
+// servers sharing redis is the leader. The leader renews the lease at a
+// third of its duration, and steps down if it cannot be renewed. Other
+// servers try to acquire the lock at the same rate.
+type LeaderElection struct {
+	logger hclog.Logger
+	client RedisClient
+	lease  time.Duration
+
+	// token is set while this server holds the leader lock
+	token string
+	l     sync.Mutex
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// NewLeaderElection creates a leader election and starts campaigning
+func NewLeaderElection(logger hclog.Logger, client RedisClient, lease time.Duration) *LeaderElection {
+	e := &LeaderElection{
+		logger: logger,
+		client: client,
+		lease:  lease,
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// IsLeader returns if this server currently holds the leader lock
+func (e *LeaderElection) IsLeader() bool {
+	e.l.Lock()
+	defer e.l.Unlock()
+	return e.token != ""
+}
+
+// Close stops campaigning and releases the leader lock if it is held,
+// so another server can take over without waiting for the lease
+func (e *LeaderElection) Close() {
+	close(e.stopCh)
+	<-e.doneCh
+	e.release()
+}
+
+// run acquires or renews the lock until stopped
+func (e *LeaderElection) run() {
+	defer close(e.doneCh)
+	ticker := time.NewTicker(e.lease / 3)
+	defer ticker.Stop()
+	for {
+		e.step()
+		select {
+		case <-ticker.C:
+		case <-e.stopCh:
+			return
+		}
+	}
+}
+
+// step renews the lock if this server is the leader,
+// and otherwise attempts to acquire it. Only the run goroutine
+// changes the token, so the lock is only held to read and write it,
+// and IsLeader does not block on slow redis calls.
+func (e *LeaderElection) step() {
+	ctx := context.Background()
+	e.l.Lock()
+	token := e.token
+	e.l.Unlock()
+
+	if token != "" {
+		held, err := e.client.RenewLock(ctx, LeaderLockName, token, e.lease)
+		if err != nil {
+			e.logger.Error("failed to renew leader lock", "error", err)
+		}
+		if err != nil || !held {
+			e.logger.Warn("lost leadership")
+			e.setToken("")
+		}
+		return
+	}
+
+	token, ok, err := e.client.AcquireLock(ctx, LeaderLockName, e.lease)
+	if err != nil {
+		e.logger.Error("failed to acquire leader lock", "error", err)
+		return
+	}
+	if ok {
+		e.logger.Info("acquired leadership")
+		e.setToken(token)
+	}
+}
+
+// setToken updates the token of the held leader lock
+func (e *LeaderElection) setToken(token string) {
+	e.l.Lock()
+	defer e.l.Unlock()
+	e.token = token
+}
+
+// release gives up the leader lock if it is held. It is called
+// once the run goroutine has stopped, so the token cannot change.
+func (e *LeaderElection) release() {
+	e.l.Lock()
+	token := e.token
+	e.l.Unlock()
+	if token == "" {
+		return
+	}
+	if err := e.client.ReleaseLock(context.Background(), LeaderLockName, token); err != nil {
+		e.logger.Warn("failed to release leader lock", "error", err)
+	}
+	e.setToken("")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeaderElection(t *testing.T) {
+	redis := NewMockRedisClient()
+	a := &LeaderElection{logger: hclog.Default(), client: redis, lease: time.Minute}
+	b := &LeaderElection{logger: hclog.Default(), client: redis, lease: time.Minute}
+
+	// Only one server acquires the lock
+	a.step()
+	b.step()
+	assert.True(t, a.IsLeader())
+	assert.False(t, b.IsLeader())
+
+	// The leader keeps the lock when renewing
+	a.step()
+	b.step()
+	assert.True(t, a.IsLeader())
+	assert.False(t, b.IsLeader())
+
+	// The leader steps down if the lease expired and was taken over
+	redis.ReleaseLock(context.Background(), LeaderLockName, a.token)
+	b.step()
+	a.step()
+	assert.False(t, a.IsLeader())
+	assert.True(t, b.IsLeader())
+
+	// Releasing lets another server take over
+	b.release()
+	assert.False(t, b.IsLeader())
+	a.step()
+	assert.True(t, a.IsLeader())
+}
+
+func TestLeaderElection_Close(t *testing.T) {
+	redis := NewMockRedisClient()
+	e := NewLeaderElection(hclog.Default(), redis, time.Minute)
+
+	// The first step runs immediately
+	deadline := time.Now().Add(time.Second)
+	for !e.IsLeader() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, e.IsLeader())
+
+	// Closing releases the lock
+	e.Close()
+	assert.False(t, e.IsLeader())
+	assert.Empty(t, redis.locks)
+}
+
+func TestAPI_Health_Leader(t *testing.T) {
+	redis := NewMockRedisClient()
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		client: redis,
+	}
+	mux := NewHTTPHandler(api, nil)
+	health := func() *bool {
+		req := httptest.NewRequest("GET", "/health", nil)
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		assert.Equal(t, 200, resp.Result().StatusCode)
+		var out HealthResponse
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&out))
+		return out.Leader
+	}
+
+	// Omitted without leader election
+	assert.Nil(t, health())
+
+	api.leader = &LeaderElection{logger: hclog.Default(), client: redis, lease: time.Minute}
+	leader := health()
+	if assert.NotNil(t, leader) {
+		assert.False(t, *leader)
+	}
+
+	api.leader.step()
+	leader = health()
+	if assert.NotNil(t, leader) {
+		assert.True(t, *leader)
+	}
+}
+
+// blockingLockClient blocks renewing a lock until released
+type blockingLockClient struct {
+	RedisClient
+	renewing chan struct{}
+	release  chan struct{}
+}
+
+func (b *blockingLockClient) RenewLock(ctx context.Context, name, token string, ttl time.Duration) (bool, error) {
+	close(b.renewing)
+	<-b.release
+	return b.RedisClient.RenewLock(ctx, name, token, ttl)
+}
+
+func TestLeaderElection_SlowRedis(t *testing.T) {
+	redis := &blockingLockClient{
+		RedisClient: NewMockRedisClient(),
+		renewing:    make(chan struct{}),
+		release:     make(chan struct{}),
+	}
+	e := &LeaderElection{logger: hclog.Default(), client: redis, lease: time.Minute}
+	e.step()
+	assert.True(t, e.IsLeader())
+
+	// IsLeader does not wait for the renewal
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.step()
+	}()
+	<-redis.renewing
+	assert.True(t, e.IsLeader())
+	close(redis.release)
+	<-done
+	assert.True(t, e.IsLeader())
+}
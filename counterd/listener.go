@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	// unixScheme is the prefix of listen addresses using a unix socket
+	unixScheme = "unix://"
+)
+
+// ParseListenAddress splits a listen address into the network and address.
+// Addresses like "unix:///var/run/counterd.sock" use a unix domain socket,
+// otherwise the address is a TCP "host:port".
+func ParseListenAddress(addr string) (network, address string, err error) {
+	if !strings.HasPrefix(addr, unixScheme) {
+		return "tcp", addr, nil
+	}
+	path := strings.TrimPrefix(addr, unixScheme)
+	if path == "" {
+		return "", "", fmt.Errorf("missing unix socket path")
+	}
+	return "unix", path, nil
+}
+
+// Listen starts a listener on the listen address. For unix sockets, a stale
+// socket file is removed first and the permissions are set if a mode is given.
+func Listen(addr string, mode os.FileMode) (net.Listener, error) {
+	network, address, err := ParseListenAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+
+	// Remove a socket left behind by a previous run, but never other files
+	if info, err := os.Lstat(address); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", address)
+		}
+		if err := os.Remove(address); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %v", err)
+		}
+	}
+
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(address, mode); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("failed to set socket permissions: %v", err)
+		}
+	}
+	return ln, nil
+}
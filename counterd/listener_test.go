@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseListenAddress(t *testing.T) {
+	type tcase struct {
+		Input   string
+		Network string
+		Address string
+		Err     bool
+	}
+	tcases := []tcase{
+		{"127.0.0.1:8001", "tcp", "127.0.0.1:8001", false},
+		{"0.0.0.0:80", "tcp", "0.0.0.0:80", false},
+		{"unix:///var/run/counterd.sock", "unix", "/var/run/counterd.sock", false},
+		{"unix://counterd.sock", "unix", "counterd.sock", false},
+		{"unix://", "", "", true},
+	}
+	for _, tc := range tcases {
+		network, address, err := ParseListenAddress(tc.Input)
+		assert.Equal(t, tc.Err, err != nil, tc.Input)
+		assert.Equal(t, tc.Network, network, tc.Input)
+		assert.Equal(t, tc.Address, address, tc.Input)
+	}
+}
+
+func TestListen_Unix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "counterd")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "counterd.sock")
+
+	// Leave a stale socket behind
+	ln, err := Listen("unix://"+path, 0)
+	assert.Nil(t, err)
+	ln.(interface{ SetUnlinkOnClose(bool) }).SetUnlinkOnClose(false)
+	ln.Close()
+	_, err = os.Lstat(path)
+	assert.Nil(t, err)
+
+	// The stale socket is replaced and the mode is set
+	ln, err = Listen("unix://"+path, 0600)
+	assert.Nil(t, err)
+	defer ln.Close()
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Regular files are never removed
+	file := filepath.Join(dir, "file")
+	assert.Nil(t, ioutil.WriteFile(file, nil, 0644))
+	_, err = Listen("unix://"+file, 0)
+	assert.NotNil(t, err)
+}
@@ -8,12 +8,27 @@ import (
 )
 
 func main() {
-	c := cli.NewCLI("counterd", "0.1.0")
+	c := cli.NewCLI("counterd", VersionString())
 	c.Args = os.Args[1:]
 	c.Commands = map[string]cli.CommandFactory{
 		"dbinit": func() (cli.Command, error) {
 			return &DBInitCommand{}, nil
 		},
+		"dbreset": func() (cli.Command, error) {
+			return &DBResetCommand{}, nil
+		},
+		"export": func() (cli.Command, error) {
+			return &ExportCommand{}, nil
+		},
+		"forget": func() (cli.Command, error) {
+			return &ForgetCommand{}, nil
+		},
+		"import": func() (cli.Command, error) {
+			return &ImportCommand{}, nil
+		},
+		"migrate-keys": func() (cli.Command, error) {
+			return &MigrateKeysCommand{}, nil
+		},
 		"server": func() (cli.Command, error) {
 			return &ServerCommand{}, nil
 		},
@@ -23,6 +38,12 @@ func main() {
 		"snapshot": func() (cli.Command, error) {
 			return &SnapshotCommand{}, nil
 		},
+		"verify": func() (cli.Command, error) {
+			return &VerifyCommand{}, nil
+		},
+		"version": func() (cli.Command, error) {
+			return &VersionCommand{}, nil
+		},
 	}
 
 	exitStatus, err := c.Run()
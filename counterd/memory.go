@@ -0,0 +1,909 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryDatabaseAddress is the postgresql_address or redis_address used to
+// select the in-memory implementation instead of connecting
+const MemoryDatabaseAddress = "memory://"
+
+// IsMemoryAddress checks if a database or redis address selects the
+// in-memory implementation
+func IsMemoryAddress(addr string) bool {
+	return strings.HasPrefix(addr, MemoryDatabaseAddress)
+}
+
+// memoryCounter is a single counter stored by the MemoryDatabase
+type memoryCounter struct {
+	interval   string
+	date       time.Time
+	kind       string
+	attributes map[string]string
+	count      int64
+	hll        []byte
+	sampleRate float64
+
+	// firstSeen is when the counter was inserted, and lastUpdated
+	// when it was last upserted
+	firstSeen   time.Time
+	lastUpdated time.Time
+}
+
+// scaledCount is the count scaled up by the sample rate, like the queries
+func (m *memoryCounter) scaledCount() float64 {
+	return float64(m.count) / m.sampleRate
+}
+
+// key returns the index key of the counter, see memoryCounterKey
+func (m *memoryCounter) key() string {
+	return memoryCounterKey(m.interval, m.date, m.kind, m.attributes)
+}
+
+// memoryCounterKey returns a key that is unique for each interval, date,
+// kind and set of attributes. Each part is quoted so the concatenation
+// is unambiguous, and the attributes are sorted by name.
+func memoryCounterKey(interval string, date time.Time, kind string, attributes map[string]string) string {
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(strconv.Quote(interval))
+	b.WriteString(strconv.Quote(date.Format(time.RFC3339Nano)))
+	b.WriteString(strconv.Quote(kind))
+	for _, name := range names {
+		b.WriteString(strconv.Quote(name))
+		b.WriteString(strconv.Quote(attributes[name]))
+	}
+	return b.String()
+}
+
+// MemoryDatabase is a DatabaseClient that keeps everything in memory. It is
+// used for local development and testing without a postgresql server, and
+// all the data is lost when the process exits.
+type MemoryDatabase struct {
+	domain   map[string]map[string]struct{}
+	accuracy []*AccuracySample
+
+	// counters are kept in insertion order, and index maps
+	// the key of each counter to it for the upserts
+	counters []*memoryCounter
+	index    map[string]*memoryCounter
+
+	// conflictStrategy is how the count of an existing counter
+	// is updated, like the PGDatabase. Defaults to ConflictGreatest.
+	conflictStrategy string
+
+	sync.Mutex
+}
+
+// NewMemoryDatabase returns an empty MemoryDatabase
+func NewMemoryDatabase() *MemoryDatabase {
+	return &MemoryDatabase{
+		domain: make(map[string]map[string]struct{}),
+		index:  make(map[string]*memoryCounter),
+	}
+}
+
+// UpsertDomain merges the attribute values into the domain. The values
+// are copied, so the caller is free to reuse the maps.
+func (m *MemoryDatabase) UpsertDomain(ctx context.Context, attributes map[string]map[string]struct{}) error {
+	m.Lock()
+	defer m.Unlock()
+
+	// Merge the new attributes with the existing ones
+	for key, values := range attributes {
+		existing, ok := m.domain[key]
+		if !ok {
+			existing = make(map[string]struct{}, len(values))
+			m.domain[key] = existing
+		}
+		for value := range values {
+			existing[value] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// UpsertCounters inserts the counters, or updates the count of an existing
+// counter according to the conflict strategy
+func (m *MemoryDatabase) UpsertCounters(ctx context.Context, counters []*ParsedKey) error {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now().UTC()
+	for _, counter := range counters {
+		// Create a counter
+		c := &memoryCounter{
+			interval:    counter.Interval,
+			date:        counter.Date,
+			kind:        counter.Kind(),
+			attributes:  counter.Attributes,
+			count:       counter.Count,
+			hll:         counter.HLL,
+			sampleRate:  counter.sampleRate(),
+			firstSeen:   now,
+			lastUpdated: now,
+		}
+
+		key := c.key()
+		existing, ok := m.index[key]
+		if !ok {
+			m.counters = append(m.counters, c)
+			m.index[key] = c
+			continue
+		}
+
+		switch m.conflictStrategy {
+		case ConflictLatest:
+			existing.count = c.count
+		case ConflictSum:
+			existing.count += c.count
+		default:
+			if c.count > existing.count {
+				existing.count = c.count
+			}
+		}
+		if c.hll != nil {
+			existing.hll = c.hll
+		}
+		existing.sampleRate = c.sampleRate
+		existing.lastUpdated = now
+	}
+	return nil
+}
+
+// StreamCounters returns the counters of the interval with a date in [from, to)
+func (m *MemoryDatabase) StreamCounters(ctx context.Context, interval string, from, to time.Time) (CounterIterator, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	var out []*ParsedKey
+	for _, c := range m.counters {
+		if interval != "" && c.interval != interval {
+			continue
+		}
+		if c.date.Before(from) || c.date.After(to) {
+			continue
+		}
+		out = append(out, &ParsedKey{
+			Interval:   c.interval,
+			Date:       c.date,
+			Attributes: c.attributes,
+			Count:      int64(math.Round(c.scaledCount())),
+			Incr:       c.kind == CounterKindEvents,
+		})
+	}
+	return &memoryCounterIterator{counters: out}, nil
+}
+
+// QueryCounters returns the counters matching the filter
+func (m *MemoryDatabase) QueryCounters(ctx context.Context, filter *QueryFilter) (QueryResultIterator, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	sums := make(map[time.Time]float64)
+	results := make(map[time.Time]*QueryResult)
+	for _, c := range m.counters {
+		if c.interval != filter.Interval || c.kind != filter.kind() || !filter.Matches(c.attributes) {
+			continue
+		}
+		if !filter.From.IsZero() && c.date.Before(filter.From) {
+			continue
+		}
+		if !filter.To.IsZero() && c.date.After(filter.To) {
+			continue
+		}
+		sums[c.date] += c.scaledCount()
+
+		// Track the earliest first seen and latest update of the date
+		res := results[c.date]
+		if res == nil {
+			res = &QueryResult{Date: c.date, FirstSeen: c.firstSeen, LastUpdated: c.lastUpdated}
+			results[c.date] = res
+		}
+		if c.firstSeen.Before(res.FirstSeen) {
+			res.FirstSeen = c.firstSeen
+		}
+		if c.lastUpdated.After(res.LastUpdated) {
+			res.LastUpdated = c.lastUpdated
+		}
+	}
+
+	out := make([]*QueryResult, 0, len(sums))
+	for date, count := range sums {
+		res := results[date]
+		res.Count = int64(math.Round(count))
+		out = append(out, res)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Date.Before(out[j].Date) })
+	return &memoryQueryResultIterator{results: out}, nil
+}
+
+// TopValues returns the values of the attribute with the largest counts.
+// Ties are ordered by value, like the ORDER BY of topValuesSQL.
+func (m *MemoryDatabase) TopValues(ctx context.Context, kind, interval string, date time.Time, attribute string, limit int) ([]*ValueCount, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	sums := make(map[string]float64)
+	for _, c := range m.counters {
+		if c.interval != interval || c.kind != kind || !c.date.Equal(date) {
+			continue
+		}
+		if val, ok := c.attributes[attribute]; ok {
+			sums[val] += c.scaledCount()
+		}
+	}
+
+	out := make([]*ValueCount, 0, len(sums))
+	for val, count := range sums {
+		out = append(out, &ValueCount{Value: val, Count: int64(math.Round(count))})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Value < out[j].Value
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+// CompareValues returns the counts of each value of the attribute at
+// the date and the previous date, ordered like compareValuesSQL
+func (m *MemoryDatabase) CompareValues(ctx context.Context, kind, interval string, date, prev time.Time, attribute string) ([]*ValueComparison, error) {
+	cur, err := m.TopValues(ctx, kind, interval, date, attribute, math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+	before, err := m.TopValues(ctx, kind, interval, prev, attribute, math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*ValueComparison
+	values := make(map[string]*ValueComparison)
+	for _, vc := range cur {
+		values[vc.Value] = &ValueComparison{Value: vc.Value, Count: vc.Count}
+		out = append(out, values[vc.Value])
+	}
+	for _, vc := range before {
+		if existing, ok := values[vc.Value]; ok {
+			existing.Previous = vc.Count
+		} else {
+			out = append(out, &ValueComparison{Value: vc.Value, Previous: vc.Count})
+		}
+	}
+
+	// Values only in the previous date sort with the other zero counts
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Value < out[j].Value
+	})
+	return out, nil
+}
+
+// PruneDomain removes the attribute values that are no longer used by
+// any counter, returning the number removed
+func (m *MemoryDatabase) PruneDomain(ctx context.Context) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	// Collect the values in use with a single pass over the counters
+	used := make(map[string]map[string]struct{})
+	for _, c := range m.counters {
+		for key, value := range c.attributes {
+			if used[key] == nil {
+				used[key] = make(map[string]struct{})
+			}
+			used[key][value] = struct{}{}
+		}
+	}
+
+	var pruned int64
+	for key, values := range m.domain {
+		for value := range values {
+			if _, ok := used[key][value]; ok {
+				continue
+			}
+			delete(values, value)
+			pruned++
+		}
+		if len(values) == 0 {
+			delete(m.domain, key)
+		}
+	}
+	return pruned, nil
+}
+
+// GetCounter returns the unique counter of the interval, date and
+// attributes, or nil if there is none
+func (m *MemoryDatabase) GetCounter(ctx context.Context, interval string, date time.Time, attributes map[string]string) (*ParsedKey, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	existing, ok := m.index[memoryCounterKey(interval, date, CounterKindUnique, attributes)]
+	if !ok {
+		return nil, nil
+	}
+	return &ParsedKey{
+		Interval:   existing.interval,
+		Date:       existing.date,
+		Attributes: existing.attributes,
+		Count:      existing.count,
+	}, nil
+}
+
+// MergeCardinality estimates the cardinality of the union of the unique
+// counters by merging their stored HyperLogLogs through redis
+func (m *MemoryDatabase) MergeCardinality(ctx context.Context, client RedisClient, counters []*ParsedKey) (int64, error) {
+	m.Lock()
+	var hlls [][]byte
+	for _, counter := range counters {
+		key := memoryCounterKey(counter.Interval, counter.Date, CounterKindUnique, counter.Attributes)
+
+		// Counters without a stored HyperLogLog are skipped
+		if existing, ok := m.index[key]; ok && existing.hll != nil {
+			hlls = append(hlls, existing.hll)
+		}
+	}
+	m.Unlock()
+	return client.MergeHLLs(ctx, hlls)
+}
+
+// DomainCounts returns the number of values of each attribute
+func (m *MemoryDatabase) DomainCounts(ctx context.Context) (map[string]int64, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	out := make(map[string]int64, len(m.domain))
+	for key, values := range m.domain {
+		out[key] = int64(len(values))
+	}
+	return out, nil
+}
+
+// ListDomain returns up to limit values of the attribute that sort after the given value
+func (m *MemoryDatabase) ListDomain(ctx context.Context, attribute, after string, limit int) ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	var out []string
+	for value := range m.domain[attribute] {
+		if value > after {
+			out = append(out, value)
+		}
+	}
+	sort.Strings(out)
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+// RecordAccuracy stores the accuracy samples
+func (m *MemoryDatabase) RecordAccuracy(ctx context.Context, samples []*AccuracySample) error {
+	m.Lock()
+	defer m.Unlock()
+	m.accuracy = append(m.accuracy, samples...)
+	return nil
+}
+
+// memoryCounterIterator iterates over a fixed set of counters
+type memoryCounterIterator struct {
+	counters []*ParsedKey
+}
+
+func (m *memoryCounterIterator) Next() (*ParsedKey, error) {
+	if len(m.counters) == 0 {
+		return nil, nil
+	}
+	c := m.counters[0]
+	m.counters = m.counters[1:]
+	return c, nil
+}
+
+func (m *memoryCounterIterator) Close() error {
+	return nil
+}
+
+// memoryQueryResultIterator iterates over a fixed set of query results
+type memoryQueryResultIterator struct {
+	results []*QueryResult
+}
+
+func (m *memoryQueryResultIterator) Next() (*QueryResult, error) {
+	if len(m.results) == 0 {
+		return nil, nil
+	}
+	res := m.results[0]
+	m.results = m.results[1:]
+	return res, nil
+}
+
+func (m *memoryQueryResultIterator) Close() error {
+	return nil
+}
+
+// MemoryRedisClient is a RedisClient that keeps every counter as an exact
+// set of IDs in memory. Together with the MemoryDatabase it lets the server
+// run without redis or postgresql for demos, and everything is lost when the
+// process exits. The HyperLogLogs are the sorted IDs joined by newlines.
+type MemoryRedisClient struct {
+	counters map[string]map[string]struct{}
+	locks    map[string]memoryLock
+	lockSeq  int
+	incrSeq  int
+
+	// dirty are the keys updated since the last swap, and dirtySnapshot
+	// the dirty keys being snapshotted. Updates are always tracked.
+	dirty         map[string]struct{}
+	dirtySnapshot map[string]struct{}
+
+	// lastUpdates is the last update time of each key
+	lastUpdates map[string]time.Time
+
+	// ingressRate is recorded in sampleRates for each new key, like
+	// the PooledClient, if it is below one
+	ingressRate float64
+	sampleRates map[string]float64
+
+	// domainUpdated is when a snapshot last wrote the domain
+	domainUpdated time.Time
+
+	// deadLetters are the keys of the pending dead letters
+	deadLetters map[string]struct{}
+
+	// keyBudget is the number of keys at which UpdateKeys rejects
+	// updates that create a new key. If zero, there is no budget.
+	keyBudget int
+	sync.Mutex
+}
+
+// NewMemoryRedisClient returns an empty MemoryRedisClient
+func NewMemoryRedisClient() *MemoryRedisClient {
+	return &MemoryRedisClient{
+		counters:      make(map[string]map[string]struct{}),
+		locks:         make(map[string]memoryLock),
+		dirty:         make(map[string]struct{}),
+		dirtySnapshot: make(map[string]struct{}),
+		lastUpdates:   make(map[string]time.Time),
+		sampleRates:   make(map[string]float64),
+		deadLetters:   make(map[string]struct{}),
+	}
+}
+
+// memoryLock is a lock held by a token until it expires
+type memoryLock struct {
+	token   string
+	expires time.Time
+}
+
+// heldLock returns the token of a lock that has not expired, deleting
+// the lock if it has. The caller must hold the mutex.
+func (m *MemoryRedisClient) heldLock(name string) string {
+	lock, ok := m.locks[name]
+	if !ok {
+		return ""
+	}
+	if !time.Now().Before(lock.expires) {
+		delete(m.locks, name)
+		return ""
+	}
+	return lock.token
+}
+
+// AcquireLock takes the lock for the ttl if it is not held, like SET NX PX
+func (m *MemoryRedisClient) AcquireLock(ctx context.Context, name string, ttl time.Duration) (string, bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.heldLock(name) != "" {
+		return "", false, nil
+	}
+	m.lockSeq++
+	token := strconv.Itoa(m.lockSeq)
+	m.locks[name] = memoryLock{token: token, expires: time.Now().Add(ttl)}
+	return token, true, nil
+}
+
+// RenewLock extends the lock for the ttl if the token still holds it
+func (m *MemoryRedisClient) RenewLock(ctx context.Context, name, token string, ttl time.Duration) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.heldLock(name) != token {
+		return false, nil
+	}
+	m.locks[name] = memoryLock{token: token, expires: time.Now().Add(ttl)}
+	return true, nil
+}
+
+// ReleaseLock deletes the lock if the token still holds it
+func (m *MemoryRedisClient) ReleaseLock(ctx context.Context, name, token string) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.heldLock(name) == token {
+		delete(m.locks, name)
+	}
+	return nil
+}
+
+// UpdateKeys adds the ID to each key and marks the keys dirty. New keys
+// are rejected with ErrKeyBudget once the key budget is reached.
+func (m *MemoryRedisClient) UpdateKeys(ctx context.Context, keys []string, id string) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.keyBudget > 0 && len(m.counters) >= m.keyBudget {
+		for _, key := range keys {
+			if _, ok := m.counters[key]; !ok {
+				return ErrKeyBudget
+			}
+		}
+	}
+	for _, key := range keys {
+		vals := m.counters[key]
+		if vals == nil {
+			vals = make(map[string]struct{})
+			m.counters[key] = vals
+		}
+
+		// Increments are counted as unique IDs, so they can be merged
+		val := id
+		if IsIncrKey(key) {
+			m.incrSeq++
+			val = "incr-" + strconv.Itoa(m.incrSeq)
+		}
+		vals[val] = struct{}{}
+		m.dirty[key] = struct{}{}
+		m.lastUpdates[key] = time.Now()
+		if _, ok := m.sampleRates[key]; !ok && m.ingressRate > 0 && m.ingressRate < 1 {
+			m.sampleRates[key] = m.ingressRate
+		}
+	}
+	return nil
+}
+
+// UpdateKeysBatch applies each update in turn
+func (m *MemoryRedisClient) UpdateKeysBatch(ctx context.Context, updates []KeyUpdate) []error {
+	var errs []error
+	for idx, update := range updates {
+		if err := m.UpdateKeys(ctx, update.Keys, update.ID); err != nil {
+			if errs == nil {
+				errs = make([]error, len(updates))
+			}
+			errs[idx] = err
+		}
+	}
+	return errs
+}
+
+// ListKeys returns the sorted counter keys
+func (m *MemoryRedisClient) ListKeys(ctx context.Context) ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	out := make([]string, 0, len(m.counters))
+	for key := range m.counters {
+		out = append(out, key)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// ListKeysStream invokes fn with each counter key
+func (m *MemoryRedisClient) ListKeysStream(ctx context.Context, fn func(key string) error) error {
+	// Copy the keys, since fn may modify the counters
+	keys, _ := m.ListKeys(ctx)
+	for _, key := range keys {
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetCounts returns the number of IDs of each key
+func (m *MemoryRedisClient) GetCounts(ctx context.Context, keys []string) ([]int64, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	out := make([]int64, len(keys))
+	for idx, key := range keys {
+		ids := m.counters[key]
+		out[idx] = int64(len(ids))
+	}
+	return out, nil
+}
+
+// MoveKeys merges the IDs of each From key into its To key, deleting
+// the From key if del is set
+func (m *MemoryRedisClient) MoveKeys(ctx context.Context, moves []KeyMove, del bool) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, move := range moves {
+		vals := m.counters[move.To]
+		if vals == nil {
+			vals = make(map[string]struct{})
+			m.counters[move.To] = vals
+		}
+		for id := range m.counters[move.From] {
+			vals[id] = struct{}{}
+		}
+		m.dirty[move.To] = struct{}{}
+		m.lastUpdates[move.To] = time.Now()
+		if rate, ok := m.sampleRates[move.From]; ok {
+			if _, ok := m.sampleRates[move.To]; !ok {
+				m.sampleRates[move.To] = rate
+			}
+		}
+		if del {
+			delete(m.counters, move.From)
+			delete(m.lastUpdates, move.From)
+			delete(m.sampleRates, move.From)
+		}
+	}
+	return nil
+}
+
+// DeleteKeys removes the keys with their update times and sample rates
+func (m *MemoryRedisClient) DeleteKeys(ctx context.Context, keys []string) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, key := range keys {
+		delete(m.counters, key)
+		delete(m.lastUpdates, key)
+		delete(m.sampleRates, key)
+	}
+	return nil
+}
+
+// GetSampleRates returns the sample rate of each key, zero if unsampled
+func (m *MemoryRedisClient) GetSampleRates(ctx context.Context, keys []string) ([]float64, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	out := make([]float64, len(keys))
+	for idx, key := range keys {
+		out[idx] = m.sampleRates[key]
+	}
+	return out, nil
+}
+
+// GetLastUpdates returns the last update time of each key, zero if unknown
+func (m *MemoryRedisClient) GetLastUpdates(ctx context.Context, keys []string) ([]time.Time, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	out := make([]time.Time, len(keys))
+	for idx, key := range keys {
+		out[idx] = m.lastUpdates[key]
+	}
+	return out, nil
+}
+
+// PruneKeyFields removes the update times and sample rates of keys
+// that no longer exist
+func (m *MemoryRedisClient) PruneKeyFields(ctx context.Context) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	var pruned int
+	for key := range m.lastUpdates {
+		if _, ok := m.counters[key]; !ok {
+			delete(m.lastUpdates, key)
+			pruned++
+		}
+	}
+	for key := range m.sampleRates {
+		if _, ok := m.counters[key]; !ok {
+			delete(m.sampleRates, key)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// SetDomainUpdated records when the domain was last purged
+func (m *MemoryRedisClient) SetDomainUpdated(ctx context.Context, t time.Time) error {
+	m.Lock()
+	defer m.Unlock()
+	m.domainUpdated = t
+	return nil
+}
+
+// GetDomainUpdated returns when the domain was last purged
+func (m *MemoryRedisClient) GetDomainUpdated(ctx context.Context) (time.Time, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.domainUpdated, nil
+}
+
+// SwapDirtyKeys moves the dirty keys into the snapshot set
+func (m *MemoryRedisClient) SwapDirtyKeys(ctx context.Context) error {
+	m.Lock()
+	defer m.Unlock()
+	for key := range m.dirty {
+		m.dirtySnapshot[key] = struct{}{}
+	}
+	m.dirty = make(map[string]struct{})
+	return nil
+}
+
+// ListDirtyKeysStream invokes fn with each key of the snapshot set
+func (m *MemoryRedisClient) ListDirtyKeysStream(ctx context.Context, fn func(key string) error) error {
+	// Copy the keys, since fn may update them
+	m.Lock()
+	keys := make([]string, 0, len(m.dirtySnapshot))
+	for key := range m.dirtySnapshot {
+		keys = append(keys, key)
+	}
+	m.Unlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ClearDirtyKeys empties the snapshot set, and the dirty set if all is set
+func (m *MemoryRedisClient) ClearDirtyKeys(ctx context.Context, all bool) error {
+	m.Lock()
+	defer m.Unlock()
+	m.dirtySnapshot = make(map[string]struct{})
+	if all {
+		m.dirty = make(map[string]struct{})
+	}
+	return nil
+}
+
+// MarkDirtyKeys adds the keys to the dirty set
+func (m *MemoryRedisClient) MarkDirtyKeys(ctx context.Context, keys []string) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, key := range keys {
+		m.dirty[key] = struct{}{}
+	}
+	return nil
+}
+
+// GetDeadLetters returns the sorted keys of the pending dead letters
+func (m *MemoryRedisClient) GetDeadLetters(ctx context.Context) ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	out := make([]string, 0, len(m.deadLetters))
+	for key := range m.deadLetters {
+		out = append(out, key)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// UpdateDeadLetters removes and then adds the keys of the dead letters
+func (m *MemoryRedisClient) UpdateDeadLetters(ctx context.Context, add, remove []string) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, key := range remove {
+		delete(m.deadLetters, key)
+	}
+	for _, key := range add {
+		m.deadLetters[key] = struct{}{}
+	}
+	return nil
+}
+
+// RemoveID only removes the ID from the exact keys, like redis
+func (m *MemoryRedisClient) RemoveID(ctx context.Context, keys []string, id string) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	removed := 0
+	for _, key := range keys {
+		if _, ok := m.counters[key][id]; ok && IsExactKey(key) {
+			delete(m.counters[key], id)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// GetSampleCounts returns the exact counts, since the client counts
+// every key exactly
+func (m *MemoryRedisClient) GetSampleCounts(ctx context.Context, keys []string) ([]int64, error) {
+	return m.GetCounts(ctx, keys)
+}
+
+// GetHLLs returns the sorted IDs of each key joined by newlines
+func (m *MemoryRedisClient) GetHLLs(ctx context.Context, keys []string) ([][]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	out := make([][]byte, len(keys))
+	for idx, key := range keys {
+		ids := make([]string, 0, len(m.counters[key]))
+		for id := range m.counters[key] {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		out[idx] = []byte(strings.Join(ids, "\n"))
+	}
+	return out, nil
+}
+
+// MergeHLLs counts the unique IDs across the output of GetHLLs
+func (m *MemoryRedisClient) MergeHLLs(ctx context.Context, hlls [][]byte) (int64, error) {
+	ids := make(map[string]struct{})
+	for _, hll := range hlls {
+		for _, id := range strings.Split(string(hll), "\n") {
+			if id != "" {
+				ids[id] = struct{}{}
+			}
+		}
+	}
+	return int64(len(ids)), nil
+}
+
+// MergeKeys counts the unique IDs across each group of keys, using the
+// same HyperLogLog format as GetHLLs
+func (m *MemoryRedisClient) MergeKeys(ctx context.Context, groups [][]string, withHLL bool) ([]int64, [][]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	counts := make([]int64, len(groups))
+	var hlls [][]byte
+	if withHLL {
+		hlls = make([][]byte, len(groups))
+	}
+	for idx, keys := range groups {
+		union := make(map[string]struct{})
+		for _, key := range keys {
+			for id := range m.counters[key] {
+				union[id] = struct{}{}
+			}
+		}
+		counts[idx] = int64(len(union))
+		if withHLL {
+			ids := make([]string, 0, len(union))
+			for id := range union {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			hlls[idx] = []byte(strings.Join(ids, "\n"))
+		}
+	}
+	return counts, hlls, nil
+}
+
+// MemoryEstimate approximates the memory of a key by the length of the
+// key and its IDs, sampling the first keys in order
+func (m *MemoryRedisClient) MemoryEstimate(ctx context.Context, sample int) (*MemoryEstimate, error) {
+	keys, _ := m.ListKeys(ctx)
+	if sample > len(keys) {
+		sample = len(keys)
+	}
+	m.Lock()
+	defer m.Unlock()
+	var bytes int64
+	for _, key := range keys[:sample] {
+		bytes += int64(len(RedisKeyPrefix + key))
+		for id := range m.counters[key] {
+			bytes += int64(len(id))
+		}
+	}
+	return newMemoryEstimate(int64(len(keys)), sample, bytes), nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryDatabase(t *testing.T) {
+	var db DatabaseClient = NewMemoryDatabase()
+	ctx := context.Background()
+	date := time.Date(2009, 11, 10, 0, 0, 0, 0, time.UTC)
+
+	err := db.UpsertDomain(ctx, map[string]map[string]struct{}{
+		"country": {"US": struct{}{}, "CA": struct{}{}},
+	})
+	assert.Nil(t, err)
+
+	err = db.UpsertCounters(ctx, []*ParsedKey{
+		{Interval: "day", Date: date, Attributes: map[string]string{"country": "US"}, Count: 10},
+		{Interval: "day", Date: date, Attributes: map[string]string{"country": "US"}, Count: 5},
+	})
+	assert.Nil(t, err)
+
+	// Counters only increase
+	counter, err := db.GetCounter(ctx, "day", date, map[string]string{"country": "US"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), counter.Count)
+
+	top, err := db.TopValues(ctx, CounterKindUnique, "day", date, "country", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []*ValueCount{{Value: "US", Count: 10}}, top)
+
+	// CA is not used by any counter
+	pruned, err := db.PruneDomain(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), pruned)
+
+	counts, err := db.DomainCounts(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int64{"country": 1}, counts)
+}
+
+func TestMemoryDatabase_UpsertDomainCopies(t *testing.T) {
+	db := NewMemoryDatabase()
+	ctx := context.Background()
+
+	// The caller reuses the map after the upsert
+	values := map[string]struct{}{"US": struct{}{}}
+	assert.Nil(t, db.UpsertDomain(ctx, map[string]map[string]struct{}{"country": values}))
+	values["CA"] = struct{}{}
+
+	counts, err := db.DomainCounts(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int64{"country": 1}, counts)
+}
+
+func TestMemoryDatabase_ValueOrder(t *testing.T) {
+	db := NewMemoryDatabase()
+	ctx := context.Background()
+	jan := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	feb := time.Date(2017, 2, 1, 0, 0, 0, 0, time.UTC)
+	counter := func(date time.Time, value string, count int64) *ParsedKey {
+		return &ParsedKey{Interval: "month", Date: date, Attributes: map[string]string{"country": value}, Count: count}
+	}
+	assert.Nil(t, db.UpsertCounters(ctx, []*ParsedKey{
+		counter(feb, "z", 3),
+		counter(feb, "y", 3),
+		counter(feb, "c", 0),
+		counter(jan, "b", 1),
+		counter(jan, "a", 5),
+	}))
+
+	// Ties are ordered by value, like the ORDER BY of the queries
+	top, err := db.TopValues(ctx, CounterKindUnique, "month", feb, "country", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []*ValueCount{{Value: "y", Count: 3}, {Value: "z", Count: 3}, {Value: "c", Count: 0}}, top)
+
+	cmp, err := db.CompareValues(ctx, CounterKindUnique, "month", feb, jan, "country")
+	assert.Nil(t, err)
+	var values []string
+	for _, vc := range cmp {
+		values = append(values, vc.Value)
+	}
+	assert.Equal(t, []string{"y", "z", "a", "b", "c"}, values)
+}
+
+func TestMemoryCounterKey(t *testing.T) {
+	date := time.Date(2009, 11, 10, 0, 0, 0, 0, time.UTC)
+
+	// The attribute order does not matter, but the values can not be shifted
+	// between the names
+	assert.Equal(t,
+		memoryCounterKey("day", date, CounterKindUnique, map[string]string{"a": "1", "b": "2"}),
+		memoryCounterKey("day", date, CounterKindUnique, map[string]string{"b": "2", "a": "1"}))
+	assert.NotEqual(t,
+		memoryCounterKey("day", date, CounterKindUnique, map[string]string{"a": "b\"c"}),
+		memoryCounterKey("day", date, CounterKindUnique, map[string]string{"a\"b": "c"}))
+	assert.NotEqual(t,
+		memoryCounterKey("day", date, CounterKindUnique, nil),
+		memoryCounterKey("day", date, CounterKindEvents, nil))
+}
+
+func TestMemoryDatabase_SeenTimes(t *testing.T) {
+	db := NewMemoryDatabase()
+	ctx := context.Background()
+	date := time.Date(2009, 11, 10, 0, 0, 0, 0, time.UTC)
+	us := &ParsedKey{Interval: "day", Date: date, Attributes: map[string]string{"country": "US"}, Count: 10}
+	ca := &ParsedKey{Interval: "day", Date: date, Attributes: map[string]string{"country": "CA"}, Count: 5}
+
+	assert.Nil(t, db.UpsertCounters(ctx, []*ParsedKey{us}))
+	time.Sleep(time.Millisecond)
+	assert.Nil(t, db.UpsertCounters(ctx, []*ParsedKey{us, ca}))
+
+	// First seen is kept from the insert, last updated from the latest upsert
+	first, last := db.counters[0].firstSeen, db.counters[0].lastUpdated
+	assert.True(t, first.Before(last))
+	assert.Equal(t, last, db.counters[1].firstSeen)
+
+	iter, err := db.QueryCounters(ctx, &QueryFilter{Interval: "day"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer iter.Close()
+	res, err := iter.Next()
+	assert.Nil(t, err)
+	if assert.NotNil(t, res) {
+		assert.Equal(t, int64(15), res.Count)
+		assert.Equal(t, first, res.FirstSeen)
+		assert.Equal(t, last, res.LastUpdated)
+	}
+}
+
+func TestIsMemoryAddress(t *testing.T) {
+	assert.True(t, IsMemoryAddress("memory://"))
+	assert.False(t, IsMemoryAddress("postgres://postgres@localhost/postgres"))
+}
+
+func TestMemoryRedisClient_LockTTL(t *testing.T) {
+	client := NewMemoryRedisClient()
+	ctx := context.Background()
+
+	token, ok, err := client.AcquireLock(ctx, "test", 10*time.Millisecond)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	held, err := client.RenewLock(ctx, "test", token, 10*time.Millisecond)
+	assert.Nil(t, err)
+	assert.True(t, held)
+
+	// The lock is taken over once it expires, like in redis
+	time.Sleep(20 * time.Millisecond)
+	other, ok, err := client.AcquireLock(ctx, "test", time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	held, err = client.RenewLock(ctx, "test", token, time.Minute)
+	assert.Nil(t, err)
+	assert.False(t, held)
+
+	// Releasing with the expired token keeps the new lock
+	assert.Nil(t, client.ReleaseLock(ctx, "test", token))
+	held, err = client.RenewLock(ctx, "test", other, time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, held)
+}
+
+func TestMemoryDatabase_ConflictStrategy(t *testing.T) {
+	ctx := context.Background()
+	date := time.Date(2009, 11, 10, 0, 0, 0, 0, time.UTC)
+	attrs := map[string]string{"country": "US"}
+
+	type tcase struct {
+		strategy string
+		expect   int64
+	}
+	cases := []tcase{
+		{"", 10},
+		{ConflictGreatest, 10},
+		{ConflictLatest, 5},
+		{ConflictSum, 15},
+	}
+	for _, tc := range cases {
+		t.Run(tc.strategy, func(t *testing.T) {
+			db := NewMemoryDatabase()
+			db.conflictStrategy = tc.strategy
+			assert.Nil(t, db.UpsertCounters(ctx, []*ParsedKey{
+				{Interval: "day", Date: date, Attributes: attrs, Count: 10},
+			}))
+			assert.Nil(t, db.UpsertCounters(ctx, []*ParsedKey{
+				{Interval: "day", Date: date, Attributes: attrs, Count: 5},
+			}))
+
+			counter, err := db.GetCounter(ctx, "day", date, attrs)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expect, counter.Count)
+		})
+	}
+}
+
+// mergeRecordingClient records the HyperLogLogs merged
+type mergeRecordingClient struct {
+	*MockRedisClient
+	merged [][]byte
+}
+
+func (m *mergeRecordingClient) MergeHLLs(ctx context.Context, hlls [][]byte) (int64, error) {
+	m.merged = hlls
+	return m.MockRedisClient.MergeHLLs(ctx, hlls)
+}
+
+func TestMemoryDatabase_MergeCardinality_SkipsMissingHLL(t *testing.T) {
+	db := NewMemoryDatabase()
+	ctx := context.Background()
+	date := time.Date(2009, 11, 10, 0, 0, 0, 0, time.UTC)
+	us := &ParsedKey{Interval: "day", Date: date, Attributes: map[string]string{"country": "US"}, Count: 1, HLL: []byte("1234\n")}
+	ca := &ParsedKey{Interval: "day", Date: date, Attributes: map[string]string{"country": "CA"}, Count: 1}
+	assert.Nil(t, db.UpsertCounters(ctx, []*ParsedKey{us, ca}))
+
+	// Like the PGDatabase, counters without a HyperLogLog are not merged
+	client := &mergeRecordingClient{MockRedisClient: NewMockRedisClient()}
+	count, err := db.MergeCardinality(ctx, client, []*ParsedKey{us, ca})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+	assert.Equal(t, [][]byte{[]byte("1234\n")}, client.merged)
+}
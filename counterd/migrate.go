@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+const (
+	// MigrateBatchSize is the number of keys moved in a single transaction
+	MigrateBatchSize = 1000
+)
+
+type MigrateKeysCommand struct{}
+
+func (m *MigrateKeysCommand) Help() string {
+	helpText := `
+Usage: counterd migrate-keys <config> [flags]
+
+	migrate-keys is used to re-encode the existing redis keys into the
+	key_format of the configuration. Every key in another format is merged
+	into the same key in the configured format, so counters that were
+	already updated in the new format are not lost. Keys that cannot be
+	represented in the configured format are skipped. The server can keep
+	running during the migration.
+	The path to the configuration file must be provided.
+
+Options:
+
+	-delete	Deletes the original keys once they are merged.
+	-dry-run	Reports the keys that would be migrated without changing them.
+	`
+	return strings.TrimSpace(helpText)
+}
+
+func (m *MigrateKeysCommand) Synopsis() string {
+	return "Re-encode the redis keys into the configured key format"
+}
+
+func (m *MigrateKeysCommand) Run(args []string) int {
+	// Check that we got at least the config argument
+	if len(args) < 1 {
+		fmt.Println(m.Help())
+		return 1
+	}
+	filename := args[0]
+
+	var del, dryRun bool
+	flags := flag.NewFlagSet("migrate-keys", flag.ContinueOnError)
+	flags.BoolVar(&del, "delete", false, "")
+	flags.BoolVar(&dryRun, "dry-run", false, "")
+	flags.Usage = func() { fmt.Println(m.Help()) }
+	if err := flags.Parse(args[1:]); err != nil {
+		return 1
+	}
+
+	// Attempt to parse the config
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		hclog.Default().Error("Failed to load configuration file", "file", filename, "error", err)
+		return 1
+	}
+
+	// Parse the config
+	config, err := ParseConfig(string(raw))
+	if err != nil {
+		hclog.Default().Error("Failed to parse configuration file", "error", err)
+		return 1
+	}
+
+	// Setup the redis pool
+	hclog.Default().Info("Connecting to redis", "addr", RedactAddress(config.RedisAddress))
+	client, err := NewPooledClient(config.RedisAddress)
+	if err != nil {
+		hclog.Default().Error("Failed to setup redis connection", "error", err)
+		return 1
+	}
+
+	// Keep the expiration of the migrated keys, and snapshot them
+	client.trackDirty = config.Snapshot.Incremental
+	client.trackUpdates = config.Snapshot.TrackUpdates
+	client.hybridThreshold = config.Redis.HybridThreshold
+	if config.Snapshot.ExpireBuffer > 0 {
+		client.expireAfter = config.Snapshot.DeleteThreshold + config.Snapshot.ExpireBuffer
+		client.customInterval = config.CustomInterval
+	}
+
+	// Stop if we are interrupted, after the current batch
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	migrator := &KeyMigrator{
+		logger: hclog.Default().Named("migrate"),
+		client: client,
+		config: config.Attributes,
+		custom: config.CustomInterval,
+		delete: del,
+		dryRun: dryRun,
+	}
+	migrated, skipped, err := migrator.Run(ctx)
+	if err != nil {
+		hclog.Default().Error("Failed to migrate keys", "error", err)
+		return 1
+	}
+	if dryRun {
+		fmt.Printf("Would migrate %d keys to %s, skipping %d\n", migrated, config.Attributes.KeyFormat, skipped)
+	} else {
+		fmt.Printf("Migrated %d keys to %s, skipped %d\n", migrated, config.Attributes.KeyFormat, skipped)
+	}
+	return 0
+}
+
+// KeyMigrator is used to move the redis keys into the configured format
+type KeyMigrator struct {
+	logger hclog.Logger
+	client RedisClient
+	config *AttributeConfig
+
+	// custom is the custom interval, keys of which are skipped if nil
+	custom *CustomIntervalConfig
+
+	// delete is used to delete the original keys once they are merged
+	delete bool
+
+	// dryRun only counts the keys that would be migrated
+	dryRun bool
+}
+
+// Run scans all the keys and merges the keys that are not in the configured
+// format into the configured format. Returns the number of keys migrated,
+// and the number skipped because they are invalid or cannot be represented.
+func (m *KeyMigrator) Run(ctx context.Context) (migrated, skipped int, err error) {
+	v2 := m.config.keyFormat() == KeyFormatV2
+	encodeValues := m.config.encodeValues()
+
+	var moves []KeyMove
+	err = m.client.ListKeysStream(ctx, func(key string) error {
+		parsed, err := ParseKey(key, m.custom)
+		if err != nil {
+			m.logger.Warn("skipping invalid key", "key", key)
+			skipped++
+			return nil
+		}
+		if parsed.V2 == v2 {
+			return nil
+		}
+
+		// Find the same counter in the configured format
+		if encodeValues {
+			parsed.DecodeValues()
+		}
+		to, ok := parsed.AlternateKey(encodeValues, m.custom)
+		if !ok {
+			m.logger.Warn("skipping key that cannot be migrated", "key", key)
+			skipped++
+			return nil
+		}
+		m.logger.Debug("migrating key", "from", key, "to", to)
+		migrated++
+		moves = append(moves, KeyMove{From: key, To: to})
+		if len(moves) < MigrateBatchSize {
+			return nil
+		}
+		err = m.move(ctx, moves)
+		moves = moves[:0]
+		return err
+	})
+	if err == nil {
+		err = m.move(ctx, moves)
+	}
+	return migrated, skipped, err
+}
+
+// move merges a batch of keys unless this is a dry run
+func (m *KeyMigrator) move(ctx context.Context, moves []KeyMove) error {
+	if m.dryRun || len(moves) == 0 {
+		return nil
+	}
+	return m.client.MoveKeys(ctx, moves, m.delete)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyMigrator(t *testing.T) {
+	type tcase struct {
+		name     string
+		delete   bool
+		dryRun   bool
+		migrated int
+		expect   map[string]int
+	}
+	cases := []tcase{
+		{
+			name:     "merge",
+			migrated: 2,
+			expect: map[string]int{
+				"day:2017-01-18:foo:bar":             2,
+				"exact:day:2017-01-18:foo:bar":       1,
+				"v2:day:2017-01-18:3:foo3:bar":       3,
+				"exact:v2:day:2017-01-18:3:foo3:bar": 1,
+				"v2:day:2017-01-18:3:foo3:b:r":       1,
+				"invalid":                            1,
+			},
+		},
+		{
+			name:     "delete",
+			delete:   true,
+			migrated: 2,
+			expect: map[string]int{
+				"v2:day:2017-01-18:3:foo3:bar":       3,
+				"exact:v2:day:2017-01-18:3:foo3:bar": 1,
+				"v2:day:2017-01-18:3:foo3:b:r":       1,
+				"invalid":                            1,
+			},
+		},
+		{
+			name:     "dry-run",
+			delete:   true,
+			dryRun:   true,
+			migrated: 2,
+			expect: map[string]int{
+				"day:2017-01-18:foo:bar":       2,
+				"exact:day:2017-01-18:foo:bar": 1,
+				"v2:day:2017-01-18:3:foo3:bar": 2,
+				"v2:day:2017-01-18:3:foo3:b:r": 1,
+				"invalid":                      1,
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			redis := NewMockRedisClient()
+			ctx := context.Background()
+			assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:bar"}, "1234"))
+			assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:bar"}, "2345"))
+			assert.Nil(t, redis.UpdateKeys(ctx, []string{"exact:day:2017-01-18:foo:bar"}, "1234"))
+			assert.Nil(t, redis.UpdateKeys(ctx, []string{"v2:day:2017-01-18:3:foo3:bar"}, "2345"))
+			assert.Nil(t, redis.UpdateKeys(ctx, []string{"v2:day:2017-01-18:3:foo3:bar"}, "3456"))
+			assert.Nil(t, redis.UpdateKeys(ctx, []string{"v2:day:2017-01-18:3:foo3:b:r"}, "1234"))
+			assert.Nil(t, redis.UpdateKeys(ctx, []string{"invalid"}, "1234"))
+
+			m := &KeyMigrator{
+				logger: hclog.Default(),
+				client: redis,
+				config: &AttributeConfig{KeyFormat: KeyFormatV2},
+				delete: tc.delete,
+				dryRun: tc.dryRun,
+			}
+			migrated, skipped, err := m.Run(ctx)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.migrated, migrated)
+			assert.Equal(t, 1, skipped)
+
+			out := make(map[string]int)
+			for key, vals := range redis.counters {
+				out[key] = len(vals)
+			}
+			assert.Equal(t, tc.expect, out)
+		})
+	}
+}
+
+func TestKeyMigrator_Unrepresentable(t *testing.T) {
+	redis := NewMockRedisClient()
+	ctx := context.Background()
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"v2:day:2017-01-18:3:foo3:b:r"}, "1234"))
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"v2:day:2017-01-18:3:foo3:bar"}, "1234"))
+
+	// Migrating back to v1 skips the value with a colon
+	m := &KeyMigrator{
+		logger: hclog.Default(),
+		client: redis,
+		config: &AttributeConfig{KeyFormat: KeyFormatV1},
+		delete: true,
+	}
+	migrated, skipped, err := m.Run(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, migrated)
+	assert.Equal(t, 1, skipped)
+	assert.Len(t, redis.counters["day:2017-01-18:foo:bar"], 1)
+	assert.Len(t, redis.counters["v2:day:2017-01-18:3:foo3:b:r"], 1)
+	assert.Nil(t, redis.counters["v2:day:2017-01-18:3:foo3:bar"])
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+const (
+	// DefaultQueueWorkers is the default number of workers flushing
+	// the ingress queue if no setting is specified
+	DefaultQueueWorkers = 4
+
+	// QueueBatchSize is the maximum number of updates a worker
+	// flushes to redis in a single round trip
+	QueueBatchSize = 128
+)
+
+// IngressQueue buffers key updates between ingress and redis, so that
+// requests do not wait on redis. A pool of workers flushes the updates
+// in batches. Updates still in the queue are lost if the process crashes,
+// and updates that fail are not retried.
+type IngressQueue struct {
+	logger  hclog.Logger
+	client  RedisClient
+	stats   *Stats
+	breaker *CircuitBreaker
+	updates chan KeyUpdate
+	wg      sync.WaitGroup
+}
+
+// NewIngressQueue creates a queue buffering up to size updates
+// and starts the workers
+func NewIngressQueue(logger hclog.Logger, client RedisClient, stats *Stats, size, workers int) *IngressQueue {
+	q := &IngressQueue{
+		logger:  logger,
+		client:  client,
+		stats:   stats,
+		updates: make(chan KeyUpdate, size),
+	}
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.run()
+	}
+	return q
+}
+
+// Enqueue adds an update to the queue without blocking.
+// Returns false if the queue is full.
+func (q *IngressQueue) Enqueue(update KeyUpdate) bool {
+	select {
+	case q.updates <- update:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops accepting updates and waits for the workers to flush
+// everything in the queue. Enqueue must not be called after Close.
+func (q *IngressQueue) Close() {
+	close(q.updates)
+	q.wg.Wait()
+}
+
+// run is a worker that flushes batches of updates until the queue is closed
+func (q *IngressQueue) run() {
+	defer q.wg.Done()
+	batch := make([]KeyUpdate, 0, QueueBatchSize)
+	for update := range q.updates {
+		// Batch any other updates that are already waiting
+		batch = append(batch[:0], update)
+	FILL:
+		for len(batch) < QueueBatchSize {
+			select {
+			case update, ok := <-q.updates:
+				if !ok {
+					break FILL
+				}
+				batch = append(batch, update)
+			default:
+				break FILL
+			}
+		}
+		q.flush(batch)
+	}
+}
+
+// flush writes a batch of updates to redis. Only the updates that
+// failed are counted as failed, since the others were written.
+func (q *IngressQueue) flush(batch []KeyUpdate) {
+	errs := q.client.UpdateKeysBatch(context.Background(), batch)
+	var failed int
+	var firstErr error
+	for idx := range batch {
+		if errs != nil && errs[idx] != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = errs[idx]
+			}
+			q.stats.EventFailed()
+			continue
+		}
+		q.stats.EventIngested()
+	}
+	if failed > 0 {
+		q.logger.Error("failed to update redis", "updates", len(batch), "failed", failed, "error", firstErr)
+		q.breaker.Failure(time.Now())
+		return
+	}
+	q.breaker.Success()
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingRedisClient blocks batch updates until released
+type blockingRedisClient struct {
+	*MockRedisClient
+	release chan struct{}
+}
+
+func (b *blockingRedisClient) UpdateKeysBatch(ctx context.Context, updates []KeyUpdate) []error {
+	<-b.release
+	return b.MockRedisClient.UpdateKeysBatch(ctx, updates)
+}
+
+func TestIngressQueue_Drain(t *testing.T) {
+	stats := new(Stats)
+	mock := NewMockRedisClient()
+	q := NewIngressQueue(hclog.Default(), mock, stats, 1024, 2)
+
+	for i := 0; i < 1000; i++ {
+		assert.True(t, q.Enqueue(KeyUpdate{
+			Keys: []string{"day:2017-01-18:foo:bar"},
+			ID:   fmt.Sprintf("%d", i),
+		}))
+	}
+
+	// Closing should flush everything that was queued
+	q.Close()
+	assert.Equal(t, 1000, len(mock.counters["day:2017-01-18:foo:bar"]))
+	assert.Equal(t, uint64(1000), stats.Response(mock, nil).Events.Ingested)
+}
+
+// partialRedisClient fails the updates of one ID in each batch
+type partialRedisClient struct {
+	*MockRedisClient
+	failID string
+}
+
+func (p *partialRedisClient) UpdateKeysBatch(ctx context.Context, updates []KeyUpdate) []error {
+	errs := make([]error, len(updates))
+	for idx, update := range updates {
+		if update.ID == p.failID {
+			errs[idx] = fmt.Errorf("update failed")
+			continue
+		}
+		errs[idx] = p.MockRedisClient.UpdateKeys(ctx, update.Keys, update.ID)
+	}
+	return errs
+}
+
+func TestIngressQueue_PartialFailure(t *testing.T) {
+	stats := new(Stats)
+	client := &partialRedisClient{MockRedisClient: NewMockRedisClient(), failID: "1"}
+	q := NewIngressQueue(hclog.Default(), client, stats, 16, 1)
+	for i := 0; i < 4; i++ {
+		assert.True(t, q.Enqueue(KeyUpdate{
+			Keys: []string{"day:2017-01-18:foo:bar"},
+			ID:   fmt.Sprintf("%d", i),
+		}))
+	}
+	q.Close()
+
+	// Only the failed update is counted as failed
+	out := stats.Response(client, nil)
+	assert.Equal(t, uint64(3), out.Events.Ingested)
+	assert.Equal(t, uint64(1), out.Events.Failed)
+	assert.Equal(t, 3, len(client.counters["day:2017-01-18:foo:bar"]))
+}
+
+func TestIngressQueue_Full(t *testing.T) {
+	client := &blockingRedisClient{
+		MockRedisClient: NewMockRedisClient(),
+		release:         make(chan struct{}),
+	}
+	q := NewIngressQueue(hclog.Default(), client, nil, 1, 1)
+
+	// The worker takes at most one update before blocking,
+	// so the queue fills after at most two
+	full := false
+	for i := 0; i < 3; i++ {
+		if !q.Enqueue(KeyUpdate{Keys: []string{"day:2017-01-18:foo:bar"}, ID: "1234"}) {
+			full = true
+		}
+	}
+	assert.True(t, full)
+
+	close(client.release)
+	q.Close()
+}
+
+func TestAPI_Ingress_Queue(t *testing.T) {
+	client := &blockingRedisClient{
+		MockRedisClient: NewMockRedisClient(),
+		release:         make(chan struct{}),
+	}
+	stats := new(Stats)
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		client: client,
+		queue:  NewIngressQueue(hclog.Default(), client, stats, 1, 1),
+		stats:  stats,
+	}
+	mux := NewHTTPHandler(api, nil)
+
+	// Events are accepted until the queue is full
+	var codes []int
+	for i := 0; i < 3; i++ {
+		input := fmt.Sprintf(`{"id": "%d", "attributes": {"foo": "bar"}}`, i)
+		req := httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(input))
+		req.Header.Set("Content-Type", "application/json")
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		codes = append(codes, resp.Result().StatusCode)
+	}
+	assert.Equal(t, 202, codes[0])
+	assert.Equal(t, 503, codes[2])
+
+	// Nothing is written until the worker is released
+	assert.Equal(t, 0, len(client.counters))
+	close(client.release)
+	api.queue.Close()
+	assert.NotEqual(t, 0, len(client.counters))
+}
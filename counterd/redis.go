@@ -1,11 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/uuid"
 )
 
 const (
@@ -14,150 +24,1646 @@ const (
 
 	// ScanCount is the number of entries scanned at a time
 	ScanCount = 100
+
+	// RedisTempPrefix is prefixed to temporary keys. It must not match
+	// RedisKeyPrefix so that they are never snapshotted.
+	RedisTempPrefix = "counterd-tmp:"
+
+	// RedisSamplePrefix is prefixed to the sets used to count sampled keys
+	// exactly. It must not match RedisKeyPrefix so they are never snapshotted.
+	RedisSamplePrefix = "counterd-sample:"
+
+	// RedisLockPrefix is prefixed to lock keys. It must not match
+	// RedisKeyPrefix so that they are never snapshotted.
+	RedisLockPrefix = "counterd-lock:"
+
+	// RedisDirtyKey is the set of keys updated since the last incremental
+	// snapshot. It must not match RedisKeyPrefix so it is never snapshotted.
+	RedisDirtyKey = "counterd-dirty"
+
+	// RedisDirtySnapshotKey is the set of dirty keys being snapshotted.
+	// Keys are only removed once a snapshot succeeds.
+	RedisDirtySnapshotKey = "counterd-dirty-snapshot"
+
+	// RedisLastUpdateKey is the hash of the last update time of each key in
+	// unix milliseconds. It must not match RedisKeyPrefix so it is never
+	// snapshotted.
+	RedisLastUpdateKey = "counterd-lastupdate"
+
+	// RedisHybridKey is set once hybrid keys are enabled, so that clients
+	// with them disabled still handle the keys that are sets. It must not
+	// match RedisKeyPrefix so it is never snapshotted.
+	RedisHybridKey = "counterd-hybrid"
+
+	// RedisSampleRateKey is the hash of the ingress sample rate each key
+	// was created with, if events were sampled. It must not match
+	// RedisKeyPrefix so it is never snapshotted.
+	RedisSampleRateKey = "counterd-samplerate"
+
+	// RedisDomainUpdatedKey is when a snapshot last wrote the domain in unix
+	// milliseconds, so every server purges its domain cache after a snapshot.
+	// It must not match RedisKeyPrefix so it is never snapshotted.
+	RedisDomainUpdatedKey = "counterd-domain-updated"
+
+	// RedisDeadLetterKey is the set of keys whose counters failed to update,
+	// which are retried instead of deleted until they succeed. It must not
+	// match RedisKeyPrefix so it is never snapshotted.
+	RedisDeadLetterKey = "counterd-deadletters"
+
+	// DefaultFlushSize is the default maximum number of commands sent in
+	// a single transaction by UpdateKeys. This is large enough that events
+	// are normally updated in a single transaction.
+	DefaultFlushSize = 4096
+
+	// CountScriptBatchSize is the maximum number of keys counted by a
+	// single evaluation of countScript, to avoid blocking redis for long.
+	CountScriptBatchSize = 1000
 )
 
-// RedisClient is used to abstract the client for testing
+// ErrKeyBudget is returned by UpdateKeys if redis has reached the key
+// budget and the update would create a new key
+var ErrKeyBudget = errors.New("key budget exceeded, new keys are rejected")
+
+// releaseScript deletes a lock only if it is still held with the token,
+// so an expired lock acquired by another process is not released.
+var releaseScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// renewScript extends a lock only if it is still held with the token
+var renewScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// countScript counts a batch of keys server side. Each key is followed by
+// an argument that is "1" if the key is exact and counted with SCARD, "2"
+// if the key is an incremented counter read with GET, or "3" if the key is
+// a hybrid key that may still be a set.
+var countScript = redis.NewScript(-1, `
+local out = {}
+for i, key in ipairs(KEYS) do
+	if ARGV[i] == "1" then
+		out[i] = redis.call("SCARD", key)
+	elseif ARGV[i] == "3" and redis.call("TYPE", key)["ok"] == "set" then
+		out[i] = redis.call("SCARD", key)
+	elseif ARGV[i] == "2" then
+		out[i] = tonumber(redis.call("GET", key) or "0")
+	else
+		out[i] = redis.call("PFCOUNT", key)
+	end
+end
+return out
+`)
+
+// moveSampleRateScript copies the sample rate of a key to another key,
+// unless that key already has a sample rate
+var moveSampleRateScript = redis.NewScript(1, `
+local rate = redis.call("HGET", KEYS[1], ARGV[1])
+if rate then
+	return redis.call("HSETNX", KEYS[1], ARGV[2], rate)
+end
+return 0
+`)
+
+// moveCountScript adds the value of an incremented counter to another
+var moveCountScript = redis.NewScript(2, `
+local n = redis.call("GET", KEYS[1])
+if n then
+	return redis.call("INCRBY", KEYS[2], n)
+end
+return 0
+`)
+
+// hybridLua are the functions shared by the scripts for hybrid keys, which
+// store the IDs in a set until the threshold and are then promoted to a
+// HyperLogLog. IDs are added in batches, since unpack is limited.
+const hybridLua = `
+local function pfadd(key, ids)
+	redis.call("PFADD", key)
+	for i = 1, #ids, 1000 do
+		redis.call("PFADD", key, unpack(ids, i, math.min(i + 999, #ids)))
+	end
+end
+
+local function promote(key)
+	if redis.call("TYPE", key)["ok"] == "set" then
+		local ids = redis.call("SMEMBERS", key)
+		redis.call("DEL", key)
+		pfadd(key, ids)
+	end
+end
+
+local function merge(dest, src)
+	local t = redis.call("TYPE", src)["ok"]
+	if t == "set" then
+		pfadd(dest, redis.call("SMEMBERS", src))
+	elseif t == "string" then
+		redis.call("PFMERGE", dest, src)
+	end
+end
+`
+
+// hybridAddScript adds the ID to a hybrid key, promoting the set once it
+// has more IDs than the threshold. A threshold of zero only promotes the
+// existing sets. Returns 1 if the key changed.
+var hybridAddScript = redis.NewScript(1, hybridLua+`
+local t = redis.call("TYPE", KEYS[1])["ok"]
+if t == "string" or (t == "none" and tonumber(ARGV[2]) == 0) then
+	return redis.call("PFADD", KEYS[1], ARGV[1])
+end
+local added = redis.call("SADD", KEYS[1], ARGV[1])
+if redis.call("SCARD", KEYS[1]) > tonumber(ARGV[2]) then
+	promote(KEYS[1])
+end
+return added
+`)
+
+// hybridCountScript counts a hybrid key exactly if it is still a set
+var hybridCountScript = redis.NewScript(1, `
+if redis.call("TYPE", KEYS[1])["ok"] == "set" then
+	return redis.call("SCARD", KEYS[1])
+end
+return redis.call("PFCOUNT", KEYS[1])
+`)
+
+// hybridMergeScript is PFMERGE for hybrid keys. The destination is
+// promoted if it is a set, and the sources are not modified.
+var hybridMergeScript = redis.NewScript(-1, hybridLua+`
+promote(KEYS[1])
+for i = 2, #KEYS do
+	merge(KEYS[1], KEYS[i])
+end
+return redis.call("PFADD", KEYS[1])
+`)
+
+// hybridGetScript returns the HyperLogLog of a hybrid key, building it
+// in the temporary key if the key is still a set
+var hybridGetScript = redis.NewScript(2, hybridLua+`
+if redis.call("TYPE", KEYS[1])["ok"] ~= "set" then
+	return redis.call("GET", KEYS[1])
+end
+merge(KEYS[2], KEYS[1])
+local hll = redis.call("GET", KEYS[2])
+redis.call("DEL", KEYS[2])
+return hll
+`)
+
+// hybridRemoveScript removes the ID from a hybrid key if it is still a set
+var hybridRemoveScript = redis.NewScript(1, `
+if redis.call("TYPE", KEYS[1])["ok"] == "set" then
+	return redis.call("SREM", KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// hybridScripts are loaded on each connection when hybrid keys may exist,
+// so that they are sent by their hash instead of their body
+var hybridScripts = []*redis.Script{
+	hybridAddScript,
+	hybridCountScript,
+	hybridMergeScript,
+	hybridGetScript,
+	hybridRemoveScript,
+}
+
+// RedisClient is used to abstract the client for testing.
+// The context carries the tracing span of the caller.
 type RedisClient interface {
 	// UpdateKeys sets the ID for each of the given keys
-	UpdateKeys(keys []string, id string) error
+	UpdateKeys(ctx context.Context, keys []string, id string) error
+
+	// UpdateKeysBatch applies many updates in a single round trip. The
+	// commands are pipelined without a transaction, so an update is not
+	// atomic and a failed command leaves the other keys of its update set.
+	// Returns the error of each update in order, or nil if all succeeded.
+	UpdateKeysBatch(ctx context.Context, updates []KeyUpdate) []error
 
 	// ListKeys returns all the keys in sorted order
-	ListKeys() ([]string, error)
+	ListKeys(ctx context.Context) ([]string, error)
+
+	// ListKeysStream calls fn for each key without sorting them or holding
+	// them in memory, stopping at the first error. Keys may be repeated.
+	ListKeysStream(ctx context.Context, fn func(key string) error) error
 
 	// GetCounts returns the counts for the given keys
-	GetCounts(keys []string) ([]int64, error)
+	GetCounts(ctx context.Context, keys []string) ([]int64, error)
 
 	// DeleteKeys deletes a set of keys
-	DeleteKeys([]string) error
+	DeleteKeys(ctx context.Context, keys []string) error
+
+	// GetLastUpdates returns the time each key was last updated, or the
+	// zero time if the update time of the key was not recorded
+	GetLastUpdates(ctx context.Context, keys []string) ([]time.Time, error)
+
+	// PruneKeyFields removes the last update times and sample rates of
+	// the keys that no longer exist, e.g. keys expired by redis. Returns
+	// the number of fields removed.
+	PruneKeyFields(ctx context.Context) (int, error)
+
+	// SetDomainUpdated records when a snapshot last wrote the domain
+	SetDomainUpdated(ctx context.Context, t time.Time) error
+
+	// GetDomainUpdated returns when a snapshot last wrote the domain,
+	// or the zero time if it was not recorded
+	GetDomainUpdated(ctx context.Context) (time.Time, error)
+
+	// SwapDirtyKeys moves the keys updated since the last swap into the
+	// dirty keys being snapshotted, keeping any left by a failed snapshot
+	SwapDirtyKeys(ctx context.Context) error
+
+	// ListDirtyKeysStream calls fn for each dirty key being snapshotted,
+	// stopping at the first error. Keys may be repeated.
+	ListDirtyKeysStream(ctx context.Context, fn func(key string) error) error
+
+	// ClearDirtyKeys discards the dirty keys being snapshotted. If all is
+	// set, the keys updated since the last swap are also discarded.
+	ClearDirtyKeys(ctx context.Context, all bool) error
+
+	// MarkDirtyKeys adds the keys to the dirty set, so they are counted
+	// again by the next incremental snapshot
+	MarkDirtyKeys(ctx context.Context, keys []string) error
+
+	// GetDeadLetters returns the keys of the pending dead letters
+	GetDeadLetters(ctx context.Context) ([]string, error)
+
+	// UpdateDeadLetters removes the keys of the dead letters that were
+	// updated, and adds the keys of the new dead letters
+	UpdateDeadLetters(ctx context.Context, add, remove []string) error
+
+	// RemoveID removes an ID from the sets of the exact keys and from the
+	// accuracy samples of the other keys, returning the number of keys that
+	// contained it. The ID cannot be removed from a HyperLogLog.
+	RemoveID(ctx context.Context, keys []string, id string) (int, error)
+
+	// GetHLLs returns the raw HyperLogLog registers for the given keys
+	GetHLLs(ctx context.Context, keys []string) ([][]byte, error)
+
+	// MergeHLLs returns the cardinality of the union of the raw HyperLogLogs
+	MergeHLLs(ctx context.Context, hlls [][]byte) (int64, error)
+
+	// GetSampleCounts returns the exact counts of sampled keys
+	GetSampleCounts(ctx context.Context, keys []string) ([]int64, error)
+
+	// GetSampleRates returns the ingress sample rate each key was created
+	// with, or zero if every event of the key was counted
+	GetSampleRates(ctx context.Context, keys []string) ([]float64, error)
+
+	// MergeKeys returns the cardinality of the union of each group of keys,
+	// and the raw HyperLogLog of the union if withHLL is set. Missing keys
+	// are treated as empty, and exact keys are not supported.
+	MergeKeys(ctx context.Context, groups [][]string, withHLL bool) ([]int64, [][]byte, error)
+
+	// MoveKeys merges the values of each source key into the destination
+	// key, and deletes the source keys if del is set. Exact and incremented
+	// keys must only be moved to keys of the same kind.
+	MoveKeys(ctx context.Context, moves []KeyMove, del bool) error
+
+	// AcquireLock attempts to acquire the named lock until it expires after
+	// the TTL. If acquired, it returns the token used to release the lock.
+	AcquireLock(ctx context.Context, name string, ttl time.Duration) (string, bool, error)
+
+	// RenewLock extends the expiration of the named lock to the TTL.
+	// Returns false if the lock is no longer held with the token.
+	RenewLock(ctx context.Context, name, token string, ttl time.Duration) (bool, error)
+
+	// ReleaseLock releases the named lock if it is held with the token
+	ReleaseLock(ctx context.Context, name, token string) error
+
+	// MemoryEstimate estimates the memory used by the counters, by
+	// measuring a random sample of up to sample keys and extrapolating
+	// by the number of keys. This scans every key, so it is not cheap.
+	MemoryEstimate(ctx context.Context, sample int) (*MemoryEstimate, error)
+}
+
+// KeyMove is used to merge a key into another key
+type KeyMove struct {
+	From string
+	To   string
+}
+
+// KeyUpdate is used to set an ID for a set of keys in a batch
+type KeyUpdate struct {
+	Keys []string
+	ID   string
+}
+
+// UpdateStats counts the updates that added an ID to at least one key,
+// and the duplicate updates that changed none of their keys. A HyperLogLog
+// may not change for a new ID, so the duplicate count is an upper bound.
+type UpdateStats struct {
+	New            uint64  `json:"new"`
+	Duplicate      uint64  `json:"duplicate"`
+	DuplicateRatio float64 `json:"duplicate_ratio"`
+}
+
+// MemoryEstimate is the estimated memory used by the counters in redis,
+// extrapolated from the memory used by a sample of the keys
+type MemoryEstimate struct {
+	Time           time.Time `json:"time"`
+	Keys           int64     `json:"keys"`
+	SampledKeys    int       `json:"sampled_keys"`
+	SampledBytes   int64     `json:"sampled_bytes"`
+	EstimatedBytes int64     `json:"estimated_bytes"`
+}
+
+// newMemoryEstimate extrapolates the bytes used by the sampled keys
+func newMemoryEstimate(keys int64, sampled int, sampledBytes int64) *MemoryEstimate {
+	out := &MemoryEstimate{
+		Time:         time.Now().UTC(),
+		Keys:         keys,
+		SampledKeys:  sampled,
+		SampledBytes: sampledBytes,
+	}
+	if sampled > 0 {
+		out.EstimatedBytes = int64(float64(sampledBytes) / float64(sampled) * float64(keys))
+	}
+	return out
 }
 
 // PooledClient uses a connection pool for redis
 type PooledClient struct {
+	// updatesNew and updatesDuplicate are updated atomically,
+	// so they are first to keep them 64-bit aligned
+	updatesNew       uint64
+	updatesDuplicate uint64
+
 	pool *redis.Pool
+
+	// expireAfter is how long after the date of a key it should expire.
+	// If zero, keys do not expire.
+	expireAfter time.Duration
+
+	// customInterval is needed to expire the keys of the custom interval,
+	// which do not expire if nil
+	customInterval *CustomIntervalConfig
+
+	// flushSize is the maximum number of commands in a transaction
+	// by UpdateKeys. If zero, DefaultFlushSize is used.
+	flushSize int
+
+	// sampleRate is the fraction of keys that are also counted exactly
+	// to measure the accuracy of the HyperLogLogs. If zero, none are.
+	sampleRate float64
+
+	// ingressRate is the fraction of events counted by the ingress. If
+	// below one, it is recorded in RedisSampleRateKey when a key is
+	// created, so snapshots scale the key by the rate it was counted at.
+	ingressRate float64
+
+	// countScript is used to count keys with a Lua script instead of
+	// a transaction of PFCOUNT commands. If the script fails, GetCounts
+	// falls back to the transaction, logging the first fallback.
+	countScript   bool
+	countFallback sync.Once
+
+	// logger is used to log the count script fallback. If nil,
+	// the default logger is used.
+	logger hclog.Logger
+
+	// hybridThreshold is the number of IDs an approximate key stores in a
+	// set, so it is counted exactly, before it is promoted to a HyperLogLog.
+	// If zero, approximate keys are always a HyperLogLog.
+	hybridThreshold int
+
+	// hybridKeys is set to 1 when a connection finds RedisHybridKey, since
+	// keys may still be sets even if hybridThreshold is zero
+	hybridKeys int32
+
+	// trackDirty adds every updated key to the RedisDirtyKey set,
+	// so incremental snapshots only count the changed keys
+	trackDirty bool
+
+	// trackUpdates records the time every key is updated in the
+	// RedisLastUpdateKey hash, so snapshots skip the unchanged keys
+	trackUpdates bool
+
+	// keyBudget is the number of keys in redis at which UpdateKeys rejects
+	// updates that create a new key. If zero, there is no budget.
+	keyBudget int64
+
+	// keyCountInterval is how long the number of keys is cached
+	keyCountInterval time.Duration
+
+	// keyCount is the number of keys in redis when last checked
+	keyCount     int64
+	keyCountAt   time.Time
+	keyCountLock sync.Mutex
 }
 
 // Setup the redis pool
 func NewPooledClient(addr string) (*PooledClient, error) {
-	pool := &redis.Pool{
+	pc := &PooledClient{}
+	pc.pool = &redis.Pool{
 		MaxIdle:     3,
 		IdleTimeout: 30 * time.Second,
-		Dial:        func() (redis.Conn, error) { return redis.DialURL(addr) },
-	}
-	pc := &PooledClient{
-		pool: pool,
+		Dial: func() (redis.Conn, error) {
+			c, err := redis.DialURL(addr)
+			if err != nil {
+				return nil, err
+			}
+			if err := pc.setupConn(c); err != nil {
+				c.Close()
+				return nil, err
+			}
+			return c, nil
+		},
 	}
 	return pc, nil
 }
 
-func (p *PooledClient) UpdateKeys(keys []string, id string) error {
+// conn gets a connection from the pool for the caller. The pool cannot
+// wait on a context, so a cancelled caller gets a connection that fails
+// every command instead.
+func (p *PooledClient) conn(ctx context.Context) redis.Conn {
+	if err := ctx.Err(); err != nil {
+		return errorConn{err: err}
+	}
+	return p.pool.Get()
+}
+
+// errorConn is a connection that fails with the error
+type errorConn struct {
+	err error
+}
+
+func (e errorConn) Close() error                                   { return nil }
+func (e errorConn) Err() error                                     { return e.err }
+func (e errorConn) Do(string, ...interface{}) (interface{}, error) { return nil, e.err }
+func (e errorConn) Send(string, ...interface{}) error              { return e.err }
+func (e errorConn) Flush() error                                   { return e.err }
+func (e errorConn) Receive() (interface{}, error)                  { return nil, e.err }
+
+// setupConn prepares a new connection. If hybrid keys are enabled, or were
+// enabled before so that some keys may still be sets, the hybrid scripts
+// are loaded so that the connection sends them by their hash.
+func (p *PooledClient) setupConn(c redis.Conn) error {
+	if p.hybridThreshold > 0 {
+		if _, err := c.Do("SET", RedisHybridKey, "1"); err != nil {
+			return err
+		}
+	} else if atomic.LoadInt32(&p.hybridKeys) == 0 {
+		exists, err := redis.Bool(c.Do("EXISTS", RedisHybridKey))
+		if err != nil || !exists {
+			return err
+		}
+	}
+	atomic.StoreInt32(&p.hybridKeys, 1)
+	for _, script := range hybridScripts {
+		if err := script.Load(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hybrid returns if approximate keys may be hybrid keys that are still sets.
+// The scripts handling them are only loaded on connections from the pool.
+func (p *PooledClient) hybrid() bool {
+	return p.hybridThreshold > 0 || atomic.LoadInt32(&p.hybridKeys) == 1
+}
+
+// PoolStats returns the connection pool stats
+func (p *PooledClient) PoolStats() redis.PoolStats {
+	return p.pool.Stats()
+}
+
+// UpdateStats returns the counts of new and duplicate updates
+func (p *PooledClient) UpdateStats() UpdateStats {
+	stats := UpdateStats{
+		New:       atomic.LoadUint64(&p.updatesNew),
+		Duplicate: atomic.LoadUint64(&p.updatesDuplicate),
+	}
+	if total := stats.New + stats.Duplicate; total > 0 {
+		stats.DuplicateRatio = float64(stats.Duplicate) / float64(total)
+	}
+	return stats
+}
+
+// recordUpdate counts an update by whether it changed any key
+func (p *PooledClient) recordUpdate(changed bool) {
+	if changed {
+		atomic.AddUint64(&p.updatesNew, 1)
+	} else {
+		atomic.AddUint64(&p.updatesDuplicate, 1)
+	}
+}
+
+// keysAdded checks the replies of the commands sent by sendUpdate, where
+// commands is the number of commands sent for each key. The first reply
+// for each key is from PFADD, SADD or INCR, and is positive if the key changed.
+func keysAdded(replies []interface{}, commands []int) bool {
+	offset := 0
+	for _, n := range commands {
+		if offset >= len(replies) {
+			break
+		}
+		if added, ok := replies[offset].(int64); ok && added > 0 {
+			return true
+		}
+		offset += n
+	}
+	return false
+}
+
+func (p *PooledClient) UpdateKeys(ctx context.Context, keys []string, id string) error {
 	// Fast path on no-op
 	if len(keys) == 0 {
 		return nil
 	}
 
 	// Get a connection to redis
-	c := p.pool.Get()
+	c := p.conn(ctx)
 	defer c.Close()
 
-	// Increment all the keys in a transaction
+	// Only update existing keys once the key budget is reached
+	if err := p.checkKeyBudget(c, keys); err != nil {
+		return err
+	}
+
+	flushSize := p.flushSize
+	if flushSize <= 0 {
+		flushSize = DefaultFlushSize
+	}
+
+	// Increment all the keys in a transaction, starting a new transaction
+	// once the flush size is reached. The commands for a single key are
+	// never split across transactions.
 	c.Send("MULTI")
+	pending := 0
+	changed := false
+	var commands []int
 	for _, key := range keys {
-		c.Send("PFADD", RedisKeyPrefix+key, id)
+		if pending > 0 && pending+p.keyCommands(key) > flushSize {
+			raw, err := c.Do("EXEC")
+			if err != nil {
+				return err
+			}
+			replies, _ := raw.([]interface{})
+			changed = keysAdded(replies, commands) || changed
+			c.Send("MULTI")
+			pending = 0
+			commands = commands[:0]
+		}
+		n := p.sendUpdate(c, key, id)
+		commands = append(commands, n)
+		pending += n
 	}
-	if _, err := c.Do("EXEC"); err != nil {
+	raw, err := c.Do("EXEC")
+	if err != nil {
 		return err
 	}
+	replies, _ := raw.([]interface{})
+	p.recordUpdate(keysAdded(replies, commands) || changed)
 	return nil
 }
 
-func (p *PooledClient) ListKeys() ([]string, error) {
+func (p *PooledClient) UpdateKeysBatch(ctx context.Context, updates []KeyUpdate) []error {
+	// Fast path on no-op
+	if len(updates) == 0 {
+		return nil
+	}
+
 	// Get a connection to redis
-	c := p.pool.Get()
+	c := p.conn(ctx)
 	defer c.Close()
 
+	// Pipeline all the updates without a transaction
+	commands := make([][]int, len(updates))
+	for idx, update := range updates {
+		for _, key := range update.Keys {
+			commands[idx] = append(commands[idx], p.sendUpdate(c, key, update.ID))
+		}
+	}
+	if err := c.Flush(); err != nil {
+		return batchErrors(len(updates), err)
+	}
+
+	// Read all the replies, keeping the first error of each update.
+	// Updates with an error are not counted as new or duplicate.
+	var errs []error
+	for idx := range updates {
+		var replies []interface{}
+		var updateErr error
+		for _, n := range commands[idx] {
+			for ; n > 0; n-- {
+				reply, err := c.Receive()
+				if err != nil && updateErr == nil {
+					updateErr = err
+				}
+				replies = append(replies, reply)
+			}
+		}
+		if updateErr != nil {
+			if errs == nil {
+				errs = make([]error, len(updates))
+			}
+			errs[idx] = updateErr
+			continue
+		}
+		p.recordUpdate(keysAdded(replies, commands[idx]))
+	}
+	return errs
+}
+
+// batchErrors returns the errors of a batch where every update failed
+func batchErrors(n int, err error) []error {
+	errs := make([]error, n)
+	for idx := range errs {
+		errs[idx] = err
+	}
+	return errs
+}
+
+// checkKeyBudget returns ErrKeyBudget if redis has reached the key budget
+// and any of the keys do not exist. The number of keys is counted with
+// DBSIZE, which is cached for the key count interval.
+func (p *PooledClient) checkKeyBudget(c redis.Conn, keys []string) error {
+	if p.keyBudget <= 0 {
+		return nil
+	}
+	p.keyCountLock.Lock()
+	if time.Since(p.keyCountAt) >= p.keyCountInterval {
+		n, err := redis.Int64(c.Do("DBSIZE"))
+		if err != nil {
+			p.keyCountLock.Unlock()
+			return err
+		}
+		p.keyCount, p.keyCountAt = n, time.Now()
+	}
+	over := p.keyCount >= p.keyBudget
+	p.keyCountLock.Unlock()
+	if !over {
+		return nil
+	}
+
+	// Check if the keys exist in a transaction. A key created concurrently
+	// may still be rejected, so the budget is not exact.
+	c.Send("MULTI")
+	for _, key := range keys {
+		c.Send("EXISTS", RedisKeyPrefix+key)
+	}
+	exists, err := redis.Int64s(c.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+	for _, n := range exists {
+		if n == 0 {
+			return ErrKeyBudget
+		}
+	}
+	return nil
+}
+
+// keyCommands returns the number of commands sendUpdate uses for a key
+func (p *PooledClient) keyCommands(key string) int {
+	n := 1
+	if IsApproxKey(key) && SampledKey(key, p.sampleRate) {
+		n = 2
+	}
+	if _, ok := KeyExpireAt(key, p.expireAfter, p.customInterval); ok {
+		n *= 2
+	}
+	if p.trackDirty {
+		n++
+	}
+	if p.trackUpdates {
+		n++
+	}
+	if p.sampled() {
+		n++
+	}
+	return n
+}
+
+// sampled checks if the ingress sample rate is recorded for the keys
+func (p *PooledClient) sampled() bool {
+	return p.ingressRate > 0 && p.ingressRate < 1
+}
+
+// sendUpdate buffers the commands to set the ID for a key,
+// returning the number of commands sent
+func (p *PooledClient) sendUpdate(c redis.Conn, key, id string) int {
+	keys := []string{RedisKeyPrefix + key}
+	if IsExactKey(key) {
+		c.Send("SADD", RedisKeyPrefix+key, id)
+	} else if IsIncrKey(key) {
+		c.Send("INCR", RedisKeyPrefix+key)
+	} else {
+		if p.hybrid() {
+			// Sets left from when hybrid keys were enabled are promoted
+			// by the next update if the threshold is now zero
+			hybridAddScript.SendHash(c, RedisKeyPrefix+key, id, p.hybridThreshold)
+		} else {
+			c.Send("PFADD", RedisKeyPrefix+key, id)
+		}
+
+		// Count sampled keys exactly as well to measure accuracy
+		if SampledKey(key, p.sampleRate) {
+			c.Send("SADD", RedisSamplePrefix+key, id)
+			keys = append(keys, RedisSamplePrefix+key)
+		}
+	}
+
+	// Refresh the expiration, since adding does not set it
+	n := len(keys)
+	if expireAt, ok := KeyExpireAt(key, p.expireAfter, p.customInterval); ok {
+		for _, k := range keys {
+			c.Send("EXPIREAT", k, expireAt.Unix())
+		}
+		n *= 2
+	}
+
+	// Mark the key dirty for the next incremental snapshot
+	if p.trackDirty {
+		c.Send("SADD", RedisDirtyKey, key)
+		n++
+	}
+
+	// Record when the key changed, so unchanged keys are not counted
+	if p.trackUpdates {
+		c.Send("HSET", RedisLastUpdateKey, key, unixMillis(time.Now()))
+		n++
+	}
+
+	// Record the sample rate the key is counted at, keeping the
+	// rate it was created with if the configured rate changes
+	if p.sampled() {
+		c.Send("HSETNX", RedisSampleRateKey, key, p.ingressRate)
+		n++
+	}
+	return n
+}
+
+// unixMillis returns the time in milliseconds since the unix epoch
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func (p *PooledClient) ListKeys(ctx context.Context) ([]string, error) {
 	// Track all the keys in a map, since redis may return duplicates
 	keyMap := make(map[string]struct{})
+	err := p.ListKeysStream(ctx, func(key string) error {
+		keyMap[key] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert the map to a flat list
+	keys := make([]string, 0, len(keyMap))
+	for key := range keyMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (p *PooledClient) ListKeysStream(ctx context.Context, fn func(key string) error) error {
+	// Get a connection to redis
+	c := p.conn(ctx)
+	defer c.Close()
+
 	var cursor int64 = 0
 	for {
+		// Stop scanning if the caller is cancelled
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		respSet, err := redis.Values(c.Do("SCAN", cursor, "MATCH", RedisKeyPrefix+"*", "COUNT", ScanCount))
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		// Scan all the keys
 		keys := respSet[1].([]interface{})
 		for _, keyRaw := range keys {
-			keyMap[string(keyRaw.([]byte))] = struct{}{}
+			key := strings.TrimPrefix(string(keyRaw.([]byte)), RedisKeyPrefix)
+			if err := fn(key); err != nil {
+				return err
+			}
 		}
 
 		// Update the cursor
 		cursor, err = redis.Int64(respSet[0], nil)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		if cursor == 0 {
-			break
+			return nil
 		}
 	}
-
-	// Convert the map to a flat list
-	keys := make([]string, 0, len(keyMap))
-	for key := range keyMap {
-		keys = append(keys, strings.TrimPrefix(key, RedisKeyPrefix))
-	}
-	sort.Strings(keys)
-	return keys, nil
 }
 
-func (p *PooledClient) GetCounts(keys []string) ([]int64, error) {
+func (p *PooledClient) GetCounts(ctx context.Context, keys []string) ([]int64, error) {
 	// Fast path on no-op
 	if len(keys) == 0 {
 		return nil, nil
 	}
 
 	// Get a connection to redis
-	c := p.pool.Get()
+	c := p.conn(ctx)
 	defer c.Close()
 
-	// Count all the keys in a transaction
+	// Try the script first, falling back to the transaction
+	if p.countScript {
+		out, err := scriptCounts(c, keys, p.hybrid())
+		if err == nil {
+			return out, nil
+		}
+		p.countFallback.Do(func() {
+			logger := p.logger
+			if logger == nil {
+				logger = hclog.Default()
+			}
+			logger.Warn("count script failed, counting keys with transactions instead", "error", err)
+		})
+	}
+
+	// Count all the keys in a transaction. Hybrid keys are counted by
+	// their type, since they are sets until promoted.
 	c.Send("MULTI")
 	for _, key := range keys {
-		c.Send("PFCOUNT", RedisKeyPrefix+key)
+		if IsExactKey(key) {
+			c.Send("SCARD", RedisKeyPrefix+key)
+		} else if IsIncrKey(key) {
+			c.Send("GET", RedisKeyPrefix+key)
+		} else if p.hybrid() {
+			hybridCountScript.SendHash(c, RedisKeyPrefix+key)
+		} else {
+			c.Send("PFCOUNT", RedisKeyPrefix+key)
+		}
 	}
-	raw, err := c.Do("EXEC")
+	rawList, err := redis.Values(c.Do("EXEC"))
 	if err != nil {
 		return nil, err
 	}
-	rawList := raw.([]interface{})
 
-	// Parse the result
+	// Parse the result. Incremented counters are strings, and may have
+	// been deleted since they were listed.
 	out := make([]int64, len(keys))
 	for idx := range keys {
-		count := rawList[idx].(int64)
-		out[idx] = count
+		if rawList[idx] == nil {
+			continue
+		}
+		out[idx], err = redis.Int64(rawList[idx], nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// scriptCounts counts the keys using countScript in batches. The script
+// is evaluated by its hash, and only sent in full if redis has not loaded it.
+// If hybrid is set, the approximate keys are counted by their type.
+func scriptCounts(c redis.Conn, keys []string, hybrid bool) ([]int64, error) {
+	out := make([]int64, 0, len(keys))
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > CountScriptBatchSize {
+			batch = batch[:CountScriptBatchSize]
+		}
+		keys = keys[len(batch):]
+
+		args := make([]interface{}, 0, 1+2*len(batch))
+		args = append(args, len(batch))
+		for _, key := range batch {
+			args = append(args, RedisKeyPrefix+key)
+		}
+		for _, key := range batch {
+			if IsExactKey(key) {
+				args = append(args, "1")
+			} else if IsIncrKey(key) {
+				args = append(args, "2")
+			} else if hybrid {
+				args = append(args, "3")
+			} else {
+				args = append(args, "0")
+			}
+		}
+		counts, err := redis.Int64s(countScript.Do(c, args...))
+		if err != nil {
+			return nil, err
+		}
+		if len(counts) != len(batch) {
+			return nil, fmt.Errorf("count script returned %d counts for %d keys", len(counts), len(batch))
+		}
+		out = append(out, counts...)
 	}
 	return out, nil
 }
 
-func (p *PooledClient) DeleteKeys(keys []string) error {
+func (p *PooledClient) DeleteKeys(ctx context.Context, keys []string) error {
 	// Fast path on no-op
 	if len(keys) == 0 {
 		return nil
 	}
 
 	// Get a connection to redis
-	c := p.pool.Get()
+	c := p.conn(ctx)
 	defer c.Close()
 
-	// Convert from string list to interface list
-	intList := make([]interface{}, len(keys))
-	for idx, key := range keys {
-		intList[idx] = RedisKeyPrefix + key
+	// Convert from string list to interface list, including any
+	// sampled exact count of the keys
+	intList := make([]interface{}, 0, 2*len(keys))
+	updates := make([]interface{}, 0, len(keys)+1)
+	updates = append(updates, RedisLastUpdateKey)
+	for _, key := range keys {
+		intList = append(intList, RedisKeyPrefix+key, RedisSamplePrefix+key)
+		updates = append(updates, key)
 	}
 
-	// Delete all the keys
-	if _, err := c.Do("DEL", intList...); err != nil {
+	rates := make([]interface{}, len(updates))
+	copy(rates, updates)
+	rates[0] = RedisSampleRateKey
+
+	// Delete all the keys, their last update times and sample rates
+	c.Send("MULTI")
+	c.Send("DEL", intList...)
+	c.Send("HDEL", updates...)
+	c.Send("HDEL", rates...)
+	if _, err := c.Do("EXEC"); err != nil {
 		return err
 	}
 	return nil
 }
+
+func (p *PooledClient) GetLastUpdates(ctx context.Context, keys []string) ([]time.Time, error) {
+	// Fast path on no-op
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	// Get a connection to redis
+	c := p.conn(ctx)
+	defer c.Close()
+
+	args := make([]interface{}, 0, len(keys)+1)
+	args = append(args, RedisLastUpdateKey)
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	raw, err := redis.Values(c.Do("HMGET", args...))
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys without an update time are left as the zero time
+	out := make([]time.Time, len(keys))
+	for idx, val := range raw {
+		if val == nil {
+			continue
+		}
+		ms, err := redis.Int64(val, nil)
+		if err != nil {
+			return nil, err
+		}
+		out[idx] = time.Unix(0, ms*int64(time.Millisecond))
+	}
+	return out, nil
+}
+
+func (p *PooledClient) PruneKeyFields(ctx context.Context) (int, error) {
+	// Get a connection to redis
+	c := p.conn(ctx)
+	defer c.Close()
+
+	var pruned int
+	for _, hash := range []string{RedisLastUpdateKey, RedisSampleRateKey} {
+		n, err := pruneHashFields(ctx, c, hash)
+		pruned += n
+		if err != nil {
+			return pruned, err
+		}
+	}
+	return pruned, nil
+}
+
+// pruneHashFields scans the hash of keys, removing the fields of
+// the keys that no longer exist
+func pruneHashFields(ctx context.Context, c redis.Conn, hash string) (int, error) {
+	var pruned int
+	var cursor int64 = 0
+	for {
+		// Stop scanning if the caller is cancelled
+		if err := ctx.Err(); err != nil {
+			return pruned, err
+		}
+		respSet, err := redis.Values(c.Do("HSCAN", hash, cursor, "COUNT", ScanCount))
+		if err != nil {
+			return pruned, err
+		}
+
+		// Check which keys still exist. The fields alternate with their values.
+		entries, err := redis.Strings(respSet[1], nil)
+		if err != nil {
+			return pruned, err
+		}
+		if len(entries) > 0 {
+			c.Send("MULTI")
+			for i := 0; i < len(entries); i += 2 {
+				c.Send("EXISTS", RedisKeyPrefix+entries[i])
+			}
+			exists, err := redis.Int64s(c.Do("EXEC"))
+			if err != nil {
+				return pruned, err
+			}
+			missing := []interface{}{hash}
+			for idx, n := range exists {
+				if n == 0 {
+					missing = append(missing, entries[2*idx])
+				}
+			}
+			if len(missing) > 1 {
+				if _, err := c.Do("HDEL", missing...); err != nil {
+					return pruned, err
+				}
+				pruned += len(missing) - 1
+			}
+		}
+
+		// Update the cursor
+		cursor, err = redis.Int64(respSet[0], nil)
+		if err != nil {
+			return pruned, err
+		}
+		if cursor == 0 {
+			return pruned, nil
+		}
+	}
+}
+
+func (p *PooledClient) SetDomainUpdated(ctx context.Context, t time.Time) error {
+	// Get a connection to redis
+	c := p.conn(ctx)
+	defer c.Close()
+
+	_, err := c.Do("SET", RedisDomainUpdatedKey, unixMillis(t))
+	return err
+}
+
+func (p *PooledClient) GetDomainUpdated(ctx context.Context) (time.Time, error) {
+	// Get a connection to redis
+	c := p.conn(ctx)
+	defer c.Close()
+
+	ms, err := redis.Int64(c.Do("GET", RedisDomainUpdatedKey))
+	if err == redis.ErrNil {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), nil
+}
+
+func (p *PooledClient) SwapDirtyKeys(ctx context.Context) error {
+	// Get a connection to redis
+	c := p.conn(ctx)
+	defer c.Close()
+
+	// Merge into any keys left by a failed snapshot, so they are retried
+	c.Send("MULTI")
+	c.Send("SUNIONSTORE", RedisDirtySnapshotKey, RedisDirtySnapshotKey, RedisDirtyKey)
+	c.Send("DEL", RedisDirtyKey)
+	_, err := c.Do("EXEC")
+	return err
+}
+
+func (p *PooledClient) ListDirtyKeysStream(ctx context.Context, fn func(key string) error) error {
+	// Get a connection to redis
+	c := p.conn(ctx)
+	defer c.Close()
+
+	var cursor int64 = 0
+	for {
+		// Stop scanning if the caller is cancelled
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		respSet, err := redis.Values(c.Do("SSCAN", RedisDirtySnapshotKey, cursor, "COUNT", ScanCount))
+		if err != nil {
+			return err
+		}
+
+		// Scan all the keys
+		keys, err := redis.Strings(respSet[1], nil)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+
+		// Update the cursor
+		cursor, err = redis.Int64(respSet[0], nil)
+		if err != nil {
+			return err
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+func (p *PooledClient) ClearDirtyKeys(ctx context.Context, all bool) error {
+	// Get a connection to redis
+	c := p.conn(ctx)
+	defer c.Close()
+
+	keys := []interface{}{RedisDirtySnapshotKey}
+	if all {
+		keys = append(keys, RedisDirtyKey)
+	}
+	_, err := c.Do("DEL", keys...)
+	return err
+}
+
+func (p *PooledClient) MarkDirtyKeys(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	// Get a connection to redis
+	c := p.conn(ctx)
+	defer c.Close()
+
+	_, err := c.Do("SADD", setArgs(RedisDirtyKey, keys)...)
+	return err
+}
+
+// setArgs returns the arguments to add or remove the members of a set
+func setArgs(set string, members []string) []interface{} {
+	args := make([]interface{}, 0, len(members)+1)
+	args = append(args, set)
+	for _, member := range members {
+		args = append(args, member)
+	}
+	return args
+}
+
+func (p *PooledClient) GetDeadLetters(ctx context.Context) ([]string, error) {
+	// Get a connection to redis
+	c := p.conn(ctx)
+	defer c.Close()
+
+	return redis.Strings(c.Do("SMEMBERS", RedisDeadLetterKey))
+}
+
+func (p *PooledClient) UpdateDeadLetters(ctx context.Context, add, remove []string) error {
+	if len(add) == 0 && len(remove) == 0 {
+		return nil
+	}
+
+	// Get a connection to redis
+	c := p.conn(ctx)
+	defer c.Close()
+
+	c.Send("MULTI")
+	if len(remove) > 0 {
+		c.Send("SREM", setArgs(RedisDeadLetterKey, remove)...)
+	}
+	if len(add) > 0 {
+		c.Send("SADD", setArgs(RedisDeadLetterKey, add)...)
+	}
+	_, err := c.Do("EXEC")
+	return err
+}
+
+func (p *PooledClient) RemoveID(ctx context.Context, keys []string, id string) (int, error) {
+	// Only exact keys, hybrid keys and the accuracy samples store the IDs
+	var sets, approx []string
+	for _, key := range keys {
+		if IsExactKey(key) {
+			sets = append(sets, RedisKeyPrefix+key)
+		} else if IsApproxKey(key) {
+			sets = append(sets, RedisSamplePrefix+key)
+			approx = append(approx, RedisKeyPrefix+key)
+		}
+	}
+
+	// Fast path on no-op
+	if len(sets) == 0 {
+		return 0, nil
+	}
+
+	// Get a connection to redis
+	c := p.conn(ctx)
+	defer c.Close()
+
+	var hybrids []string
+	if p.hybrid() {
+		hybrids = approx
+	}
+
+	// Remove the ID from all the sets in a transaction. Hybrid keys
+	// are only changed if they have not been promoted.
+	c.Send("MULTI")
+	for _, set := range sets {
+		c.Send("SREM", set, id)
+	}
+	for _, key := range hybrids {
+		hybridRemoveScript.SendHash(c, key, id)
+	}
+	raw, err := redis.Int64s(c.Do("EXEC"))
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, n := range raw {
+		if n > 0 {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (p *PooledClient) MoveKeys(ctx context.Context, moves []KeyMove, del bool) error {
+	// Fast path on no-op
+	if len(moves) == 0 {
+		return nil
+	}
+
+	// Get a connection to redis
+	c := p.conn(ctx)
+	defer c.Close()
+
+	// Merge all the keys in a transaction, since the destination may
+	// already have values. The expiration is set since merging does not.
+	c.Send("MULTI")
+	for _, move := range moves {
+		from, to := RedisKeyPrefix+move.From, RedisKeyPrefix+move.To
+		if IsExactKey(move.To) {
+			c.Send("SUNIONSTORE", to, to, from)
+		} else if IsIncrKey(move.To) {
+			moveCountScript.Send(c, from, to)
+		} else if p.hybrid() {
+			hybridMergeScript.SendHash(c, 2, to, from)
+		} else {
+			c.Send("PFMERGE", to, from)
+		}
+
+		// The accuracy samples of approximate keys are merged as well, so
+		// the exact counts still match the merged counters
+		sampleTo := RedisSamplePrefix + move.To
+		if IsApproxKey(move.To) {
+			c.Send("SUNIONSTORE", sampleTo, sampleTo, RedisSamplePrefix+move.From)
+		}
+		if expireAt, ok := KeyExpireAt(move.To, p.expireAfter, p.customInterval); ok {
+			c.Send("EXPIREAT", to, expireAt.Unix())
+			if IsApproxKey(move.To) {
+				c.Send("EXPIREAT", sampleTo, expireAt.Unix())
+			}
+		}
+		if p.trackDirty {
+			c.Send("SADD", RedisDirtyKey, move.To)
+		}
+		if p.trackUpdates {
+			c.Send("HSET", RedisLastUpdateKey, move.To, unixMillis(time.Now()))
+		}
+		moveSampleRateScript.Send(c, RedisSampleRateKey, move.From, move.To)
+		if del {
+			c.Send("DEL", from, RedisSamplePrefix+move.From)
+			c.Send("HDEL", RedisLastUpdateKey, move.From)
+			c.Send("HDEL", RedisSampleRateKey, move.From)
+		}
+	}
+	if _, err := c.Do("EXEC"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (p *PooledClient) GetHLLs(ctx context.Context, keys []string) ([][]byte, error) {
+	// Fast path on no-op
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	// Get a connection to redis
+	c := p.conn(ctx)
+	defer c.Close()
+
+	// Read all the keys in a transaction. HyperLogLogs are stored as strings.
+	// Exact and incremented counters have no HyperLogLog, so they are skipped.
+	// Hybrid keys that are still sets are converted in a temporary key.
+	var indexes []int
+	prefix := RedisTempPrefix + uuid.GenerateUUID() + ":"
+	c.Send("MULTI")
+	for idx, key := range keys {
+		if !IsApproxKey(key) {
+			continue
+		}
+		if p.hybrid() {
+			hybridGetScript.SendHash(c, RedisKeyPrefix+key, prefix+strconv.Itoa(idx))
+		} else {
+			c.Send("GET", RedisKeyPrefix+key)
+		}
+		indexes = append(indexes, idx)
+	}
+	raw, err := redis.Values(c.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the result
+	out := make([][]byte, len(keys))
+	for i, idx := range indexes {
+		if raw[i] == nil {
+			continue
+		}
+		out[idx], err = redis.Bytes(raw[i], nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (p *PooledClient) MergeHLLs(ctx context.Context, hlls [][]byte) (int64, error) {
+	// Fast path on no-op
+	if len(hlls) == 0 {
+		return 0, nil
+	}
+
+	// Get a connection to redis
+	c := p.conn(ctx)
+	defer c.Close()
+
+	// Restore each register into a temporary key, merge them, count the
+	// result, and clean up all in a single transaction
+	prefix := RedisTempPrefix + uuid.GenerateUUID() + ":"
+	dest := prefix + "merged"
+	temps := make([]interface{}, 0, len(hlls)+1)
+	temps = append(temps, dest)
+	c.Send("MULTI")
+	for idx, hll := range hlls {
+		key := prefix + strconv.Itoa(idx)
+		temps = append(temps, key)
+		c.Send("SET", key, hll)
+	}
+	c.Send("PFMERGE", temps...)
+	c.Send("PFCOUNT", dest)
+	c.Send("DEL", temps...)
+	raw, err := redis.Values(c.Do("EXEC"))
+	if err != nil {
+		return 0, err
+	}
+	return redis.Int64(raw[len(hlls)+1], nil)
+}
+
+func (p *PooledClient) GetSampleRates(ctx context.Context, keys []string) ([]float64, error) {
+	// Fast path on no-op
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	// Get a connection to redis
+	c := p.conn(ctx)
+	defer c.Close()
+
+	args := make([]interface{}, 0, len(keys)+1)
+	args = append(args, RedisSampleRateKey)
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	raw, err := redis.Values(c.Do("HMGET", args...))
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys without a sample rate are left as zero
+	out := make([]float64, len(keys))
+	for idx, val := range raw {
+		if val == nil {
+			continue
+		}
+		out[idx], err = redis.Float64(val, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (p *PooledClient) GetSampleCounts(ctx context.Context, keys []string) ([]int64, error) {
+	// Fast path on no-op
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	// Get a connection to redis
+	c := p.conn(ctx)
+	defer c.Close()
+
+	// Count all the sample sets in a transaction
+	c.Send("MULTI")
+	for _, key := range keys {
+		c.Send("SCARD", RedisSamplePrefix+key)
+	}
+	raw, err := redis.Int64s(c.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+func (p *PooledClient) MergeKeys(ctx context.Context, groups [][]string, withHLL bool) ([]int64, [][]byte, error) {
+	// Fast path on no-op
+	if len(groups) == 0 {
+		return nil, nil, nil
+	}
+
+	// Get a connection to redis
+	c := p.conn(ctx)
+	defer c.Close()
+
+	// Merge each group into a temporary key, count the result, and
+	// clean up all in a single transaction
+	prefix := RedisTempPrefix + uuid.GenerateUUID() + ":"
+	c.Send("MULTI")
+	for idx, keys := range groups {
+		dest := prefix + strconv.Itoa(idx)
+		args := make([]interface{}, 0, len(keys)+1)
+		args = append(args, dest)
+		for _, key := range keys {
+			args = append(args, RedisKeyPrefix+key)
+		}
+		if p.hybrid() {
+			hybridMergeScript.SendHash(c, append([]interface{}{len(args)}, args...)...)
+		} else {
+			c.Send("PFMERGE", args...)
+		}
+		c.Send("PFCOUNT", dest)
+		if withHLL {
+			c.Send("GET", dest)
+		}
+		c.Send("DEL", dest)
+	}
+	raw, err := redis.Values(c.Do("EXEC"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Parse the result, skipping the PFMERGE and DEL replies
+	step := 3
+	if withHLL {
+		step = 4
+	}
+	counts := make([]int64, len(groups))
+	var hlls [][]byte
+	if withHLL {
+		hlls = make([][]byte, len(groups))
+	}
+	for idx := range groups {
+		counts[idx], err = redis.Int64(raw[idx*step+1], nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if withHLL {
+			hlls[idx], err = redis.Bytes(raw[idx*step+2], nil)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return counts, hlls, nil
+}
+
+func (p *PooledClient) AcquireLock(ctx context.Context, name string, ttl time.Duration) (string, bool, error) {
+	// Get a connection to redis
+	c := p.conn(ctx)
+	defer c.Close()
+
+	// Set the lock only if it is not already held
+	token := uuid.GenerateUUID()
+	ms := int64(ttl / time.Millisecond)
+	_, err := redis.String(c.Do("SET", RedisLockPrefix+name, token, "NX", "PX", ms))
+	if err == redis.ErrNil {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return token, true, nil
+}
+
+func (p *PooledClient) RenewLock(ctx context.Context, name, token string, ttl time.Duration) (bool, error) {
+	// Get a connection to redis
+	c := p.conn(ctx)
+	defer c.Close()
+
+	ms := int64(ttl / time.Millisecond)
+	return redis.Bool(renewScript.Do(c, RedisLockPrefix+name, token, ms))
+}
+
+func (p *PooledClient) ReleaseLock(ctx context.Context, name, token string) error {
+	// Get a connection to redis
+	c := p.conn(ctx)
+	defer c.Close()
+
+	_, err := releaseScript.Do(c, RedisLockPrefix+name, token)
+	return err
+}
+
+// MemoryEstimate scans every key to count them and pick a uniform sample,
+// then measures the sample with MEMORY USAGE. The scan costs as much as a
+// full snapshot listing, so it should only run on one server at a time.
+func (p *PooledClient) MemoryEstimate(ctx context.Context, sample int) (*MemoryEstimate, error) {
+	// Count every key, keeping a uniform random sample using reservoir sampling
+	var keys int64
+	var sampled []string
+	err := p.ListKeysStream(ctx, func(key string) error {
+		keys++
+		if len(sampled) < sample {
+			sampled = append(sampled, key)
+		} else if idx := rand.Int63n(keys); idx < int64(sample) {
+			sampled[idx] = key
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(sampled) == 0 {
+		return newMemoryEstimate(keys, 0, 0), nil
+	}
+
+	// Get a connection to redis
+	c := p.conn(ctx)
+	defer c.Close()
+
+	// Measure the sampled keys, skipping any deleted since the scan
+	c.Send("MULTI")
+	for _, key := range sampled {
+		c.Send("MEMORY", "USAGE", RedisKeyPrefix+key)
+	}
+	raw, err := redis.Values(c.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+	var measured int
+	var bytes int64
+	for _, r := range raw {
+		if r == nil {
+			continue
+		}
+		n, err := redis.Int64(r, nil)
+		if err != nil {
+			return nil, err
+		}
+		measured++
+		bytes += n
+	}
+	return newMemoryEstimate(keys, measured, bytes), nil
+}
+
+// SampledKey checks if a key is sampled for accuracy at the given rate.
+// Keys are sampled by a hash so the same keys are always sampled.
+func SampledKey(key string, rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	return float64(crc32.ChecksumIEEE([]byte(key))) < rate*(1<<32)
+}
+
+// IsExactKey checks if a key is counted exactly using a set
+func IsExactKey(key string) bool {
+	return strings.HasPrefix(key, ExactKeyPrefix)
+}
+
+// IsIncrKey checks if a key counts every event using INCR
+func IsIncrKey(key string) bool {
+	return strings.HasPrefix(key, IncrKeyPrefix)
+}
+
+// IsApproxKey checks if a key counts unique IDs using a HyperLogLog
+func IsApproxKey(key string) bool {
+	return !IsExactKey(key) && !IsIncrKey(key)
+}
+
+// KeyExpireAt returns when a key should expire, which is a fixed duration
+// after the end of the interval of the key. Measuring from the start would
+// expire keys of long intervals, like quarters, while they can still be
+// updated. Returns false if the key should not expire.
+func KeyExpireAt(key string, after time.Duration, custom *CustomIntervalConfig) (time.Time, bool) {
+	if after <= 0 {
+		return time.Time{}, false
+	}
+	parsed, err := ParseKey(key, custom)
+	if err != nil {
+		return time.Time{}, false
+	}
+	end, ok := IntervalEnd(parsed.Interval, parsed.Date, custom)
+	if !ok {
+		return time.Time{}, false
+	}
+	return end.Add(after), true
+}
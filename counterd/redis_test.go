@@ -1,70 +1,311 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"os"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/garyburd/redigo/redis"
+	hclog "github.com/hashicorp/go-hclog"
 	"github.com/stretchr/testify/assert"
 )
 
-type MockRedisClient struct {
-	counters map[string]map[string]struct{}
-	sync.Mutex
-}
+// MockRedisClient is the in-memory redis client, used as the test double
+type MockRedisClient = MemoryRedisClient
 
 func NewMockRedisClient() *MockRedisClient {
-	return &MockRedisClient{
-		counters: make(map[string]map[string]struct{}),
+	return NewMemoryRedisClient()
+}
+
+// recordingConn is a redis connection that records the commands sent.
+// EXEC replies with exec, and Receive replies with each of received.
+type recordingConn struct {
+	l        sync.Mutex
+	commands []string
+	exec     []interface{}
+	received []interface{}
+}
+
+func (r *recordingConn) Close() error { return nil }
+func (r *recordingConn) Err() error   { return nil }
+func (r *recordingConn) Flush() error { return nil }
+
+func (r *recordingConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if err := r.Send(cmd, args...); err != nil {
+		return nil, err
+	}
+	if cmd == "EXEC" && r.exec != nil {
+		return r.exec, nil
 	}
+	return nil, nil
 }
 
-func (m *MockRedisClient) UpdateKeys(keys []string, id string) error {
-	m.Lock()
-	defer m.Unlock()
-	for _, key := range keys {
-		vals := m.counters[key]
-		if vals == nil {
-			vals = make(map[string]struct{})
-			m.counters[key] = vals
-		}
-		vals[id] = struct{}{}
+func (r *recordingConn) Send(cmd string, args ...interface{}) error {
+	// The pool flushes connections with an empty command
+	if cmd == "" {
+		return nil
 	}
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.commands = append(r.commands, cmd)
 	return nil
 }
 
-func (m *MockRedisClient) ListKeys() ([]string, error) {
-	m.Lock()
-	defer m.Unlock()
+func (r *recordingConn) Receive() (interface{}, error) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	if len(r.received) == 0 {
+		return nil, nil
+	}
+	reply := r.received[0]
+	r.received = r.received[1:]
+	return reply, nil
+}
 
-	out := make([]string, 0, len(m.counters))
-	for key := range m.counters {
-		out = append(out, key)
+func TestPooledClient_UpdateKeysFlushSize(t *testing.T) {
+	conn := &recordingConn{}
+	client := &PooledClient{
+		pool: &redis.Pool{
+			Dial: func() (redis.Conn, error) { return conn, nil },
+		},
+		flushSize: 3,
 	}
-	sort.Strings(out)
-	return out, nil
+	ctx := context.Background()
+
+	keys := []string{"a", "b", "c", "d", "e"}
+	assert.Nil(t, client.UpdateKeys(ctx, keys, "1234"))
+	assert.Equal(t, []string{
+		"MULTI", "PFADD", "PFADD", "PFADD", "EXEC",
+		"MULTI", "PFADD", "PFADD", "EXEC",
+	}, conn.commands)
+
+	// The expiration of a key is kept in the same transaction
+	conn.commands = nil
+	client.expireAfter = time.Hour
+	keys = []string{"day:2017-01-18:foo:bar", "day:2017-01-18:foo:baz"}
+	assert.Nil(t, client.UpdateKeys(ctx, keys, "1234"))
+	assert.Equal(t, []string{
+		"MULTI", "PFADD", "EXPIREAT", "EXEC",
+		"MULTI", "PFADD", "EXPIREAT", "EXEC",
+	}, conn.commands)
+
+	// By default everything is in a single transaction
+	conn.commands = nil
+	client.flushSize = 0
+	client.expireAfter = 0
+	assert.Nil(t, client.UpdateKeys(ctx, []string{"a", "b", "c", "d", "e"}, "1234"))
+	assert.Equal(t, []string{
+		"MULTI", "PFADD", "PFADD", "PFADD", "PFADD", "PFADD", "EXEC",
+	}, conn.commands)
 }
 
-func (m *MockRedisClient) GetCounts(keys []string) ([]int64, error) {
-	m.Lock()
-	defer m.Unlock()
+func TestPooledClient_UpdateKeysSampled(t *testing.T) {
+	conn := &recordingConn{}
+	client := &PooledClient{
+		pool: &redis.Pool{
+			Dial: func() (redis.Conn, error) { return conn, nil },
+		},
+		sampleRate: 1,
+		flushSize:  4,
+	}
+	ctx := context.Background()
+
+	// Sampled keys are also added to a set, in the same transaction
+	keys := []string{"day:2017-01-18:foo:bar", "exact:day:2017-01-18:foo:bar", "day:2017-01-18:foo:baz"}
+	assert.Nil(t, client.UpdateKeys(ctx, keys, "1234"))
+	assert.Equal(t, []string{
+		"MULTI", "PFADD", "SADD", "SADD", "EXEC",
+		"MULTI", "PFADD", "SADD", "EXEC",
+	}, conn.commands)
+}
 
-	out := make([]int64, len(keys))
-	for idx, key := range keys {
-		ids := m.counters[key]
-		out[idx] = int64(len(ids))
+func TestPooledClient_MoveKeysSampled(t *testing.T) {
+	conn := &recordingConn{}
+	client := &PooledClient{
+		pool: &redis.Pool{
+			Dial: func() (redis.Conn, error) { return conn, nil },
+		},
+		expireAfter: time.Hour,
 	}
-	return out, nil
+	ctx := context.Background()
+
+	// The accuracy samples of approximate keys move with the counters
+	moves := []KeyMove{
+		{From: "day:2017-01-18:foo:bar", To: "v2:day:2017-01-18:3:foo3:bar"},
+		{From: "exact:day:2017-01-18:foo:bar", To: "exact:v2:day:2017-01-18:3:foo3:bar"},
+	}
+	assert.Nil(t, client.MoveKeys(ctx, moves, true))
+	assert.Equal(t, []string{
+		"MULTI",
+		"PFMERGE", "SUNIONSTORE", "EXPIREAT", "EXPIREAT", "EVAL", "DEL", "HDEL", "HDEL",
+		"SUNIONSTORE", "EXPIREAT", "EVAL", "DEL", "HDEL", "HDEL",
+		"EXEC",
+	}, conn.commands)
 }
 
-func (m *MockRedisClient) DeleteKeys(keys []string) error {
-	m.Lock()
-	defer m.Unlock()
-	for _, key := range keys {
-		delete(m.counters, key)
+func TestPooledClient_UpdateKeysHybrid(t *testing.T) {
+	conn := &recordingConn{}
+	client := &PooledClient{
+		pool: &redis.Pool{
+			Dial: func() (redis.Conn, error) { return conn, nil },
+		},
+		hybridThreshold: 10,
 	}
-	return nil
+	ctx := context.Background()
+
+	// Only approximate keys are hybrid
+	keys := []string{"day:2017-01-18:foo:bar", "exact:day:2017-01-18:foo:bar", "incr:day:2017-01-18:foo:bar"}
+	assert.Nil(t, client.UpdateKeys(ctx, keys, "1234"))
+	assert.Equal(t, []string{"MULTI", "EVALSHA", "SADD", "INCR", "EXEC"}, conn.commands)
+}
+
+func TestPooledClient_SetupConnHybrid(t *testing.T) {
+	conn := &recordingConn{}
+	client := &PooledClient{hybridThreshold: 10}
+
+	// The marker is set and the scripts are loaded once per connection
+	assert.Equal(t, int32(0), client.hybridKeys)
+	assert.Nil(t, client.setupConn(conn))
+	assert.Equal(t, []string{"SET", "SCRIPT", "SCRIPT", "SCRIPT", "SCRIPT", "SCRIPT"}, conn.commands)
+	assert.Equal(t, int32(1), client.hybridKeys)
+
+	// Once hybrid keys are found, they are handled even if disabled
+	conn.commands = nil
+	client.hybridThreshold = 0
+	assert.True(t, client.hybrid())
+	assert.Nil(t, client.setupConn(conn))
+	assert.Equal(t, []string{"SCRIPT", "SCRIPT", "SCRIPT", "SCRIPT", "SCRIPT"}, conn.commands)
+}
+
+func TestPooledClient_CancelledContext(t *testing.T) {
+	conn := &recordingConn{}
+	client := &PooledClient{
+		pool: &redis.Pool{
+			Dial: func() (redis.Conn, error) { return conn, nil },
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Nothing is sent once the caller is cancelled
+	assert.Equal(t, context.Canceled, client.UpdateKeys(ctx, []string{"day:2017-01-18:foo:bar"}, "1234"))
+	_, err := client.GetCounts(ctx, []string{"day:2017-01-18:foo:bar"})
+	assert.Equal(t, context.Canceled, err)
+	assert.Empty(t, conn.commands)
+}
+
+func TestPooledClient_CountScriptFallback(t *testing.T) {
+	var buf bytes.Buffer
+	conn := &recordingConn{exec: []interface{}{int64(1)}}
+	client := &PooledClient{
+		pool: &redis.Pool{
+			Dial: func() (redis.Conn, error) { return conn, nil },
+		},
+		countScript: true,
+		logger:      hclog.New(&hclog.LoggerOptions{Output: &buf}),
+	}
+	ctx := context.Background()
+
+	// The script is evaluated by its hash, and the transaction is used
+	// if it fails. Only the first fallback is logged.
+	for i := 0; i < 2; i++ {
+		counts, err := client.GetCounts(ctx, []string{"day:2017-01-18:foo:bar"})
+		assert.Nil(t, err)
+		assert.Equal(t, []int64{1}, counts)
+	}
+	assert.Equal(t, []string{
+		"EVALSHA", "MULTI", "PFCOUNT", "EXEC",
+		"EVALSHA", "MULTI", "PFCOUNT", "EXEC",
+	}, conn.commands)
+	assert.Equal(t, 1, strings.Count(buf.String(), "count script failed"))
+}
+
+func TestPooledClient_KeyBudget(t *testing.T) {
+	conn := &recordingConn{}
+	client := &PooledClient{
+		pool: &redis.Pool{
+			Dial: func() (redis.Conn, error) { return conn, nil },
+		},
+		keyBudget:        10,
+		keyCountInterval: time.Minute,
+		keyCount:         10,
+		keyCountAt:       time.Now(),
+	}
+	ctx := context.Background()
+	keys := []string{"day:2017-01-18:foo:bar", "day:2017-01-18:foo:baz"}
+
+	// A missing key is rejected, using the cached key count
+	conn.exec = []interface{}{int64(1), int64(0)}
+	assert.Equal(t, ErrKeyBudget, client.UpdateKeys(ctx, keys, "1234"))
+	assert.Equal(t, []string{"MULTI", "EXISTS", "EXISTS", "EXEC"}, conn.commands)
+
+	// Existing keys are updated
+	conn.commands = nil
+	conn.exec = []interface{}{int64(1), int64(1)}
+	assert.Nil(t, client.UpdateKeys(ctx, keys, "1234"))
+	assert.Equal(t, []string{"MULTI", "EXISTS", "EXISTS", "EXEC", "MULTI", "PFADD", "PFADD", "EXEC"}, conn.commands)
+
+	// Nothing is checked under the budget
+	conn.commands = nil
+	client.keyCount = 9
+	assert.Nil(t, client.UpdateKeys(ctx, keys, "1234"))
+	assert.Equal(t, []string{"MULTI", "PFADD", "PFADD", "EXEC"}, conn.commands)
+}
+
+func TestPooledClient_UpdateStats(t *testing.T) {
+	conn := &recordingConn{}
+	client := &PooledClient{
+		pool: &redis.Pool{
+			Dial: func() (redis.Conn, error) { return conn, nil },
+		},
+		expireAfter: time.Hour,
+	}
+	ctx := context.Background()
+	keys := []string{"day:2017-01-18:foo:bar", "day:2017-01-18:foo:baz"}
+
+	// An update is new if any key changed
+	conn.exec = []interface{}{int64(0), int64(1), int64(1), int64(1)}
+	assert.Nil(t, client.UpdateKeys(ctx, keys, "1234"))
+	assert.Equal(t, UpdateStats{New: 1}, client.UpdateStats())
+
+	// The EXPIREAT replies are ignored
+	conn.exec = []interface{}{int64(0), int64(1), int64(0), int64(1)}
+	assert.Nil(t, client.UpdateKeys(ctx, keys, "1234"))
+	assert.Equal(t, UpdateStats{New: 1, Duplicate: 1, DuplicateRatio: 0.5}, client.UpdateStats())
+
+	// Each update in a batch is counted
+	conn.received = []interface{}{
+		int64(0), int64(1), int64(0), int64(1),
+		int64(1), int64(1),
+	}
+	batch := []KeyUpdate{
+		{Keys: keys, ID: "1234"},
+		{Keys: keys[:1], ID: "2345"},
+	}
+	assert.Nil(t, client.UpdateKeysBatch(ctx, batch))
+	assert.Equal(t, UpdateStats{New: 2, Duplicate: 2, DuplicateRatio: 0.5}, client.UpdateStats())
+}
+
+func TestSampledKey(t *testing.T) {
+	assert.False(t, SampledKey("day:2017-01-18:foo:bar", 0))
+	assert.True(t, SampledKey("day:2017-01-18:foo:bar", 1))
+
+	// Sampling is deterministic and close to the rate
+	sampled := 0
+	for i := 0; i < 10000; i++ {
+		key := "day:2017-01-18:id:" + strconv.Itoa(i)
+		if SampledKey(key, 0.1) {
+			sampled++
+		}
+		assert.Equal(t, SampledKey(key, 0.1), SampledKey(key, 0.1))
+	}
+	assert.InDelta(t, 1000, sampled, 150)
 }
 
 // IsReidsInteg checks for the INTEG and REDIS_ADDR env vars
@@ -85,28 +326,511 @@ func TestRedisInteg(t *testing.T) {
 
 	client, err := NewPooledClient(redisAddr)
 	assert.Nil(t, err)
+	ctx := context.Background()
 
 	// Update the keys
 	keys := []string{"bar", "baz", "foo"}
-	assert.Nil(t, client.UpdateKeys(keys, "1234"))
-	assert.Nil(t, client.UpdateKeys(keys, "2345"))
+	assert.Nil(t, client.UpdateKeys(ctx, keys, "1234"))
+	assert.Nil(t, client.UpdateKeys(ctx, keys, "2345"))
 
 	// Check the keys exist
-	out, err := client.ListKeys()
+	out, err := client.ListKeys(ctx)
 	assert.Nil(t, err)
 	assert.Equal(t, keys, out)
 
 	// Verify the counts
-	counts, err := client.GetCounts(keys)
+	counts, err := client.GetCounts(ctx, keys)
 	assert.Nil(t, err)
 	expect := []int64{2, 2, 2}
 	assert.Equal(t, expect, counts)
 
+	// Merge the raw values
+	assert.Nil(t, client.UpdateKeys(ctx, []string{"foo"}, "3456"))
+	hlls, err := client.GetHLLs(ctx, keys)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(hlls))
+	merged, err := client.MergeHLLs(ctx, hlls)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), merged)
+
+	// Batch update the keys
+	batch := []KeyUpdate{
+		{Keys: keys, ID: "4567"},
+		{Keys: keys[:1], ID: "5678"},
+	}
+	assert.Nil(t, client.UpdateKeysBatch(ctx, batch))
+	counts, err = client.GetCounts(ctx, keys)
+	assert.Nil(t, err)
+	expect = []int64{4, 3, 4}
+	assert.Equal(t, expect, counts)
+
+	// Merge the keys in groups, treating missing keys as empty
+	merges, mergedHLLs, err := client.MergeKeys(ctx, [][]string{{"bar", "foo"}, {"baz", "missing"}}, true)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{5, 3}, merges)
+	assert.Equal(t, 2, len(mergedHLLs))
+	merged, err = client.MergeHLLs(ctx, mergedHLLs)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), merged)
+
 	// Delete all the keys
-	assert.Nil(t, client.DeleteKeys(keys))
+	assert.Nil(t, client.DeleteKeys(ctx, keys))
 
 	// Ensure there are no keys
-	out, err = client.ListKeys()
+	out, err = client.ListKeys(ctx)
 	assert.Nil(t, err)
 	assert.Equal(t, []string{}, out)
 }
+
+func TestRedisInteg_CountScript(t *testing.T) {
+	redisAddr, integ := IsRedisInteg()
+	if !integ {
+		t.SkipNow()
+	}
+
+	client, err := NewPooledClient(redisAddr)
+	assert.Nil(t, err)
+	client.countScript = true
+	ctx := context.Background()
+
+	// Count a mix of exact, estimated and missing keys
+	keys := []string{"day:2017-01-18:foo:bar", "exact:day:2017-01-18:foo:bar"}
+	defer client.DeleteKeys(ctx, keys)
+	assert.Nil(t, client.UpdateKeys(ctx, keys, "1234"))
+	assert.Nil(t, client.UpdateKeys(ctx, keys[1:], "2345"))
+
+	counts, err := client.GetCounts(ctx, append(keys, "missing"))
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1, 2, 0}, counts)
+}
+
+func TestRedisInteg_SampledEstimate(t *testing.T) {
+	redisAddr, integ := IsRedisInteg()
+	if !integ {
+		t.SkipNow()
+	}
+
+	client, err := NewPooledClient(redisAddr)
+	assert.Nil(t, err)
+	ctx := context.Background()
+
+	// Count a sample of 100k users in a HyperLogLog
+	const users, rate = 100000, 0.1
+	key := "day:2017-01-18:sampled:true"
+	defer client.DeleteKeys(ctx, []string{key})
+	for i := 0; i < users; i++ {
+		id := "user-" + strconv.Itoa(i)
+		if SampledID(id, rate) {
+			assert.Nil(t, client.UpdateKeys(ctx, []string{key}, id))
+		}
+	}
+
+	// The scaled estimate is within the HyperLogLog and sampling error
+	counts, err := client.GetCounts(ctx, []string{key})
+	assert.Nil(t, err)
+	assert.InEpsilon(t, users, float64(counts[0])/rate, 0.05)
+}
+
+func TestRedisInteg_Increments(t *testing.T) {
+	redisAddr, integ := IsRedisInteg()
+	if !integ {
+		t.SkipNow()
+	}
+
+	client, err := NewPooledClient(redisAddr)
+	assert.Nil(t, err)
+	ctx := context.Background()
+
+	keys := []string{"incr:day:2017-01-18:foo:bar", "incr:v2:day:2017-01-18:3:foo3:bar"}
+	defer client.DeleteKeys(ctx, keys)
+	assert.Nil(t, client.UpdateKeys(ctx, keys[:1], ""))
+	assert.Nil(t, client.UpdateKeys(ctx, keys[:1], ""))
+	assert.Nil(t, client.UpdateKeys(ctx, keys[1:], ""))
+
+	// Count with both the transaction and the script
+	for _, script := range []bool{false, true} {
+		client.countScript = script
+		counts, err := client.GetCounts(ctx, append(keys, "incr:missing"))
+		assert.Nil(t, err)
+		assert.Equal(t, []int64{2, 1, 0}, counts)
+	}
+
+	// Moving adds the counts
+	assert.Nil(t, client.MoveKeys(ctx, []KeyMove{{From: keys[0], To: keys[1]}}, true))
+	counts, err := client.GetCounts(ctx, keys)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{0, 3}, counts)
+}
+
+func TestRedisInteg_Hybrid(t *testing.T) {
+	redisAddr, integ := IsRedisInteg()
+	if !integ {
+		t.SkipNow()
+	}
+
+	client, err := NewPooledClient(redisAddr)
+	assert.Nil(t, err)
+	client.hybridThreshold = 10
+	ctx := context.Background()
+
+	keys := []string{"day:2017-01-18:foo:bar", "day:2017-01-18:foo:baz"}
+	defer client.DeleteKeys(ctx, keys)
+	typeOf := func(key string) string {
+		c := client.pool.Get()
+		defer c.Close()
+		out, _ := redis.String(c.Do("TYPE", RedisKeyPrefix+key))
+		return out
+	}
+
+	// Keys are exact sets until the threshold
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, client.UpdateKeys(ctx, keys, strconv.Itoa(i)))
+	}
+	assert.Nil(t, client.UpdateKeys(ctx, keys[1:], "10"))
+	assert.Equal(t, "set", typeOf(keys[0]))
+	assert.Equal(t, "string", typeOf(keys[1]))
+
+	// Both kinds are counted, with the transaction and the script
+	for _, script := range []bool{false, true} {
+		client.countScript = script
+		counts, err := client.GetCounts(ctx, append(keys, "missing"))
+		assert.Nil(t, err)
+		assert.Equal(t, []int64{10, 11, 0}, counts)
+	}
+
+	// Sets are converted to a HyperLogLog without promoting them
+	hlls, err := client.GetHLLs(ctx, keys)
+	assert.Nil(t, err)
+	count, err := client.MergeHLLs(ctx, hlls)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), count)
+	assert.Equal(t, "set", typeOf(keys[0]))
+
+	merged, _, err := client.MergeKeys(ctx, [][]string{keys}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{11}, merged)
+
+	// IDs are removed from sets
+	removed, err := client.RemoveID(ctx, keys[:1], "0")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+
+	// Moving into a set promotes it
+	assert.Nil(t, client.MoveKeys(ctx, []KeyMove{{From: keys[1], To: keys[0]}}, true))
+	assert.Equal(t, "string", typeOf(keys[0]))
+	counts, err := client.GetCounts(ctx, keys)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{11, 0}, counts)
+
+	// Disabling hybrid keys still counts the sets, and promotes them
+	assert.Nil(t, client.UpdateKeys(ctx, keys[1:], "1"))
+	disabled, err := NewPooledClient(redisAddr)
+	assert.Nil(t, err)
+	counts, err = disabled.GetCounts(ctx, keys)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{11, 1}, counts)
+	assert.Nil(t, disabled.UpdateKeys(ctx, keys[1:], "2"))
+	assert.Equal(t, "string", typeOf(keys[1]))
+	counts, err = disabled.GetCounts(ctx, keys)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{11, 2}, counts)
+}
+
+func TestRedisInteg_RemoveID(t *testing.T) {
+	redisAddr, integ := IsRedisInteg()
+	if !integ {
+		t.SkipNow()
+	}
+
+	client, err := NewPooledClient(redisAddr)
+	assert.Nil(t, err)
+	client.sampleRate = 1
+	ctx := context.Background()
+
+	keys := []string{"exact:day:2017-01-18:foo:bar", "day:2017-01-18:foo:bar", "incr:day:2017-01-18:foo:bar"}
+	defer client.DeleteKeys(ctx, keys)
+	assert.Nil(t, client.UpdateKeys(ctx, keys[:2], "1234"))
+	assert.Nil(t, client.UpdateKeys(ctx, keys[:2], "5678"))
+
+	// The ID is removed from the exact set and the accuracy sample
+	removed, err := client.RemoveID(ctx, keys, "1234")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, removed)
+
+	counts, err := client.GetCounts(ctx, keys[:1])
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1}, counts)
+	samples, err := client.GetSampleCounts(ctx, keys[1:2])
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1}, samples)
+}
+
+func TestRedisInteg_DirtyKeys(t *testing.T) {
+	redisAddr, integ := IsRedisInteg()
+	if !integ {
+		t.SkipNow()
+	}
+
+	client, err := NewPooledClient(redisAddr)
+	assert.Nil(t, err)
+	client.trackDirty = true
+	ctx := context.Background()
+
+	keys := []string{"day:2017-01-18:foo:bar", "exact:day:2017-01-18:foo:bar"}
+	defer client.DeleteKeys(ctx, keys)
+	defer client.ClearDirtyKeys(ctx, true)
+	assert.Nil(t, client.ClearDirtyKeys(ctx, true))
+	assert.Nil(t, client.UpdateKeys(ctx, keys, "1234"))
+
+	list := func() []string {
+		var out []string
+		assert.Nil(t, client.ListDirtyKeysStream(ctx, func(key string) error {
+			out = append(out, key)
+			return nil
+		}))
+		sort.Strings(out)
+		return out
+	}
+
+	// Updated keys are listed once swapped
+	assert.Empty(t, list())
+	assert.Nil(t, client.SwapDirtyKeys(ctx))
+	assert.Equal(t, keys, list())
+
+	// Keys left by a failed snapshot are kept by the next swap
+	assert.Nil(t, client.UpdateKeys(ctx, keys[:1], "5678"))
+	assert.Nil(t, client.SwapDirtyKeys(ctx))
+	assert.Equal(t, keys, list())
+
+	assert.Nil(t, client.ClearDirtyKeys(ctx, false))
+	assert.Empty(t, list())
+
+	// Marked keys are listed by the next swap
+	assert.Nil(t, client.MarkDirtyKeys(ctx, keys[1:]))
+	assert.Nil(t, client.SwapDirtyKeys(ctx))
+	assert.Equal(t, keys[1:], list())
+}
+
+func TestRedisInteg_DeadLetters(t *testing.T) {
+	redisAddr, integ := IsRedisInteg()
+	if !integ {
+		t.SkipNow()
+	}
+
+	client, err := NewPooledClient(redisAddr)
+	assert.Nil(t, err)
+	ctx := context.Background()
+
+	keys := []string{"day:2017-01-18:foo:bar", "day:2017-01-18:foo:baz"}
+	defer client.UpdateDeadLetters(ctx, nil, keys)
+	assert.Nil(t, client.UpdateDeadLetters(ctx, keys, nil))
+	pending, err := client.GetDeadLetters(ctx)
+	assert.Nil(t, err)
+	sort.Strings(pending)
+	assert.Equal(t, keys, pending)
+
+	// Removing and adding the same key keeps it
+	assert.Nil(t, client.UpdateDeadLetters(ctx, keys[1:], keys))
+	pending, err = client.GetDeadLetters(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, keys[1:], pending)
+}
+
+func TestRedisInteg_LastUpdates(t *testing.T) {
+	redisAddr, integ := IsRedisInteg()
+	if !integ {
+		t.SkipNow()
+	}
+
+	client, err := NewPooledClient(redisAddr)
+	assert.Nil(t, err)
+	client.trackUpdates = true
+	ctx := context.Background()
+
+	keys := []string{"day:2017-01-18:foo:bar", "exact:day:2017-01-18:foo:bar"}
+	defer client.DeleteKeys(ctx, keys)
+	start := time.Now().Truncate(time.Millisecond)
+	assert.Nil(t, client.UpdateKeys(ctx, keys[:1], "1234"))
+
+	// Only the updated key has a time
+	times, err := client.GetLastUpdates(ctx, keys)
+	assert.Nil(t, err)
+	assert.False(t, times[0].Before(start))
+	assert.True(t, times[1].IsZero())
+
+	// Deleting a key removes its time
+	assert.Nil(t, client.DeleteKeys(ctx, keys[:1]))
+	times, err = client.GetLastUpdates(ctx, keys[:1])
+	assert.Nil(t, err)
+	assert.True(t, times[0].IsZero())
+}
+
+func TestRedisInteg_Lock(t *testing.T) {
+	redisAddr, integ := IsRedisInteg()
+	if !integ {
+		t.SkipNow()
+	}
+
+	client, err := NewPooledClient(redisAddr)
+	assert.Nil(t, err)
+	ctx := context.Background()
+
+	// Only one holder at a time
+	token, ok, err := client.AcquireLock(ctx, "test", time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	_, ok, err = client.AcquireLock(ctx, "test", time.Minute)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// Releasing with the wrong token is a no-op
+	assert.Nil(t, client.ReleaseLock(ctx, "test", "wrong"))
+	_, ok, err = client.AcquireLock(ctx, "test", time.Minute)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// Released locks can be acquired again
+	assert.Nil(t, client.ReleaseLock(ctx, "test", token))
+	token, ok, err = client.AcquireLock(ctx, "test", time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Nil(t, client.ReleaseLock(ctx, "test", token))
+}
+
+func TestRedisInteg_MemoryEstimate(t *testing.T) {
+	redisAddr, integ := IsRedisInteg()
+	if !integ {
+		t.SkipNow()
+	}
+
+	client, err := NewPooledClient(redisAddr)
+	assert.Nil(t, err)
+	ctx := context.Background()
+
+	keys := []string{"day:2017-01-18:foo:bar", "day:2017-01-19:foo:bar", "exact:day:2017-01-18:foo:bar"}
+	defer client.DeleteKeys(ctx, keys)
+	assert.Nil(t, client.UpdateKeys(ctx, keys, "1234"))
+
+	// Other keys may exist, so only check the bounds
+	est, err := client.MemoryEstimate(ctx, 2)
+	assert.Nil(t, err)
+	assert.True(t, est.Keys >= 3)
+	assert.Equal(t, 2, est.SampledKeys)
+	assert.True(t, est.SampledBytes > 0)
+	assert.True(t, est.EstimatedBytes >= est.SampledBytes)
+
+	// Disabled sampling still counts the keys
+	est, err = client.MemoryEstimate(ctx, 0)
+	assert.Nil(t, err)
+	assert.True(t, est.Keys >= 3)
+	assert.Equal(t, int64(0), est.EstimatedBytes)
+}
+
+func TestKeyExpireAt(t *testing.T) {
+	// Disabled without a duration
+	_, ok := KeyExpireAt("day:2017-01-18:foo:bar", 0, nil)
+	assert.False(t, ok)
+
+	// Invalid keys never expire
+	_, ok = KeyExpireAt("bar", time.Hour, nil)
+	assert.False(t, ok)
+
+	// Expire relative to the end of the interval of the key
+	expireAt, ok := KeyExpireAt("day:2017-01-18:foo:bar", 48*time.Hour, nil)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2017, 1, 21, 0, 0, 0, 0, time.UTC), expireAt)
+
+	expireAt, ok = KeyExpireAt("exact:month:2017-01:foo:bar", 48*time.Hour, nil)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2017, 2, 3, 0, 0, 0, 0, time.UTC), expireAt)
+
+	// A quarter is still updatable after a shorter duration than the quarter
+	expireAt, ok = KeyExpireAt("quarter:2017-Q1:foo:bar", 30*24*time.Hour, nil)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2017, 5, 1, 0, 0, 0, 0, time.UTC), expireAt)
+}
+
+// benchmarkUpdates returns a set of updates similar to ingress events
+func benchmarkUpdates(n int) []KeyUpdate {
+	updates := make([]KeyUpdate, n)
+	for i := range updates {
+		updates[i] = KeyUpdate{
+			Keys: []string{
+				"day:2017-01-18:foo:bar",
+				"week:2017-01-15:foo:bar",
+				"month:2017-01:foo:bar",
+			},
+			ID: strconv.Itoa(i),
+		}
+	}
+	return updates
+}
+
+func BenchmarkRedis_UpdateKeys(b *testing.B) {
+	redisAddr, integ := IsRedisInteg()
+	if !integ {
+		b.SkipNow()
+	}
+	client, err := NewPooledClient(redisAddr)
+	assert.Nil(b, err)
+	ctx := context.Background()
+	updates := benchmarkUpdates(100)
+	defer client.DeleteKeys(ctx, updates[0].Keys)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, update := range updates {
+			client.UpdateKeys(ctx, update.Keys, update.ID)
+		}
+	}
+}
+
+func BenchmarkRedis_UpdateKeysBatch(b *testing.B) {
+	redisAddr, integ := IsRedisInteg()
+	if !integ {
+		b.SkipNow()
+	}
+	client, err := NewPooledClient(redisAddr)
+	assert.Nil(b, err)
+	ctx := context.Background()
+	updates := benchmarkUpdates(100)
+	defer client.DeleteKeys(ctx, updates[0].Keys)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client.UpdateKeysBatch(ctx, updates)
+	}
+}
+
+// benchmarkGetCounts counts a set of keys with or without the count script
+func benchmarkGetCounts(b *testing.B, script bool) {
+	redisAddr, integ := IsRedisInteg()
+	if !integ {
+		b.SkipNow()
+	}
+	client, err := NewPooledClient(redisAddr)
+	assert.Nil(b, err)
+	client.countScript = script
+	ctx := context.Background()
+
+	keys := make([]string, 5000)
+	for i := range keys {
+		keys[i] = "day:2017-01-18:bench:" + strconv.Itoa(i)
+	}
+	updates := []KeyUpdate{{Keys: keys, ID: "1234"}}
+	assert.Nil(b, client.UpdateKeysBatch(ctx, updates))
+	defer client.DeleteKeys(ctx, keys)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client.GetCounts(ctx, keys)
+	}
+}
+
+func BenchmarkRedis_GetCounts(b *testing.B) {
+	benchmarkGetCounts(b, false)
+}
+
+func BenchmarkRedis_GetCountsScript(b *testing.B) {
+	benchmarkGetCounts(b, true)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/uuid"
+)
+
+const (
+	// RequestIDHeader is used to propagate a request ID across services
+	RequestIDHeader = "X-Request-ID"
+
+	// MaxRequestIDLength limits the size of an incoming request ID.
+	// Longer IDs are replaced with a generated one.
+	MaxRequestIDLength = 128
+)
+
+// requestLoggerKey is the context key of the per-request logger
+type requestLoggerKey struct{}
+
+// RequestIDHandler wraps a handler to assign each request an ID, using the
+// X-Request-ID header if provided. The ID is echoed in the response header,
+// and included in every log line of a logger stored in the request context.
+func RequestIDHandler(logger hclog.Logger, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.GenerateUUID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		ctx := context.WithValue(r.Context(), requestLoggerKey{}, logger.With("request_id", id))
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequestLogger returns the per-request logger of the context, or the
+// fallback if there is none
+func RequestLogger(ctx context.Context, fallback hclog.Logger) hclog.Logger {
+	if logger, ok := ctx.Value(requestLoggerKey{}).(hclog.Logger); ok {
+		return logger
+	}
+	return fallback
+}
+
+// validRequestID checks that a request ID is non-empty, bounded, and only
+// uses printable ASCII so that it is safe to log and echo
+func validRequestID(id string) bool {
+	if id == "" || len(id) > MaxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
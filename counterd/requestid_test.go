@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestIDHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := hclog.New(&hclog.LoggerOptions{Output: &buf})
+	h := RequestIDHandler(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		RequestLogger(r.Context(), nil).Info("handled")
+	}))
+
+	// The incoming ID is echoed and logged
+	req := httptest.NewRequest("GET", "/health", nil)
+	req.Header.Set(RequestIDHeader, "abc-123")
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	assert.Equal(t, "abc-123", resp.Result().Header.Get(RequestIDHeader))
+	assert.Contains(t, buf.String(), "request_id=abc-123")
+
+	// An ID is generated if missing or invalid
+	for _, id := range []string{"", "has space", strings.Repeat("a", MaxRequestIDLength+1)} {
+		buf.Reset()
+		req = httptest.NewRequest("GET", "/health", nil)
+		req.Header.Set(RequestIDHeader, id)
+		resp = httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+
+		generated := resp.Result().Header.Get(RequestIDHeader)
+		assert.Equal(t, 36, len(generated), id)
+		assert.Contains(t, buf.String(), "request_id="+generated, id)
+	}
+}
+
+func TestRequestIDHandler_Auth(t *testing.T) {
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+	}
+	mux := NewHTTPHandler(api, &AuthConfig{Required: true})
+
+	// Rejected requests still get an ID
+	req := httptest.NewRequest("GET", "/stats", nil)
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 403, resp.Result().StatusCode)
+	assert.NotEmpty(t, resp.Result().Header.Get(RequestIDHeader))
+}
+
+func TestRequestLogger_Fallback(t *testing.T) {
+	req := httptest.NewRequest("GET", "/health", nil)
+	assert.Equal(t, hclog.Default(), RequestLogger(req.Context(), hclog.Default()))
+}
@@ -1,17 +1,26 @@
 package main
 
 import (
+	"context"
 	"crypto/subtle"
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	hclog "github.com/hashicorp/go-hclog"
-	"github.com/robfig/cron"
+)
+
+const (
+	// ShutdownTimeout is how long in-flight requests are given to
+	// complete when the server is interrupted
+	ShutdownTimeout = 30 * time.Second
 )
 
 type ServerCommand struct{}
@@ -52,51 +61,140 @@ func (s *ServerCommand) Run(args []string) int {
 		hclog.Default().Error("Failed to parse configuration file", "error", err)
 		return 1
 	}
+	hclog.Default().Info("Starting counterd", "version", VersionString())
 
-	// Start a TCP listener
-	ln, err := net.Listen("tcp", config.ListenAddress)
+	// Setup tracing if configured
+	shutdownTracing, err := SetupTracing(config.Tracing)
 	if err != nil {
-		hclog.Default().Error("Failed to start listener", "error", err)
+		hclog.Default().Error("Failed to setup tracing", "error", err)
 		return 1
 	}
-	hclog.Default().Info("Listener started", "address", config.ListenAddress)
+	defer shutdownTracing(context.Background())
 
-	// Setup the redis pool
-	hclog.Default().Info("Connecting to redis", "addr", config.RedisAddress)
-	client, err := NewPooledClient(config.RedisAddress)
-	if err != nil {
-		hclog.Default().Error("Failed to setup redis connection", "error", err)
-		return 1
+	// Load the TLS certificate if configured
+	var certs *CertReloader
+	if config.TLS.CertFile != "" {
+		certs, err = NewCertReloader(config.TLS.CertFile, config.TLS.KeyFile)
+		if err != nil {
+			hclog.Default().Error("Failed to setup TLS", "error", err)
+			return 1
+		}
 	}
 
-	// Attempt to connect to the database
-	hclog.Default().Info("Connecting to postgresql", "addr", config.PGAddress)
-	pg, err := NewPGDatabase(hclog.Default().Named("postgresql"), config.PGAddress, true)
+	// Start a TCP or unix socket listener
+	ln, err := Listen(config.ListenAddress, config.SocketMode)
 	if err != nil {
-		hclog.Default().Error("Failed to setup database connection", "error", err)
+		hclog.Default().Error("Failed to start listener", "error", err)
 		return 1
 	}
+	hclog.Default().Info("Listener started", "address", config.ListenAddress)
+
+	// Setup the redis pool, unless running in memory
+	var client RedisClient
+	if IsMemoryAddress(config.RedisAddress) {
+		hclog.Default().Warn("Using the in-memory redis client, counters will be lost on exit")
+		mem := NewMemoryRedisClient()
+		mem.keyBudget = config.Redis.KeyBudget
+		mem.ingressRate = config.Ingress.SampleRate
+		client = mem
+	} else {
+		hclog.Default().Info("Connecting to redis", "addr", RedactAddress(config.RedisAddress))
+		pool, err := NewPooledClient(config.RedisAddress)
+		if err != nil {
+			hclog.Default().Error("Failed to setup redis connection", "error", err)
+			return 1
+		}
+
+		pool.flushSize = config.Redis.FlushSize
+		pool.countScript = config.Redis.CountScript
+		pool.logger = hclog.Default().Named("redis")
+		pool.hybridThreshold = config.Redis.HybridThreshold
+		pool.keyBudget = int64(config.Redis.KeyBudget)
+		pool.keyCountInterval = config.Redis.KeyCountInterval
+		pool.sampleRate = config.Snapshot.AccuracySample
+		pool.ingressRate = config.Ingress.SampleRate
+		pool.trackDirty = config.Snapshot.Incremental
+		pool.trackUpdates = config.Snapshot.TrackUpdates
+
+		// Expire keys after the delete threshold as a safety net
+		if config.Snapshot.ExpireBuffer > 0 {
+			pool.expireAfter = config.Snapshot.DeleteThreshold + config.Snapshot.ExpireBuffer
+			pool.customInterval = config.CustomInterval
+		}
+		client = pool
+	}
+
+	// Attempt to connect to the database, unless running in memory
+	var db DatabaseClient
+	if IsMemoryAddress(config.PGAddress) {
+		hclog.Default().Warn("Using the in-memory database, counters will be lost on exit")
+		mem := NewMemoryDatabase()
+		mem.conflictStrategy = config.Database.ConflictStrategy
+		db = mem
+	} else {
+		hclog.Default().Info("Connecting to postgresql", "addr", RedactAddress(config.PGAddress))
+		if config.PGReadAddress != "" {
+			hclog.Default().Info("Using postgresql read replica", "addr", RedactAddress(config.PGReadAddress))
+		}
+		pg, err := NewPGDatabaseFromConfig(hclog.Default().Named("postgresql"), config.PGAddress, config.PGReadAddress, config.Database, true)
+		if err != nil {
+			hclog.Default().Error("Failed to setup database connection", "error", err)
+			return 1
+		}
+		db = pg
+	}
+
+	// Track process level stats
+	stats := new(Stats)
+
+	// Cache the domain responses if configured, purged by each snapshot
+	var domainCache *DomainCache
+	if config.HTTP.DomainCacheTTL > 0 {
+		domainCache, err = NewDomainCache(DomainCacheSize, config.HTTP.DomainCacheTTL)
+		if err != nil {
+			hclog.Default().Error("Failed to setup domain cache", "error", err)
+			return 1
+		}
+	}
 
 	// Check if we have a cron setup
+	var leader *LeaderElection
 	if config.Snapshot.Cron != "" {
+		// Elect a leader to run the cron if there are multiple servers
+		if config.Snapshot.LeaderElection {
+			leader = NewLeaderElection(hclog.Default().Named("leader"), client, config.Snapshot.LeaderLease)
+			defer leader.Close()
+		}
+
 		// Create the snapshotter
 		snap := &Snapshotter{
 			config: config,
 			logger: hclog.Default().Named("snapshotter"),
 			client: client,
-			db:     pg,
+			db:     db,
+			stats:  stats,
+
+			domainCache: domainCache,
 		}
 		var snapshotLock sync.Mutex
 
 		// Setup a cron
-		cron := cron.New()
-		err := cron.AddFunc(config.Snapshot.Cron, func() {
+		cron, err := NewSnapshotCron(config.Snapshot, func() {
+			// Only the leader snapshots if leader election is enabled
+			if leader != nil && !leader.IsLeader() {
+				hclog.Default().Debug("Skipping snapshot, not the leader")
+				return
+			}
+
 			// Prevent concurrent snapshots if the cron is too frequent
 			snapshotLock.Lock()
 			defer snapshotLock.Unlock()
 
 			// Run the snapshot at the current time
-			if err := snap.Run(time.Now().UTC()); err != nil {
+			err := snap.Run(context.Background(), time.Now().UTC())
+			if err == ErrSnapshotLocked {
+				hclog.Default().Info("Skipping snapshot, another snapshot is in progress")
+			} else if err != nil {
 				hclog.Default().Error("Failed to snapshot", "error", err)
 			}
 		})
@@ -105,45 +203,156 @@ func (s *ServerCommand) Run(args []string) int {
 			return 1
 		}
 		cron.Start()
-		hclog.Default().Info("Snapshot cron initialized", "cron", config.Snapshot.Cron)
+		hclog.Default().Info("Snapshot cron initialized", "cron", config.Snapshot.Cron,
+			"timezone", cron.Location().String())
 	}
 
 	// Setup the endpoint handlers
 	api := &APIHandler{
-		logger:     hclog.Default().Named("api"),
-		client:     client,
-		db:         pg,
-		attrConfig: config.Attributes,
+		logger:        hclog.Default().Named("api"),
+		client:        client,
+		db:            db,
+		attrConfig:    config.Attributes,
+		exactConfig:   config.Exact,
+		ingressConfig: config.Ingress,
+		timezone:      config.Timezone,
+		breaker:       NewCircuitBreaker(config.Ingress.BreakerThreshold, config.Ingress.BreakerCooldown),
+		stats:         stats,
+		leader:        leader,
+		intervals:     config.Intervals,
+		info:          NewInfoResponse(config),
+		root:          config.HTTP.Root,
+		domainCache:   domainCache,
+
+		customInterval:  config.CustomInterval,
+		weeklyFromDaily: config.Snapshot.WeeklyFromDaily,
+	}
+	if config.Ingress.DedupWindow > 0 {
+		api.recentIDs, err = NewRecentIDs(config.Ingress.DedupSize, config.Ingress.DedupWindow)
+		if err != nil {
+			hclog.Default().Error("Failed to setup event deduplication", "error", err)
+			return 1
+		}
+	}
+
+	if config.Ingress.QueueSize > 0 {
+		api.queue = NewIngressQueue(hclog.Default().Named("queue"), client, stats,
+			config.Ingress.QueueSize, config.Ingress.QueueWorkers)
+		api.queue.breaker = api.breaker
 	}
 
 	// Setup the HTTP handler
 	mux := NewHTTPHandler(api, config.Auth)
+	srv := NewHTTPServer(mux, config.HTTP)
+
+	// Use TLS if configured, reloading the certificate on SIGHUP for rotation
+	if certs != nil {
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     config.TLS.MinVersion,
+			GetCertificate: certs.GetCertificate,
+		}
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		defer signal.Stop(hupCh)
+		go func() {
+			for range hupCh {
+				if err := certs.Reload(); err != nil {
+					hclog.Default().Error("Failed to reload TLS certificate", "error", err)
+				} else {
+					hclog.Default().Info("Reloaded TLS certificate")
+				}
+			}
+		}()
+	}
+
+	// Stop serving once we are interrupted, waiting for in-flight requests
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Start the HTTP server
-	if err := http.Serve(ln, mux); err != nil {
+	// Periodically estimate the redis memory used if enabled
+	if config.Redis.MemorySample > 0 {
+		go stats.RunMemoryEstimates(ctx, hclog.Default().Named("memory"), client, leader,
+			config.Redis.MemorySample, config.Redis.MemoryInterval)
+	}
+	shutdownCh := make(chan struct{})
+	go func() {
+		defer close(shutdownCh)
+		<-ctx.Done()
+		hclog.Default().Info("Shutting down HTTP server")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			hclog.Default().Error("Failed to shutdown HTTP server", "error", err)
+		}
+	}()
+
+	// Start the HTTP server, using TLS if configured
+	if certs != nil {
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
 		hclog.Default().Error("HTTP listener failed", "error", err)
+		return 1
+	}
+	<-shutdownCh
+
+	// Flush any queued events before exiting
+	if api.queue != nil {
+		hclog.Default().Info("Draining ingress queue")
+		api.queue.Close()
 	}
 	return 0
 }
 
+// NewHTTPServer creates a server for the handler with the configured
+// timeouts, so slow or hung clients cannot hold connections open
+func NewHTTPServer(handler http.Handler, config *HTTPConfig) *http.Server {
+	srv := &http.Server{Handler: handler}
+	if config != nil {
+		srv.ReadHeaderTimeout = config.ReadHeaderTimeout
+		srv.ReadTimeout = config.ReadTimeout
+		srv.WriteTimeout = config.WriteTimeout
+		srv.IdleTimeout = config.IdleTimeout
+	}
+	return srv
+}
+
 // NewHTTPHandler creates a new router to all the endpoints
 func NewHTTPHandler(api *APIHandler, auth *AuthConfig) http.Handler {
 	// Create a muxer with all the routes
 	mux := http.NewServeMux()
 	mux.HandleFunc("/v1/ingress", api.Ingress)
+	mux.HandleFunc("/v1/ingress/simple", api.SimpleIngress)
+	mux.HandleFunc("/v1/ingress/beacon", api.Beacon)
 	mux.HandleFunc("/v1/query/", api.Query)
+	mux.HandleFunc("/v1/top/", api.Top)
+	mux.HandleFunc("/v1/compare/", api.Compare)
 	mux.HandleFunc("/v1/domain/", api.Domain)
+	mux.HandleFunc("/v1/domain/counts", api.DomainCounts)
 	mux.HandleFunc("/v1/range/", api.Range)
-	mux.HandleFunc("/ui", nil)
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		http.Redirect(w, r, "/ui", http.StatusMovedPermanently)
-	})
+	mux.HandleFunc("/v1/info", api.Info)
+	mux.HandleFunc("/stats", api.Stats)
+	mux.HandleFunc("/health", api.Health)
+	mux.HandleFunc("/", api.Root)
 
-	// Check if auth is enabled, wrap the muxer to enforce
+	// Transparently handle compressed requests and responses
+	handler := GzipHandler(mux)
+
+	// Check if auth is enabled, wrap the muxer to enforce. Requests are
+	// assigned an ID first, so that rejected requests also have one.
 	if auth != nil && auth.Required {
 		enforce := func(w http.ResponseWriter, r *http.Request) {
-			// Check for the Auth header
+			// Allow health checks without a token, but check a token if
+			// one is provided so that clients can verify it
 			authHeader := r.Header.Get("Authorization")
+			if r.URL.Path == "/health" && authHeader == "" {
+				handler.ServeHTTP(w, r)
+				return
+			}
+
+			// Check for the Auth header
 			if authHeader == "" {
 				w.WriteHeader(http.StatusForbidden)
 				return
@@ -165,14 +374,14 @@ func NewHTTPHandler(api *APIHandler, auth *AuthConfig) http.Handler {
 				}
 			}
 
-			// Route to the muxer if we found a matching token
+			// Route to the handler if we found a matching token
 			if pass {
-				mux.ServeHTTP(w, r)
+				handler.ServeHTTP(w, r)
 			} else {
 				w.WriteHeader(http.StatusForbidden)
 			}
 		}
-		return http.HandlerFunc(enforce)
+		return RequestIDHandler(api.logger, http.HandlerFunc(enforce))
 	}
-	return mux
+	return RequestIDHandler(api.logger, handler)
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewHTTPServer_SlowHeaders(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	srv := NewHTTPServer(http.NotFoundHandler(), &HTTPConfig{
+		ReadHeaderTimeout: 100 * time.Millisecond,
+		ReadTimeout:       time.Second,
+		WriteTimeout:      time.Second,
+		IdleTimeout:       time.Second,
+	})
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	// Send a partial request and never finish the headers
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /health HTTP/1.1\r\nHost: localhost\r\n"))
+	assert.Nil(t, err)
+
+	// The server should close the connection after the header timeout
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(5 * time.Second))
+	_, err = io.ReadAll(conn)
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) < time.Second, "connection was not closed: %v", time.Since(start))
+}
+
+func TestNewHTTPServer_Timeouts(t *testing.T) {
+	config, err := ParseConfig(`
+http {
+	read_header_timeout = "1s"
+	read_timeout = "2s"
+	write_timeout = "3s"
+	idle_timeout = "4s"
+}
+`)
+	if !assert.Nil(t, err) {
+		return
+	}
+	srv := NewHTTPServer(http.NotFoundHandler(), config.HTTP)
+	assert.Equal(t, time.Second, srv.ReadHeaderTimeout)
+	assert.Equal(t, 2*time.Second, srv.ReadTimeout)
+	assert.Equal(t, 3*time.Second, srv.WriteTimeout)
+	assert.Equal(t, 4*time.Second, srv.IdleTimeout)
+}
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"math/rand"
+	"os"
+	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/armon/counterd/client"
@@ -13,6 +21,9 @@ import (
 	"github.com/hashicorp/uuid"
 )
 
+// PingTimeout is how long to wait for the server to respond at startup
+const PingTimeout = 10 * time.Second
+
 type SimCommand struct{}
 
 func (s *SimCommand) Help() string {
@@ -20,6 +31,9 @@ func (s *SimCommand) Help() string {
 Usage: counterd sim [flags]
 
 	sim is used to simulate input to the API for testing and benchmarking.
+	The server is checked at startup, so an unreachable address or a bad
+	auth token fails early. A summary of the events sent and the achieved
+	rate is printed when done, or when interrupted.
 
 Options:
 
@@ -31,9 +45,19 @@ Options:
 	-to		Configures the ending range of the date interval. Must be provided with -from.
 			Given in RFC3339 format, e.g. 2006-01-02T15:04:05.
 	-num	(Default: 1000). Configures the number of events in the range to generate.
+	-realtime	Sends the events of the range in real time, so an event is sent once the time
+			since starting matches its offset from the start of the range.
+	-speed	(Default: 1). Configures how many times faster than real time to send with -realtime.
+
+	-rate	Configures the maximum number of events sent per second. Defaults to unlimited.
+	-workers	(Default: 1). Configures the number of events sent concurrently.
+			Sending stops after the first failure.
 
 	-a | -attribute key=value	Defines a possible attribute pair. Can be specified multiple times
 	to add more keys or values. Events are generated all keys present and a random value.
+	Multiple values can be given separated by commas, each with an optional integer weight,
+	e.g. -a country=us:80,ca:15,mx:5. Values are sampled in proportion to their weight,
+	which defaults to 1.
 	`
 	return strings.TrimSpace(helpText)
 }
@@ -45,7 +69,9 @@ func (s *SimCommand) Synopsis() string {
 func (s *SimCommand) Run(args []string) int {
 	var address, authToken string
 	var fromDate, toDate string
-	var numEvents int
+	var numEvents, rate, workers int
+	var realtime bool
+	var speed float64
 	attributes := map[string][]string{}
 	kvAttr := FlagStringKV(attributes)
 	flags := flag.NewFlagSet("counterd", flag.ContinueOnError)
@@ -54,6 +80,10 @@ func (s *SimCommand) Run(args []string) int {
 	flags.StringVar(&fromDate, "from", "", "")
 	flags.StringVar(&toDate, "to", "", "")
 	flags.IntVar(&numEvents, "num", 1000, "")
+	flags.BoolVar(&realtime, "realtime", false, "")
+	flags.Float64Var(&speed, "speed", 1, "")
+	flags.IntVar(&rate, "rate", 0, "")
+	flags.IntVar(&workers, "workers", 1, "")
 	flags.Var(&kvAttr, "attribute", "")
 	flags.Var(&kvAttr, "a", "")
 	flags.Usage = func() { fmt.Println(s.Help()) }
@@ -61,9 +91,17 @@ func (s *SimCommand) Run(args []string) int {
 		return 1
 	}
 
+	// Parse the attribute weights
+	weighted, err := ParseWeightedAttributes(attributes)
+	if err != nil {
+		hclog.Default().Error("Failed to parse attributes", "error", err)
+		return 1
+	}
+
 	// Setup the client
 	opts := &client.ClientOptions{
-		AuthToken: authToken,
+		AuthToken:           authToken,
+		MaxIdleConnsPerHost: workers,
 	}
 	counterdClient, err := client.NewClient(address, opts)
 	if err != nil {
@@ -71,6 +109,11 @@ func (s *SimCommand) Run(args []string) int {
 		return 1
 	}
 
+	// Check the server is reachable before generating events
+	if !pingServer(counterdClient, address) {
+		return 1
+	}
+
 	// Deteremine if this is a fixed range or continuous
 	var eventCh <-chan *client.Event
 	if fromDate != "" || toDate != "" {
@@ -93,28 +136,128 @@ func (s *SimCommand) Run(args []string) int {
 			return 1
 		}
 
-		eventCh = simulateRange(fromTime, toTime, numEvents, attributes)
+		eventCh = simulateRange(fromTime, toTime, numEvents, weighted)
+		if realtime {
+			if speed <= 0 {
+				hclog.Default().Error("Speed must be positive")
+				return 1
+			}
+			eventCh = realtimeEvents(eventCh, fromTime, speed)
+		}
 	} else {
-		eventCh = continuousEvents(attributes)
+		eventCh = continuousEvents(weighted)
+	}
+
+	// Throttle the events if a rate is set
+	if rate < 0 {
+		hclog.Default().Error("Rate must not be negative")
+		return 1
+	} else if rate > 0 {
+		eventCh = rateLimitEvents(eventCh, rate)
 	}
 
 	// Send all the events
-	sent := 0
-	for e := range eventCh {
-		if err := counterdClient.SendEvent(e); err != nil {
+	if workers <= 0 {
+		hclog.Default().Error("Must have a non-zero number of workers")
+		return 1
+	}
+	// Stop sending if we are interrupted, still printing the summary
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	start := time.Now()
+	sent, failed, err := sendEvents(ctx, counterdClient, eventCh, workers)
+	fmt.Print(SimSummary(sent, failed, time.Since(start)))
+	if err != nil {
+		switch {
+		case errors.Is(err, client.ErrUnauthorized):
+			hclog.Default().Error("Failed to send event, check the -auth token", "error", err)
+		case errors.Is(err, client.ErrBadRequest):
+			hclog.Default().Error("Event was rejected, check the -attribute flags", "error", err)
+		default:
 			hclog.Default().Error("Failed to send event", "error", err)
-			return 1
-		}
-		sent++
-		if sent%1000 == 0 {
-			hclog.Default().Info(fmt.Sprintf("Sent %d events", sent))
 		}
+		return 1
 	}
 	return 0
 }
 
+// pingServer checks the server is reachable and the auth token is accepted,
+// logging a helpful message if not
+func pingServer(c *client.Client, address string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), PingTimeout)
+	defer cancel()
+	err := c.Ping(ctx)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, client.ErrUnauthorized):
+		hclog.Default().Error("Failed to authenticate with counterd, check the -auth token", "error", err)
+	default:
+		hclog.Default().Error("Failed to reach counterd, check the -address", "address", address, "error", err)
+	}
+	return false
+}
+
+// SimSummary formats the results of a simulation
+func SimSummary(sent, failed uint64, elapsed time.Duration) string {
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(sent) / elapsed.Seconds()
+	}
+	return fmt.Sprintf("Sent: %d\nFailed: %d\nElapsed: %v\nRate: %.1f events/sec\n",
+		sent, failed, elapsed.Round(time.Millisecond), rate)
+}
+
+// eventSender is used to send events, implemented by the client
+type eventSender interface {
+	SendEvent(e *client.Event) error
+}
+
+// sendEvents sends the events using a number of concurrent workers. Sending
+// stops after the first error, which is returned along with the counts.
+func sendEvents(ctx context.Context, sender eventSender, eventCh <-chan *client.Event, workers int) (sent, failed uint64, err error) {
+	var errOnce sync.Once
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				var e *client.Event
+				var ok bool
+				select {
+				case <-stopCh:
+					return
+				case <-ctx.Done():
+					return
+				case e, ok = <-eventCh:
+					if !ok {
+						return
+					}
+				}
+
+				if sendErr := sender.SendEvent(e); sendErr != nil {
+					atomic.AddUint64(&failed, 1)
+					errOnce.Do(func() {
+						err = sendErr
+						close(stopCh)
+					})
+					return
+				}
+				if n := atomic.AddUint64(&sent, 1); n%1000 == 0 {
+					hclog.Default().Info(fmt.Sprintf("Sent %d events", n))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return sent, failed, err
+}
+
 // simulateRange creates a set of events from a given range
-func simulateRange(from, to time.Time, numEvents int, attributes map[string][]string) <-chan *client.Event {
+func simulateRange(from, to time.Time, numEvents int, attributes map[string]*WeightedValues) <-chan *client.Event {
 	eventCh := make(chan *client.Event, 256)
 	go func() {
 		defer close(eventCh)
@@ -135,7 +278,7 @@ func simulateRange(from, to time.Time, numEvents int, attributes map[string][]st
 
 			// Select a random attribute value
 			for key, vals := range attributes {
-				e.Attributes[key] = vals[rand.Intn(len(vals))]
+				e.Attributes[key] = vals.Sample()
 			}
 			eventCh <- e
 		}
@@ -145,7 +288,7 @@ func simulateRange(from, to time.Time, numEvents int, attributes map[string][]st
 }
 
 // continuousEvents generates events until interrupted
-func continuousEvents(attributes map[string][]string) <-chan *client.Event {
+func continuousEvents(attributes map[string]*WeightedValues) <-chan *client.Event {
 	eventCh := make(chan *client.Event, 256)
 	go func() {
 		prefix := uuid.GenerateUUID()[:9]
@@ -159,7 +302,7 @@ func continuousEvents(attributes map[string][]string) <-chan *client.Event {
 
 			// Select a random attribute value
 			for key, vals := range attributes {
-				e.Attributes[key] = vals[rand.Intn(len(vals))]
+				e.Attributes[key] = vals.Sample()
 			}
 			eventCh <- e
 			counter++
@@ -168,6 +311,88 @@ func continuousEvents(attributes map[string][]string) <-chan *client.Event {
 	return eventCh
 }
 
+// rateLimitEvents passes through events at no more than rate per second
+func rateLimitEvents(in <-chan *client.Event, rate int) <-chan *client.Event {
+	eventCh := make(chan *client.Event)
+	go func() {
+		defer close(eventCh)
+		ticker := time.NewTicker(time.Second / time.Duration(rate))
+		defer ticker.Stop()
+		for e := range in {
+			<-ticker.C
+			eventCh <- e
+		}
+	}()
+	return eventCh
+}
+
+// realtimeEvents passes through each event once the time since starting
+// matches the offset of the event date from the start, divided by the speed
+func realtimeEvents(in <-chan *client.Event, from time.Time, speed float64) <-chan *client.Event {
+	eventCh := make(chan *client.Event)
+	go func() {
+		defer close(eventCh)
+		start := time.Now()
+		for e := range in {
+			offset := time.Duration(float64(e.Date.Sub(from)) / speed)
+			if wait := time.Until(start.Add(offset)); wait > 0 {
+				time.Sleep(wait)
+			}
+			eventCh <- e
+		}
+	}()
+	return eventCh
+}
+
+// WeightedValues is a set of attribute values that are sampled
+// in proportion to their weights
+type WeightedValues struct {
+	values     []string
+	cumulative []int
+}
+
+// Add adds a value with a positive weight
+func (w *WeightedValues) Add(value string, weight int) {
+	total := weight
+	if n := len(w.cumulative); n > 0 {
+		total += w.cumulative[n-1]
+	}
+	w.values = append(w.values, value)
+	w.cumulative = append(w.cumulative, total)
+}
+
+// Sample returns a random value according to the weights
+func (w *WeightedValues) Sample() string {
+	n := rand.Intn(w.cumulative[len(w.cumulative)-1])
+	return w.values[sort.SearchInts(w.cumulative, n+1)]
+}
+
+// ParseWeightedAttributes parses the raw attribute values, which are comma
+// separated values each with an optional weight, e.g. "us:80,ca:15,mx:5".
+// Colons are reserved in attribute values, so they cannot be ambiguous.
+func ParseWeightedAttributes(attributes map[string][]string) (map[string]*WeightedValues, error) {
+	out := make(map[string]*WeightedValues, len(attributes))
+	for key, raws := range attributes {
+		values := &WeightedValues{}
+		for _, raw := range raws {
+			for _, item := range strings.Split(raw, ",") {
+				value, weight := item, 1
+				if idx := strings.LastIndex(item, KeySeperator); idx != -1 {
+					var err error
+					value = item[:idx]
+					weight, err = strconv.Atoi(item[idx+1:])
+					if err != nil || weight <= 0 {
+						return nil, fmt.Errorf("invalid weight for %s=%s", key, item)
+					}
+				}
+				values.Add(value, weight)
+			}
+		}
+		out[key] = values
+	}
+	return out, nil
+}
+
 // FlagStringKV is a flag.Value implementation for parsing user variables
 // from the command-line in the format of '-var key=value', where value is
 // only ever a primitive.
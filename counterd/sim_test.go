@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/armon/counterd/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseWeightedAttributes(t *testing.T) {
+	out, err := ParseWeightedAttributes(map[string][]string{
+		"country": {"us:80,ca:15,mx:5"},
+		"plan":    {"free", "paid"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"us", "ca", "mx"}, out["country"].values)
+	assert.Equal(t, []int{80, 95, 100}, out["country"].cumulative)
+	assert.Equal(t, []string{"free", "paid"}, out["plan"].values)
+	assert.Equal(t, []int{1, 2}, out["plan"].cumulative)
+
+	for _, raw := range []string{"us:0", "us:-1", "us:x", "us:"} {
+		_, err := ParseWeightedAttributes(map[string][]string{"country": {raw}})
+		assert.NotNil(t, err, raw)
+	}
+}
+
+func TestWeightedValues_Sample(t *testing.T) {
+	var w WeightedValues
+	w.Add("us", 80)
+	w.Add("ca", 15)
+	w.Add("mx", 5)
+
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[w.Sample()]++
+	}
+	assert.InDelta(t, 8000, counts["us"], 400)
+	assert.InDelta(t, 1500, counts["ca"], 300)
+	assert.InDelta(t, 500, counts["mx"], 200)
+}
+
+func TestRateLimitEvents(t *testing.T) {
+	in := make(chan *client.Event, 10)
+	for i := 0; i < 10; i++ {
+		in <- &client.Event{ID: strconv.Itoa(i)}
+	}
+	close(in)
+
+	// 10 events at 100/sec should take about 100ms
+	start := time.Now()
+	n := 0
+	for range rateLimitEvents(in, 100) {
+		n++
+	}
+	assert.Equal(t, 10, n)
+	assert.True(t, time.Since(start) >= 90*time.Millisecond)
+}
+
+func TestRealtimeEvents(t *testing.T) {
+	from := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(10 * time.Second)
+
+	// Ten seconds of events at 100x speed should take about 100ms
+	start := time.Now()
+	var last time.Time
+	n := 0
+	for e := range realtimeEvents(simulateRange(from, to, 10, nil), from, 100) {
+		assert.True(t, !e.Date.Before(last))
+		last = e.Date
+		n++
+	}
+	assert.Equal(t, 10, n)
+	assert.True(t, time.Since(start) >= 80*time.Millisecond)
+}
+
+// mockSender records sent events, failing any with the failID
+type mockSender struct {
+	failID string
+	sent   sync.Map
+}
+
+func (m *mockSender) SendEvent(e *client.Event) error {
+	if e.ID == m.failID {
+		return fmt.Errorf("bad response code 500")
+	}
+	m.sent.Store(e.ID, struct{}{})
+	return nil
+}
+
+func TestSendEvents(t *testing.T) {
+	eventCh := make(chan *client.Event, 1000)
+	for i := 0; i < 1000; i++ {
+		eventCh <- &client.Event{ID: strconv.Itoa(i)}
+	}
+	close(eventCh)
+
+	sender := &mockSender{}
+	sent, failed, err := sendEvents(context.Background(), sender, eventCh, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1000), sent)
+	assert.Equal(t, uint64(0), failed)
+
+	n := 0
+	sender.sent.Range(func(k, v interface{}) bool {
+		n++
+		return true
+	})
+	assert.Equal(t, 1000, n)
+}
+
+// endlessEvents returns an unbuffered channel of events that is written
+// until the returned stop function is called, which waits for the writer
+func endlessEvents() (chan *client.Event, func()) {
+	eventCh := make(chan *client.Event)
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for i := 0; ; i++ {
+			select {
+			case eventCh <- &client.Event{ID: strconv.Itoa(i)}:
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return eventCh, func() {
+		close(stopCh)
+		<-doneCh
+	}
+}
+
+func TestSendEvents_Error(t *testing.T) {
+	// An endless channel should stop after the failure
+	eventCh, stop := endlessEvents()
+	defer stop()
+
+	sender := &mockSender{failID: "100"}
+	sent, failed, err := sendEvents(context.Background(), sender, eventCh, 4)
+	assert.NotNil(t, err)
+	assert.Equal(t, uint64(1), failed)
+	assert.True(t, sent >= 100)
+}
+
+func TestSendEvents_Cancel(t *testing.T) {
+	eventCh, stop := endlessEvents()
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	sent, failed, err := sendEvents(ctx, &mockSender{}, eventCh, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), failed)
+	assert.True(t, sent > 0)
+}
+
+func TestSimSummary(t *testing.T) {
+	out := SimSummary(1000, 2, 2*time.Second)
+	assert.Equal(t, "Sent: 1000\nFailed: 2\nElapsed: 2s\nRate: 500.0 events/sec\n", out)
+
+	out = SimSummary(0, 0, 0)
+	assert.Contains(t, out, "Rate: 0.0 events/sec")
+}
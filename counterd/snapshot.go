@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	hclog "github.com/hashicorp/go-hclog"
@@ -48,17 +52,28 @@ func (s *SnapshotCommand) Run(args []string) int {
 		return 1
 	}
 
+	// Setup tracing if configured
+	shutdownTracing, err := SetupTracing(config.Tracing)
+	if err != nil {
+		hclog.Default().Error("Failed to setup tracing", "error", err)
+		return 1
+	}
+	defer shutdownTracing(context.Background())
+
 	// Setup the redis pool
-	hclog.Default().Info("Connecting to redis", "addr", config.RedisAddress)
+	hclog.Default().Info("Connecting to redis", "addr", RedactAddress(config.RedisAddress))
 	client, err := NewPooledClient(config.RedisAddress)
 	if err != nil {
 		hclog.Default().Error("Failed to setup redis connection", "error", err)
 		return 1
 	}
+	client.countScript = config.Redis.CountScript
+	client.logger = hclog.Default().Named("redis")
+	client.hybridThreshold = config.Redis.HybridThreshold
 
 	// Attempt to connect to the database
-	hclog.Default().Info("Connecting to postgresql", "addr", config.PGAddress)
-	pg, err := NewPGDatabase(hclog.Default().Named("postgresql"), config.PGAddress, true)
+	hclog.Default().Info("Connecting to postgresql", "addr", RedactAddress(config.PGAddress))
+	pg, err := NewPGDatabaseFromConfig(hclog.Default().Named("postgresql"), config.PGAddress, "", config.Database, true)
 	if err != nil {
 		hclog.Default().Error("Failed to setup database connection", "error", err)
 		return 1
@@ -72,8 +87,16 @@ func (s *SnapshotCommand) Run(args []string) int {
 		db:     pg,
 	}
 
+	// Cancel any in-flight writes if we are interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Run the snapshotter now
-	if err := snap.Run(time.Now().UTC()); err != nil {
+	err = snap.Run(ctx, time.Now().UTC())
+	if err == ErrSnapshotLocked {
+		hclog.Default().Error("Aborting snapshot, another snapshot is in progress")
+		return 1
+	} else if err != nil {
 		hclog.Default().Error("Failed to snapshot", "error", err)
 		return 1
 	}
@@ -1,89 +1,651 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	hclog "github.com/hashicorp/go-hclog"
+	"github.com/robfig/cron"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
+const (
+	// SnapshotLockName is the name of the redis lock held during a snapshot
+	SnapshotLockName = "snapshot"
+
+	// LastUpdateSkew is how long before the previous snapshot a key must
+	// have last been updated to be skipped, allowing for clock skew
+	// between the servers updating keys and the snapshot
+	LastUpdateSkew = time.Minute
+)
+
+// ErrSnapshotLocked is returned if another snapshot holds the lock
+var ErrSnapshotLocked = errors.New("snapshot already in progress")
+
+// ErrSnapshotLockLost is returned if the lock could not be renewed
+// while snapshotting, so the snapshot was cancelled
+var ErrSnapshotLockLost = errors.New("snapshot lock lost")
+
 // Snapshotter is used to perform snapshotting
 type Snapshotter struct {
 	config *Config
 	logger hclog.Logger
 	client RedisClient
 	db     DatabaseClient
+	stats  *Stats
+
+	// lastFull is when the last full snapshot succeeded, used to
+	// schedule the full snapshots between incremental ones
+	lastFull time.Time
+
+	// lastSnapshot is when the last snapshot that updated every
+	// counter started. Keys not updated since are not counted.
+	lastSnapshot time.Time
+
+	// domainCache is purged after each snapshot, since it may
+	// have written new domain values. Not purged if nil. Other
+	// servers purge their cache using RedisDomainUpdatedKey.
+	domainCache *DomainCache
+}
+
+// NewSnapshotCron returns a cron that calls run on the snapshot schedule.
+// The schedule is evaluated in the cron timezone, not the host timezone.
+func NewSnapshotCron(config *SnapshotConfig, run func()) (*cron.Cron, error) {
+	loc := config.CronTimezone
+	if loc == nil {
+		loc = time.UTC
+	}
+	c := cron.NewWithLocation(loc)
+	if err := c.AddFunc(config.Cron, run); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// renewLock renews the snapshot lock every third of the TTL until the
+// returned function is called, which stops renewing and returns if the
+// lock was lost. If a renewal fails, cancel is called so the snapshot
+// stops before another process can acquire the expired lock.
+func (s *Snapshotter) renewLock(cancel context.CancelFunc, token string) func() bool {
+	ttl := s.config.Snapshot.LockTTL
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	var lost bool
+	go func() {
+		defer close(doneCh)
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stopCh:
+				return
+			}
+			held, err := s.client.RenewLock(context.Background(), SnapshotLockName, token, ttl)
+			if err != nil {
+				s.logger.Error("failed to renew snapshot lock", "error", err)
+			}
+			if err != nil || !held {
+				s.logger.Warn("lost snapshot lock, cancelling the snapshot")
+				lost = true
+				cancel()
+				return
+			}
+		}
+	}()
+	return func() bool {
+		close(stopCh)
+		<-doneCh
+		return lost
+	}
 }
 
 // Run is used to both snapshot new data and delete old data
-func (s *Snapshotter) Run(now time.Time) error {
+func (s *Snapshotter) Run(ctx context.Context, now time.Time) (err error) {
+	// Prevent concurrent snapshots by other processes or hosts
+	token, ok, err := s.client.AcquireLock(ctx, SnapshotLockName, s.config.Snapshot.LockTTL)
+	if err != nil {
+		s.logger.Error("failed to acquire snapshot lock", "error", err)
+		return err
+	}
+	if !ok {
+		return ErrSnapshotLocked
+	}
+	defer func() {
+		// Release the lock even if the snapshot was cancelled
+		if err := s.client.ReleaseLock(context.Background(), SnapshotLockName, token); err != nil {
+			s.logger.Warn("failed to release snapshot lock", "error", err)
+		}
+	}()
+
+	// Renew the lock while snapshotting, cancelling the snapshot if lost
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stopRenew := s.renewLock(cancel, token)
+
 	start := time.Now()
+	ctx, span := tracer.Start(ctx, "Snapshot")
+	defer span.End()
+	var deadLetters []*ParsedKey
+	defer func() { s.stats.SnapshotComplete(start, deadLetters, err) }()
+	defer func() {
+		if stopRenew() {
+			err = ErrSnapshotLockLost
+		}
+	}()
 
-	// Get the list of keys
-	keys, err := s.client.ListKeys()
+	// Incremental snapshots only list the keys updated since the last
+	// snapshot, with a periodic full snapshot to delete the expired keys
+	runTime := now
+	incremental := s.incremental(runTime)
+	span.SetAttributes(attribute.Bool("counterd.incremental", incremental))
+	listKeys := s.client.ListKeysStream
+	if incremental {
+		listKeys = s.client.ListDirtyKeysStream
+		err = s.client.SwapDirtyKeys(ctx)
+	} else if s.config.Snapshot.Incremental {
+		// Every dirty key is counted by the full snapshot
+		err = s.client.ClearDirtyKeys(ctx, true)
+	}
 	if err != nil {
-		s.logger.Error("failed to get key list", "error", err)
+		s.logger.Error("failed to reset the dirty keys", "error", err)
+		span.SetStatus(codes.Error, err.Error())
 		return err
 	}
 
-	// Parse the keys into a structured form
-	parsed, invalid := ParseKeyList(keys)
-	if len(invalid) > 0 {
-		s.logger.Warn("found invalid keys", "keys", invalid)
+	// Pending dead letters are retried instead of deleted until they succeed
+	pendingKeys, err := s.client.GetDeadLetters(ctx)
+	if err != nil {
+		s.logger.Error("failed to get the pending dead letters", "error", err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	pending := make(map[string]struct{}, len(pendingKeys))
+	for _, key := range pendingKeys {
+		pending[key] = struct{}{}
 	}
-	s.logger.Debug(fmt.Sprintf("found %d valid keys", len(parsed)))
+	var retried []string
 
-	// Determine the filter and delete thresholds
-	updateThreshold := now.Add(-1 * s.config.Snapshot.UpdateThreshold)
+	// Determine the filter and delete thresholds. Key dates are in local
+	// time, so compare against the local wall clock.
+	now = LocalWallClock(now, s.config.Timezone)
+	updateThresholds := s.config.Snapshot.UpdateThresholds(now)
 	deleteThreshold := now.Add(-1 * s.config.Snapshot.DeleteThreshold)
-	s.logger.Info("determining thresholds", "update", updateThreshold,
-		"delete", deleteThreshold)
+	s.logger.Info("determining thresholds", "update", updateThresholds.Default,
+		"intervals", updateThresholds.Intervals, "delete", deleteThreshold,
+		"incremental", incremental)
+
+	// Weekly rollups are updated like the weekly counters
+	rollupThreshold := updateThresholds.For("week")
+
+	// Stream the keys, deleting and updating them in batches so memory
+	// is bounded by the batch size instead of the number of keys. Only
+	// the daily keys of weeks that may be updated are kept for rollups.
+	batchSize := s.config.Snapshot.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultSnapshotBatchSize
+	}
+	var update, delete, days []*ParsedKey
+	var numUpdate, numDelete, numIgnore, numInvalid int
+	listCtx, listSpan := tracer.Start(ctx, "Snapshot.List")
+	err = listKeys(listCtx, func(key string) error {
+		parsed, err := ParseKey(key, s.config.CustomInterval)
+		if err != nil {
+			s.logger.Warn("found invalid key", "key", key)
+			numInvalid++
+			return nil
+		}
+		if s.config.Attributes.encodeValues() {
+			parsed.DecodeValues()
+		}
+
+		filter := FilterKey(parsed, updateThresholds.For(parsed.Interval), deleteThreshold, s.config.CustomInterval)
+		if _, ok := pending[key]; ok {
+			retried = append(retried, key)
+			filter = FilterUpdate
+		}
+		switch filter {
+		case FilterUpdate:
+			numUpdate++
+			update = append(update, parsed)
+		case FilterDelete:
+			numDelete++
+			delete = append(delete, parsed)
+			return s.flushDelete(listCtx, &delete, batchSize)
+		default:
+			numIgnore++
+		}
+		if s.config.Snapshot.WeeklyFromDaily && RollupDay(parsed, rollupThreshold) {
+			days = append(days, parsed)
+		}
+
+		var dead []*ParsedKey
+		dead, err = s.flushUpdate(listCtx, &update, batchSize)
+		deadLetters = append(deadLetters, dead...)
+		return err
+	})
+	if err == nil {
+		err = s.flushDelete(listCtx, &delete, 1)
+	}
+	if err == nil {
+		var dead []*ParsedKey
+		dead, err = s.flushUpdate(listCtx, &update, 1)
+		deadLetters = append(deadLetters, dead...)
+	}
+	listSpan.SetAttributes(attribute.Int("counterd.keys", numUpdate+numDelete+numIgnore+numInvalid))
+	endSpan(listSpan, err)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	s.logger.Info("sorted keys", "update", numUpdate,
+		"delete", numDelete, "ignore", numIgnore, "invalid", numInvalid)
+
+	span.SetAttributes(
+		attribute.Int("counterd.update", numUpdate),
+		attribute.Int("counterd.delete", numDelete),
+		attribute.Int("counterd.ignore", numIgnore),
+	)
+
+	// Derive the weekly counters from the daily keys we are keeping. The
+	// last day of each week is retried if its weekly counter fails.
+	rollupDays := make(map[string]string)
+	if s.config.Snapshot.WeeklyFromDaily {
+		rollups := WeeklyRollups(days, rollupThreshold)
+
+		// Only the updated days are listed, so merge every day of the week
+		if incremental {
+			for _, r := range rollups {
+				r.AllDays()
+			}
+		}
+
+		rollupCtx, rollupSpan := tracer.Start(ctx, "Snapshot.Rollup")
+		rollupSpan.SetAttributes(attribute.Int("counterd.rollups", len(rollups)))
+		groups := make([][]string, len(rollups))
+		for idx, r := range rollups {
+			groups[idx] = r.Days
+		}
+		counts, hlls, err := s.client.MergeKeys(rollupCtx, groups, s.config.Snapshot.StoreHLL)
+		endSpan(rollupSpan, err)
+		if err != nil {
+			s.logger.Error("failed to merge daily counters", "error", err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+		weeks := make([]*ParsedKey, len(rollups))
+		lastDays := make([]string, len(rollups))
+		for idx, r := range rollups {
+			r.Week.Count = counts[idx]
+			if hlls != nil {
+				r.Week.HLL = hlls[idx]
+			}
+			weeks[idx] = r.Week
+			lastDays[idx] = r.Days[len(r.Days)-1]
+			rollupDays[r.Week.Raw] = lastDays[idx]
+		}
+
+		// The weeks are not keys, so they use the rate of their last day
+		if err := s.sampleRates(ctx, weeks, lastDays); err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+
+		// Update all the weekly DB counters and domain attributes
+		upsertCtx, upsertSpan := tracer.Start(ctx, "Snapshot.Upsert")
+		dead, err := s.upsert(upsertCtx, weeks)
+		deadLetters = append(deadLetters, dead...)
+		endSpan(upsertSpan, err)
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+	}
+
+	// Remove the domain values no longer used by a counter
+	if s.config.Snapshot.PruneDomain {
+		pruneCtx, pruneSpan := tracer.Start(ctx, "Snapshot.PruneDomain")
+		pruned, err := s.db.PruneDomain(pruneCtx)
+		endSpan(pruneSpan, err)
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+		s.logger.Info("pruned domain values", "pruned", pruned)
+	}
+
+	// Clear the dirty keys once they are all in the database
+	if incremental {
+		if err := s.client.ClearDirtyKeys(ctx, false); err != nil {
+			s.logger.Error("failed to clear the dirty keys", "error", err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+	} else {
+		s.lastFull = runTime
+
+		// Keys expired by redis leave their update times and sample rates
+		pruned, err := s.client.PruneKeyFields(ctx)
+		if err != nil {
+			s.logger.Warn("failed to prune the fields of missing keys", "error", err)
+		} else {
+			s.logger.Debug("pruned the fields of missing keys", "pruned", pruned)
+		}
+	}
+
+	// Counters that failed to update are pending dead letters until they
+	// succeed. Weekly rollups are not keys, so their last day is retried.
+	deadKeys := make([]string, len(deadLetters))
+	dead := make(map[string]struct{}, len(deadLetters))
+	for idx, c := range deadLetters {
+		deadKeys[idx] = c.Raw
+		if day, ok := rollupDays[c.Raw]; ok {
+			deadKeys[idx] = day
+		}
+		dead[deadKeys[idx]] = struct{}{}
+	}
+	var succeeded []string
+	for _, key := range retried {
+		if _, ok := dead[key]; !ok {
+			succeeded = append(succeeded, key)
+		}
+	}
+	if err := s.client.UpdateDeadLetters(ctx, deadKeys, succeeded); err != nil {
+		s.logger.Error("failed to update the pending dead letters", "error", err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	// They are also marked dirty again, so the next incremental
+	// snapshot retries them even if it runs on another server
+	if s.config.Snapshot.Incremental && len(deadKeys) > 0 {
+		if err := s.client.MarkDirtyKeys(ctx, deadKeys); err != nil {
+			s.logger.Error("failed to mark the dead letters dirty", "error", err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+	}
+
+	// Unchanged keys can be skipped once every counter is up to date
+	if len(deadLetters) == 0 {
+		s.lastSnapshot = runTime
+	}
+
+	// Serve the new domain values from the database, including on
+	// the servers that did not run the snapshot
+	updated := time.Now()
+	s.domainCache.Purge(updated)
+	if err := s.client.SetDomainUpdated(ctx, updated); err != nil {
+		s.logger.Warn("failed to record the domain update", "error", err)
+	}
+
+	// Done!
+	s.logger.Info("snapshot complete", "duration", time.Since(start))
+	return nil
+}
 
-	// Filter the keys
-	update, ignore, delete := FilterKeys(parsed, updateThreshold,
-		deleteThreshold)
-	s.logger.Info("sorting keys", "update", len(update),
-		"delete", len(delete), "ignore", len(ignore))
+// incremental checks if a snapshot at the time only needs to count the
+// keys updated since the last snapshot. The first snapshot is always full.
+func (s *Snapshotter) incremental(now time.Time) bool {
+	if !s.config.Snapshot.Incremental || s.lastFull.IsZero() {
+		return false
+	}
+	return now.Sub(s.lastFull) < s.config.Snapshot.FullInterval
+}
 
-	// Delete the older keys
-	if err := s.client.DeleteKeys(ParsedList(delete).Keys()); err != nil {
+// flushDelete deletes the pending keys once there are at least min of them
+func (s *Snapshotter) flushDelete(ctx context.Context, pending *[]*ParsedKey, min int) error {
+	if len(*pending) == 0 || len(*pending) < min {
+		return nil
+	}
+	deleteCtx, deleteSpan := tracer.Start(ctx, "Snapshot.Delete")
+	err := s.client.DeleteKeys(deleteCtx, ParsedList(*pending).Keys())
+	endSpan(deleteSpan, err)
+	if err != nil {
 		s.logger.Error("failed to delete keys", "error", err)
 		return err
 	}
+	*pending = (*pending)[:0]
+	return nil
+}
+
+// flushUpdate counts the pending keys and updates the DB once there are
+// at least min of them, returning any counters that failed to upsert
+func (s *Snapshotter) flushUpdate(ctx context.Context, pending *[]*ParsedKey, min int) ([]*ParsedKey, error) {
+	update := *pending
+	if len(update) == 0 || len(update) < min {
+		return nil, nil
+	}
+
+	// Skip the keys that have not been updated since the last snapshot
+	if s.config.Snapshot.TrackUpdates && !s.lastSnapshot.IsZero() {
+		updatesCtx, updatesSpan := tracer.Start(ctx, "Snapshot.GetLastUpdates")
+		err := s.lastUpdates(updatesCtx, update)
+		endSpan(updatesSpan, err)
+		if err != nil {
+			return nil, err
+		}
+		var unchanged []*ParsedKey
+		update, unchanged = UpdatedKeys(update, s.lastSnapshot.Add(-LastUpdateSkew))
+		s.logger.Debug("skipping unchanged keys", "keys", len(unchanged))
+		if len(update) == 0 {
+			*pending = nil
+			return nil, nil
+		}
+	}
 
 	// Get the updated counters
-	counters, err := s.client.GetCounts(ParsedList(update).Keys())
+	countCtx, countSpan := tracer.Start(ctx, "Snapshot.GetCounts")
+	err := s.count(countCtx, update)
+	endSpan(countSpan, err)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compare the sampled counters to their exact counts
+	if s.config.Snapshot.AccuracySample > 0 {
+		sampleCtx, sampleSpan := tracer.Start(ctx, "Snapshot.Accuracy")
+		err = s.recordAccuracy(sampleCtx, update)
+		endSpan(sampleSpan, err)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Store the sample rate of each key so queries can scale the counts
+	if err := s.sampleRates(ctx, update, ParsedList(update).Keys()); err != nil {
+		return nil, err
+	}
+
+	// Update all the DB counters and domain attributes
+	upsertCtx, upsertSpan := tracer.Start(ctx, "Snapshot.Upsert")
+	deadLetters, err := s.upsert(upsertCtx, update)
+	endSpan(upsertSpan, err)
+	if err != nil {
+		return deadLetters, err
+	}
+
+	// Start a new batch, since the keys are still referenced
+	// by the rollups and dead letters
+	*pending = nil
+	return deadLetters, nil
+}
+
+// lastUpdates sets the last update time of each key. Keys that are
+// merged with their alternate key by count use the later update time
+// of the two, so a change to either key is counted.
+func (s *Snapshotter) lastUpdates(ctx context.Context, update []*ParsedKey) error {
+	keys := ParsedList(update).Keys()
+	alternates := make(map[int]int)
+	for idx, key := range update {
+		if alt, ok := s.alternateKey(key); ok {
+			alternates[idx] = len(keys)
+			keys = append(keys, alt)
+		}
+	}
+	times, err := s.client.GetLastUpdates(ctx, keys)
 	if err != nil {
-		s.logger.Error("failed to get counter values", "error", err)
 		return err
 	}
-	if len(counters) != len(update) {
-		s.logger.Error("length mis-match for counters")
+	for idx, key := range update {
+		key.LastUpdate = times[idx]
+		if altIdx, ok := alternates[idx]; ok && times[altIdx].After(key.LastUpdate) && !key.LastUpdate.IsZero() {
+			key.LastUpdate = times[altIdx]
+		}
+	}
+	return nil
+}
+
+// alternateKey returns the key a counter is merged with by count
+func (s *Snapshotter) alternateKey(key *ParsedKey) (string, bool) {
+	if s.config.Attributes.keyFormat() != KeyFormatV2 || key.Exact || key.Incr {
+		return "", false
+	}
+	return key.AlternateKey(s.config.Attributes.encodeValues(), s.config.CustomInterval)
+}
+
+// sampleRates sets the sample rate of each counter to the ingress sample
+// rate its key in redis was created with
+func (s *Snapshotter) sampleRates(ctx context.Context, update []*ParsedKey, keys []string) error {
+	rates, err := s.client.GetSampleRates(ctx, keys)
+	if err != nil {
+		s.logger.Error("failed to get sample rates", "error", err)
 		return err
 	}
-	for idx := range update {
-		update[idx].Count = counters[idx]
+	for idx, rate := range rates {
+		update[idx].SampleRate = rate
+	}
+	return nil
+}
+
+// count sets the count of each key, and the raw HyperLogLog if they are
+// persisted. While the v2 key format is configured, keys are merged with
+// the same counter in the other format, so counters are not split by a
+// migration between formats. Exact and incremented keys are not merged.
+func (s *Snapshotter) count(ctx context.Context, update []*ParsedKey) error {
+	var direct, merged []*ParsedKey
+	var groups [][]string
+	for _, key := range update {
+		if alt, ok := s.alternateKey(key); ok {
+			merged = append(merged, key)
+			groups = append(groups, []string{key.Raw, alt})
+			continue
+		}
+		direct = append(direct, key)
+	}
+
+	if len(direct) > 0 {
+		counters, err := s.client.GetCounts(ctx, ParsedList(direct).Keys())
+		if err == nil && len(counters) != len(direct) {
+			err = fmt.Errorf("got %d counts for %d keys", len(counters), len(direct))
+		}
+		if err != nil {
+			s.logger.Error("failed to get counter values", "error", err)
+			return err
+		}
+		for idx := range direct {
+			direct[idx].Count = counters[idx]
+		}
+
+		// Get the raw HyperLogLogs if we are persisting them
+		if s.config.Snapshot.StoreHLL {
+			hlls, err := s.client.GetHLLs(ctx, ParsedList(direct).Keys())
+			if err != nil {
+				s.logger.Error("failed to get raw counter values", "error", err)
+				return err
+			}
+			for idx := range direct {
+				direct[idx].HLL = hlls[idx]
+			}
+		}
 	}
 
-	// Update all the DB counters
-	if err := s.db.UpsertCounters(update); err != nil {
+	if len(merged) > 0 {
+		counts, hlls, err := s.client.MergeKeys(ctx, groups, s.config.Snapshot.StoreHLL)
+		if err != nil {
+			s.logger.Error("failed to merge counter values", "error", err)
+			return err
+		}
+		for idx, key := range merged {
+			key.Count = counts[idx]
+			if hlls != nil {
+				key.HLL = hlls[idx]
+			}
+		}
+	}
+	return nil
+}
+
+// upsert is used to update the DB counters and domain, returning any
+// counters that could not be upserted if failures are isolated
+func (s *Snapshotter) upsert(ctx context.Context, update []*ParsedKey) ([]*ParsedKey, error) {
+	// Update all the DB counters. Dead letters do not fail the snapshot,
+	// and their keys are retried by the next snapshot.
+	var deadLetters []*ParsedKey
+	err := s.db.UpsertCounters(ctx, update)
+	var deadErr *DeadLetterError
+	if errors.As(err, &deadErr) {
+		s.logger.Warn("skipped counters that failed to update", "counters", len(deadErr.Counters))
+		deadLetters = deadErr.Counters
+	} else if err != nil {
 		s.logger.Error("failed to update counter values", "error", err)
-		return err
+		return nil, err
 	}
 
 	// Collect all the domain attributes
 	attributes := CollectDomain(update)
-	if err := s.db.UpsertDomain(attributes); err != nil {
+	if err := s.db.UpsertDomain(ctx, attributes); err != nil {
 		s.logger.Error("failed to update domain values", "error", err)
-		return err
+		return deadLetters, err
 	}
+	return deadLetters, nil
+}
 
-	// Done!
-	s.logger.Info("snapshot complete", "duration", time.Since(start))
+// recordAccuracy is used to store the exact counts of the sampled counters
+func (s *Snapshotter) recordAccuracy(ctx context.Context, update []*ParsedKey) error {
+	var sampled []*ParsedKey
+	for _, key := range update {
+		if IsApproxKey(key.Raw) && SampledKey(key.Raw, s.config.Snapshot.AccuracySample) {
+			sampled = append(sampled, key)
+		}
+	}
+	if len(sampled) == 0 {
+		return nil
+	}
+
+	exact, err := s.client.GetSampleCounts(ctx, ParsedList(sampled).Keys())
+	if err != nil {
+		s.logger.Error("failed to get sampled counter values", "error", err)
+		return err
+	}
+	samples := make([]*AccuracySample, len(sampled))
+	for idx, key := range sampled {
+		samples[idx] = &AccuracySample{Counter: key, Exact: exact[idx]}
+	}
+	if err := s.db.RecordAccuracy(ctx, samples); err != nil {
+		s.logger.Error("failed to record accuracy samples", "error", err)
+		return err
+	}
 	return nil
 }
 
+// LocalWallClock returns the wall clock time in the location, represented in
+// UTC. Key dates are parsed as UTC, so this is used to compare against them.
+func LocalWallClock(t time.Time, loc *time.Location) time.Time {
+	if loc == nil {
+		return t
+	}
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(),
+		t.Second(), t.Nanosecond(), time.UTC)
+}
+
 // CollectDomain is used to collect all the domain attribute/values
 func CollectDomain(keys []*ParsedKey) map[string]map[string]struct{} {
 	out := make(map[string]map[string]struct{})
@@ -102,36 +664,188 @@ func CollectDomain(keys []*ParsedKey) map[string]map[string]struct{} {
 	return out
 }
 
-// FilterKeys sorts the input keys into a set to be updated, deleted, or ignored
-func FilterKeys(keys []*ParsedKey, updateThreshold, deleteThreshold time.Time) (update, ignore, delete []*ParsedKey) {
+// FilterAction is what a snapshot does with a key
+type FilterAction int
+
+const (
+	FilterIgnore FilterAction = iota
+	FilterUpdate
+	FilterDelete
+)
+
+// UpdatedKeys splits the keys by whether they were updated since the time.
+// Keys without a last update time are assumed to be updated.
+func UpdatedKeys(keys []*ParsedKey, since time.Time) (updated, unchanged []*ParsedKey) {
 	for _, key := range keys {
-		if key.Date.Before(deleteThreshold) {
-			delete = append(delete, key)
-			continue
+		if !key.LastUpdate.IsZero() && key.LastUpdate.Before(since) {
+			unchanged = append(unchanged, key)
+		} else {
+			updated = append(updated, key)
 		}
+	}
+	return
+}
 
-		// Determine the appropriate delta based on the interval
-		var delta time.Duration
-		switch key.Interval {
-		case "day":
-			delta = 24 * time.Hour
-		case "week":
-			delta = 7 * 24 * time.Hour
-		case "month":
-			delta = 31 * 24 * time.Hour
-		default:
-			panic(fmt.Sprintf("invalid interval %q", key.Interval))
-		}
+// UpdateThresholds are the update thresholds of each interval. Intervals
+// without their own threshold use the Default.
+type UpdateThresholds struct {
+	Default   time.Time
+	Intervals map[string]time.Time
+}
 
-		if key.Date.Add(delta).After(updateThreshold) {
+// For returns the update threshold of an interval
+func (u UpdateThresholds) For(interval string) time.Time {
+	if threshold, ok := u.Intervals[interval]; ok {
+		return threshold
+	}
+	return u.Default
+}
+
+// FilterKeys sorts the input keys into a set to be updated, deleted, or ignored,
+// using the update threshold of the interval of each key
+func FilterKeys(keys []*ParsedKey, updateThresholds UpdateThresholds, deleteThreshold time.Time, custom *CustomIntervalConfig) (update, ignore, delete []*ParsedKey) {
+	for _, key := range keys {
+		switch FilterKey(key, updateThresholds.For(key.Interval), deleteThreshold, custom) {
+		case FilterUpdate:
 			update = append(update, key)
-		} else {
+		case FilterDelete:
+			delete = append(delete, key)
+		default:
 			ignore = append(ignore, key)
 		}
 	}
 	return
 }
 
+// FilterKey determines if a key should be updated, deleted, or ignored
+func FilterKey(key *ParsedKey, updateThreshold, deleteThreshold time.Time, custom *CustomIntervalConfig) FilterAction {
+	end, ok := IntervalEnd(key.Interval, key.Date, custom)
+	if !ok {
+		panic(fmt.Sprintf("invalid interval %q", key.Interval))
+	}
+	updatable := end.After(updateThreshold)
+
+	// Never delete a counter that may still be updated, otherwise a
+	// delete threshold shorter than a quarter would reap it early
+	if key.Date.Before(deleteThreshold) && !updatable {
+		return FilterDelete
+	} else if updatable {
+		return FilterUpdate
+	}
+	return FilterIgnore
+}
+
+// IntervalEnd returns the end of the interval starting at the date, which
+// is the start of the next one. Returns false for an invalid interval.
+func IntervalEnd(interval string, date time.Time, custom *CustomIntervalConfig) (time.Time, bool) {
+	switch interval {
+	case "day":
+		return date.AddDate(0, 0, 1), true
+	case "week":
+		return date.AddDate(0, 0, 7), true
+	case "month":
+		return date.AddDate(0, 1, 0), true
+	case "quarter":
+		return date.AddDate(0, 3, 0), true
+	case "custom":
+		if custom == nil {
+			return time.Time{}, false
+		}
+		return date.Add(custom.Duration), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// WeeklyRollup is a weekly counter derived from the daily keys of the week
+type WeeklyRollup struct {
+	// Week is the weekly counter. The raw key is not stored in redis.
+	Week *ParsedKey
+
+	// Days are the raw daily keys to merge, in sorted order
+	Days []string
+}
+
+// replaceKeyDate returns the raw key with the interval and date replaced,
+// keeping the prefixes and attributes of the key
+func replaceKeyDate(raw, interval, date string) string {
+	var prefix string
+	for _, p := range []string{ExactKeyPrefix, IncrKeyPrefix} {
+		if strings.HasPrefix(raw, p) {
+			prefix += p
+			raw = strings.TrimPrefix(raw, p)
+		}
+	}
+	if strings.HasPrefix(raw, KeyFormatV2Prefix) {
+		prefix += KeyFormatV2Prefix
+		raw = strings.TrimPrefix(raw, KeyFormatV2Prefix)
+	}
+	suffix := strings.SplitN(raw, KeySeperator, 3)[2]
+	return prefix + interval + KeySeperator + date + KeySeperator + suffix
+}
+
+// AllDays sets the Days to the keys of every day of the week, including
+// the days that were not listed. Missing keys are merged as empty.
+func (r *WeeklyRollup) AllDays() {
+	days := make([]string, 7)
+	for i := range days {
+		date := r.Week.Date.AddDate(0, 0, i)
+		days[i] = replaceKeyDate(r.Days[0], "day", date.Format("2006-01-02"))
+	}
+	r.Days = days
+}
+
+// RollupDay checks if a key is a daily key used by WeeklyRollups, which
+// skips exact and incremented keys, and the days of weeks that can no
+// longer be updated
+func RollupDay(key *ParsedKey, updateThreshold time.Time) bool {
+	if key.Interval != "day" || key.Exact || key.Incr {
+		return false
+	}
+	week := key.Date.AddDate(0, 0, -1*int(key.Date.Weekday()))
+	return week.AddDate(0, 0, 7).After(updateThreshold)
+}
+
+// WeeklyRollups groups the daily keys by week and attributes, returning a
+// rollup for each week that may still be updated. Exact and incremented
+// keys are skipped, since their weekly counters are updated directly.
+func WeeklyRollups(keys []*ParsedKey, updateThreshold time.Time) []*WeeklyRollup {
+	rollups := make(map[string]*WeeklyRollup)
+	for _, key := range keys {
+		if !RollupDay(key, updateThreshold) {
+			continue
+		}
+		week := key.Date.AddDate(0, 0, -1*int(key.Date.Weekday()))
+
+		// Group by the week and the attribute suffix of the key
+		raw := replaceKeyDate(key.Raw, "week", week.Format("2006-01-02"))
+		r, ok := rollups[raw]
+		if !ok {
+			r = &WeeklyRollup{
+				Week: &ParsedKey{
+					Raw:        raw,
+					Interval:   "week",
+					Date:       week,
+					Attributes: key.Attributes,
+				},
+			}
+			rollups[raw] = r
+		}
+		r.Days = append(r.Days, key.Raw)
+	}
+
+	// Sort the output so it is deterministic
+	out := make([]*WeeklyRollup, 0, len(rollups))
+	for _, r := range rollups {
+		sort.Strings(r.Days)
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Week.Raw < out[j].Week.Raw
+	})
+	return out
+}
+
 // ParsedKey represents a raw key
 type ParsedKey struct {
 	Raw        string
@@ -139,6 +853,53 @@ type ParsedKey struct {
 	Date       time.Time
 	Attributes map[string]string
 	Count      int64
+
+	// HLL is the raw HyperLogLog, only set if it is being persisted
+	HLL []byte
+
+	// Exact is set if the counter is counted exactly with a set
+	Exact bool
+
+	// Incr is set if the counter counts every event with INCR
+	Incr bool
+
+	// SampleRate is the fraction of events that were counted, which is
+	// stored with the counter. Zero if every event was counted.
+	SampleRate float64
+
+	// V2 is set if the raw key is in the v2 format
+	V2 bool
+
+	// LastUpdate is when the key was last updated, only set if the
+	// update times are tracked. Zero if the time is unknown.
+	LastUpdate time.Time
+}
+
+// Kind returns the kind of the counter in the database
+func (p *ParsedKey) Kind() string {
+	if p.Incr {
+		return CounterKindEvents
+	}
+	return CounterKindUnique
+}
+
+// sampleRate returns the fraction of events that were counted
+func (p *ParsedKey) sampleRate() float64 {
+	if p.SampleRate <= 0 {
+		return 1
+	}
+	return p.SampleRate
+}
+
+// DecodeValues decodes the attribute values of a v1 key that were
+// encoded by EncodeAttributeValue. The v2 format is not encoded.
+func (p *ParsedKey) DecodeValues() {
+	if p.V2 {
+		return
+	}
+	for key, value := range p.Attributes {
+		p.Attributes[key] = DecodeAttributeValue(value)
+	}
 }
 
 type ParsedList []*ParsedKey
@@ -152,11 +913,11 @@ func (l ParsedList) Keys() []string {
 }
 
 // ParseKeyList parses a list of raw keys
-func ParseKeyList(keys []string) ([]*ParsedKey, []string) {
+func ParseKeyList(keys []string, custom *CustomIntervalConfig) ([]*ParsedKey, []string) {
 	var out []*ParsedKey
 	var invalid []string
 	for _, key := range keys {
-		parsed, err := ParseKey(key)
+		parsed, err := ParseKey(key, custom)
 		if err != nil {
 			invalid = append(invalid, key)
 		} else {
@@ -166,17 +927,33 @@ func ParseKeyList(keys []string) ([]*ParsedKey, []string) {
 	return out, invalid
 }
 
-// ParseKey parses a single key into a structured form
-func ParseKey(raw string) (*ParsedKey, error) {
+// ParseKey parses a single key in either format into a structured form.
+// Keys of the custom interval are only valid if it is configured.
+func ParseKey(raw string, custom *CustomIntervalConfig) (*ParsedKey, error) {
 	// Setup the parsed key
 	parsed := &ParsedKey{
 		Raw:        raw,
 		Attributes: make(map[string]string),
 	}
 
-	// Split into the various parts
-	parts := strings.Split(raw, KeySeperator)
-	if len(parts) < 4 {
+	// Check if this is an exact or incremented counter
+	if strings.HasPrefix(raw, ExactKeyPrefix) {
+		parsed.Exact = true
+		raw = strings.TrimPrefix(raw, ExactKeyPrefix)
+	} else if strings.HasPrefix(raw, IncrKeyPrefix) {
+		parsed.Incr = true
+		raw = strings.TrimPrefix(raw, IncrKeyPrefix)
+	}
+
+	// Check if this is in the v2 format
+	if strings.HasPrefix(raw, KeyFormatV2Prefix) {
+		parsed.V2 = true
+		raw = strings.TrimPrefix(raw, KeyFormatV2Prefix)
+	}
+
+	// Split into the interval, date, and attributes
+	parts := strings.SplitN(raw, KeySeperator, 3)
+	if len(parts) < 3 {
 		return nil, fmt.Errorf("invalid format")
 	}
 
@@ -185,32 +962,150 @@ func ParseKey(raw string) (*ParsedKey, error) {
 
 	// Parse the date based on that
 	var err error
-	switch parsed.Interval {
-	case "day":
-		parsed.Date, err = time.Parse("2006-01-02", parts[1])
-	case "week":
-		parsed.Date, err = time.Parse("2006-01-02", parts[1])
-	case "month":
-		parsed.Date, err = time.Parse("2006-01", parts[1])
-	default:
-		return nil, fmt.Errorf("invalid interval %q", parsed.Interval)
-	}
+	parsed.Date, err = ParseIntervalDate(parsed.Interval, parts[1], custom)
 	if err != nil {
-		return nil, fmt.Errorf("invalid date %q", parts[1])
+		return nil, err
 	}
 
-	// Skip past the interval and date
-	parts = parts[2:]
-	if len(parts)%2 != 0 {
+	// Split the attributes based on the format
+	var attrs []string
+	if parsed.V2 {
+		attrs, err = splitLengthPrefixed(parts[2])
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		attrs = strings.Split(parts[2], KeySeperator)
+	}
+	if len(attrs) < 2 {
+		return nil, fmt.Errorf("invalid format")
+	}
+	if len(attrs)%2 != 0 {
 		return nil, fmt.Errorf("key/value attributes not even")
 	}
 
 	// Parse all the K/V attributes
-	for len(parts) != 0 {
-		key := parts[0]
-		val := parts[1]
+	for len(attrs) != 0 {
+		key := attrs[0]
+		val := attrs[1]
 		parsed.Attributes[key] = val
-		parts = parts[2:]
+		attrs = attrs[2:]
 	}
 	return parsed, nil
 }
+
+// splitLengthPrefixed splits a sequence of strings that are each
+// prefixed with their length and a colon
+func splitLengthPrefixed(raw string) ([]string, error) {
+	var out []string
+	for raw != "" {
+		idx := strings.Index(raw, KeySeperator)
+		if idx <= 0 {
+			return nil, fmt.Errorf("missing length prefix")
+		}
+		n, err := strconv.ParseUint(raw[:idx], 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("invalid length prefix %q", raw[:idx])
+		}
+		raw = raw[idx+1:]
+		if int(n) > len(raw) {
+			return nil, fmt.Errorf("length prefix %d exceeds the key", n)
+		}
+		out = append(out, raw[:n])
+		raw = raw[n:]
+	}
+	return out, nil
+}
+
+// AlternateKey returns the raw key of the same counter in the other key
+// format. Returns false for v2 keys with attributes that cannot be
+// represented in the v1 format.
+func (p *ParsedKey) AlternateKey(encodeValues bool, custom *CustomIntervalConfig) (string, bool) {
+	var prefix string
+	if p.Exact {
+		prefix = ExactKeyPrefix
+	} else if p.Incr {
+		prefix = IncrKeyPrefix
+	}
+	date, ok := FormatIntervalDate(p.Interval, p.Date, custom)
+	if !ok {
+		return "", false
+	}
+	intervals := map[string]string{p.Interval: date}
+	req := &IngressRequest{Attributes: p.Attributes}
+	if p.V2 {
+		for key, value := range p.Attributes {
+			if strings.Contains(key, KeySeperator) || (!encodeValues && strings.Contains(value, KeySeperator)) {
+				return "", false
+			}
+		}
+		config := &AttributeConfig{KeyFormat: KeyFormatV1, EncodeValues: encodeValues}
+		return prefix + config.counterKeys(intervals, req)[0], true
+	}
+	return prefix + RequestCounterKeysV2(intervals, req)[0], true
+}
+
+// intervalDateFormat returns the date layout used in keys for an interval.
+// Quarters are not a time layout and are handled separately.
+func intervalDateFormat(interval string) (string, bool) {
+	switch interval {
+	case "day", "week":
+		return "2006-01-02", true
+	case "month":
+		return "2006-01", true
+	default:
+		return "", false
+	}
+}
+
+// FormatIntervalDate formats the date the same way as the keys for an interval.
+// Quarters are formatted with the calendar quarter, e.g. "2017-Q1", and the
+// custom interval with the index of the bucket, e.g. "12". The custom
+// interval is only valid if it is configured.
+func FormatIntervalDate(interval string, date time.Time, custom *CustomIntervalConfig) (string, bool) {
+	if interval == "quarter" {
+		return fmt.Sprintf("%d-Q%d", date.Year(), (int(date.Month())-1)/3+1), true
+	}
+	if interval == "custom" {
+		if custom == nil {
+			return "", false
+		}
+		return strconv.FormatInt(custom.Bucket(date), 10), true
+	}
+	layout, ok := intervalDateFormat(interval)
+	if !ok {
+		return "", false
+	}
+	return date.Format(layout), true
+}
+
+// ParseIntervalDate parses the date of a key for an interval.
+// Quarters are parsed to the first day of the quarter, and the
+// custom interval to the start of the bucket if it is configured.
+func ParseIntervalDate(interval, raw string, custom *CustomIntervalConfig) (time.Time, error) {
+	if interval == "custom" && custom != nil {
+		bucket, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || strconv.FormatInt(bucket, 10) != raw {
+			return time.Time{}, fmt.Errorf("invalid date %q", raw)
+		}
+		return custom.Start(bucket), nil
+	}
+	if interval == "quarter" {
+		var year, quarter int
+		n, err := fmt.Sscanf(raw, "%4d-Q%1d", &year, &quarter)
+		if err != nil || n != 2 || quarter < 1 || quarter > 4 || len(raw) != 7 {
+			return time.Time{}, fmt.Errorf("invalid date %q", raw)
+		}
+		return time.Date(year, time.Month((quarter-1)*3+1), 1, 0, 0, 0, 0, time.UTC), nil
+	}
+
+	layout, ok := intervalDateFormat(interval)
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid interval %q", interval)
+	}
+	date, err := time.Parse(layout, raw)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q", raw)
+	}
+	return date, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -27,15 +28,15 @@ func TestSnapshotter(t *testing.T) {
 		"day:2017-01-10:foo:baz",
 		"day:2017-01-01:zip:zap",
 	}
-	assert.Nil(t, redis.UpdateKeys(keys, "1234"))
+	assert.Nil(t, redis.UpdateKeys(context.Background(), keys, "1234"))
 
 	// Run the snapshot
 	runTime := time.Date(2017, 1, 18, 12, 0, 0, 0, time.UTC)
-	err := snap.Run(runTime)
+	err := snap.Run(context.Background(), runTime)
 	assert.Nil(t, err)
 
 	// Check that the oldest key is deleted
-	counters, _ := redis.ListKeys()
+	counters, _ := redis.ListKeys(context.Background())
 	assert.Equal(t, 2, len(counters))
 	assert.NotContains(t, counters, "day:2017-01-01:zip:zap")
 
@@ -51,10 +52,820 @@ func TestSnapshotter(t *testing.T) {
 	assert.Equal(t, domain, db.domain)
 }
 
+func TestSnapshotter_Locked(t *testing.T) {
+	conf := DefaultConfig()
+	redis := NewMockRedisClient()
+	db := NewMockDatabaseClient()
+
+	snap := &Snapshotter{
+		config: conf,
+		logger: hclog.Default(),
+		client: redis,
+		db:     db,
+	}
+	ctx := context.Background()
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:bar"}, "1234"))
+	runTime := time.Date(2017, 1, 18, 12, 0, 0, 0, time.UTC)
+
+	// Skip the snapshot while another process holds the lock
+	token, ok, err := redis.AcquireLock(ctx, SnapshotLockName, time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, ErrSnapshotLocked, snap.Run(ctx, runTime))
+	assert.Equal(t, 0, len(db.counters))
+
+	// Run once the lock is released, releasing it again after
+	assert.Nil(t, redis.ReleaseLock(ctx, SnapshotLockName, token))
+	assert.Nil(t, snap.Run(ctx, runTime))
+	assert.Equal(t, 1, len(db.counters))
+	assert.Empty(t, redis.locks)
+}
+
+// lostLockClient fails to renew locks, and blocks listing the dead
+// letters until the context is cancelled
+type lostLockClient struct {
+	*MockRedisClient
+}
+
+func (l *lostLockClient) RenewLock(ctx context.Context, name, token string, ttl time.Duration) (bool, error) {
+	return false, nil
+}
+
+func (l *lostLockClient) GetDeadLetters(ctx context.Context) ([]string, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestSnapshotter_LockLost(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Snapshot.LockTTL = 30 * time.Millisecond
+	redis := &lostLockClient{MockRedisClient: NewMockRedisClient()}
+	db := NewMockDatabaseClient()
+
+	snap := &Snapshotter{
+		config: conf,
+		logger: hclog.Default(),
+		client: redis,
+		db:     db,
+	}
+	ctx := context.Background()
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:bar"}, "1234"))
+
+	// The snapshot is cancelled once the renewal fails
+	runTime := time.Date(2017, 1, 18, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, ErrSnapshotLockLost, snap.Run(ctx, runTime))
+	assert.Equal(t, 0, len(db.counters))
+	assert.Empty(t, redis.locks)
+}
+
+func TestSnapshotter_StoreHLL(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Snapshot.StoreHLL = true
+	redis := NewMockRedisClient()
+	db := NewMockDatabaseClient()
+
+	snap := &Snapshotter{
+		config: conf,
+		logger: hclog.Default(),
+		client: redis,
+		db:     db,
+	}
+
+	// Create overlapping counter values
+	ctx := context.Background()
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:bar"}, "1234"))
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:bar"}, "2345"))
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:baz"}, "2345"))
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:baz"}, "3456"))
+
+	// Run the snapshot
+	runTime := time.Date(2017, 1, 18, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, snap.Run(ctx, runTime))
+	assert.Equal(t, 2, len(db.counters))
+
+	// Merging should not double count the shared ID
+	p1, _ := ParseKey("day:2017-01-18:foo:bar", nil)
+	p2, _ := ParseKey("day:2017-01-18:foo:baz", nil)
+	count, err := db.MergeCardinality(ctx, redis, []*ParsedKey{p1, p2})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), count)
+}
+
+func TestSnapshotter_WeeklyFromDaily(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Snapshot.WeeklyFromDaily = true
+	conf.Snapshot.StoreHLL = true
+	redis := NewMockRedisClient()
+	db := NewMockDatabaseClient()
+
+	snap := &Snapshotter{
+		config: conf,
+		logger: hclog.Default(),
+		client: redis,
+		db:     db,
+	}
+
+	// Create daily values across the week, with a repeated ID
+	ctx := context.Background()
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-15:foo:bar"}, "1234"))
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-16:foo:bar"}, "1234"))
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-16:foo:bar"}, "2345"))
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:bar"}, "3456"))
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:baz"}, "3456"))
+
+	// Run the snapshot
+	runTime := time.Date(2017, 1, 18, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, snap.Run(ctx, runTime))
+
+	// Check the weekly counters are unique across the days
+	week := time.Date(2017, 1, 15, 0, 0, 0, 0, time.UTC)
+	c, err := db.GetCounter(ctx, "week", week, map[string]string{"foo": "bar"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), c.Count)
+	c, err = db.GetCounter(ctx, "week", week, map[string]string{"foo": "baz"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), c.Count)
+
+	// The merged HLL is stored for the weekly counter
+	p, _ := ParseKey("week:2017-01-15:foo:bar", nil)
+	count, err := db.MergeCardinality(ctx, redis, []*ParsedKey{p})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), count)
+}
+
+// batchRedisClient counts the batches counted and deleted
+type batchRedisClient struct {
+	*MockRedisClient
+	counts  []int
+	deletes []int
+}
+
+func (b *batchRedisClient) GetCounts(ctx context.Context, keys []string) ([]int64, error) {
+	b.counts = append(b.counts, len(keys))
+	return b.MockRedisClient.GetCounts(ctx, keys)
+}
+
+func (b *batchRedisClient) DeleteKeys(ctx context.Context, keys []string) error {
+	b.deletes = append(b.deletes, len(keys))
+	return b.MockRedisClient.DeleteKeys(ctx, keys)
+}
+
+func TestSnapshotter_Incremental(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Snapshot.Incremental = true
+	conf.Snapshot.WeeklyFromDaily = true
+	redis := &batchRedisClient{MockRedisClient: NewMockRedisClient()}
+	db := NewMockDatabaseClient()
+
+	snap := &Snapshotter{
+		config: conf,
+		logger: hclog.Default(),
+		client: redis,
+		db:     db,
+	}
+
+	// The first snapshot is full
+	ctx := context.Background()
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-16:foo:bar"}, "1"))
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-17:foo:bar"}, "2"))
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:baz"}, "3"))
+	runTime := time.Date(2017, 1, 18, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, snap.Run(ctx, runTime))
+	assert.Equal(t, []int{1}, redis.counts)
+	assert.Equal(t, runTime, snap.lastFull)
+	assert.Empty(t, redis.dirty)
+
+	// Later snapshots only count the updated keys, but the weekly
+	// rollups still merge every day of the week
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:bar"}, "4"))
+	assert.Nil(t, snap.Run(ctx, runTime.Add(time.Hour)))
+	assert.Equal(t, []int{1, 1}, redis.counts)
+	assert.Empty(t, redis.dirty)
+	assert.Empty(t, redis.dirtySnapshot)
+
+	day := time.Date(2017, 1, 18, 0, 0, 0, 0, time.UTC)
+	c, err := db.GetCounter(ctx, "day", day, map[string]string{"foo": "bar"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), c.Count)
+	week := time.Date(2017, 1, 15, 0, 0, 0, 0, time.UTC)
+	c, err = db.GetCounter(ctx, "week", week, map[string]string{"foo": "bar"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), c.Count)
+
+	// Nothing is counted without updates
+	assert.Nil(t, snap.Run(ctx, runTime.Add(2*time.Hour)))
+	assert.Equal(t, []int{1, 1}, redis.counts)
+	assert.Equal(t, runTime, snap.lastFull)
+
+	// Full snapshots run at the full interval
+	assert.Nil(t, snap.Run(ctx, runTime.Add(DefaultFullSnapshotInterval)))
+	assert.Equal(t, runTime.Add(DefaultFullSnapshotInterval), snap.lastFull)
+}
+
+func TestSnapshotter_TrackUpdates(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Snapshot.TrackUpdates = true
+	redis := &batchRedisClient{MockRedisClient: NewMockRedisClient()}
+	db := NewMockDatabaseClient()
+
+	snap := &Snapshotter{
+		config: conf,
+		logger: hclog.Default(),
+		client: redis,
+		db:     db,
+	}
+
+	// The first snapshot counts every key
+	ctx := context.Background()
+	keys := []string{"day:2017-01-18:foo:bar", "day:2017-01-18:foo:baz"}
+	assert.Nil(t, redis.UpdateKeys(ctx, keys, "1234"))
+	runTime := time.Date(2017, 1, 18, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, snap.Run(ctx, runTime))
+	assert.Equal(t, []int{2}, redis.counts)
+	assert.Equal(t, runTime, snap.lastSnapshot)
+
+	// Keys not updated since the last snapshot are skipped, allowing
+	// for the clock skew
+	redis.lastUpdates[keys[0]] = runTime.Add(-LastUpdateSkew / 2)
+	redis.lastUpdates[keys[1]] = runTime.Add(-time.Hour)
+	assert.Nil(t, snap.Run(ctx, runTime.Add(time.Hour)))
+	assert.Equal(t, []int{2, 1}, redis.counts)
+
+	// Keys are skipped entirely when nothing changed
+	redis.lastUpdates[keys[0]] = runTime.Add(-time.Hour)
+	assert.Nil(t, snap.Run(ctx, runTime.Add(2*time.Hour)))
+	assert.Equal(t, []int{2, 1}, redis.counts)
+}
+
+func TestSnapshotter_LastUpdatesAlternateKeys(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Attributes.KeyFormat = KeyFormatV2
+	conf.Snapshot.TrackUpdates = true
+	redis := NewMockRedisClient()
+	snap := &Snapshotter{
+		config: conf,
+		logger: hclog.Default(),
+		client: redis,
+	}
+
+	// A key merged with its alternate is updated if either changed
+	now := time.Date(2017, 1, 18, 12, 0, 0, 0, time.UTC)
+	v1, _ := ParseKey("day:2017-01-18:foo:bar", nil)
+	v2, _ := ParseKey("v2:day:2017-01-18:3:foo3:bar", nil)
+	redis.lastUpdates[v1.Raw] = now
+	redis.lastUpdates[v2.Raw] = now.Add(-time.Hour)
+	assert.Nil(t, snap.lastUpdates(context.Background(), []*ParsedKey{v1, v2}))
+	assert.Equal(t, now, v1.LastUpdate)
+	assert.Equal(t, now, v2.LastUpdate)
+
+	// Keys without an update time are still assumed to be updated
+	v2.LastUpdate = time.Time{}
+	delete(redis.lastUpdates, v2.Raw)
+	assert.Nil(t, snap.lastUpdates(context.Background(), []*ParsedKey{v2}))
+	assert.True(t, v2.LastUpdate.IsZero())
+}
+
+func TestSnapshotter_PruneKeyFields(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Snapshot.TrackUpdates = true
+	redis := NewMockRedisClient()
+	redis.ingressRate = 0.5
+	snap := &Snapshotter{
+		config: conf,
+		logger: hclog.Default(),
+		client: redis,
+		db:     NewMockDatabaseClient(),
+	}
+
+	ctx := context.Background()
+	keys := []string{"day:2017-01-18:foo:bar", "day:2017-01-18:foo:baz"}
+	assert.Nil(t, redis.UpdateKeys(ctx, keys, "1234"))
+
+	// A key expired by redis leaves its fields until a full snapshot
+	delete(redis.counters, keys[1])
+	assert.Nil(t, snap.Run(ctx, time.Date(2017, 1, 18, 12, 0, 0, 0, time.UTC)))
+	assert.Contains(t, redis.lastUpdates, keys[0])
+	assert.NotContains(t, redis.lastUpdates, keys[1])
+	assert.Contains(t, redis.sampleRates, keys[0])
+	assert.NotContains(t, redis.sampleRates, keys[1])
+}
+
+func TestUpdatedKeys(t *testing.T) {
+	since := time.Date(2017, 1, 18, 12, 0, 0, 0, time.UTC)
+	p1 := &ParsedKey{Raw: "day:2017-01-18:foo:bar", LastUpdate: since.Add(time.Minute)}
+	p2 := &ParsedKey{Raw: "day:2017-01-18:foo:baz", LastUpdate: since.Add(-time.Minute)}
+	p3 := &ParsedKey{Raw: "day:2017-01-18:foo:zip"}
+
+	updated, unchanged := UpdatedKeys([]*ParsedKey{p1, p2, p3}, since)
+	assert.Equal(t, []*ParsedKey{p1, p3}, updated)
+	assert.Equal(t, []*ParsedKey{p2}, unchanged)
+}
+
+func TestSnapshotter_Batches(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Snapshot.UpdateThreshold = 48 * time.Hour
+	conf.Snapshot.DeleteThreshold = 14 * 24 * time.Hour
+	conf.Snapshot.WeeklyFromDaily = true
+	conf.Snapshot.BatchSize = 2
+	redis := &batchRedisClient{MockRedisClient: NewMockRedisClient()}
+	db := NewMockDatabaseClient()
+
+	snap := &Snapshotter{
+		config: conf,
+		logger: hclog.Default(),
+		client: redis,
+		db:     db,
+	}
+
+	// Create counters to update, ignore and delete
+	ctx := context.Background()
+	keys := []string{
+		"day:2017-01-01:zip:zap",
+		"day:2017-01-02:zip:zap",
+		"day:2017-01-03:zip:zap",
+		"day:2017-01-10:foo:baz",
+		"day:2017-01-16:foo:bar",
+		"day:2017-01-17:foo:bar",
+		"day:2017-01-18:foo:bar",
+		"invalid",
+	}
+	assert.Nil(t, redis.UpdateKeys(ctx, keys, "1234"))
+
+	// Run the snapshot
+	runTime := time.Date(2017, 1, 18, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, snap.Run(ctx, runTime))
+
+	// Keys are counted and deleted in batches
+	assert.Equal(t, []int{2, 1}, redis.counts)
+	assert.Equal(t, []int{2, 1}, redis.deletes)
+	counters, _ := redis.ListKeys(ctx)
+	assert.Equal(t, keys[3:], counters)
+
+	// The daily counters in the update threshold are stored,
+	// along with the weekly rollup of the days
+	day := time.Date(2017, 1, 18, 0, 0, 0, 0, time.UTC)
+	c, err := db.GetCounter(ctx, "day", day, map[string]string{"foo": "bar"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), c.Count)
+	week := time.Date(2017, 1, 15, 0, 0, 0, 0, time.UTC)
+	c, err = db.GetCounter(ctx, "week", week, map[string]string{"foo": "bar"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), c.Count)
+	assert.Equal(t, 4, len(db.counters))
+}
+
+func TestSnapshotter_EncodeValues(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Attributes.EncodeValues = true
+	redis := NewMockRedisClient()
+	db := NewMockDatabaseClient()
+
+	snap := &Snapshotter{
+		config: conf,
+		logger: hclog.Default(),
+		client: redis,
+		db:     db,
+	}
+
+	// The encoded values are decoded before updating the database
+	ctx := context.Background()
+	key := "day:2017-01-18:time:12%3A30:url:http%3A//x.com/100%25"
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{key}, "1234"))
+	runTime := time.Date(2017, 1, 18, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, snap.Run(ctx, runTime))
+
+	day := time.Date(2017, 1, 18, 0, 0, 0, 0, time.UTC)
+	c, err := db.GetCounter(ctx, "day", day, map[string]string{"time": "12:30", "url": "http://x.com/100%"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), c.Count)
+	assert.Contains(t, db.domain["time"], "12:30")
+}
+
+func TestSnapshotter_MixedKeyFormats(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Attributes.KeyFormat = KeyFormatV2
+	conf.Snapshot.StoreHLL = true
+	redis := NewMockRedisClient()
+	db := NewMockDatabaseClient()
+
+	snap := &Snapshotter{
+		config: conf,
+		logger: hclog.Default(),
+		client: redis,
+		db:     db,
+	}
+
+	// The same counter was updated before and after migrating to v2
+	ctx := context.Background()
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:bar"}, "1234"))
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:bar"}, "2345"))
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"v2:day:2017-01-18:3:foo3:bar"}, "2345"))
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"v2:day:2017-01-18:3:foo3:bar"}, "3456"))
+
+	// A v2 only counter with a colon
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"v2:day:2017-01-18:3:foo3:b:r"}, "1234"))
+
+	runTime := time.Date(2017, 1, 18, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, snap.Run(ctx, runTime))
+
+	// The counters of both formats are merged
+	day := time.Date(2017, 1, 18, 0, 0, 0, 0, time.UTC)
+	c, err := db.GetCounter(ctx, "day", day, map[string]string{"foo": "bar"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), c.Count)
+	c, err = db.GetCounter(ctx, "day", day, map[string]string{"foo": "b:r"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), c.Count)
+}
+
+func TestSnapshotter_SampleRate(t *testing.T) {
+	// The rate is recorded when the keys are counted, so a snapshot
+	// without the ingress configuration still scales the counts
+	conf := DefaultConfig()
+	redis := NewMockRedisClient()
+	redis.ingressRate = 0.25
+	db := NewMockDatabaseClient()
+
+	snap := &Snapshotter{
+		config: conf,
+		logger: hclog.Default(),
+		client: redis,
+		db:     db,
+	}
+
+	ctx := context.Background()
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:bar"}, "1234"))
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:bar"}, "2345"))
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:baz"}, "1234"))
+
+	runTime := time.Date(2017, 1, 18, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, snap.Run(ctx, runTime))
+
+	// The stored count is the sampled count, and queries scale it up
+	day := time.Date(2017, 1, 18, 0, 0, 0, 0, time.UTC)
+	c, err := db.GetCounter(ctx, "day", day, map[string]string{"foo": "bar"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), c.Count)
+
+	iter, err := db.QueryCounters(ctx, &QueryFilter{Interval: "day"})
+	assert.Nil(t, err)
+	res, err := CollectQueryResults(iter)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(res)) {
+		assert.Equal(t, day, res[0].Date)
+		assert.Equal(t, int64(12), res[0].Count)
+	}
+	top, err := db.TopValues(ctx, CounterKindUnique, "day", day, "foo", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []*ValueCount{{Value: "bar", Count: 8}, {Value: "baz", Count: 4}}, top)
+
+	// Exports are scaled, since the rate is not exported
+	stream, err := db.StreamCounters(ctx, "day", day, day)
+	assert.Nil(t, err)
+	exported := make(map[string]int64)
+	for {
+		c, err := stream.Next()
+		assert.Nil(t, err)
+		if c == nil {
+			break
+		}
+		exported[c.Attributes["foo"]] = c.Count
+	}
+	assert.Equal(t, map[string]int64{"bar": 8, "baz": 4}, exported)
+
+	// Keys keep the rate they were created with if the rate changes
+	redis.ingressRate = 0.5
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:bar", "day:2017-01-18:foo:new"}, "3456"))
+	rates, err := redis.GetSampleRates(ctx, []string{"day:2017-01-18:foo:bar", "day:2017-01-18:foo:new", "missing"})
+	assert.Nil(t, err)
+	assert.Equal(t, []float64{0.25, 0.5, 0}, rates)
+}
+
+func TestSnapshotter_Increments(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Snapshot.WeeklyFromDaily = true
+	conf.Snapshot.StoreHLL = true
+	conf.Snapshot.UpdateThreshold = 48 * time.Hour
+	redis := NewMockRedisClient()
+	db := NewMockDatabaseClient()
+
+	snap := &Snapshotter{
+		config: conf,
+		logger: hclog.Default(),
+		client: redis,
+		db:     db,
+	}
+
+	// Three events without an ID
+	ctx := context.Background()
+	keys := []string{"incr:day:2017-01-18:foo:bar", "incr:week:2017-01-15:foo:bar"}
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, redis.UpdateKeys(ctx, keys, ""))
+	}
+
+	runTime := time.Date(2017, 1, 18, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, snap.Run(ctx, runTime))
+
+	// Every event is counted, and the week is not rolled up from the days
+	for _, interval := range []string{"day", "week"} {
+		iter, err := db.QueryCounters(ctx, &QueryFilter{Interval: interval, Kind: CounterKindEvents})
+		assert.Nil(t, err)
+		results, err := CollectQueryResults(iter)
+		assert.Nil(t, err)
+		if assert.Equal(t, 1, len(results), interval) {
+			assert.Equal(t, int64(3), results[0].Count, interval)
+		}
+	}
+}
+
+func TestSnapshotter_IncrementsAndUniqueCounts(t *testing.T) {
+	redis := NewMockRedisClient()
+	db := NewMockDatabaseClient()
+	snap := &Snapshotter{
+		config: DefaultConfig(),
+		logger: hclog.Default(),
+		client: redis,
+		db:     db,
+	}
+
+	// Two unique IDs and three events without an ID, with the same attributes
+	ctx := context.Background()
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:bar"}, "1234"))
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:bar"}, "5678"))
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, redis.UpdateKeys(ctx, []string{"incr:day:2017-01-18:foo:bar"}, ""))
+	}
+	assert.Nil(t, snap.Run(ctx, time.Date(2017, 1, 18, 12, 0, 0, 0, time.UTC)))
+
+	// Each kind is stored and queried separately
+	day := time.Date(2017, 1, 18, 0, 0, 0, 0, time.UTC)
+	for kind, expect := range map[string]int64{CounterKindUnique: 2, CounterKindEvents: 3} {
+		iter, err := db.QueryCounters(ctx, &QueryFilter{Interval: "day", Kind: kind})
+		assert.Nil(t, err)
+		results, err := CollectQueryResults(iter)
+		assert.Nil(t, err)
+		if assert.Equal(t, 1, len(results), kind) {
+			assert.Equal(t, expect, results[0].Count, kind)
+		}
+
+		top, err := db.TopValues(ctx, kind, "day", day, "foo", 10)
+		assert.Nil(t, err)
+		assert.Equal(t, []*ValueCount{{Value: "bar", Count: expect}}, top, kind)
+	}
+	c, err := db.GetCounter(ctx, "day", day, map[string]string{"foo": "bar"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), c.Count)
+
+	// Both are exported, and the increments keep their kind
+	iter, err := db.StreamCounters(ctx, "", day, day)
+	assert.Nil(t, err)
+	var incr []bool
+	for {
+		c, err := iter.Next()
+		assert.Nil(t, err)
+		if c == nil {
+			break
+		}
+		incr = append(incr, c.Incr)
+	}
+	assert.Equal(t, 2, len(incr))
+	assert.Contains(t, incr, false)
+	assert.Contains(t, incr, true)
+}
+
+func TestReplaceKeyDate(t *testing.T) {
+	assert.Equal(t, "week:2017-01-15:foo:bar", replaceKeyDate("day:2017-01-18:foo:bar", "week", "2017-01-15"))
+	assert.Equal(t, "v2:week:2017-01-15:3:foo3:b:r", replaceKeyDate("v2:day:2017-01-18:3:foo3:b:r", "week", "2017-01-15"))
+	assert.Equal(t, "exact:v2:week:2017-01-15:3:foo3:bar", replaceKeyDate("exact:v2:day:2017-01-18:3:foo3:bar", "week", "2017-01-15"))
+	assert.Equal(t, "incr:week:2017-01-15:foo:bar", replaceKeyDate("incr:day:2017-01-18:foo:bar", "week", "2017-01-15"))
+}
+
+func TestParsedKey_AlternateKey(t *testing.T) {
+	type tcase struct {
+		Input        string
+		EncodeValues bool
+		Expect       string
+	}
+	cases := []tcase{
+		{"day:2017-01-18:foo:bar", false, "v2:day:2017-01-18:3:foo3:bar"},
+		{"v2:quarter:2017-Q1:3:foo3:bar", false, "quarter:2017-Q1:foo:bar"},
+		{"v2:day:2017-01-18:3:foo3:b:r", false, ""},
+		{"v2:day:2017-01-18:3:foo3:b:r", true, "day:2017-01-18:foo:b%3Ar"},
+		{"v2:day:2017-01-18:3:f:o3:bar", true, ""},
+		{"exact:day:2017-01-18:foo:bar", false, "exact:v2:day:2017-01-18:3:foo3:bar"},
+	}
+	for _, tc := range cases {
+		p, err := ParseKey(tc.Input, nil)
+		assert.Nil(t, err)
+		alt, ok := p.AlternateKey(tc.EncodeValues, nil)
+		assert.Equal(t, tc.Expect != "", ok, tc.Input)
+		assert.Equal(t, tc.Expect, alt, tc.Input)
+	}
+}
+
+func TestSnapshotter_AccuracySample(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Snapshot.AccuracySample = 1
+	redis := NewMockRedisClient()
+	db := NewMockDatabaseClient()
+
+	snap := &Snapshotter{
+		config: conf,
+		logger: hclog.Default(),
+		client: redis,
+		db:     db,
+	}
+
+	ctx := context.Background()
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:bar", "exact:day:2017-01-18:foo:bar"}, "1234"))
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:bar"}, "2345"))
+
+	// Run the snapshot
+	runTime := time.Date(2017, 1, 18, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, snap.Run(ctx, runTime))
+
+	// Only the HyperLogLog counter is sampled
+	assert.Equal(t, 1, len(db.accuracy))
+	assert.Equal(t, "day:2017-01-18:foo:bar", db.accuracy[0].Counter.Raw)
+	assert.Equal(t, int64(2), db.accuracy[0].Counter.Count)
+	assert.Equal(t, int64(2), db.accuracy[0].Exact)
+
+	// Nothing is recorded with sampling disabled
+	db.accuracy = nil
+	conf.Snapshot.AccuracySample = 0
+	assert.Nil(t, snap.Run(ctx, runTime))
+	assert.Empty(t, db.accuracy)
+}
+
+func TestSnapshotter_PruneDomain(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Snapshot.PruneDomain = true
+	redis := NewMockRedisClient()
+	db := NewMockDatabaseClient()
+
+	snap := &Snapshotter{
+		config: conf,
+		logger: hclog.Default(),
+		client: redis,
+		db:     db,
+	}
+
+	// Add a stale domain value with no counter
+	ctx := context.Background()
+	assert.Nil(t, db.UpsertDomain(ctx, map[string]map[string]struct{}{
+		"foo": {"old": struct{}{}},
+		"zip": {"zap": struct{}{}},
+	}))
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:bar"}, "1234"))
+
+	// Run the snapshot
+	runTime := time.Date(2017, 1, 18, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, snap.Run(ctx, runTime))
+
+	// Only the referenced value remains
+	assert.Equal(t, map[string]map[string]struct{}{
+		"foo": {"bar": struct{}{}},
+	}, db.domain)
+}
+
+func TestSnapshotter_DeadLetters(t *testing.T) {
+	db, fake := NewFakePGDatabase(t)
+	db.isolateFailures = true
+	fake.FailValue = int64(2)
+	redis := NewMockRedisClient()
+	stats := new(Stats)
+
+	snap := &Snapshotter{
+		config: DefaultConfig(),
+		logger: hclog.Default(),
+		client: redis,
+		db:     db,
+		stats:  stats,
+	}
+
+	// The counter with a count of two fails to upsert
+	ctx := context.Background()
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:bar", "day:2017-01-18:foo:baz"}, "1234"))
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:baz"}, "2345"))
+
+	// The snapshot completes and reports the dead letter
+	runTime := time.Date(2017, 1, 18, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, snap.Run(ctx, runTime))
+	last := stats.Response(nil, nil).LastSnapshot
+	assert.Equal(t, "", last.Error)
+	assert.Equal(t, []string{"day:2017-01-18:foo:baz"}, last.DeadLetters)
+}
+
+func TestSnapshotter_DeadLettersPending(t *testing.T) {
+	db, fake := NewFakePGDatabase(t)
+	db.isolateFailures = true
+	fake.FailValue = int64(2)
+	redis := NewMockRedisClient()
+
+	snap := &Snapshotter{
+		config: DefaultConfig(),
+		logger: hclog.Default(),
+		client: redis,
+		db:     db,
+	}
+
+	ctx := context.Background()
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:bar", "day:2017-01-18:foo:baz"}, "1234"))
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:baz"}, "2345"))
+	runTime := time.Date(2017, 1, 18, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, snap.Run(ctx, runTime))
+	pending, err := redis.GetDeadLetters(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"day:2017-01-18:foo:baz"}, pending)
+
+	// The pending dead letter is retried instead of deleted past the delete
+	// threshold, which fails the snapshot since it is the only counter
+	later := runTime.Add(DefaultDeleteThreshold + 24*time.Hour)
+	assert.NotNil(t, snap.Run(ctx, later))
+	keys, _ := redis.ListKeys(ctx)
+	assert.Equal(t, []string{"day:2017-01-18:foo:baz"}, keys)
+	pending, _ = redis.GetDeadLetters(ctx)
+	assert.Equal(t, []string{"day:2017-01-18:foo:baz"}, pending)
+
+	// It is retried once the database recovers, and deleted afterwards
+	fake.FailValue = nil
+	assert.Nil(t, snap.Run(ctx, later))
+	pending, _ = redis.GetDeadLetters(ctx)
+	assert.Empty(t, pending)
+	keys, _ = redis.ListKeys(ctx)
+	assert.Equal(t, []string{"day:2017-01-18:foo:baz"}, keys)
+	assert.Nil(t, snap.Run(ctx, later))
+	keys, _ = redis.ListKeys(ctx)
+	assert.Empty(t, keys)
+}
+
+func TestSnapshotter_DeadLettersIncremental(t *testing.T) {
+	db, fake := NewFakePGDatabase(t)
+	db.isolateFailures = true
+	fake.FailValue = int64(2)
+	conf := DefaultConfig()
+	conf.Snapshot.Incremental = true
+	redis := &batchRedisClient{MockRedisClient: NewMockRedisClient()}
+
+	snap := &Snapshotter{
+		config: conf,
+		logger: hclog.Default(),
+		client: redis,
+		db:     db,
+	}
+
+	ctx := context.Background()
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:bar", "day:2017-01-18:foo:baz"}, "1234"))
+	assert.Nil(t, redis.UpdateKeys(ctx, []string{"day:2017-01-18:foo:baz"}, "2345"))
+
+	// Only the dead letter is marked dirty for the next snapshot
+	runTime := time.Date(2017, 1, 18, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, snap.Run(ctx, runTime))
+	assert.Equal(t, map[string]struct{}{"day:2017-01-18:foo:baz": struct{}{}}, redis.dirty)
+
+	// The next incremental snapshot retries it once the database recovers
+	fake.FailValue = nil
+	assert.Nil(t, snap.Run(ctx, runTime.Add(time.Hour)))
+	assert.Empty(t, redis.dirty)
+	assert.Empty(t, redis.dirtySnapshot)
+	assert.Equal(t, []int{2, 1}, redis.counts)
+}
+
+func TestWeeklyRollups(t *testing.T) {
+	var keys []*ParsedKey
+	for _, raw := range []string{
+		"day:2017-01-18:foo:bar",
+		"day:2017-01-15:foo:bar",
+		"day:2017-01-21:foo:baz",
+		"day:2017-01-14:foo:bar",
+		"exact:day:2017-01-18:foo:bar",
+		"week:2017-01-15:foo:bar",
+		"month:2017-01:foo:bar",
+	} {
+		p, err := ParseKey(raw, nil)
+		assert.Nil(t, err)
+		keys = append(keys, p)
+	}
+
+	// The week of the 8th can no longer be updated
+	updateThres := time.Date(2017, 1, 17, 0, 0, 0, 0, time.UTC)
+	rollups := WeeklyRollups(keys, updateThres)
+	assert.Equal(t, 2, len(rollups))
+
+	assert.Equal(t, "week:2017-01-15:foo:bar", rollups[0].Week.Raw)
+	assert.Equal(t, "week", rollups[0].Week.Interval)
+	assert.Equal(t, time.Date(2017, 1, 15, 0, 0, 0, 0, time.UTC), rollups[0].Week.Date)
+	assert.Equal(t, map[string]string{"foo": "bar"}, rollups[0].Week.Attributes)
+	assert.Equal(t, []string{"day:2017-01-15:foo:bar", "day:2017-01-18:foo:bar"}, rollups[0].Days)
+
+	assert.Equal(t, "week:2017-01-15:foo:baz", rollups[1].Week.Raw)
+	assert.Equal(t, []string{"day:2017-01-21:foo:baz"}, rollups[1].Days)
+}
+
 func TestCollectDomain(t *testing.T) {
-	p1, _ := ParseKey("day:2017-01-18:foo:bar")
-	p2, _ := ParseKey("day:2017-01-10:foo:baz")
-	p3, _ := ParseKey("day:2017-01-01:zip:zap")
+	p1, _ := ParseKey("day:2017-01-18:foo:bar", nil)
+	p2, _ := ParseKey("day:2017-01-10:foo:baz", nil)
+	p3, _ := ParseKey("day:2017-01-01:zip:zap", nil)
 
 	inp := []*ParsedKey{p1, p2, p3}
 	attributes := CollectDomain(inp)
@@ -68,27 +879,104 @@ func TestCollectDomain(t *testing.T) {
 }
 
 func TestFilterKeys(t *testing.T) {
-	p1, _ := ParseKey("day:2017-01-18:foo:bar")
-	p2, _ := ParseKey("day:2017-01-10:foo:bar")
-	p3, _ := ParseKey("day:2017-01-01:foo:bar")
+	p1, _ := ParseKey("day:2017-01-18:foo:bar", nil)
+	p2, _ := ParseKey("day:2017-01-10:foo:bar", nil)
+	p3, _ := ParseKey("day:2017-01-01:foo:bar", nil)
 
 	inp := []*ParsedKey{p1, p2, p3}
 	updateThres := time.Date(2017, 1, 17, 0, 0, 0, 0, time.UTC)
 	deleteThres := time.Date(2017, 1, 9, 0, 0, 0, 0, time.UTC)
-	update, ignore, delete := FilterKeys(inp, updateThres, deleteThres)
+	update, ignore, delete := FilterKeys(inp, UpdateThresholds{Default: updateThres}, deleteThres, nil)
 
 	assert.Contains(t, update, p1)
 	assert.Contains(t, ignore, p2)
 	assert.Contains(t, delete, p3)
 }
 
+func TestFilterKeys_IntervalThresholds(t *testing.T) {
+	day, _ := ParseKey("day:2017-01-17:foo:bar", nil)
+	week, _ := ParseKey("week:2017-01-09:foo:bar", nil)
+	month, _ := ParseKey("month:2016-12:foo:bar", nil)
+	inp := []*ParsedKey{day, week, month}
+
+	// The day ended 2 hours ago, the week 2 days ago and the month
+	// 17 days ago, so only the day is updated by the default threshold
+	now := time.Date(2017, 1, 18, 2, 0, 0, 0, time.UTC)
+	deleteThres := now.Add(-DefaultDeleteThreshold)
+	thresholds := UpdateThresholds{Default: now.Add(-3 * time.Hour)}
+	update, ignore, _ := FilterKeys(inp, thresholds, deleteThres, nil)
+	assert.Equal(t, []*ParsedKey{day}, update)
+	assert.Equal(t, []*ParsedKey{week, month}, ignore)
+
+	// Longer thresholds keep updating the slower intervals, while a
+	// shorter one stops updating the day sooner
+	thresholds.Intervals = map[string]time.Time{
+		"day":   now.Add(-1 * time.Hour),
+		"week":  now.Add(-3 * 24 * time.Hour),
+		"month": now.Add(-20 * 24 * time.Hour),
+	}
+	update, ignore, _ = FilterKeys(inp, thresholds, deleteThres, nil)
+	assert.Equal(t, []*ParsedKey{week, month}, update)
+	assert.Equal(t, []*ParsedKey{day}, ignore)
+}
+
+func TestParseKey_CustomInterval(t *testing.T) {
+	// Custom keys are invalid unless the custom interval is configured
+	_, err := ParseKey("custom:3:foo:bar", nil)
+	assert.NotNil(t, err)
+
+	anchor := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	custom := &CustomIntervalConfig{Anchor: anchor, Duration: 14 * 24 * time.Hour}
+
+	parsed, err := ParseKey("custom:3:foo:bar", custom)
+	assert.Nil(t, err)
+	assert.Equal(t, "custom", parsed.Interval)
+	assert.Equal(t, time.Date(2018, 2, 12, 0, 0, 0, 0, time.UTC), parsed.Date)
+	assert.Equal(t, map[string]string{"foo": "bar"}, parsed.Attributes)
+
+	parsed, err = ParseKey("exact:custom:-1:foo:bar", custom)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2017, 12, 18, 0, 0, 0, 0, time.UTC), parsed.Date)
+
+	// Only the canonical bucket index is accepted
+	for _, raw := range []string{"custom:03:foo:bar", "custom:+3:foo:bar", "custom:2018-01-01:foo:bar"} {
+		_, err = ParseKey(raw, custom)
+		assert.NotNil(t, err, raw)
+	}
+
+	// The date round trips to the same key
+	date, ok := FormatIntervalDate("custom", parsed.Date, custom)
+	assert.True(t, ok)
+	assert.Equal(t, "-1", date)
+}
+
+func TestFilterKeys_CustomInterval(t *testing.T) {
+	anchor := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	custom := &CustomIntervalConfig{Anchor: anchor, Duration: 14 * 24 * time.Hour}
+
+	// The first bucket ends on 2018-01-15, so it is updated until the
+	// threshold passes the end of the bucket
+	p1, _ := ParseKey("custom:0:foo:bar", custom)
+	p2, _ := ParseKey("custom:1:foo:bar", custom)
+	inp := []*ParsedKey{p1, p2}
+	deleteThres := anchor.AddDate(-1, 0, 0)
+
+	update, ignore, _ := FilterKeys(inp, UpdateThresholds{Default: time.Date(2018, 1, 14, 0, 0, 0, 0, time.UTC)}, deleteThres, custom)
+	assert.Equal(t, []*ParsedKey{p1, p2}, update)
+	assert.Nil(t, ignore)
+
+	update, ignore, _ = FilterKeys(inp, UpdateThresholds{Default: time.Date(2018, 1, 16, 0, 0, 0, 0, time.UTC)}, deleteThres, custom)
+	assert.Equal(t, []*ParsedKey{p2}, update)
+	assert.Equal(t, []*ParsedKey{p1}, ignore)
+}
+
 func TestParseKeyList(t *testing.T) {
 	input := []string{
 		"day:2017-01-18:foo:bar",
 		"week:2017-12-18:foo:bar:zip:zap",
 		"month",
 	}
-	out, invalid := ParseKeyList(input)
+	out, invalid := ParseKeyList(input, nil)
 	assert.Equal(t, 2, len(out))
 	assert.Equal(t, 1, len(invalid))
 }
@@ -132,6 +1020,67 @@ func TestParseKey(t *testing.T) {
 				},
 			},
 		},
+		{
+			Input: "exact:day:2017-01-18:foo:bar",
+			Expected: &ParsedKey{
+				Interval: "day",
+				Date:     time.Date(2017, 1, 18, 0, 0, 0, 0, time.UTC),
+				Attributes: map[string]string{
+					"foo": "bar",
+				},
+				Exact: true,
+			},
+		},
+		{
+			Input: "v2:day:2017-01-18:3:foo4:b:r%",
+			Expected: &ParsedKey{
+				Interval: "day",
+				Date:     time.Date(2017, 1, 18, 0, 0, 0, 0, time.UTC),
+				Attributes: map[string]string{
+					"foo": "b:r%",
+				},
+				V2: true,
+			},
+		},
+		{
+			Input: "exact:v2:day:2017-01-18:3:a:b0:",
+			Expected: &ParsedKey{
+				Interval: "day",
+				Date:     time.Date(2017, 1, 18, 0, 0, 0, 0, time.UTC),
+				Attributes: map[string]string{
+					"a:b": "",
+				},
+				Exact: true,
+				V2:    true,
+			},
+		},
+		{
+			Input: "incr:day:2017-01-18:foo:bar",
+			Expected: &ParsedKey{
+				Interval: "day",
+				Date:     time.Date(2017, 1, 18, 0, 0, 0, 0, time.UTC),
+				Attributes: map[string]string{
+					"foo": "bar",
+				},
+				Incr: true,
+			},
+		},
+		{
+			Input: "v2:day:2017-01-18:3:foo9:bar",
+			Err:   "length prefix 9 exceeds the key",
+		},
+		{
+			Input: "v2:day:2017-01-18:3:foo+3:bar",
+			Err:   "invalid length prefix \"+3\"",
+		},
+		{
+			Input: "v2:day:2017-01-18:3:foo3:bar3:zip",
+			Err:   "key/value attributes not even",
+		},
+		{
+			Input: "v2:day:2017-01-18:foo",
+			Err:   "missing length prefix",
+		},
 		{
 			Input: "month:2017:foo:bar:zip:zap",
 			Err:   "invalid date \"2017\"",
@@ -151,7 +1100,7 @@ func TestParseKey(t *testing.T) {
 	}
 
 	for _, tc := range tcases {
-		out, err := ParseKey(tc.Input)
+		out, err := ParseKey(tc.Input, nil)
 		if tc.Err == "" {
 			assert.Nil(t, err)
 			tc.Expected.Raw = tc.Input
@@ -161,3 +1110,117 @@ func TestParseKey(t *testing.T) {
 		}
 	}
 }
+
+func TestQuarterIntervalDate(t *testing.T) {
+	type tcase struct {
+		Date    time.Time
+		Quarter string
+		Start   time.Time
+	}
+	tcases := []tcase{
+		{
+			Date:    time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+			Quarter: "2017-Q1",
+			Start:   time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Date:    time.Date(2017, 3, 31, 23, 59, 59, 0, time.UTC),
+			Quarter: "2017-Q1",
+			Start:   time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Date:    time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC),
+			Quarter: "2017-Q2",
+			Start:   time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Date:    time.Date(2017, 9, 30, 12, 0, 0, 0, time.UTC),
+			Quarter: "2017-Q3",
+			Start:   time.Date(2017, 7, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Date:    time.Date(2017, 12, 31, 12, 0, 0, 0, time.UTC),
+			Quarter: "2017-Q4",
+			Start:   time.Date(2017, 10, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tc := range tcases {
+		out := DateIntervals(QuarterInterval, tc.Date, nil, nil)
+		assert.Equal(t, map[string]string{"quarter": tc.Quarter}, out)
+
+		parsed, err := ParseKey("quarter:"+out["quarter"]+":foo:bar", nil)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.Start, parsed.Date)
+	}
+
+	// Invalid quarters are rejected
+	for _, raw := range []string{"2017-Q0", "2017-Q5", "2017-01", "2017-Q12", "17-Q1"} {
+		_, err := ParseKey("quarter:"+raw+":foo:bar", nil)
+		assert.NotNil(t, err, raw)
+	}
+}
+
+func TestFilterKeys_Quarter(t *testing.T) {
+	p1, _ := ParseKey("quarter:2017-Q1:foo:bar", nil)
+	p2, _ := ParseKey("quarter:2016-Q4:foo:bar", nil)
+	p3, _ := ParseKey("quarter:2016-Q3:foo:bar", nil)
+	inp := []*ParsedKey{p1, p2, p3}
+
+	// Updates continue until the end of the quarter, even though the
+	// delete threshold is shorter than the quarter
+	now := time.Date(2017, 3, 31, 23, 0, 0, 0, time.UTC)
+	updateThres := now.Add(-3 * time.Hour)
+	deleteThres := now.Add(-14 * 24 * time.Hour)
+	update, ignore, delete := FilterKeys(inp, UpdateThresholds{Default: updateThres}, deleteThres, nil)
+	assert.Equal(t, []*ParsedKey{p1}, update)
+	assert.Nil(t, ignore)
+	assert.Equal(t, []*ParsedKey{p2, p3}, delete)
+
+	// Only deleted once the quarter can no longer be updated
+	now = time.Date(2017, 4, 1, 4, 0, 0, 0, time.UTC)
+	update, ignore, delete = FilterKeys(inp, UpdateThresholds{Default: now.Add(-3 * time.Hour)}, now.Add(-DefaultDeleteThreshold), nil)
+	assert.Nil(t, update)
+	assert.Equal(t, []*ParsedKey{p1}, ignore)
+	assert.Equal(t, []*ParsedKey{p2, p3}, delete)
+}
+
+func TestLocalWallClock(t *testing.T) {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	assert.Nil(t, err)
+
+	now := time.Date(2018, 1, 19, 7, 0, 0, 0, time.UTC)
+	assert.Equal(t, now, LocalWallClock(now, nil))
+	assert.Equal(t, time.Date(2018, 1, 18, 23, 0, 0, 0, time.UTC), LocalWallClock(now, loc))
+
+	// A Pacific day is still updated until it ends in local time
+	p1, _ := ParseKey("day:2018-01-18:foo:bar", nil)
+	local := LocalWallClock(now, loc)
+	update, _, _ := FilterKeys([]*ParsedKey{p1}, UpdateThresholds{Default: local.Add(-3 * time.Hour)}, local.Add(-DefaultDeleteThreshold), nil)
+	assert.Equal(t, []*ParsedKey{p1}, update)
+}
+
+func TestNewSnapshotCron(t *testing.T) {
+	config, err := ParseConfig(`
+snapshot {
+	cron = "0 0 9 * * *"
+	cron_timezone = "America/New_York"
+}
+	`)
+	assert.Nil(t, err)
+
+	c, err := NewSnapshotCron(config.Snapshot, func() {})
+	assert.Nil(t, err)
+	assert.Equal(t, "America/New_York", c.Location().String())
+
+	// The next run is scheduled at 9am in the cron timezone
+	c.Start()
+	defer c.Stop()
+	next := c.Entries()[0].Next
+	assert.Equal(t, "America/New_York", next.Location().String())
+	assert.Equal(t, 9, next.Hour())
+
+	// Invalid schedules are rejected
+	config.Snapshot.Cron = "not a cron"
+	_, err = NewSnapshotCron(config.Snapshot, func() {})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+// Stats tracks process level counters for operational visibility.
+// All the methods are safe to call concurrently, and on a nil Stats.
+type Stats struct {
+	eventsIngested   uint64
+	eventsRejected   uint64
+	eventsFailed     uint64
+	eventsDuplicate  uint64
+	eventsSkipped    uint64
+	eventsOverBudget uint64
+
+	lastSnapshot *SnapshotResult
+	lastMemory   *MemoryEstimate
+	l            sync.Mutex
+}
+
+// SnapshotResult is the outcome of a snapshot
+type SnapshotResult struct {
+	Time     time.Time `json:"time"`
+	Duration string    `json:"duration"`
+	Error    string    `json:"error,omitempty"`
+
+	// DeadLetters are the keys of counters that failed to upsert
+	DeadLetters []string `json:"dead_letters,omitempty"`
+}
+
+// StatsResponse is the output of the stats endpoint
+type StatsResponse struct {
+	Events struct {
+		Ingested  uint64 `json:"ingested"`
+		Rejected  uint64 `json:"rejected"`
+		Failed    uint64 `json:"failed"`
+		Duplicate uint64 `json:"duplicate"`
+		Skipped   uint64 `json:"skipped"`
+
+		// OverBudget are the events rejected by the redis key budget
+		OverBudget uint64 `json:"over_budget"`
+	} `json:"events"`
+	LastSnapshot *SnapshotResult  `json:"last_snapshot"`
+	Redis        *redis.PoolStats `json:"redis,omitempty"`
+	PostgreSQL   *sql.DBStats     `json:"postgresql,omitempty"`
+	Cache        *CacheStats      `json:"cache,omitempty"`
+	Updates      *UpdateStats     `json:"updates,omitempty"`
+
+	// RedisMemory is the last estimate of the redis memory used, if enabled
+	RedisMemory *MemoryEstimate `json:"redis_memory,omitempty"`
+}
+
+// redisPoolStats is implemented by redis clients that expose pool stats
+type redisPoolStats interface {
+	PoolStats() redis.PoolStats
+}
+
+// redisUpdateStats is implemented by redis clients that count duplicate updates
+type redisUpdateStats interface {
+	UpdateStats() UpdateStats
+}
+
+// dbPoolStats is implemented by database clients that expose pool stats
+type dbPoolStats interface {
+	PoolStats() sql.DBStats
+}
+
+// dbCacheStats is implemented by database clients that expose cache stats
+type dbCacheStats interface {
+	CacheStats() CacheStats
+}
+
+// EventIngested is used to count an event that was ingested
+func (s *Stats) EventIngested() {
+	if s != nil {
+		atomic.AddUint64(&s.eventsIngested, 1)
+	}
+}
+
+// EventRejected is used to count an event that was invalid
+func (s *Stats) EventRejected() {
+	if s != nil {
+		atomic.AddUint64(&s.eventsRejected, 1)
+	}
+}
+
+// EventFailed is used to count a valid event that could not be stored
+func (s *Stats) EventFailed() {
+	if s != nil {
+		atomic.AddUint64(&s.eventsFailed, 1)
+	}
+}
+
+// EventDuplicate is used to count a replayed event that was dropped
+func (s *Stats) EventDuplicate() {
+	if s != nil {
+		atomic.AddUint64(&s.eventsDuplicate, 1)
+	}
+}
+
+// EventSkipped is used to count an event that was not sampled
+func (s *Stats) EventSkipped() {
+	if s != nil {
+		atomic.AddUint64(&s.eventsSkipped, 1)
+	}
+}
+
+// EventOverBudget is used to count an event rejected by the key budget
+func (s *Stats) EventOverBudget() {
+	if s != nil {
+		atomic.AddUint64(&s.eventsOverBudget, 1)
+	}
+}
+
+// SnapshotComplete is used to record the result of a snapshot
+func (s *Stats) SnapshotComplete(start time.Time, deadLetters []*ParsedKey, err error) {
+	if s == nil {
+		return
+	}
+	result := &SnapshotResult{
+		Time:     start,
+		Duration: time.Since(start).String(),
+	}
+	for _, c := range deadLetters {
+		result.DeadLetters = append(result.DeadLetters, c.Raw)
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	s.l.Lock()
+	s.lastSnapshot = result
+	s.l.Unlock()
+}
+
+// EstimateMemory is used to estimate the redis memory used by sampling
+// keys, recording the estimate if successful
+func (s *Stats) EstimateMemory(ctx context.Context, client RedisClient, sample int) error {
+	est, err := client.MemoryEstimate(ctx, sample)
+	if err != nil {
+		return err
+	}
+	if s != nil {
+		s.l.Lock()
+		s.lastMemory = est
+		s.l.Unlock()
+	}
+	return nil
+}
+
+// RunMemoryEstimates estimates the redis memory used immediately and then
+// at every interval, until the context is cancelled. Each estimate scans
+// every key, so only the leader estimates if leader election is enabled.
+func (s *Stats) RunMemoryEstimates(ctx context.Context, logger hclog.Logger, client RedisClient, leader *LeaderElection, sample int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		if leader != nil && !leader.IsLeader() {
+			logger.Debug("Skipping redis memory estimate, not the leader")
+		} else if err := s.EstimateMemory(ctx, client, sample); err != nil && ctx.Err() == nil {
+			logger.Error("Failed to estimate redis memory", "error", err)
+		} else if err == nil {
+			logger.Debug("Estimated redis memory", "duration", time.Since(start))
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Response returns the current stats, including the pool stats of the clients
+func (s *Stats) Response(client RedisClient, db DatabaseClient) *StatsResponse {
+	out := &StatsResponse{}
+	if s != nil {
+		out.Events.Ingested = atomic.LoadUint64(&s.eventsIngested)
+		out.Events.Rejected = atomic.LoadUint64(&s.eventsRejected)
+		out.Events.Failed = atomic.LoadUint64(&s.eventsFailed)
+		out.Events.Duplicate = atomic.LoadUint64(&s.eventsDuplicate)
+		out.Events.Skipped = atomic.LoadUint64(&s.eventsSkipped)
+		out.Events.OverBudget = atomic.LoadUint64(&s.eventsOverBudget)
+		s.l.Lock()
+		out.LastSnapshot = s.lastSnapshot
+		out.RedisMemory = s.lastMemory
+		s.l.Unlock()
+	}
+	if p, ok := client.(redisPoolStats); ok {
+		stats := p.PoolStats()
+		out.Redis = &stats
+	}
+	if u, ok := client.(redisUpdateStats); ok {
+		stats := u.UpdateStats()
+		out.Updates = &stats
+	}
+	if p, ok := db.(dbPoolStats); ok {
+		stats := p.PoolStats()
+		out.PostgreSQL = &stats
+	}
+	if c, ok := db.(dbCacheStats); ok {
+		stats := c.CacheStats()
+		out.Cache = &stats
+	}
+	return out
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPI_Stats(t *testing.T) {
+	stats := new(Stats)
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		client: NewMockRedisClient(),
+		stats:  stats,
+	}
+	mux := NewHTTPHandler(api, nil)
+
+	// Send a valid and invalid event
+	inputs := []string{
+		`{"id": "1234", "attributes": {"foo": "bar"}}`,
+		`{"attributes": {"foo": "bar"}}`,
+	}
+	for _, input := range inputs {
+		req := httptest.NewRequest("PUT", "/v1/ingress", strings.NewReader(input))
+		req.Header.Set("Content-Type", "application/json")
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Record a snapshot
+	stats.SnapshotComplete(time.Now(), nil, nil)
+
+	req := httptest.NewRequest("GET", "/stats", nil)
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Result().StatusCode)
+
+	var out StatsResponse
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&out))
+	assert.Equal(t, uint64(1), out.Events.Ingested)
+	assert.Equal(t, uint64(1), out.Events.Rejected)
+	assert.Equal(t, uint64(0), out.Events.Failed)
+	assert.NotNil(t, out.LastSnapshot)
+	assert.Equal(t, "", out.LastSnapshot.Error)
+}
+
+func TestSnapshotter_Stats(t *testing.T) {
+	stats := new(Stats)
+	snap := &Snapshotter{
+		config: DefaultConfig(),
+		logger: hclog.Default(),
+		client: NewMockRedisClient(),
+		db:     NewMockDatabaseClient(),
+		stats:  stats,
+	}
+	assert.Nil(t, snap.Run(context.Background(), time.Now()))
+
+	out := stats.Response(nil, nil)
+	assert.NotNil(t, out.LastSnapshot)
+	assert.Nil(t, out.Redis)
+	assert.Nil(t, out.PostgreSQL)
+}
+
+func TestStats_EstimateMemory(t *testing.T) {
+	client := NewMockRedisClient()
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		key := fmt.Sprintf("day:2017-01-0%d:foo:bar", i+1)
+		assert.Nil(t, client.UpdateKeys(ctx, []string{key}, "1234"))
+	}
+
+	// Disabled until the first estimate
+	stats := new(Stats)
+	assert.Nil(t, stats.Response(client, nil).RedisMemory)
+
+	// Sampling half the keys extrapolates to all of them
+	assert.Nil(t, stats.EstimateMemory(ctx, client, 2))
+	out := stats.Response(client, nil).RedisMemory
+	if !assert.NotNil(t, out) {
+		return
+	}
+	perKey := int64(len(RedisKeyPrefix+"day:2017-01-01:foo:bar") + len("1234"))
+	assert.Equal(t, int64(4), out.Keys)
+	assert.Equal(t, 2, out.SampledKeys)
+	assert.Equal(t, 2*perKey, out.SampledBytes)
+	assert.Equal(t, 4*perKey, out.EstimatedBytes)
+
+	// Sampling more than every key measures them all
+	assert.Nil(t, stats.EstimateMemory(ctx, client, 100))
+	out = stats.Response(client, nil).RedisMemory
+	assert.Equal(t, 4, out.SampledKeys)
+	assert.Equal(t, 4*perKey, out.EstimatedBytes)
+}
+
+func TestStats_RunMemoryEstimatesLeader(t *testing.T) {
+	client := NewMockRedisClient()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Nil(t, client.UpdateKeys(context.Background(), []string{"day:2017-01-01:foo:bar"}, "1234"))
+
+	// Servers that are not the leader skip the scan
+	stats := new(Stats)
+	stats.RunMemoryEstimates(ctx, hclog.Default(), client, &LeaderElection{}, 2, time.Hour)
+	assert.Nil(t, stats.Response(client, nil).RedisMemory)
+
+	// Every server estimates without leader election
+	stats.RunMemoryEstimates(ctx, hclog.Default(), client, nil, 2, time.Hour)
+	assert.NotNil(t, stats.Response(client, nil).RedisMemory)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+)
+
+// ParseTLSVersion converts a version like "1.2" into the tls constant
+func ParseTLSVersion(raw string) (uint16, error) {
+	switch raw {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS version %q", raw)
+	}
+}
+
+// CertReloader holds a certificate that can be reloaded from disk,
+// so that certificates can be rotated without a restart
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	cert *tls.Certificate
+	l    sync.RWMutex
+}
+
+// NewCertReloader loads the certificate and key, failing if they are invalid
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads the certificate and key from disk. The previous
+// certificate is kept if they cannot be loaded.
+func (c *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %v", err)
+	}
+	c.l.Lock()
+	c.cert = &cert
+	c.l.Unlock()
+	return nil
+}
+
+// GetCertificate returns the current certificate for a tls.Config
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	return c.cert, nil
+}
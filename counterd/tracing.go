@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// TracerName is the instrumentation name used for all counterd spans
+	TracerName = "github.com/armon/counterd"
+)
+
+// tracer is used to create spans. It delegates to the global provider,
+// so it is a no-op until SetupTracing installs an exporter.
+var tracer = otel.Tracer(TracerName)
+
+// SetupTracing is used to install the global OpenTelemetry tracer provider
+// and propagator. If no OTLP endpoint is configured, tracing is left as a no-op.
+// The returned function must be called to flush any pending spans on exit.
+func SetupTracing(config *TracingConfig) (func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+
+	// Skip when there is no endpoint
+	if config == nil || config.OTLPEndpoint == "" {
+		return noop, nil
+	}
+
+	// Setup the exporter
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(config.OTLPEndpoint))
+	if err != nil {
+		return noop, fmt.Errorf("failed to setup OTLP exporter: %v", err)
+	}
+
+	// Describe this service
+	res, err := resource.Merge(resource.Default(),
+		resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(config.ServiceName)))
+	if err != nil {
+		return noop, fmt.Errorf("failed to setup trace resource: %v", err)
+	}
+
+	// Install the provider and propagator globally
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// endSpan is used to end a span, recording the error if any
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/armon/counterd/client"
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+const (
+	// DefaultVerifyTolerance is the default relative error allowed between
+	// the expected and stored counts. HyperLogLogs have a standard error
+	// of 0.81%, so this allows for a little over two standard errors.
+	DefaultVerifyTolerance = 0.02
+)
+
+// DefaultVerifySizes are the cardinalities of the verification dataset
+var DefaultVerifySizes = []int{1, 10, 100, 1000, 10000}
+
+type VerifyCommand struct{}
+
+func (v *VerifyCommand) Help() string {
+	helpText := `
+Usage: counterd verify <config> [flags]
+
+	verify is used to check the full pipeline from ingress to the database.
+	A deterministic dataset is sent to the API, a snapshot is run, and the
+	stored counters are compared to the expected counts. Any counter that
+	is missing or differs by more than the tolerance is reported.
+	The path to the configuration file of the server must be provided.
+
+	The dataset is a set of events with a single attribute, with a value
+	per cardinality, e.g. verify=size-100 has 100 distinct IDs. The IDs
+	are the same on every run, so verify may be run repeatedly.
+
+Options:
+
+	-address (Default: "http://127.0.0.1:8001"). Configures the target API address.
+	-auth	Provides a bearer token to use.
+	-attribute	(Default: "verify"). Configures the attribute key of the dataset.
+			It must be allowed by the attribute configuration.
+	-tolerance	(Default: 0.02). Configures the relative error allowed per counter.
+	-wait	Configures how long to wait after sending before the snapshot,
+			which is needed if the ingress queue is enabled.
+	-workers	(Default: 1). Configures the number of events sent concurrently.
+	`
+	return strings.TrimSpace(helpText)
+}
+
+func (v *VerifyCommand) Synopsis() string {
+	return "verify checks ingested counts end to end"
+}
+
+func (v *VerifyCommand) Run(args []string) int {
+	// Check that we got at least the config argument
+	if len(args) < 1 {
+		fmt.Println(v.Help())
+		return 1
+	}
+	filename := args[0]
+
+	var address, authToken, attr string
+	var tolerance float64
+	var wait time.Duration
+	var workers int
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	flags.StringVar(&address, "address", "http://127.0.0.1:8001", "")
+	flags.StringVar(&authToken, "auth", "", "")
+	flags.StringVar(&attr, "attribute", "verify", "")
+	flags.Float64Var(&tolerance, "tolerance", DefaultVerifyTolerance, "")
+	flags.DurationVar(&wait, "wait", 0, "")
+	flags.IntVar(&workers, "workers", 1, "")
+	flags.Usage = func() { fmt.Println(v.Help()) }
+	if err := flags.Parse(args[1:]); err != nil {
+		return 1
+	}
+	if tolerance < 0 {
+		hclog.Default().Error("Tolerance must not be negative")
+		return 1
+	}
+	if workers <= 0 {
+		hclog.Default().Error("Must have a non-zero number of workers")
+		return 1
+	}
+
+	// Attempt to parse the config
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		hclog.Default().Error("Failed to load configuration file", "file", filename, "error", err)
+		return 1
+	}
+
+	// Parse the config
+	config, err := ParseConfig(string(raw))
+	if err != nil {
+		hclog.Default().Error("Failed to parse configuration file", "error", err)
+		return 1
+	}
+
+	// Setup the client
+	opts := &client.ClientOptions{
+		AuthToken:           authToken,
+		MaxIdleConnsPerHost: workers,
+	}
+	counterdClient, err := client.NewClient(address, opts)
+	if err != nil {
+		hclog.Default().Error("Failed to setup client", "error", err)
+		return 1
+	}
+	if !pingServer(counterdClient, address) {
+		return 1
+	}
+
+	// Setup the redis pool
+	hclog.Default().Info("Connecting to redis", "addr", RedactAddress(config.RedisAddress))
+	redisClient, err := NewPooledClient(config.RedisAddress)
+	if err != nil {
+		hclog.Default().Error("Failed to setup redis connection", "error", err)
+		return 1
+	}
+	redisClient.hybridThreshold = config.Redis.HybridThreshold
+
+	// Attempt to connect to the database
+	hclog.Default().Info("Connecting to postgresql", "addr", RedactAddress(config.PGAddress))
+	pg, err := NewPGDatabaseFromConfig(hclog.Default().Named("postgresql"), config.PGAddress, "", config.Database, true)
+	if err != nil {
+		hclog.Default().Error("Failed to setup database connection", "error", err)
+		return 1
+	}
+
+	// Stop if we are interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Send the dataset
+	now := time.Now().UTC()
+	events := VerifyDataset(attr, DefaultVerifySizes, now)
+	eventCh := make(chan *client.Event, len(events))
+	for _, e := range events {
+		eventCh <- e
+	}
+	close(eventCh)
+	hclog.Default().Info("Sending verification dataset", "events", len(events))
+	if _, _, err := sendEvents(ctx, counterdClient, eventCh, workers); err != nil {
+		hclog.Default().Error("Failed to send event", "error", err)
+		return 1
+	}
+	if wait > 0 {
+		hclog.Default().Info("Waiting before snapshot", "wait", wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return 1
+		}
+	}
+
+	// Snapshot the dataset into the database
+	snap := &Snapshotter{
+		config: config,
+		logger: hclog.Default().Named("snapshotter"),
+		client: redisClient,
+		db:     pg,
+	}
+	if err := snap.Run(ctx, time.Now().UTC()); err != nil {
+		hclog.Default().Error("Failed to snapshot", "error", err)
+		return 1
+	}
+
+	// Compare the stored counters
+	expected, err := VerifyExpected(attr, DefaultVerifySizes, now, config.Timezone, config.Intervals, config.CustomInterval)
+	if err != nil {
+		hclog.Default().Error("Failed to determine expected counters", "error", err)
+		return 1
+	}
+	discrepancies, err := VerifyCounters(ctx, pg, expected, tolerance)
+	if err != nil {
+		hclog.Default().Error("Failed to query counters", "error", err)
+		return 1
+	}
+	for _, d := range discrepancies {
+		fmt.Println(d.String())
+	}
+	fmt.Printf("Verified %d counters, %d discrepancies\n", len(expected), len(discrepancies))
+	if len(discrepancies) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// VerifyDataset returns the events of the verification dataset. For each
+// size there is an attribute value with that many distinct IDs. The IDs
+// are deterministic so the dataset can be re-sent without changing counts.
+func VerifyDataset(attr string, sizes []int, date time.Time) []*client.Event {
+	var out []*client.Event
+	for _, size := range sizes {
+		value := verifyValue(size)
+		for i := 0; i < size; i++ {
+			out = append(out, &client.Event{
+				ID:         "verify-" + strconv.Itoa(size) + "-" + strconv.Itoa(i),
+				Date:       date,
+				Attributes: map[string]string{attr: value},
+			})
+		}
+	}
+	return out
+}
+
+// VerifyExpected returns the counters expected to be stored for the
+// verification dataset in the enabled intervals, with the count set to
+// the expected cardinality
+func VerifyExpected(attr string, sizes []int, date time.Time, loc *time.Location, enabled int, custom *CustomIntervalConfig) ([]*ParsedKey, error) {
+	// Sort the intervals so the output is stable
+	intervals := DateIntervals(enabled, date, loc, custom)
+	names := make([]string, 0, len(intervals))
+	for interval := range intervals {
+		names = append(names, interval)
+	}
+	sort.Strings(names)
+
+	var out []*ParsedKey
+	for _, size := range sizes {
+		for _, interval := range names {
+			intervalDate, err := ParseIntervalDate(interval, intervals[interval], custom)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, &ParsedKey{
+				Interval:   interval,
+				Date:       intervalDate,
+				Attributes: map[string]string{attr: verifyValue(size)},
+				Count:      int64(size),
+			})
+		}
+	}
+	return out, nil
+}
+
+// verifyValue is the attribute value used for a dataset size
+func verifyValue(size int) string {
+	return "size-" + strconv.Itoa(size)
+}
+
+// VerifyDiscrepancy is a counter that does not match its expected count
+type VerifyDiscrepancy struct {
+	Expected *ParsedKey
+
+	// Actual is the stored count, only valid if Missing is false
+	Actual  int64
+	Missing bool
+}
+
+func (d *VerifyDiscrepancy) String() string {
+	e := d.Expected
+
+	// The bucket of a custom interval is shown by its start date
+	date, ok := FormatIntervalDate(e.Interval, e.Date, nil)
+	if !ok {
+		date = e.Date.Format(time.RFC3339)
+	}
+	if d.Missing {
+		return fmt.Sprintf("%s %s %v: missing, expected %d", e.Interval, date, e.Attributes, e.Count)
+	}
+	return fmt.Sprintf("%s %s %v: got %d, expected %d (error %.2f%%)", e.Interval, date,
+		e.Attributes, d.Actual, e.Count, 100*RelativeError(e.Count, d.Actual))
+}
+
+// VerifyCounters queries each expected counter and returns those that are
+// missing or have a relative error beyond the tolerance
+func VerifyCounters(ctx context.Context, db DatabaseClient, expected []*ParsedKey, tolerance float64) ([]*VerifyDiscrepancy, error) {
+	var out []*VerifyDiscrepancy
+	for _, e := range expected {
+		c, err := db.GetCounter(ctx, e.Interval, e.Date, e.Attributes)
+		if err != nil {
+			return nil, err
+		}
+		if c == nil {
+			out = append(out, &VerifyDiscrepancy{Expected: e, Missing: true})
+			continue
+		}
+		if RelativeError(e.Count, c.Count) > tolerance {
+			out = append(out, &VerifyDiscrepancy{Expected: e, Actual: c.Count})
+		}
+	}
+	return out, nil
+}
+
+// RelativeError returns the error of the actual count relative to the expected
+func RelativeError(expected, actual int64) float64 {
+	if expected == 0 {
+		if actual == 0 {
+			return 0
+		}
+		return math.Inf(1)
+	}
+	return math.Abs(float64(actual-expected)) / float64(expected)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/armon/counterd/client"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyDataset(t *testing.T) {
+	date := time.Date(2017, 1, 18, 12, 0, 0, 0, time.UTC)
+	events := VerifyDataset("verify", []int{1, 10}, date)
+	assert.Equal(t, 11, len(events))
+
+	// IDs must be the same on every run
+	again := VerifyDataset("verify", []int{1, 10}, date)
+	assert.Equal(t, events, again)
+
+	ids := make(map[string]struct{})
+	for _, e := range events {
+		ids[e.ID] = struct{}{}
+	}
+	assert.Equal(t, 11, len(ids))
+	assert.Equal(t, map[string]string{"verify": "size-10"}, events[5].Attributes)
+}
+
+func TestVerifyExpected(t *testing.T) {
+	date := time.Date(2017, 1, 18, 12, 0, 0, 0, time.UTC)
+	expected, err := VerifyExpected("verify", []int{10}, date, nil, AllIntervals, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(expected))
+
+	// Sorted by interval
+	assert.Equal(t, "day", expected[0].Interval)
+	assert.Equal(t, time.Date(2017, 1, 18, 0, 0, 0, 0, time.UTC), expected[0].Date)
+	assert.Equal(t, "month", expected[1].Interval)
+	assert.Equal(t, time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), expected[1].Date)
+	assert.Equal(t, "quarter", expected[2].Interval)
+	assert.Equal(t, "week", expected[3].Interval)
+	assert.Equal(t, time.Date(2017, 1, 15, 0, 0, 0, 0, time.UTC), expected[3].Date)
+	for _, e := range expected {
+		assert.Equal(t, int64(10), e.Count)
+	}
+}
+
+func TestVerifyCounters(t *testing.T) {
+	ctx := context.Background()
+	db := NewMockDatabaseClient()
+	date := time.Date(2017, 1, 18, 0, 0, 0, 0, time.UTC)
+	attrs := func(v string) map[string]string { return map[string]string{"verify": v} }
+	assert.Nil(t, db.UpsertCounters(ctx, []*ParsedKey{
+		{Interval: "day", Date: date, Attributes: attrs("close"), Count: 1010},
+		{Interval: "day", Date: date, Attributes: attrs("far"), Count: 1100},
+	}))
+
+	expected := []*ParsedKey{
+		{Interval: "day", Date: date, Attributes: attrs("close"), Count: 1000},
+		{Interval: "day", Date: date, Attributes: attrs("far"), Count: 1000},
+		{Interval: "day", Date: date, Attributes: attrs("missing"), Count: 1000},
+	}
+	out, err := VerifyCounters(ctx, db, expected, 0.02)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(out))
+
+	assert.Equal(t, expected[1], out[0].Expected)
+	assert.Equal(t, int64(1100), out[0].Actual)
+	assert.False(t, out[0].Missing)
+	assert.Equal(t, "day 2017-01-18 map[verify:far]: got 1100, expected 1000 (error 10.00%)", out[0].String())
+
+	assert.Equal(t, expected[2], out[1].Expected)
+	assert.True(t, out[1].Missing)
+	assert.Equal(t, "day 2017-01-18 map[verify:missing]: missing, expected 1000", out[1].String())
+}
+
+func TestRelativeError(t *testing.T) {
+	assert.Equal(t, 0.0, RelativeError(0, 0))
+	assert.True(t, math.IsInf(RelativeError(0, 1), 1))
+	assert.Equal(t, 0.1, RelativeError(100, 110))
+	assert.Equal(t, 0.1, RelativeError(100, 90))
+}
+
+func TestVerify_Pipeline(t *testing.T) {
+	// Serve the API backed by the mocks
+	conf := DefaultConfig()
+	redis := NewMockRedisClient()
+	db := NewMockDatabaseClient()
+	api := &APIHandler{
+		logger: hclog.Default().Named("api"),
+		client: redis,
+		db:     db,
+	}
+	srv := httptest.NewServer(NewHTTPHandler(api, nil))
+	defer srv.Close()
+
+	c, err := client.NewClient(srv.URL, nil)
+	assert.Nil(t, err)
+
+	// Send the dataset
+	ctx := context.Background()
+	sizes := []int{1, 10, 100}
+	now := time.Now().UTC()
+	events := VerifyDataset("verify", sizes, now)
+	eventCh := make(chan *client.Event, len(events))
+	for _, e := range events {
+		eventCh <- e
+	}
+	close(eventCh)
+	sent, _, err := sendEvents(ctx, c, eventCh, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(111), sent)
+
+	// Snapshot into the database
+	snap := &Snapshotter{
+		config: conf,
+		logger: hclog.Default(),
+		client: redis,
+		db:     db,
+	}
+	assert.Nil(t, snap.Run(ctx, now))
+
+	// Everything should match exactly
+	expected, err := VerifyExpected("verify", sizes, now, conf.Timezone, conf.Intervals, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 12, len(expected))
+	out, err := VerifyCounters(ctx, db, expected, 0)
+	assert.Nil(t, err)
+	assert.Empty(t, out)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	// Version is the release version of counterd
+	Version = "0.1.0"
+
+	// GitCommit and BuildDate are injected at build time with -ldflags,
+	// and are blank for a plain go build
+	GitCommit string
+	BuildDate string
+)
+
+// VersionString formats the version with any build metadata
+func VersionString() string {
+	out := Version
+	if GitCommit != "" {
+		out += fmt.Sprintf(" (%s)", GitCommit)
+	}
+	if BuildDate != "" {
+		out += fmt.Sprintf(", built %s", BuildDate)
+	}
+	return out
+}
+
+// VersionCommand prints the version of counterd and its build metadata
+type VersionCommand struct{}
+
+func (v *VersionCommand) Help() string {
+	helpText := `
+Usage: counterd version
+
+	Version prints the version of counterd, along with the git commit
+	and build date if they were provided at build time.
+	`
+	return strings.TrimSpace(helpText)
+}
+
+func (v *VersionCommand) Synopsis() string {
+	return "Prints the counterd version"
+}
+
+func (v *VersionCommand) Run(args []string) int {
+	fmt.Printf("counterd v%s\n", VersionString())
+	return 0
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionString(t *testing.T) {
+	defer func(commit, date string) {
+		GitCommit, BuildDate = commit, date
+	}(GitCommit, BuildDate)
+
+	GitCommit, BuildDate = "", ""
+	assert.Equal(t, Version, VersionString())
+
+	GitCommit = "abc1234"
+	assert.Equal(t, Version+" (abc1234)", VersionString())
+
+	BuildDate = "2017-01-18T12:00:00Z"
+	assert.Equal(t, Version+" (abc1234), built 2017-01-18T12:00:00Z", VersionString())
+}